@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// childStopTimeout is how long the child gets to exit after an interrupt before it is killed
+const childStopTimeout = 10 * time.Second
+
+// splitChildCommand splits args at --, returning the command's own arguments and the child command after it
+func splitChildCommand(cmd *cobra.Command, args []string) ([]string, []string) {
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		return args[:dash], args[dash:]
+	}
+	return args, nil
+}
+
+// childProcess is the command tungo runs and tunnels to (tungo --local-port 3000 -- npm run dev)
+type childProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{} // Closed once the child has exited
+	err  error         // Set before done is closed
+
+	stopping atomic.Bool // Set once tungo stops the child itself
+}
+
+// startChild starts command in the foreground, sharing tungo's terminal
+func startChild(command []string) (*childProcess, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", command[0], err)
+	}
+
+	child := &childProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		child.err = cmd.Wait()
+		close(child.done)
+	}()
+	return child, nil
+}
+
+// waitForPorts waits until every address accepts connections
+// It returns an error if the child exits first, and false if quit fires
+func (c *childProcess) waitForPorts(addresses []string, quit <-chan os.Signal) (bool, error) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for _, address := range addresses {
+		log.Info().Str("local", address).Msg("Waiting for the command to accept connections")
+		for {
+			conn, err := net.DialTimeout("tcp", address, time.Second)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			select {
+			case <-c.done:
+				return false, fmt.Errorf("command exited before listening on %s: %v", address, c.exitStatus())
+			case <-quit:
+				return false, nil
+			case <-ticker.C:
+			}
+		}
+	}
+	return true, nil
+}
+
+// exitStatus describes how the child exited
+func (c *childProcess) exitStatus() string {
+	if c.err != nil {
+		return c.err.Error()
+	}
+	return "exit status 0"
+}
+
+// stop interrupts the child, killing it if it hasn't exited within childStopTimeout
+func (c *childProcess) stop() {
+	c.stopping.Store(true)
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	// Interrupt isn't supported on Windows, where the child is killed right away
+	if err := c.cmd.Process.Signal(os.Interrupt); err != nil {
+		c.cmd.Process.Kill()
+	}
+	select {
+	case <-c.done:
+	case <-time.After(childStopTimeout):
+		log.Warn().Msg("Command did not exit after an interrupt, killing it")
+		c.cmd.Process.Kill()
+		<-c.done
+	}
+}
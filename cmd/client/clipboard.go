@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atotto/clipboard"
+)
+
+// copyPublicURLs places the public URLs on the system clipboard, one per line
+// Linux needs xclip, xsel or wl-clipboard installed, so a failure only warns
+func copyPublicURLs(urls []string) {
+	if len(urls) == 0 {
+		return
+	}
+	if err := clipboard.WriteAll(strings.Join(urls, "\n")); err != nil {
+		fmt.Printf("⚠️  Failed to copy the public URL to the clipboard: %v\n", err)
+		return
+	}
+	if len(urls) == 1 {
+		fmt.Printf("📋 Copied %s to the clipboard\n", urls[0])
+	} else {
+		fmt.Printf("📋 Copied %d public URLs to the clipboard\n", len(urls))
+	}
+}
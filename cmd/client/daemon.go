@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/sombochea/tungo/internal/client"
+)
+
+var (
+	daemonMode  bool // start --daemon
+	daemonChild bool // Set on the background process started by start --daemon
+	logsFollow  bool
+	logsLines   int
+)
+
+// daemonStartTimeout bounds how long start --daemon waits for the background process to come up
+const daemonStartTimeout = 15 * time.Second
+
+// daemonStatus is what the daemon reports on its control socket
+type daemonStatus struct {
+	PID       int            `json:"pid"`
+	StartedAt time.Time      `json:"started_at"`
+	Connected bool           `json:"connected"`
+	Server    string         `json:"server"`
+	Tunnels   []daemonTunnel `json:"tunnels"`
+}
+
+// daemonTunnel is one tunnel of the daemon's status
+type daemonTunnel struct {
+	Name          string `json:"name,omitempty"`
+	PublicURL     string `json:"public_url"`
+	LocalURL      string `json:"local_url"`
+	Requests      int64  `json:"requests"`
+	ActiveStreams int64  `json:"active_streams"`
+}
+
+// daemonDir holds the daemon's control socket and log file
+func daemonDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return os.TempDir()
+	}
+	return filepath.Join(home, ".tungo")
+}
+
+func daemonSocketPath() string { return filepath.Join(daemonDir(), "tungo.sock") }
+func daemonLogPath() string    { return filepath.Join(daemonDir(), "tungo.log") }
+
+// daemonClient talks HTTP to the daemon over its control socket
+func daemonClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", daemonSocketPath())
+			},
+		},
+	}
+}
+
+// fetchDaemonStatus asks the running daemon for its status
+func fetchDaemonStatus() (*daemonStatus, error) {
+	resp, err := daemonClient(5 * time.Second).Get("http://tungo/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status daemonStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// startDaemon starts this command again in the background, logging to the daemon log file
+func startDaemon() {
+	if _, err := fetchDaemonStatus(); err == nil {
+		log.Fatal().Msg("A tungo daemon is already running, stop it first with tungo stop")
+	}
+	if err := os.MkdirAll(daemonDir(), 0o700); err != nil {
+		log.Fatal().Err(err).Msg("Failed to create daemon directory")
+	}
+	logFile, err := os.OpenFile(daemonLogPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open daemon log file")
+	}
+	defer logFile.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to find the tungo executable")
+	}
+	args := slices.DeleteFunc(slices.Clone(os.Args[1:]), func(arg string) bool {
+		return arg == "--daemon" || strings.HasPrefix(arg, "--daemon=")
+	})
+	// Flags must come before a command to run after --
+	dash := slices.Index(args, "--")
+	if dash < 0 {
+		dash = len(args)
+	}
+	args = slices.Insert(args, dash, "--daemon-child")
+	child := exec.Command(executable, args...)
+	child.Stdout = logFile
+	child.Stderr = logFile
+	child.SysProcAttr = detachedProcAttr()
+	if err := child.Start(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to start daemon")
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- child.Wait() }()
+
+	// Wait for the tunnels to come up, or for the daemon to give up
+	deadline := time.After(daemonStartTimeout)
+	for {
+		select {
+		case err := <-exited:
+			fmt.Printf("❌ Daemon exited during startup (%v), last lines of %s:\n", err, daemonLogPath())
+			if file, err := os.Open(daemonLogPath()); err == nil {
+				writeLastLines(os.Stdout, file, 5)
+				file.Close()
+			}
+			os.Exit(1)
+		case <-deadline:
+			fmt.Printf("⏳ Daemon started (pid %d) but is still connecting, check it with tungo status\n", child.Process.Pid)
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		if status, err := fetchDaemonStatus(); err == nil && status.Connected {
+			fmt.Printf("✅ Daemon started (pid %d), logging to %s\n", status.PID, daemonLogPath())
+			printDaemonStatus(status)
+			return
+		}
+	}
+}
+
+// serveDaemonControl serves the daemon's control socket until the returned func is called
+// POST /stop is delivered to quit like a signal
+func serveDaemonControl(tunnelClient *client.TunnelClient, connected *atomic.Bool, quit chan<- os.Signal) func() {
+	socketPath := daemonSocketPath()
+	os.Remove(socketPath) // Left behind by a daemon that didn't exit cleanly
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Fatal().Err(err).Str("socket", socketPath).Msg("Failed to listen on the daemon control socket")
+	}
+	os.Chmod(socketPath, 0o600)
+
+	startedAt := time.Now()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		currentServer := tunnelClient.GetCurrentServer()
+		status := daemonStatus{
+			PID:       os.Getpid(),
+			StartedAt: startedAt,
+			Connected: connected.Load(),
+			Server:    net.JoinHostPort(currentServer.Host, strconv.Itoa(currentServer.Port)),
+		}
+		for _, tunnel := range tunnelClient.Tunnels() {
+			status.Tunnels = append(status.Tunnels, daemonTunnel{
+				Name:          tunnel.Name(),
+				PublicURL:     tunnel.PublicURL(),
+				LocalURL:      tunnel.LocalURL(),
+				Requests:      tunnel.Requests(),
+				ActiveStreams: tunnel.ActiveStreams(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	mux.HandleFunc("POST /stop", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		select {
+		case quit <- syscall.SIGTERM:
+		default:
+		}
+	})
+	mux.HandleFunc("GET /logs", serveDaemonLogs)
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	return func() {
+		server.Close()
+		os.Remove(socketPath)
+	}
+}
+
+// serveDaemonLogs writes the last lines of the daemon log, then what is appended to it while follow is set
+func serveDaemonLogs(w http.ResponseWriter, r *http.Request) {
+	file, err := os.Open(daemonLogPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	lines, _ := strconv.Atoi(r.URL.Query().Get("lines"))
+	if err := writeLastLines(w, file, lines); err != nil {
+		return
+	}
+	if r.URL.Query().Get("follow") != "true" {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := io.Copy(w, file); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeLastLines copies the last n lines of file to w (all of it when n <= 0), leaving file at its end
+func writeLastLines(w io.Writer, file *os.File, n int) error {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		start := len(data)
+		for i := 0; i < n && start > 0; i++ {
+			start = bytes.LastIndexByte(data[:start-1], '\n') + 1
+			if start == 0 {
+				break
+			}
+		}
+		data = data[start:]
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// printDaemonStatus shows the daemon's tunnels
+func printDaemonStatus(status *daemonStatus) {
+	state := "connected"
+	if !status.Connected {
+		state = "reconnecting"
+	}
+	fmt.Printf("tungo daemon (pid %d) %s to %s, up %s\n",
+		status.PID, state, status.Server, time.Since(status.StartedAt).Round(time.Second))
+	for _, tunnel := range status.Tunnels {
+		name := tunnel.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Printf("  %-16s %s -> %s  (%d requests, %d active)\n",
+			name, tunnel.PublicURL, tunnel.LocalURL, tunnel.Requests, tunnel.ActiveStreams)
+	}
+}
+
+func runStatus(cmd *cobra.Command, args []string) {
+	status, err := fetchDaemonStatus()
+	if err != nil {
+		fmt.Println("No tungo daemon is running")
+		os.Exit(1)
+	}
+	printDaemonStatus(status)
+}
+
+func runStop(cmd *cobra.Command, args []string) {
+	resp, err := daemonClient(5*time.Second).Post("http://tungo/stop", "", nil)
+	if err != nil {
+		fmt.Println("No tungo daemon is running")
+		os.Exit(1)
+	}
+	resp.Body.Close()
+
+	// The daemon closes its control socket last, once its tunnels are down
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		if _, err := fetchDaemonStatus(); err != nil {
+			fmt.Println("✅ Daemon stopped")
+			return
+		}
+	}
+	fmt.Println("❌ Daemon is still running after 10s")
+	os.Exit(1)
+}
+
+func runLogs(cmd *cobra.Command, args []string) {
+	url := fmt.Sprintf("http://tungo/logs?lines=%d&follow=%t", logsLines, logsFollow)
+	resp, err := daemonClient(0).Get(url)
+	if err != nil {
+		fmt.Println("No tungo daemon is running")
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+}
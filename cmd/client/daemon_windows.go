@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// detachedProcess is DETACHED_PROCESS, starting the daemon without a console
+const detachedProcess = 0x00000008
+
+// detachedProcAttr starts the daemon without a console, so it outlives the terminal
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP,
+		HideWindow:    true,
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// devPorts are the ports --auto-detect looks at, in order of preference: the defaults of
+// React/Next/Rails (3000), Vite (5173), Django (8000), most others (8080), Angular (4200) and Flask (5000)
+var devPorts = []int{3000, 5173, 8000, 8080, 4200, 5000, 3001, 5174, 8081, 4000, 4321, 8888, 1313, 9000}
+
+// listeningPorts returns the dev ports accepting connections on host
+func listeningPorts(host string) map[int]bool {
+	listening := make(map[int]bool)
+	for _, port := range devPorts {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), 200*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			listening[port] = true
+		}
+	}
+	return listening
+}
+
+// detectLocalPort waits for a dev port on host to accept connections, skipping those in ignore
+// (ports in use before the child started, the dashboard's). With a child it watches for the
+// port the child opens, failing if it exits first. It returns 0 if quit fires.
+func detectLocalPort(host string, ignore map[int]bool, child *childProcess, quit <-chan os.Signal) (int, error) {
+	var exited <-chan struct{} // Never closes without a child
+	if child != nil {
+		exited = child.done
+	}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	waiting := false
+	for {
+		listening := listeningPorts(host)
+		for _, port := range devPorts {
+			if listening[port] && !ignore[port] {
+				log.Info().Int("port", port).Msg("Detected local app")
+				return port, nil
+			}
+		}
+		if !waiting {
+			log.Info().Str("host", host).Msg("Waiting for a local app to listen on a common dev port")
+			waiting = true
+		}
+
+		select {
+		case <-exited:
+			return 0, fmt.Errorf("command exited before listening on a common dev port: %v", child.exitStatus())
+		case <-quit:
+			return 0, nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+
+	"github.com/sombochea/tungo/internal/client"
+	"github.com/sombochea/tungo/pkg/config"
+	"github.com/sombochea/tungo/pkg/protocol"
+	"github.com/sombochea/tungo/pkg/version"
+)
+
+var initForce bool // init --force
+
+// initConfigTemplate is the client.yaml written by tungo init
+const initConfigTemplate = `# Written by tungo init, see configs/client.example.yaml for every setting
+server_url: %q
+secret_key: %q
+subdomain: %q     # Empty for a random subdomain
+local_host: "localhost"
+local_port: %d
+`
+
+// prompter asks questions on stdin
+type prompter struct {
+	in *bufio.Reader
+}
+
+// ask prints question and returns the trimmed answer, or def when the answer is empty
+func (p *prompter) ask(question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := p.in.ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		os.Exit(1) // stdin closed, e.g. Ctrl+D
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def
+	}
+	return answer
+}
+
+// confirm asks a yes/no question, defaulting to no
+func (p *prompter) confirm(question string) bool {
+	answer := strings.ToLower(p.ask(question+" [y/N]", ""))
+	return answer == "y" || answer == "yes"
+}
+
+func runInit(cmd *cobra.Command, args []string) {
+	configPath := filepath.Join(daemonDir(), "client.yaml")
+	p := &prompter{in: bufio.NewReader(os.Stdin)}
+
+	fmt.Println("🚀 Let's set up TunGo. Press Enter to keep a suggestion.")
+	if _, err := os.Stat(configPath); err == nil && !initForce {
+		if !p.confirm(fmt.Sprintf("%s already exists. Overwrite it?", configPath)) {
+			return
+		}
+	}
+
+	// Suggest the settings of the config file tungo reads today, if any
+	cfg, err := config.LoadClientConfig("")
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	defaultURL := cfg.ServerURL
+	if defaultURL == "" {
+		defaultURL = defaultServerURL
+		if version.GetShortVersion() == "dev" {
+			defaultURL = "ws://localhost:5555"
+		}
+	}
+	defaultSubDomain := cfg.SubDomain
+	defaultPort := strconv.Itoa(cfg.LocalPort)
+
+	for {
+		cfg.ServerURL = p.ask("Server URL", defaultURL)
+		if _, _, _, err := config.ParseServerURL(cfg.ServerURL); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			continue
+		}
+		break
+	}
+	cfg.SecretKey = p.ask("Secret key (leave empty if the server doesn't require one)", "")
+	for {
+		cfg.SubDomain = p.ask("Subdomain (leave empty for a random one)", defaultSubDomain)
+		if cfg.SubDomain == "" {
+			break
+		}
+		if err := protocol.ValidateSubDomain(cfg.SubDomain); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			continue
+		}
+		break
+	}
+	for {
+		port, err := strconv.Atoi(p.ask("Local port", defaultPort))
+		if err != nil || port <= 0 || port > 65535 {
+			fmt.Println("❌ Enter a port between 1 and 65535")
+			continue
+		}
+		cfg.LocalPort = port
+		break
+	}
+	cfg.LocalHost = "localhost"
+	cfg.Tunnels = nil
+	cfg.ServerCluster = nil
+
+	// Open the tunnel once to check the server, the secret key and the subdomain
+	fmt.Printf("🔌 Checking %s...\n", cfg.ServerURL)
+	if err := checkConnection(cfg); err != nil {
+		fmt.Printf("❌ Could not open a tunnel: %v\n", err)
+		if !p.confirm("Save the configuration anyway?") {
+			os.Exit(1)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(configPath), 0o700); err != nil {
+		fmt.Printf("❌ Failed to create %s: %v\n", filepath.Dir(configPath), err)
+		os.Exit(1)
+	}
+	data := fmt.Sprintf(initConfigTemplate, cfg.ServerURL, cfg.SecretKey, cfg.SubDomain, cfg.LocalPort)
+	if err := os.WriteFile(configPath, []byte(data), 0o600); err != nil {
+		fmt.Printf("❌ Failed to write %s: %v\n", configPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("✅ Saved %s, run tungo to start your tunnel\n", configPath)
+}
+
+// checkConnection connects with cfg and closes the tunnel again, reporting its public URL
+func checkConnection(cfg *config.ClientConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	tunnelClient := client.NewTunnelClient(cfg, zerolog.Nop())
+	if err := tunnelClient.Connect(); err != nil {
+		return err
+	}
+	defer tunnelClient.Close()
+
+	for _, tunnel := range tunnelClient.Tunnels() {
+		fmt.Printf("✅ Connected, your tunnel will be at %s\n", tunnel.PublicURL())
+	}
+	return nil
+}
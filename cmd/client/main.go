@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -14,6 +18,8 @@ import (
 	"github.com/sombochea/tungo/internal/client"
 	"github.com/sombochea/tungo/internal/client/introspect"
 	"github.com/sombochea/tungo/pkg/config"
+	"github.com/sombochea/tungo/pkg/protocol"
+	"github.com/sombochea/tungo/pkg/tracing"
 	"github.com/sombochea/tungo/pkg/version"
 )
 
@@ -23,22 +29,78 @@ var (
 	serverHost      string
 	serverPort      int
 	localHost       string
-	localPort       int
+	localPort       string
+	autoDetect      bool
+	localScheme     string
+	localSkipVerify bool
+	hostHeader      string
+	rewriteURLs     bool
 	subDomain       string
 	secretKey       string
 	password        string
+	basicAuth       string
+	webhookVerify   string
+	webhookReject   bool
+	injectLatency   time.Duration
+	injectError     string
+	rateLimit       string
+	oauthProvider   string
+	oauthAllow      []string
+	ipAllow         []string
+	ipDeny          []string
+	maxBodySize     int64
+	headers         []string
+	securityHeaders bool
+	affinity        string
+	labels          []string
+	region          string
 	enableDashboard bool
+	captureLimit    int64
+	captureFile     string
+	captureBuffer   int
 	dashboardPort   int
+	shareDashboard  bool
+	dashboardPass   string
 	insecureTLS     bool
+	showQR          bool
+	copyURL         bool
+	tunnelDuration  time.Duration
+	showStats       bool
+	showTUI         bool
+	statsInterval   time.Duration
+	resourceBudget  string
+	requestLogPath  string
+	requestLogFmt   string
+	requestLogSize  int64
+	requestLogKeep  int
+	startAll        bool
+	tunnelNames     []string // Tunnels picked by the start command, nil for the root command
+	tunnelProtocol  string   // Set by the tcp command
 )
 
+// defaultServerURL is the server release builds connect to when none is configured
+const defaultServerURL = "wss://singal-tg01.ctdn.dev"
+
 func main() {
 	rootCmd := &cobra.Command{
-		Use:     "tungo",
-		Short:   "TunGo client - expose your local server to the internet",
-		Long:    `TunGo client creates a secure tunnel from a public URL to your local development server.`,
+		Use:   "tungo [-- command...]",
+		Short: "TunGo client - expose your local server to the internet",
+		Long: `TunGo client creates a secure tunnel from a public URL to your local development server.
+
+Use tungo http 3000 or tungo tcp 22 for a single tunnel, and tungo start <name> for tunnels
+from the config file. Without a subcommand, tungo opens the tunnel of its flags and config file.
+
+A command after -- is run first, and the tunnel opens once it accepts connections on the local port
+(e.g. tungo --local-port 3000 -- npm run dev). Both stop when either exits. With --auto-detect
+the tunnel opens to whichever common dev port the command starts listening on.`,
 		Version: version.GetShortVersion(),
-		Run:     runClient,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if rest, _ := splitChildCommand(cmd, args); len(rest) > 0 {
+				return fmt.Errorf("unknown command %q for %q", rest[0], cmd.CommandPath())
+			}
+			return nil
+		},
+		Run: runClient,
 	}
 
 	// Version command
@@ -58,23 +120,93 @@ func main() {
 		Run:   runUpgrade,
 	}
 
+	// Start command (named tunnels from the config file)
+	startCmd := &cobra.Command{
+		Use:   "start [name...] [-- command...]",
+		Short: "Start tunnels defined in the config file",
+		Long:  `Starts the named entries of the config file's tunnels list over one connection, or all of them with --all.`,
+		Run:   runStart,
+	}
+	startCmd.Flags().BoolVar(&startAll, "all", false, "start every tunnel in the config file")
+	startCmd.Flags().BoolVar(&daemonMode, "daemon", false, "run in the background, managed with tungo status, stop and logs")
+	startCmd.Flags().BoolVar(&daemonChild, "daemon-child", false, "")
+	startCmd.Flags().MarkHidden("daemon-child")
+
+	// Daemon commands (talk to tungo start --daemon over its control socket)
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the background daemon's tunnels",
+		Args:  cobra.NoArgs,
+		Run:   runStatus,
+	}
+	stopCmd := &cobra.Command{
+		Use:   "stop",
+		Short: "Stop the background daemon",
+		Args:  cobra.NoArgs,
+		Run:   runStop,
+	}
+	logsCmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Show the background daemon's logs",
+		Args:  cobra.NoArgs,
+		Run:   runLogs,
+	}
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "keep printing new log lines")
+	logsCmd.Flags().IntVarP(&logsLines, "lines", "n", 100, "number of recent lines to show (0 = all)")
+
+	// Init command (interactive setup of ~/.tungo/client.yaml)
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create a config file interactively",
+		Long:  `Asks for the server URL, secret key, subdomain and local port, checks them by opening a tunnel, and writes ~/.tungo/client.yaml.`,
+		Args:  cobra.NoArgs,
+		Run:   runInit,
+	}
+	initCmd.Flags().BoolVarP(&initForce, "force", "f", false, "overwrite an existing config file without asking")
+
+	// HTTP command (HTTP tunnel to a local port)
+	httpCmd := &cobra.Command{
+		Use:   "http [local-port] [-- command...]",
+		Short: "Expose a local HTTP server",
+		Long: `Opens an HTTP tunnel to the local port (e.g. tungo http 3000), or to local_port from the config file.
+Several instances of the app can share the tunnel (tungo http 8000,8001).`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			rest, _ := splitChildCommand(cmd, args)
+			return cobra.MaximumNArgs(1)(cmd, rest)
+		},
+		Run: runHTTP,
+	}
+
+	// TCP command (raw TCP tunnel to a local port)
+	tcpCmd := &cobra.Command{
+		Use:   "tcp <local-port> [-- command...]",
+		Short: "Expose a local TCP port",
+		Long:  `Requests a raw TCP tunnel and relays its public host:port to the local port (e.g. tungo tcp 22 for SSH).`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			rest, _ := splitChildCommand(cmd, args)
+			return cobra.ExactArgs(1)(cmd, rest)
+		},
+		Run: runTCP,
+	}
+
 	// Add subcommands
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(upgradeCmd)
-
-	// Flags for the root command (tunnel)
-	rootCmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file path")
-	rootCmd.Flags().StringVar(&serverURL, "server-url", "", "full server URL with control port (e.g., http://tungo.example.com:5555 or ws://tungo.example.com:5555)")
-	rootCmd.Flags().StringVar(&serverHost, "server", "localhost", "tungo server host")
-	rootCmd.Flags().IntVar(&serverPort, "port", 5555, "tungo server control port")
-	rootCmd.Flags().StringVar(&localHost, "local-host", "localhost", "local server host")
-	rootCmd.Flags().IntVar(&localPort, "local-port", 8000, "local server port")
-	rootCmd.Flags().StringVarP(&subDomain, "subdomain", "s", "", "requested subdomain")
-	rootCmd.Flags().StringVarP(&secretKey, "key", "k", "", "secret key for authentication")
-	rootCmd.Flags().StringVarP(&password, "password", "p", "", "password to protect tunnel access")
-	rootCmd.Flags().BoolVarP(&enableDashboard, "dashboard", "d", false, "enable introspection dashboard")
-	rootCmd.Flags().IntVar(&dashboardPort, "dashboard-port", 3000, "introspection dashboard port")
-	rootCmd.Flags().BoolVar(&insecureTLS, "insecure", false, "skip TLS certificate verification (for testing only)")
+	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(startCmd)
+	rootCmd.AddCommand(httpCmd)
+	rootCmd.AddCommand(tcpCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(stopCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(newServiceCmd())
+
+	for _, cmd := range []*cobra.Command{rootCmd, startCmd, httpCmd, tcpCmd} {
+		addTunnelFlags(cmd)
+	}
+	for _, cmd := range []*cobra.Command{rootCmd, startCmd, httpCmd} {
+		addHTTPFlags(cmd)
+	}
 
 	// Set version template
 	rootCmd.SetVersionTemplate("{{.Version}}\n")
@@ -85,6 +217,95 @@ func main() {
 	}
 }
 
+// addTunnelFlags adds the flags shared by every command that opens tunnels
+func addTunnelFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file path")
+	cmd.Flags().StringVar(&serverURL, "server-url", "", "full server URL with control port (e.g., http://tungo.example.com:5555 or ws://tungo.example.com:5555)")
+	cmd.Flags().StringVar(&serverHost, "server", "localhost", "tungo server host")
+	cmd.Flags().IntVar(&serverPort, "port", 5555, "tungo server control port")
+	cmd.Flags().StringVar(&localHost, "local-host", "localhost", "local server host")
+	cmd.Flags().StringVar(&localPort, "local-port", "8000", "local server port, or the ports of several instances to spread requests over (e.g. 8000,8001)")
+	cmd.Flags().BoolVar(&autoDetect, "auto-detect", false, "find the local server on a common dev port (3000, 5173, 8000, 8080, ...), or the one the command after -- opens")
+	cmd.Flags().StringVar(&localScheme, "local-scheme", "http", "local server scheme: http, or https for local servers that only speak TLS")
+	cmd.Flags().BoolVar(&localSkipVerify, "local-skip-verify", false, "accept any certificate from an https local server (self-signed dev certs)")
+	cmd.Flags().StringVarP(&subDomain, "subdomain", "s", "", "requested subdomain")
+	cmd.Flags().StringVarP(&secretKey, "key", "k", "", "secret key for authentication")
+	cmd.Flags().StringVar(&rateLimit, "rate-limit", "", "max streams forwarded to the local server, e.g. 100/s, 600/m or 1000/h (over it visitors get a 429)")
+	cmd.Flags().StringSliceVar(&ipAllow, "ip-allow", nil, "only allow visitors from these CIDRs (comma-separated)")
+	cmd.Flags().StringSliceVar(&ipDeny, "ip-deny", nil, "deny visitors from these CIDRs (comma-separated)")
+	cmd.Flags().StringArrayVar(&labels, "label", nil, "label the tunnel in the server's registry, \"key=value\" (repeatable)")
+	cmd.Flags().StringVar(&region, "region", "", "prefer servers in this region when connecting and reconnecting")
+	cmd.Flags().StringVar(&resourceBudget, "resource-budget", "", "limit client resource usage: low, medium or high")
+	cmd.Flags().BoolVar(&showQR, "qr", false, "print a QR code of the public URL once the tunnel is up, for testing on phones")
+	cmd.Flags().BoolVar(&copyURL, "copy", false, "copy the public URL to the clipboard once the tunnel is up")
+	cmd.Flags().DurationVar(&tunnelDuration, "duration", 0, "shut the tunnel down this long after it comes up, e.g. 2h for a temporary demo (0 = run until stopped)")
+	cmd.Flags().BoolVar(&showStats, "stats", false, "print each tunnel's req/s, active streams and bytes in/out periodically")
+	cmd.Flags().DurationVar(&statsInterval, "stats-interval", 5*time.Second, "how often --stats prints")
+	cmd.Flags().BoolVar(&showTUI, "tui", false, "show the tunnels and live requests in an interactive terminal UI")
+	cmd.Flags().BoolVar(&insecureTLS, "insecure", false, "skip TLS certificate verification (for testing only)")
+}
+
+// addHTTPFlags adds the flags of HTTP tunnels, for every command but tcp
+func addHTTPFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&hostHeader, "host-header", "preserve", "Host header sent to the local server: preserve, rewrite (to local host:port) or custom:<value>")
+	cmd.Flags().BoolVar(&rewriteURLs, "rewrite-urls", false, "point http://localhost:<port> URLs in HTML and redirects at the public URL")
+	cmd.Flags().StringVarP(&password, "password", "p", "", "password to protect tunnel access")
+	cmd.Flags().StringVar(&basicAuth, "basic-auth", "", "protect tunnel with HTTP Basic Auth (user:pass), checked by the server and again by the client")
+	cmd.Flags().StringVar(&webhookVerify, "verify-webhook", "", "check webhook signatures, provider:secret with stripe, github or shopify (e.g. stripe:whsec_...)")
+	cmd.Flags().BoolVar(&webhookReject, "reject-invalid-webhooks", false, "answer webhooks with a bad signature with a 401 instead of forwarding them")
+	cmd.Flags().StringVar(&oauthProvider, "oauth", "", "make visitors log in at the edge with an OAuth provider: github or google")
+	cmd.Flags().StringSliceVar(&oauthAllow, "oauth-allow", nil, "who may visit with --oauth: org:<name>, user:<login>, email:<address>, domain:<domain> (comma-separated)")
+	cmd.Flags().Int64Var(&maxBodySize, "max-body-size", 0, "reject request bodies larger than this many bytes (0 = server limit)")
+	cmd.Flags().StringArrayVar(&headers, "header", nil, "add a response header at the edge, \"Name: value\" (repeatable)")
+	cmd.Flags().BoolVar(&securityHeaders, "security-headers", false, "add HSTS, X-Frame-Options, X-Content-Type-Options and Referrer-Policy to responses")
+	cmd.Flags().StringVar(&affinity, "affinity", "", "pin visitors to one client when several share the subdomain: cookie or ip")
+	cmd.Flags().BoolVarP(&enableDashboard, "dashboard", "d", false, "enable introspection dashboard")
+	cmd.Flags().IntVar(&dashboardPort, "dashboard-port", 3000, "introspection dashboard port")
+	cmd.Flags().BoolVar(&shareDashboard, "share-dashboard", false, "share the dashboard through the tunnel at /_tungo/inspect")
+	cmd.Flags().StringVar(&dashboardPass, "dashboard-password", "", "password required to view the shared dashboard")
+	cmd.Flags().Int64Var(&captureLimit, "capture-limit", 1<<20, "max bytes of each request and response captured for the dashboard (0 = unlimited)")
+	cmd.Flags().IntVar(&captureBuffer, "capture-buffer", 500, "most captured requests kept in memory for the dashboard, oldest evicted first (0 = unlimited)")
+	cmd.Flags().StringVar(&captureFile, "capture-file", "", "keep captured requests in this file so they survive restarts")
+	cmd.Flags().StringVar(&requestLogPath, "log-requests", "", "also write each served request to this file")
+	cmd.Flags().StringVar(&requestLogFmt, "log-format", "json", "format of the --log-requests file: json or clf (Common Log Format)")
+	cmd.Flags().Int64Var(&requestLogSize, "log-requests-max-size", 100<<20, "rotate the --log-requests file after this many bytes (0 = never)")
+	cmd.Flags().IntVar(&requestLogKeep, "log-requests-max-backups", 5, "rotated --log-requests files to keep")
+	cmd.Flags().DurationVar(&injectLatency, "inject-latency", 0, "delay each forwarded request, to test callers against a slow endpoint")
+	cmd.Flags().StringVar(&injectError, "inject-error", "", "fail a share of requests with a status before they reach the local server, e.g. 500:5%")
+}
+
+func runStart(cmd *cobra.Command, args []string) {
+	names, _ := splitChildCommand(cmd, args)
+	if startAll == (len(names) > 0) {
+		log.Fatal().Msg("Name the tunnels to start, or use --all")
+	}
+	if daemonMode {
+		startDaemon()
+		return
+	}
+	tunnelNames = names
+	if tunnelNames == nil {
+		tunnelNames = []string{}
+	}
+	runClient(cmd, args)
+}
+
+func runHTTP(cmd *cobra.Command, args []string) {
+	if ports, _ := splitChildCommand(cmd, args); len(ports) > 0 {
+		cmd.Flags().Set("local-port", ports[0]) // Checked by runClient
+	}
+	tunnelProtocol = protocol.ProtocolHTTP
+	runClient(cmd, args)
+}
+
+func runTCP(cmd *cobra.Command, args []string) {
+	if err := cmd.Flags().Set("local-port", args[0]); err != nil {
+		log.Fatal().Str("port", args[0]).Msg("Invalid local port")
+	}
+	tunnelProtocol = protocol.ProtocolTCP
+	runClient(cmd, args)
+}
+
 func runClient(cmd *cobra.Command, args []string) {
 	// Load configuration
 	cfg, err := config.LoadClientConfig(cfgFile)
@@ -100,9 +321,9 @@ func runClient(cmd *cobra.Command, args []string) {
 		cfg.ServerHost = ""
 		cfg.ControlPort = 0
 	} else {
-		if serverURL == "" && version.GetShortVersion() != "dev" {
+		if cfg.ServerURL == "" && len(cfg.ServerCluster) == 0 && version.GetShortVersion() != "dev" {
 			// For production releases, use default server URL if none provided
-			cfg.ServerURL = "wss://singal-tg01.ctdn.dev"
+			cfg.ServerURL = defaultServerURL
 			cfg.ServerHost = ""
 			cfg.ControlPort = 0
 		} else {
@@ -118,7 +339,26 @@ func runClient(cmd *cobra.Command, args []string) {
 		cfg.LocalHost = localHost
 	}
 	if cmd.Flags().Changed("local-port") {
-		cfg.LocalPort = localPort
+		ports, err := parseLocalPorts(localPort)
+		if err != nil {
+			log.Fatal().Str("port", localPort).Msg("Invalid local port")
+		}
+		cfg.LocalPort, cfg.LocalPorts = ports[0], ports[1:]
+	}
+	if cmd.Flags().Changed("auto-detect") {
+		cfg.AutoDetect = autoDetect
+	}
+	if cmd.Flags().Changed("local-scheme") {
+		cfg.LocalScheme = localScheme
+	}
+	if cmd.Flags().Changed("local-skip-verify") {
+		cfg.LocalSkipVerify = localSkipVerify
+	}
+	if cmd.Flags().Changed("host-header") {
+		cfg.HostHeader = hostHeader
+	}
+	if cmd.Flags().Changed("rewrite-urls") {
+		cfg.RewriteURLs = rewriteURLs
 	}
 	if subDomain != "" && cmd.Flags().Changed("subdomain") {
 		cfg.SubDomain = subDomain
@@ -129,15 +369,143 @@ func runClient(cmd *cobra.Command, args []string) {
 	if password != "" && cmd.Flags().Changed("password") {
 		cfg.Password = password
 	}
+	if basicAuth != "" && cmd.Flags().Changed("basic-auth") {
+		cfg.BasicAuth = basicAuth
+	}
+	if cmd.Flags().Changed("verify-webhook") {
+		cfg.WebhookVerify = webhookVerify
+	}
+	if cmd.Flags().Changed("reject-invalid-webhooks") {
+		cfg.WebhookReject = webhookReject
+	}
+	if cmd.Flags().Changed("rate-limit") {
+		cfg.RateLimit = rateLimit
+	}
+	if cmd.Flags().Changed("oauth") {
+		cfg.OAuth = oauthProvider
+	}
+	if cmd.Flags().Changed("oauth-allow") {
+		cfg.OAuthAllow = oauthAllow
+	}
+	if cmd.Flags().Changed("ip-allow") {
+		cfg.IPAllow = ipAllow
+	}
+	if cmd.Flags().Changed("ip-deny") {
+		cfg.IPDeny = ipDeny
+	}
+	if cmd.Flags().Changed("max-body-size") {
+		cfg.MaxBodySize = maxBodySize
+	}
+	if cmd.Flags().Changed("header") {
+		if cfg.ResponseHeaders == nil {
+			cfg.ResponseHeaders = make(map[string]string)
+		}
+		for _, header := range headers {
+			name, value, ok := strings.Cut(header, ":")
+			if !ok {
+				log.Fatal().Str("header", header).Msg("Invalid --header, expected \"Name: value\"")
+			}
+			cfg.ResponseHeaders[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	if cmd.Flags().Changed("security-headers") {
+		cfg.SecurityHeaders = securityHeaders
+	}
+	if cmd.Flags().Changed("affinity") {
+		cfg.Affinity = affinity
+	}
+	if cmd.Flags().Changed("label") {
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		for _, label := range labels {
+			key, value, ok := strings.Cut(label, "=")
+			if !ok {
+				log.Fatal().Str("label", label).Msg("Invalid --label, expected \"key=value\"")
+			}
+			cfg.Labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if cmd.Flags().Changed("region") {
+		cfg.Region = region
+	}
 	if cmd.Flags().Changed("dashboard") {
 		cfg.EnableDashboard = enableDashboard
 	}
 	if cmd.Flags().Changed("dashboard-port") {
 		cfg.DashboardPort = dashboardPort
 	}
+	if cmd.Flags().Changed("share-dashboard") {
+		cfg.ShareDashboard = shareDashboard
+	}
+	if dashboardPass != "" && cmd.Flags().Changed("dashboard-password") {
+		cfg.DashboardPassword = dashboardPass
+	}
+	if cmd.Flags().Changed("capture-limit") {
+		cfg.CaptureLimit = captureLimit
+	}
+	if cmd.Flags().Changed("capture-buffer") {
+		cfg.CaptureBuffer = captureBuffer
+	}
+	if cmd.Flags().Changed("capture-file") {
+		cfg.CaptureFile = captureFile
+	}
 	if cmd.Flags().Changed("insecure") {
 		cfg.InsecureTLS = insecureTLS
 	}
+	if cmd.Flags().Changed("qr") {
+		cfg.QRCode = showQR
+	}
+	if cmd.Flags().Changed("copy") {
+		cfg.CopyURL = copyURL
+	}
+	if cmd.Flags().Changed("duration") {
+		cfg.Duration = tunnelDuration
+	}
+	if cmd.Flags().Changed("stats") {
+		cfg.Stats = showStats
+	}
+	if cmd.Flags().Changed("stats-interval") {
+		cfg.StatsInterval = statsInterval
+	}
+	if cmd.Flags().Changed("tui") {
+		cfg.TUI = showTUI
+	}
+	if cmd.Flags().Changed("inject-latency") {
+		cfg.InjectLatency = injectLatency
+	}
+	if cmd.Flags().Changed("inject-error") {
+		cfg.InjectError = injectError
+	}
+	if cmd.Flags().Changed("log-requests") {
+		cfg.RequestLog = requestLogPath
+	}
+	if cmd.Flags().Changed("log-format") {
+		cfg.RequestLogFormat = requestLogFmt
+	}
+	if cmd.Flags().Changed("log-requests-max-size") {
+		cfg.RequestLogMaxSize = requestLogSize
+	}
+	if cmd.Flags().Changed("log-requests-max-backups") {
+		cfg.RequestLogMaxBackups = requestLogKeep
+	}
+
+	if resourceBudget != "" && cmd.Flags().Changed("resource-budget") {
+		cfg.ResourceBudget = resourceBudget
+	}
+	if err := cfg.ApplyResourceBudget(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
+	}
+	if tunnelProtocol != "" {
+		// The http and tcp commands open just their own tunnel
+		cfg.Protocol = tunnelProtocol
+		cfg.Tunnels = nil
+	}
+	if tunnelNames != nil {
+		if err := cfg.SelectTunnels(tunnelNames); err != nil {
+			log.Fatal().Err(err).Msg("Invalid configuration")
+		}
+	}
 
 	if err := cfg.Validate(); err != nil {
 		log.Fatal().Err(err).Msg("Invalid configuration")
@@ -146,6 +514,29 @@ func runClient(cmd *cobra.Command, args []string) {
 	// Setup logger
 	setupLogger(cfg)
 
+	// The TUI takes over the terminal: logs are shown in it and anything else printed is dropped
+	var feed *tuiFeed
+	terminal := os.Stdout
+	if cfg.TUI && !daemonChild {
+		feed = &tuiFeed{}
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: feed, TimeFormat: time.TimeOnly, NoColor: true})
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stdout = devNull
+		}
+	}
+
+	// Setup tracing
+	shutdownTracing, err := tracing.Init("tungo-client", tracing.Config{
+		Enabled:    cfg.TracingEnabled,
+		Endpoint:   cfg.TracingEndpoint,
+		Insecure:   cfg.TracingInsecure,
+		SampleRate: cfg.TracingSampleRate,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize tracing")
+	}
+	defer shutdownTracing(context.Background())
+
 	// Start dashboard if enabled
 	var dashboard *introspect.Dashboard
 	if cfg.EnableDashboard {
@@ -154,6 +545,14 @@ func runClient(cmd *cobra.Command, args []string) {
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to create dashboard")
 		}
+		introspect.GetStore().SetLimit(cfg.CaptureBuffer)
+		if cfg.CaptureFile != "" {
+			if err := introspect.OpenStore(cfg.CaptureFile, cfg.CaptureRetention, cfg.CaptureMaxAge); err != nil {
+				log.Warn().Err(err).Msg("Keeping captured requests in memory only")
+			} else {
+				defer introspect.CloseStore()
+			}
+		}
 		go func() {
 			if err := dashboard.Start(); err != nil {
 				log.Error().Err(err).Msg("Dashboard server error")
@@ -162,19 +561,102 @@ func runClient(cmd *cobra.Command, args []string) {
 		defer dashboard.Stop()
 	}
 
+	// Setup signal handling
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	defer serviceControl(quit)()
+
+	// Run the command given after -- first, the tunnel opens once it listens
+	var child *childProcess
+	_, command := splitChildCommand(cmd, args)
+	ignore := make(map[int]bool) // Ports --auto-detect skips
+	if cfg.AutoDetect && len(command) > 0 {
+		ignore = listeningPorts(cfg.LocalHost) // Already taken by something else
+	}
+	if cfg.EnableDashboard {
+		ignore[cfg.DashboardPort] = true
+	}
+	if len(command) > 0 {
+		child, err = startChild(command)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to run command")
+		}
+		defer child.stop()
+	}
+	ready := true
+	if cfg.AutoDetect {
+		var port int
+		port, err = detectLocalPort(cfg.LocalHost, ignore, child, quit)
+		cfg.LocalPort, cfg.LocalPorts, ready = port, nil, port > 0
+	} else if child != nil {
+		var addresses []string
+		for _, tunnel := range cfg.TunnelList() {
+			addresses = append(addresses, fmt.Sprintf("%s:%d", tunnel.LocalHost, tunnel.LocalPort))
+		}
+		ready, err = child.waitForPorts(addresses, quit)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Command failed")
+	}
+	if !ready {
+		log.Info().Msg("Shutting down client...")
+		return
+	}
+
 	log.Info().Msg("Starting tungo client")
-	log.Info().
-		Str("server", fmt.Sprintf("%s:%d", cfg.ServerHost, cfg.ControlPort)).
-		Str("local", fmt.Sprintf("%s:%d", cfg.LocalHost, cfg.LocalPort)).
-		Str("subdomain", cfg.SubDomain).
-		Msg("Client configuration")
+	for _, tunnel := range cfg.TunnelList() {
+		log.Info().
+			Str("server", fmt.Sprintf("%s:%d", cfg.ServerHost, cfg.ControlPort)).
+			Str("tunnel", tunnel.Name).
+			Str("local", fmt.Sprintf("%s:%d", tunnel.LocalHost, tunnel.LocalPort)).
+			Str("subdomain", tunnel.SubDomain).
+			Msg("Client configuration")
+	}
 
 	// Create tunnel client
 	tunnelClient := client.NewTunnelClient(cfg, log.Logger)
+	if cfg.RequestLog != "" {
+		requestLog, err := client.NewRequestLog(cfg.RequestLog, cfg.RequestLogFormat, cfg.RequestLogMaxSize, cfg.RequestLogMaxBackups)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open request log")
+		}
+		defer requestLog.Close()
+		tunnelClient.SetRequestLog(requestLog)
+	}
+	if dashboard != nil {
+		dashboard.SetPublicURLs(func() []string { return publicURLs(tunnelClient) })
+		dashboard.SetReplayer(tunnelClient.Replay)
+	}
 
-	// Setup signal handling
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	// A daemon is managed over its control socket
+	var online atomic.Bool
+	if daemonChild {
+		stopControl := serveDaemonControl(tunnelClient, &online, quit)
+		defer stopControl()
+	}
+	if feed != nil {
+		defer startTUI(terminal, cfg, tunnelClient, &online, feed, quit)()
+	}
+
+	// Take the tunnel down with the command
+	if child != nil {
+		go func() {
+			<-child.done
+			if child.stopping.Load() {
+				return
+			}
+			log.Warn().Str("status", child.exitStatus()).Msg("Command exited, shutting down")
+			select {
+			case quit <- syscall.SIGTERM:
+			default: // Already shutting down
+			}
+		}()
+	}
+
+	// Start at the fastest server of a cluster, within the preferred region
+	if tunnelClient.GetServerCount() > 1 {
+		tunnelClient.SelectFastestServer(false)
+	}
 
 	// Continuous connection loop with auto-reconnect
 	firstConnection := true
@@ -202,8 +684,9 @@ func runClient(cmd *cobra.Command, args []string) {
 					Str("server", fmt.Sprintf("%s:%d", currentServer.Host, currentServer.Port)).
 					Msg("Retrying connection")
 				time.Sleep(cfg.RetryInterval)
-			} else if !firstConnection {
+			} else if !firstConnection && !tunnelClient.Migrating() && !tunnelClient.TimedOut() {
 				// Not first connection and first retry - wait before reconnecting
+				// (migrations and dead connections reconnect right away so the tunnel moves quickly)
 				log.Info().Msg("Attempting to reconnect...")
 				time.Sleep(cfg.RetryInterval)
 			}
@@ -218,8 +701,10 @@ func runClient(cmd *cobra.Command, args []string) {
 				if retry == cfg.MaxRetries {
 					// Max retries for current server reached
 					if tunnelClient.GetServerCount() > 1 {
-						// Rotate to next server in cluster
-						tunnelClient.RotateToNextServer()
+						// Fail over to the fastest other server in the cluster, or the next one if none answers
+						if !tunnelClient.SelectFastestServer(true) {
+							tunnelClient.RotateToNextServer()
+						}
 						serverRotation++
 
 						// If we've tried all servers, wait before retrying
@@ -248,75 +733,115 @@ func runClient(cmd *cobra.Command, args []string) {
 			continue // Restart retry cycle
 		}
 
+		online.Store(true)
+
 		// Display connection info
-		serverInfo := tunnelClient.GetServerInfo()
 		currentServer := tunnelClient.GetCurrentServer()
 
 		if firstConnection {
-			// Use PublicURL if available, otherwise fall back to Hostname
-			publicURL := serverInfo.PublicURL
-			if publicURL == "" {
-				publicURL = fmt.Sprintf("http://%s", serverInfo.Hostname)
+			for _, tunnel := range tunnelClient.Tunnels() {
+				log.Info().
+					Str("tunnel", tunnel.Name()).
+					Str("url", tunnel.PublicURL()).
+					Str("subdomain", tunnel.SubDomain()).
+					Str("server", fmt.Sprintf("%s:%d", currentServer.Host, currentServer.Port)).
+					Int("cluster_size", tunnelClient.GetServerCount()).
+					Msg("✓ Tunnel established successfully!")
 			}
 
-			log.Info().
-				Str("url", publicURL).
-				Str("subdomain", serverInfo.SubDomain).
-				Str("server", fmt.Sprintf("%s:%d", currentServer.Host, currentServer.Port)).
-				Int("cluster_size", tunnelClient.GetServerCount()).
-				Msg("✓ Tunnel established successfully!")
-
 			fmt.Println()
 			fmt.Println("┌────────────────────────────────────────────────────────────┐")
 			fmt.Printf("│  🌐 Your tunnel is ready!                                  │\n")
-			fmt.Println("├────────────────────────────────────────────────────────────┤")
-			fmt.Printf("│  Public URL:  %-44s │\n", publicURL)
-			fmt.Printf("│  Local:       http://%-36s │\n", fmt.Sprintf("%s:%d", cfg.LocalHost, cfg.LocalPort))
+			for _, tunnel := range tunnelClient.Tunnels() {
+				fmt.Println("├────────────────────────────────────────────────────────────┤")
+				if tunnel.Name() != "" {
+					fmt.Printf("│  Tunnel:      %-44s │\n", tunnel.Name())
+				}
+				fmt.Printf("│  Public URL:  %-44s │\n", tunnel.PublicURL())
+				fmt.Printf("│  Local:       %-44s │\n", tunnel.LocalURL())
+			}
 			if tunnelClient.GetServerCount() > 1 {
+				fmt.Println("├────────────────────────────────────────────────────────────┤")
 				fmt.Printf("│  Cluster:     %d servers (auto-failover enabled)%-9s│\n", tunnelClient.GetServerCount(), "")
 			}
+			if cfg.Duration > 0 {
+				fmt.Println("├────────────────────────────────────────────────────────────┤")
+				expires := fmt.Sprintf("%s (in %s)", time.Now().Add(cfg.Duration).Format("15:04:05"), cfg.Duration)
+				fmt.Printf("│  Expires:     %-44s │\n", expires)
+			}
 			fmt.Println("└────────────────────────────────────────────────────────────┘")
 			fmt.Println()
+			if cfg.QRCode && !daemonChild {
+				for _, tunnel := range tunnelClient.Tunnels() {
+					if tunnel.ServerInfo() != nil && !strings.HasPrefix(tunnel.PublicURL(), "tcp://") {
+						printQRCode(tunnel.PublicURL())
+					}
+				}
+			}
+			if cfg.CopyURL && !daemonChild {
+				copyPublicURLs(publicURLs(tunnelClient))
+			}
+			// The time limit runs from the first connection, reconnects don't extend it
+			if cfg.Duration > 0 {
+				defer scheduleExpiry(cfg.Duration, quit)()
+			}
 			firstConnection = false
 		} else {
-			// Use PublicURL if available, otherwise fall back to Hostname
-			publicURL := serverInfo.PublicURL
-			if publicURL == "" {
-				publicURL = fmt.Sprintf("http://%s", serverInfo.Hostname)
+			for _, tunnel := range tunnelClient.Tunnels() {
+				log.Info().
+					Str("tunnel", tunnel.Name()).
+					Str("url", tunnel.PublicURL()).
+					Str("subdomain", tunnel.SubDomain()).
+					Str("server", fmt.Sprintf("%s:%d", currentServer.Host, currentServer.Port)).
+					Msg("✓ Reconnected successfully!")
 			}
-
-			log.Info().
-				Str("url", publicURL).
-				Str("subdomain", serverInfo.SubDomain).
-				Str("server", fmt.Sprintf("%s:%d", currentServer.Host, currentServer.Port)).
-				Msg("✓ Reconnected successfully!")
 		}
 
-		// Start periodic stats logging
+		// Start periodic stats, printed with --stats and otherwise logged at debug level
 		statsQuit := make(chan struct{})
 		go func() {
-			ticker := time.NewTicker(30 * time.Second)
+			interval := debugStatsInterval
+			if cfg.Stats {
+				interval = cfg.StatsInterval
+			}
+			ticker := time.NewTicker(interval)
 			defer ticker.Stop()
 
+			stats := newThroughput(tunnelClient.Tunnels())
 			for {
 				select {
 				case <-ticker.C:
-					activeStreams := tunnelClient.GetActiveStreams()
-					if activeStreams > 0 {
-						log.Debug().Int("active_streams", activeStreams).Msg("Client stats")
-					}
+					stats.report(tunnelClient.Tunnels(), cfg.Stats)
 				case <-statsQuit:
 					return
 				}
 			}
 		}()
 
+		// Close the connection on shutdown so Run returns, leaving the signal for the check below
+		go func() {
+			select {
+			case sig := <-quit:
+				quit <- sig
+				tunnelClient.Close()
+			case <-statsQuit:
+			}
+		}()
+
 		// Run the client event loop (blocks until connection drops)
 		log.Info().Msg("Starting tunnel...")
 		err := tunnelClient.Run()
 
 		// Connection dropped or error
 		close(statsQuit)
+		online.Store(false)
+
+		// The server expired the tunnel (idle or session limit); reconnecting would just hold the subdomain again
+		if reason := tunnelClient.Expired(); reason != "" {
+			log.Warn().Str("reason", reason).Msg("Tunnel closed by the server, exiting")
+			tunnelClient.Close()
+			return
+		}
 
 		select {
 		case <-quit:
@@ -336,6 +861,51 @@ func runClient(cmd *cobra.Command, args []string) {
 	}
 }
 
+// scheduleExpiry shuts the client down through quit once duration has passed, warning shortly before
+// It returns a function cancelling the timers
+func scheduleExpiry(duration time.Duration, quit chan<- os.Signal) func() {
+	// Warn when a tenth of the duration is left, at most five minutes ahead
+	warnBefore := min(duration/10, 5*time.Minute)
+	warning := time.AfterFunc(duration-warnBefore, func() {
+		log.Warn().Dur("remaining", warnBefore).Msg("Tunnel will shut down soon, its duration is almost over")
+	})
+	expiry := time.AfterFunc(duration, func() {
+		log.Warn().Dur("duration", duration).Msg("Tunnel duration reached, shutting down")
+		select {
+		case quit <- syscall.SIGTERM:
+		default: // Already shutting down
+		}
+	})
+	return func() {
+		warning.Stop()
+		expiry.Stop()
+	}
+}
+
+// parseLocalPorts parses a --local-port value: one port, or several separated by commas
+func parseLocalPorts(value string) ([]int, error) {
+	var ports []int
+	for _, field := range strings.Split(value, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// publicURLs returns the public URLs of the connected tunnels
+func publicURLs(tunnelClient *client.TunnelClient) []string {
+	var urls []string
+	for _, tunnel := range tunnelClient.Tunnels() {
+		if url := tunnel.PublicURL(); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
 func setupLogger(cfg *config.ClientConfig) {
 	// Set log level
 	var level zerolog.Level
@@ -357,7 +927,7 @@ func setupLogger(cfg *config.ClientConfig) {
 
 	// Set log format
 	if cfg.LogFormat == "console" {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, NoColor: daemonChild})
 	}
 }
 
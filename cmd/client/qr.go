@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// printQRCode renders url as a QR code in the terminal, two modules per character cell
+func printQRCode(url string) {
+	code, err := qrcode.New(url, qrcode.Medium)
+	if err != nil {
+		fmt.Printf("Failed to render a QR code for %s: %v\n", url, err)
+		return
+	}
+	// Blocks draw the light modules, leaving the dark ones to the background of dark terminal themes
+	fmt.Printf("📱 Scan to open %s\n", url)
+	fmt.Print(code.ToSmallString(true))
+	fmt.Println()
+}
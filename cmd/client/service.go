@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/sombochea/tungo/pkg/config"
+)
+
+var serviceName string // service install/uninstall/start --name
+
+// serviceSpec is what service install registers with the OS service manager
+type serviceSpec struct {
+	Name       string   // Service name (systemd unit, launchd label, Windows service)
+	Executable string   // Absolute path of the tungo binary
+	Args       []string // tungo start arguments the service runs with
+}
+
+// serviceControl hooks the client into the OS service manager when it runs as a service,
+// delivering stop requests to quit; the returned func is called once the client has shut down
+// Only Windows needs it, its services talk to the service control manager
+var serviceControl = func(quit chan<- os.Signal) func() { return func() {} }
+
+// newServiceCmd builds tungo service and its install, uninstall and start subcommands
+func newServiceCmd() *cobra.Command {
+	serviceCmd := &cobra.Command{
+		Use:   "service",
+		Short: "Run tunnels from the config file as a system service",
+		Long:  `Registers tungo start with systemd (Linux), launchd (macOS) or the service control manager (Windows), so the tunnels come up at boot.`,
+	}
+
+	installCmd := &cobra.Command{
+		Use:   "install [name...]",
+		Short: "Install a service running the named tunnels of the config file",
+		Run:   runServiceInstall,
+	}
+	installCmd.Flags().StringVarP(&cfgFile, "config", "c", "", "config file path (default: the one tungo start would read)")
+	installCmd.Flags().BoolVar(&startAll, "all", false, "run every tunnel in the config file")
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Stop and remove the service",
+		Args:  cobra.NoArgs,
+		Run:   runServiceUninstall,
+	}
+	startCmd := &cobra.Command{
+		Use:   "start",
+		Short: "Start the installed service",
+		Args:  cobra.NoArgs,
+		Run:   runServiceStart,
+	}
+
+	for _, cmd := range []*cobra.Command{installCmd, uninstallCmd, startCmd} {
+		cmd.Flags().StringVar(&serviceName, "name", "tungo", "service name, to install several services")
+		serviceCmd.AddCommand(cmd)
+	}
+	return serviceCmd
+}
+
+func runServiceInstall(cmd *cobra.Command, args []string) {
+	if startAll == (len(args) > 0) {
+		log.Fatal().Msg("Name the tunnels to run, or use --all")
+	}
+
+	// The service runs from another directory, so pin down the config file now
+	configPath, err := config.FindClientConfig(cfgFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to find the config file")
+	}
+	if configPath == "" {
+		log.Fatal().Msg("No config file found, pass one with --config")
+	}
+	cfg, err := config.LoadClientConfig(configPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+	if err := cfg.SelectTunnels(args); err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to find the tungo executable")
+	}
+	spec := serviceSpec{Name: serviceName, Executable: executable, Args: []string{"start"}}
+	if startAll {
+		spec.Args = append(spec.Args, "--all")
+	} else {
+		spec.Args = append(spec.Args, args...)
+	}
+	spec.Args = append(spec.Args, "--config", configPath)
+
+	if err := installService(spec); err != nil {
+		fmt.Printf("❌ Failed to install service %s: %v\n", spec.Name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("✅ Service %s installed, running: tungo %s\n", spec.Name, strings.Join(spec.Args, " "))
+	fmt.Printf("Start it now with: tungo service start --name %s\n", spec.Name)
+}
+
+func runServiceUninstall(cmd *cobra.Command, args []string) {
+	if err := uninstallService(serviceName); err != nil {
+		fmt.Printf("❌ Failed to uninstall service %s: %v\n", serviceName, err)
+		os.Exit(1)
+	}
+	fmt.Printf("✅ Service %s uninstalled\n", serviceName)
+}
+
+func runServiceStart(cmd *cobra.Command, args []string) {
+	if err := startService(serviceName); err != nil {
+		fmt.Printf("❌ Failed to start service %s: %v\n", serviceName, err)
+		os.Exit(1)
+	}
+	fmt.Printf("✅ Service %s started\n", serviceName)
+}
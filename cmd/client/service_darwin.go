@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchdPlist runs tungo start at load, restarting it whenever it exits
+const launchdPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`
+
+// launchdPlistPath is a launch daemon for root, started at boot,
+// and a launch agent otherwise, started when the user logs in
+func launchdPlistPath(name string) (string, error) {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/Library/LaunchDaemons", name+".plist"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", name+".plist"), nil
+}
+
+func launchctl(args ...string) error {
+	output, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// plistString escapes s for a <string> element
+func plistString(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func installService(spec serviceSpec) error {
+	plistPath, err := launchdPlistPath(spec.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(plistPath); err == nil {
+		return fmt.Errorf("%s already exists, uninstall the service first", plistPath)
+	}
+	if err := os.MkdirAll(daemonDir(), 0o700); err != nil {
+		return err
+	}
+
+	var arguments strings.Builder
+	for _, arg := range append([]string{spec.Executable}, spec.Args...) {
+		fmt.Fprintf(&arguments, "\t\t<string>%s</string>\n", plistString(arg))
+	}
+	logPath := plistString(filepath.Join(daemonDir(), spec.Name+".log"))
+	plist := fmt.Sprintf(launchdPlist, plistString(spec.Name), arguments.String(), logPath, logPath)
+
+	if err := os.MkdirAll(filepath.Dir(plistPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(plistPath, []byte(plist), 0o644); err != nil {
+		return err
+	}
+	// Loading also starts it, as RunAtLoad does at every boot or login
+	return launchctl("load", "-w", plistPath)
+}
+
+func uninstallService(name string) error {
+	plistPath, err := launchdPlistPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(plistPath); err != nil {
+		return fmt.Errorf("%s not found", plistPath)
+	}
+	if err := launchctl("unload", "-w", plistPath); err != nil {
+		return err
+	}
+	return os.Remove(plistPath)
+}
+
+func startService(name string) error {
+	return launchctl("start", name)
+}
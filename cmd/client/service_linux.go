@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// systemdUnit runs tungo start, restarting it whenever it exits
+const systemdUnit = `[Unit]
+Description=TunGo tunnel (%s)
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=%s
+`
+
+// systemdScope picks the system instance for root and the user's instance otherwise
+// User units start at boot only with lingering enabled (loginctl enable-linger)
+func systemdScope(name string) (unitPath string, systemctlArgs []string, err error) {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/etc/systemd/system", name+".service"), nil, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Join(configDir, "systemd", "user", name+".service"), []string{"--user"}, nil
+}
+
+func systemctl(scope []string, args ...string) error {
+	output, err := exec.Command("systemctl", append(scope, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// systemdQuote quotes an ExecStart word when it needs it
+func systemdQuote(word string) string {
+	if word != "" && !strings.ContainsAny(word, " \t\"'\\$%;") {
+		return word
+	}
+	word = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`).Replace(word)
+	return `"` + word + `"`
+}
+
+func installService(spec serviceSpec) error {
+	unitPath, scope, err := systemdScope(spec.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(unitPath); err == nil {
+		return fmt.Errorf("%s already exists, uninstall the service first", unitPath)
+	}
+
+	words := []string{systemdQuote(spec.Executable)}
+	for _, arg := range spec.Args {
+		words = append(words, systemdQuote(arg))
+	}
+	wantedBy := "multi-user.target"
+	if scope != nil {
+		wantedBy = "default.target"
+	}
+	unit := fmt.Sprintf(systemdUnit, spec.Name, strings.Join(words, " "), wantedBy)
+
+	if err := os.MkdirAll(filepath.Dir(unitPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(unitPath, []byte(unit), 0o644); err != nil {
+		return err
+	}
+	if err := systemctl(scope, "daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl(scope, "enable", spec.Name+".service"); err != nil {
+		return err
+	}
+	if scope != nil {
+		fmt.Println("ℹ️  User services start at boot only with lingering: loginctl enable-linger")
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	unitPath, scope, err := systemdScope(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(unitPath); err != nil {
+		return fmt.Errorf("%s not found", unitPath)
+	}
+	if err := systemctl(scope, "disable", "--now", name+".service"); err != nil {
+		return err
+	}
+	if err := os.Remove(unitPath); err != nil {
+		return err
+	}
+	return systemctl(scope, "daemon-reload")
+}
+
+func startService(name string) error {
+	_, scope, err := systemdScope(name)
+	if err != nil {
+		return err
+	}
+	return systemctl(scope, "start", name+".service")
+}
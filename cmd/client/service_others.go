@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func installService(spec serviceSpec) error {
+	return fmt.Errorf("services are not supported on %s", runtime.GOOS)
+}
+
+func uninstallService(name string) error {
+	return fmt.Errorf("services are not supported on %s", runtime.GOOS)
+}
+
+func startService(name string) error {
+	return fmt.Errorf("services are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func init() {
+	serviceControl = windowsServiceControl
+}
+
+func installService(spec serviceSpec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(spec.Name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists, uninstall it first", spec.Name)
+	}
+	s, err := m.CreateService(spec.Name, spec.Executable, mgr.Config{
+		DisplayName: fmt.Sprintf("TunGo tunnel (%s)", spec.Name),
+		Description: "Exposes local servers through TunGo tunnels",
+		StartType:   mgr.StartAutomatic,
+	}, spec.Args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Restart tungo whenever it exits, like Restart=always under systemd
+	return s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, 24*60*60)
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s not found: %w", name, err)
+	}
+	defer s.Close()
+	s.Control(svc.Stop) // Fails when it isn't running
+	return s.Delete()
+}
+
+func startService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s not found: %w", name, err)
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+// windowsService answers the service control manager for a running client
+type windowsService struct {
+	quit chan<- os.Signal
+	done <-chan struct{} // Closed once the client has shut down
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-s.done:
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				select {
+				case s.quit <- syscall.SIGTERM:
+				default:
+				}
+				<-s.done
+				return false, 0
+			}
+		}
+	}
+}
+
+// windowsServiceControl reports to the service control manager when tungo runs as a service
+func windowsServiceControl(quit chan<- os.Signal) func() {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		// The name is ignored for services running in their own process
+		svc.Run("tungo", &windowsService{quit: quit, done: done})
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sombochea/tungo/internal/client"
+)
+
+// debugStatsInterval is how often the tunnels' stats are logged at debug level without --stats
+const debugStatsInterval = 30 * time.Second
+
+// throughput turns the tunnels' counters into a per-interval request rate
+type throughput struct {
+	requests map[*client.Tunnel]int64 // Each tunnel's request count at the last report
+	last     time.Time
+}
+
+func newThroughput(tunnels []*client.Tunnel) *throughput {
+	t := &throughput{requests: make(map[*client.Tunnel]int64), last: time.Now()}
+	for _, tunnel := range tunnels {
+		t.requests[tunnel] = tunnel.Requests()
+	}
+	return t
+}
+
+// report prints one line per tunnel with --stats, or logs the tunnels that are busy at debug level
+func (t *throughput) report(tunnels []*client.Tunnel, print bool) {
+	now := time.Now()
+	elapsed := now.Sub(t.last).Seconds()
+	t.last = now
+
+	for _, tunnel := range tunnels {
+		requests := tunnel.Requests()
+		rate := float64(requests-t.requests[tunnel]) / elapsed
+		t.requests[tunnel] = requests
+
+		if print {
+			prefix := ""
+			if name := tunnel.Name(); name != "" {
+				prefix = "[" + name + "] "
+			}
+			fmt.Printf("📊 %s%.1f req/s, %d active, %d total, ↓ %s ↑ %s\n",
+				prefix, rate, tunnel.ActiveStreams(), requests,
+				formatBytes(tunnel.BytesIn()), formatBytes(tunnel.BytesOut()))
+		} else if activeStreams := tunnel.ActiveStreams(); activeStreams > 0 {
+			log.Debug().
+				Str("tunnel", tunnel.Name()).
+				Int64("active_streams", activeStreams).
+				Int64("requests", requests).
+				Float64("requests_per_second", rate).
+				Int64("bytes_in", tunnel.BytesIn()).
+				Int64("bytes_out", tunnel.BytesOut()).
+				Msg("Client stats")
+		}
+	}
+}
+
+// formatBytes renders a byte count in human-readable units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
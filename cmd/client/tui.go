@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	"github.com/sombochea/tungo/internal/client"
+	"github.com/sombochea/tungo/pkg/config"
+)
+
+const (
+	tuiMaxRequests  = 500 // Requests kept for the list, and held back while paused
+	tuiMaxLogs      = 3   // Latest log lines shown under the list
+	tuiTickInterval = 250 * time.Millisecond
+)
+
+var (
+	tuiTitleStyle  = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12"))
+	tuiOnlineStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
+	tuiWaitStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("11"))
+	tuiDimStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	tuiHeaderStyle = lipgloss.NewStyle().Bold(true).Underline(true)
+)
+
+// tuiFeed collects the requests and log lines the client reports, which the TUI picks up on each tick
+type tuiFeed struct {
+	mutex    sync.Mutex
+	requests []client.RequestEntry // Not yet shown
+	logs     []string
+}
+
+func (f *tuiFeed) addRequest(entry client.RequestEntry) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests = append(f.requests, entry)
+	if len(f.requests) > tuiMaxRequests {
+		f.requests = f.requests[len(f.requests)-tuiMaxRequests:]
+	}
+}
+
+// Write takes the console logger's lines
+func (f *tuiFeed) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		f.logs = append(f.logs, line)
+	}
+	if len(f.logs) > tuiMaxLogs {
+		f.logs = f.logs[len(f.logs)-tuiMaxLogs:]
+	}
+	return len(p), nil
+}
+
+// take returns the requests reported since the last call (oldest first) and the latest log lines
+func (f *tuiFeed) take() ([]client.RequestEntry, []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests, append([]string(nil), f.logs...)
+}
+
+// pending returns how many requests are waiting to be shown
+func (f *tuiFeed) pending() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.requests)
+}
+
+type tuiTickMsg struct{}
+
+func tuiTick() tea.Cmd {
+	return tea.Tick(tuiTickInterval, func(time.Time) tea.Msg { return tuiTickMsg{} })
+}
+
+// tuiModel is the terminal UI of tungo --tui: the tunnels, their state and the latest requests
+type tuiModel struct {
+	cfg          *config.ClientConfig
+	tunnelClient *client.TunnelClient
+	online       *atomic.Bool
+	feed         *tuiFeed
+	requests     []client.RequestEntry // Newest first
+	logs         []string
+	paused       bool
+	width        int
+	height       int
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return tuiTick()
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		case "c":
+			m.requests = nil
+		case "p", " ":
+			m.paused = !m.paused
+		}
+	case tuiTickMsg:
+		if m.paused {
+			_, m.logs = m.feed.take() // Only the requests wait for the list to resume
+		} else {
+			var requests []client.RequestEntry
+			requests, m.logs = m.feed.take()
+			for _, entry := range requests {
+				m.requests = append([]client.RequestEntry{entry}, m.requests...)
+			}
+			if len(m.requests) > tuiMaxRequests {
+				m.requests = m.requests[:tuiMaxRequests]
+			}
+		}
+		return m, tuiTick()
+	}
+	return m, nil
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+
+	state := tuiWaitStyle.Render("○ connecting")
+	if m.online.Load() {
+		server := m.tunnelClient.GetCurrentServer()
+		state = tuiOnlineStyle.Render(fmt.Sprintf("● online via %s:%d", server.Host, server.Port))
+	}
+	fmt.Fprintf(&b, "%s  %s\n\n", tuiTitleStyle.Render("TunGo"), state)
+
+	for _, tunnel := range m.tunnelClient.Tunnels() {
+		publicURL := tunnel.PublicURL()
+		if publicURL == "" {
+			publicURL = "..."
+		}
+		if name := tunnel.Name(); name != "" {
+			fmt.Fprintf(&b, "[%s] ", name)
+		}
+		fmt.Fprintf(&b, "%s → %s  %s\n", publicURL, tunnel.LocalURL(),
+			tuiDimStyle.Render(fmt.Sprintf("%d active, %d requests, ↓ %s ↑ %s",
+				tunnel.ActiveStreams(), tunnel.Requests(), formatBytes(tunnel.BytesIn()), formatBytes(tunnel.BytesOut()))))
+	}
+	if m.cfg.EnableDashboard {
+		fmt.Fprintf(&b, "%s\n", tuiDimStyle.Render(fmt.Sprintf("Dashboard: http://localhost:%d", m.cfg.DashboardPort)))
+	}
+	b.WriteString("\n")
+
+	// Columns: time, method, status, latency and size are fixed, the path takes the rest
+	pathWidth := max(m.width-49, 10)
+	fmt.Fprintf(&b, "%s\n", tuiHeaderStyle.Render(fmt.Sprintf("%-8s  %-7s  %-*s  %6s  %9s  %9s",
+		"TIME", "METHOD", pathWidth, "PATH", "STATUS", "LATENCY", "SIZE")))
+
+	// Keep the header, tunnels and footer on screen, filling the rest with requests
+	used := strings.Count(b.String(), "\n") + tuiMaxLogs + 2
+	rows := max(m.height-used, 1)
+	for i, entry := range m.requests {
+		if i == rows {
+			break
+		}
+		path := entry.Path
+		if len(path) > pathWidth {
+			path = path[:pathWidth-1] + "…"
+		}
+		status := lipgloss.NewStyle().Foreground(tuiStatusColor(entry.Status)).Render(fmt.Sprintf("%6d", entry.Status))
+		fmt.Fprintf(&b, "%-8s  %-7s  %-*s  %s  %9s  %9s\n",
+			entry.Time.Format("15:04:05"), entry.Method, pathWidth, path, status,
+			entry.Latency.Round(time.Millisecond), formatBytes(entry.BytesOut))
+	}
+	for i := len(m.requests); i < rows; i++ {
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\n")
+	for i := len(m.logs); i < tuiMaxLogs; i++ {
+		b.WriteString("\n")
+	}
+	for _, line := range m.logs {
+		if m.width > 0 && len(line) > m.width {
+			line = line[:m.width]
+		}
+		fmt.Fprintf(&b, "%s\n", tuiDimStyle.Render(line))
+	}
+	keys := "q quit • c clear • p pause"
+	if m.paused {
+		keys = fmt.Sprintf("q quit • c clear • p resume (paused, %d new)", m.feed.pending())
+	}
+	b.WriteString(tuiDimStyle.Render(keys))
+	return b.String()
+}
+
+// tuiStatusColor colors statuses like the request lines on the console
+func tuiStatusColor(status int) lipgloss.Color {
+	switch {
+	case status >= 200 && status < 300:
+		return lipgloss.Color("2")
+	case status >= 300 && status < 400:
+		return lipgloss.Color("6")
+	case status >= 400 && status < 500:
+		return lipgloss.Color("3")
+	case status >= 500:
+		return lipgloss.Color("1")
+	default:
+		return lipgloss.Color("7")
+	}
+}
+
+// startTUI runs the TUI on terminal until the user quits it, which shuts the client down through quit
+// It returns a function closing the TUI and restoring the terminal
+func startTUI(terminal *os.File, cfg *config.ClientConfig, tunnelClient *client.TunnelClient,
+	online *atomic.Bool, feed *tuiFeed, quit chan<- os.Signal) func() {
+	model := &tuiModel{cfg: cfg, tunnelClient: tunnelClient, online: online, feed: feed}
+	program := tea.NewProgram(model, tea.WithAltScreen(), tea.WithInput(os.Stdin), tea.WithOutput(terminal))
+	tunnelClient.SetRequestHandler(feed.addRequest)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		program.Run()
+		select {
+		case quit <- syscall.SIGINT:
+		default: // Already shutting down
+		}
+	}()
+	return func() {
+		program.Quit()
+		<-done
+	}
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -14,14 +25,19 @@ import (
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/adaptor"
 	"github.com/gorilla/websocket"
+	"github.com/pires/go-proxyproto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp/fasthttputil"
 
 	"github.com/sombochea/tungo/internal/proxy"
 	"github.com/sombochea/tungo/internal/registry"
 	"github.com/sombochea/tungo/internal/server"
+	"github.com/sombochea/tungo/internal/server/admin"
 	"github.com/sombochea/tungo/pkg/config"
+	"github.com/sombochea/tungo/pkg/protocol"
+	"github.com/sombochea/tungo/pkg/tracing"
 )
 
 func main() {
@@ -38,32 +54,59 @@ func main() {
 	// Setup logger
 	setupLogger(cfg)
 
+	// Setup tracing
+	shutdownTracing, err := tracing.Init("tungo-server", tracing.Config{
+		Enabled:    cfg.TracingEnabled,
+		Endpoint:   cfg.TracingEndpoint,
+		Insecure:   cfg.TracingInsecure,
+		SampleRate: cfg.TracingSampleRate,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize tracing")
+	}
+	defer shutdownTracing(context.Background())
+
 	log.Info().Msg("Starting tungo server")
 	log.Info().
 		Str("server_id", cfg.ID).
+		Str("region", cfg.Region).
 		Str("host", cfg.Host).
 		Int("port", cfg.Port).
 		Int("control_port", cfg.ControlPort).
+		Bool("single_port", cfg.SinglePort).
 		Str("domain", cfg.Domain).
 		Str("redis_url", cfg.RedisURL).
 		Msg("Server configuration")
 
-	// Initialize registry (auto-detect: Redis if URL provided, otherwise in-memory)
+	// Initialize registry (auto-detect: Consul, NATS or Redis if configured, otherwise in-memory)
 	slogger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}))
 
-	datastore, err := registry.NewRegistry(cfg.RedisURL, cfg.ID, slogger)
+	var datastore registry.Registry
+	switch {
+	case cfg.ConsulAddress != "":
+		datastore, err = registry.NewConsulRegistry(cfg.ConsulAddress, cfg.ConsulToken, registryTimings(cfg), cfg.ID, slogger)
+	case cfg.NATSURL != "":
+		datastore, err = registry.NewNATSRegistry(cfg.NATSURL, registryTimings(cfg), cfg.ID, slogger)
+	default:
+		datastore, err = registry.NewRegistry(redisOptions(cfg), registryTimings(cfg), cfg.ID, slogger)
+	}
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize registry")
 	}
 	defer datastore.Close()
 
 	// Log the datastore mode
-	if cfg.RedisURL == "" {
+	switch {
+	case cfg.ConsulAddress != "":
+		log.Info().Str("consul_address", cfg.ConsulAddress).Msg("Using Consul datastore (distributed mode)")
+	case cfg.NATSURL != "":
+		log.Info().Msg("Using NATS datastore (distributed mode)")
+	case !cfg.UsesRedis():
 		log.Info().Msg("Using in-memory datastore (non-distributed mode)")
-	} else {
-		log.Info().Str("redis_url", cfg.RedisURL).Msg("Using Redis datastore (distributed mode)")
+	default:
+		log.Info().Msg("Using Redis datastore (distributed mode)")
 	}
 
 	// Register this server and start heartbeat
@@ -71,24 +114,124 @@ func main() {
 		ServerID:    cfg.ID,
 		Host:        cfg.Host,
 		ProxyPort:   cfg.Port,
-		ControlPort: cfg.ControlPort,
+		ControlPort: cfg.AdvertisedControlPort(),
+		Region:      cfg.Region,
+		Zone:        cfg.Zone,
 	}
 	if err := datastore.RegisterServer(serverInfo); err != nil {
 		log.Fatal().Err(err).Msg("Failed to register server")
 	}
 	datastore.StartHeartbeat(serverInfo)
 
+	// Run cluster-wide jobs on the elected leader only
+	housekeeper := server.NewHousekeeper(datastore, cfg.RegistryTunnelTTL, log.Logger)
+	housekeeper.Start()
+	defer housekeeper.Stop()
+
+	// Seed configured tenant accounts
+	for _, account := range cfg.Accounts {
+		if err := datastore.SaveAccount(account.SecretKey, registryAccount(account)); err != nil {
+			log.Fatal().Err(err).Str("account", account.ID).Msg("Failed to save account")
+		}
+	}
+	if len(cfg.Accounts) > 0 {
+		log.Info().Int("accounts", len(cfg.Accounts)).Msg("Tenant accounts loaded")
+	}
+
+	// Authenticate server-to-server traffic with mutual TLS
+	var clusterTLS *server.ClusterTLS
+	var clusterClientTLS *tls.Config
+	if cfg.ClusterTLS {
+		if cfg.ClusterTLSCertFile != "" {
+			clusterTLS, err = server.LoadClusterTLS(cfg.ClusterTLSCertFile, cfg.ClusterTLSKeyFile, cfg.ClusterTLSCAFile)
+		} else {
+			clusterTLS, err = server.NewClusterTLS(datastore, cfg.ID)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up cluster TLS")
+		}
+		clusterClientTLS = clusterTLS.ClientConfig()
+	}
+
 	// Initialize server proxy for cross-server communication
-	serverProxy := proxy.NewServerProxy(datastore, slogger)
+	serverProxy := proxy.NewServerProxy(datastore, clusterClientTLS, slogger)
+	var dataPlanePool *proxy.DataPlanePool
+	if cfg.DataPlane == "grpc" {
+		dataPlanePool = proxy.NewDataPlanePool(clusterClientTLS, slogger)
+		serverProxy.SetDataPlane(dataPlanePool)
+	}
 
 	// Create connection manager
 	connMgr := server.NewConnectionManager(datastore, log.Logger, cfg.MaxConnections)
+	connMgr.SetBandwidthQuota(server.BandwidthQuota{
+		DailyBytes:   cfg.BandwidthQuotaDaily,
+		MonthlyBytes: cfg.BandwidthQuotaMonthly,
+		Action:       cfg.BandwidthQuotaAction,
+		ThrottleRate: cfg.BandwidthThrottleRate,
+	})
+	connMgr.SetCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown)
+	connMgr.SetReconnectGrace(cfg.ReconnectGrace)
+	connMgr.SetMaxStreams(cfg.MaxStreams)
 
 	// Create control server
 	controlServer := server.NewControlServer(cfg, connMgr, log.Logger, datastore)
 
+	// Create access logger
+	var accessLog *server.AccessLogger
+	if cfg.AccessLog {
+		accessLog, err = server.NewAccessLogger(log.Logger, cfg.AccessLogFile, cfg.AccessLogBodies)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create access logger")
+		}
+		defer accessLog.Close()
+	}
+
 	// Create proxy handler
-	proxyHandler := server.NewProxyHandler(connMgr, log.Logger)
+	proxyHandler := server.NewProxyHandler(connMgr, log.Logger, accessLog)
+	proxyHandler.SetResponseHeaders(cfg.EdgeHeaders())
+	proxyHandler.SetMaxBodySize(int64(cfg.MaxBodySize))
+	proxyHandler.SetCompression(cfg.Compression)
+	proxyHandler.SetResponseTimeouts(server.ResponseTimeouts{
+		FirstByte: cfg.ResponseFirstByteTimeout,
+		Header:    cfg.ResponseHeaderTimeout,
+		Idle:      cfg.ResponseIdleTimeout,
+	})
+	if cfg.MetricsEnabled {
+		proxyHandler.SetTunnelMetrics(cfg.MetricsSubdomainLimit)
+	}
+
+	// Peers allowed to report the visitor IP through forwarding headers
+	trustedProxies, err := server.NewTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid trusted proxies configuration")
+	}
+	proxyHandler.SetTrustedProxies(trustedProxies)
+
+	// Visitor logins for tunnels protected with OAuth
+	oauthGate := server.NewOAuthGate(cfg, log.Logger)
+
+	// Edge cache for cacheable tunnel responses
+	if cfg.Cache {
+		var store server.CacheStore = server.NewMemoryCacheStore(cfg.CacheMaxSize)
+		if cfg.CacheBackend == "redis" {
+			redisStore, err := server.NewRedisCacheStore(redisOptions(cfg), log.Logger)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to create cache store")
+			}
+			defer redisStore.Close()
+			store = redisStore
+		}
+		cache := server.NewResponseCache(store, cfg.CacheMaxEntrySize)
+		proxyHandler.SetCache(cache)
+		connMgr.SetResponseCache(cache)
+		log.Info().Str("backend", cfg.CacheBackend).Msg("Edge response cache enabled")
+	}
+
+	// Server-wide visitor IP filter
+	ipFilter, err := server.NewIPFilter(cfg.IPAllow, cfg.IPDeny)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid IP filter configuration")
+	}
 
 	// Create Fiber app for control server
 	controlApp := fiber.New(fiber.Config{
@@ -118,23 +261,122 @@ func main() {
 		controlServer.HandleConnection(conn)
 	})))
 
-	// Health check endpoint
+	// Health check endpoint: aggregate counts, with the tunnels and their clients for the admin token
 	controlApp.Get("/health", func(c fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"status":      "ok",
+		if connMgr.IsDraining() {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"status":  "draining",
+				"streams": connMgr.GetActiveStreamsCount(),
+			})
+		}
+		// A server that can't reach its registry can't register or route tunnels, so take it out of rotation
+		status, code, registryStatus := "ok", fiber.StatusOK, fiber.Map{"connected": true}
+		if err := datastore.Ping(); err != nil {
+			status, code = "degraded", fiber.StatusServiceUnavailable
+			registryStatus = fiber.Map{"connected": false, "error": err.Error()}
+		}
+		registryStatus["cache"] = datastore.GetCacheStats()
+		registryStatus["leader"] = datastore.IsLeader()
+		if cfg.Region != "" {
+			if servers, err := datastore.GetServersInRegion(cfg.Region); err == nil {
+				registryStatus["region"] = fiber.Map{"name": cfg.Region, "zone": cfg.Zone, "servers": len(servers)}
+			}
+		}
+
+		health := fiber.Map{
+			"status":      status,
+			"maintenance": connMgr.Maintenance().Enabled,
 			"connections": connMgr.GetActiveConnections(),
-			"subdomains":  connMgr.ListSubDomains(),
-		})
+			"tunnels":     len(connMgr.ListSubDomains()),
+			"registry":    registryStatus,
+		}
+		if hasAdminToken(c, cfg.AdminToken) {
+			clients := connMgr.ListClients()
+			sort.Slice(clients, func(i, j int) bool { return clients[i].SubDomain < clients[j].SubDomain })
+			health["subdomains"] = connMgr.ListSubDomains()
+			health["clients"] = clients
+		}
+		return c.Status(code).JSON(health)
 	})
 
-	// Start control server
-	go func() {
-		addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.ControlPort)
-		log.Info().Str("addr", addr).Msg("Control server listening")
-		if err := controlApp.Listen(addr); err != nil {
-			log.Fatal().Err(err).Msg("Control server failed")
+	// Bandwidth usage for a tunnel, for the admin or the tunnel's owner (with its secret key as the bearer token)
+	controlApp.Get("/usage/:subdomain", func(c fiber.Ctx) error {
+		subDomain := c.Params("subdomain")
+		key, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok {
+			key = ""
 		}
-	}()
+		if !hasAdminToken(c, cfg.AdminToken) && !connMgr.IsOwnedByKey(subDomain, key) {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="usage"`)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+		}
+		return c.JSON(connMgr.Bandwidth().Usage(subDomain))
+	})
+
+	// Providers send visitors back here (oauth_callback_url), and on to the tunnel host in the login's state
+	if len(cfg.OAuthProviders()) > 0 {
+		controlApp.Get(server.OAuthCallbackPath, func(c fiber.Ctx) error {
+			target, err := oauthGate.Return(c)
+			if err != nil {
+				return sendPrettyError(c, fiber.StatusBadRequest,
+					"Login Failed",
+					"Your login could not be completed. Please open the tunnel again to retry.")
+			}
+			return c.Redirect().Status(fiber.StatusSeeOther).To(target)
+		})
+	}
+
+	// Cluster-wide tunnel events as server-sent events
+	if cfg.EventStream {
+		eventStream, err := server.NewEventStream(datastore, cfg.AdminToken, log.Logger)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to subscribe to registry events")
+		}
+		defer eventStream.Close()
+		controlApp.Get("/events", eventStream.Handler())
+	}
+
+	// Admin dashboard (only when an admin token is configured)
+	if cfg.AdminToken != "" {
+		dashboard, err := admin.NewDashboard(cfg.AdminToken, connMgr, proxyHandler, datastore)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create admin dashboard")
+		}
+		dashboard.Start()
+		defer dashboard.Stop()
+
+		adminHandler := adaptor.HTTPHandler(http.StripPrefix("/admin", dashboard.Handler()))
+		controlApp.All("/admin/*", func(c fiber.Ctx) error {
+			prefix, _ := c.Locals(controlPathLocal).(string)
+			c.Request().Header.Set(admin.MountPathHeader, prefix+"/admin")
+
+			// Relative links in the dashboard need the trailing slash
+			if c.Path() == "/admin" {
+				target := "admin/" // Relative, so a control_path prefix is kept
+				if query := c.Request().URI().QueryString(); len(query) > 0 {
+					target += "?" + string(query)
+				}
+				return c.Redirect().To(target)
+			}
+			return adminHandler(c)
+		})
+		log.Info().Int("port", cfg.AdvertisedControlPort()).Msg("Admin dashboard enabled at /admin/")
+	}
+
+	// Start control server (in single-port mode it is served by the proxy listeners below)
+	if !cfg.SinglePort {
+		go func() {
+			addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.ControlPort)
+			ln, err := listen(cfg, addr)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to listen for control server")
+			}
+			log.Info().Str("addr", addr).Bool("proxy_protocol", cfg.ProxyProtocol).Msg("Control server listening")
+			if err := controlApp.Listener(ln); err != nil {
+				log.Fatal().Err(err).Msg("Control server failed")
+			}
+		}()
+	}
 
 	// Create Fiber app for HTTP proxy
 	proxyApp := fiber.New(fiber.Config{
@@ -142,71 +384,246 @@ func main() {
 		ReadTimeout:  cfg.ReadTimeout,
 		WriteTimeout: cfg.WriteTimeout,
 		IdleTimeout:  cfg.IdleTimeout,
+		BodyLimit:    cfg.MaxBodySize,
+		// Request bodies are streamed into the tunnel rather than buffered; limits are enforced by the proxy handler
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		ErrorHandler: func(c fiber.Ctx, err error) error {
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) && fiberErr.Code == fiber.StatusRequestEntityTooLarge {
+				return sendPrettyError(c, fiber.StatusRequestEntityTooLarge,
+					"Request Too Large",
+					fmt.Sprintf("The request body exceeds the maximum allowed size of %d bytes.", cfg.MaxBodySize))
+			}
+			return fiber.DefaultErrorHandler(c, err)
+		},
 	})
 
+	// Single-port mode: hand control requests to the control app
+	if cfg.SinglePort {
+		controlHandler := controlApp.Handler()
+		proxyApp.Use(func(c fiber.Ctx) error {
+			path, ok := controlRequestPath(controlServer.Config(), c.Hostname(), c.Path())
+			if !ok {
+				return c.Next()
+			}
+			// Remember the prefix the browser sees, for paths the control server hands out
+			if path != c.Path() {
+				c.Locals(controlPathLocal, controlServer.Config().ControlPath)
+			}
+			c.Request().URI().SetPath(path)
+			c.Request().Header.SetRequestURIBytes(c.Request().URI().RequestURI()) // net/http handlers read the request line
+			controlHandler(c.RequestCtx())
+			return nil
+		})
+		log.Info().Str("control_host", cfg.ControlHost).Str("control_path", cfg.ControlPath).Msg("Single-port mode: control server shares the proxy port")
+	}
+
 	// Catch-all handler for subdomain routing
 	proxyApp.All("/*", func(c fiber.Ctx) error {
 		host := c.Hostname()
 
 		// Extract subdomain
-		subDomain := extractSubDomain(host, cfg.Domain)
+		subDomain := tunnelSubDomain(host, controlServer.Config())
 		if subDomain == "" {
 			return sendPrettyError(c, fiber.StatusNotFound,
 				"Tunnel Not Found",
 				"No tunnel is configured for this subdomain. Please check your tunnel URL and ensure your client is connected.")
 		}
 
+		// Serve the maintenance page unless connected tunnels keep running
+		maintenance := connMgr.Maintenance()
+		if maintenance.Enabled && !maintenance.KeepTunnels {
+			return sendMaintenancePage(c, maintenance)
+		}
+
+		// Tag the request so it can be correlated across servers and the client
+		requestID := server.EnsureRequestID(c)
+		visitorIP := trustedProxies.ResolveVisitorIP(c)
+		if fromClusterPeer(c, clusterTLS != nil) {
+			visitorIP = server.ResolvePeerVisitorIP(c)
+		}
+
+		// Upgrade plain-HTTP tunnel requests to HTTPS
+		if cfg.HTTPSRedirect && c.Scheme() != "https" {
+			target := "https://" + host
+			if cfg.TLSPort != 443 {
+				target += fmt.Sprintf(":%d", cfg.TLSPort)
+			}
+			return c.Redirect().Status(fiber.StatusMovedPermanently).To(target + c.OriginalURL())
+		}
+
+		if !ipFilter.Allowed(visitorIP) {
+			return sendPrettyError(c, fiber.StatusForbidden,
+				"Access Denied",
+				"Your IP address is not allowed to access this server.")
+		}
+
 		// Check if we need to proxy to another server (distributed mode)
 		shouldProxy, tunnelInfo, err := serverProxy.ShouldProxy(subDomain)
 		if err != nil {
 			log.Debug().Err(err).Str("subdomain", subDomain).Msg("Tunnel not found in registry")
 			// Fall through to local check
 		} else if shouldProxy {
+			// The owning server only sees this server's address unless it trusts it, so check the tunnel's own lists here
+			if filter, err := server.NewIPFilter(tunnelInfo.IPAllow, tunnelInfo.IPDeny); err == nil && !filter.Allowed(visitorIP) {
+				return sendPrettyError(c, fiber.StatusForbidden,
+					"Access Denied",
+					"Your IP address is not allowed to access this tunnel.")
+			}
+
+			// Send the visitor straight to the owning server when it has its own hostname
+			if controlServer.Config().CrossServerMode == "redirect" && tunnelInfo.NodeHost != "" {
+				log.Info().
+					Str("subdomain", subDomain).
+					Str("request_id", requestID).
+					Str("target_server", tunnelInfo.ServerID).
+					Msg("Redirecting request to remote server")
+				return c.Redirect().Status(fiber.StatusTemporaryRedirect).To(nodeURL(c, tunnelInfo.NodeHost))
+			}
+
 			// Proxy to the server that owns this tunnel
 			log.Info().
 				Str("subdomain", subDomain).
+				Str("request_id", requestID).
 				Str("target_server", tunnelInfo.ServerID).
 				Msg("Proxying request to remote server")
 
-			// Convert Fiber context to standard http.Request
+			// Convert Fiber context to standard http.Request, streaming the visitor's body through
 			w := &responseWriter{c: c, headers: make(http.Header)}
 			r, _ := http.NewRequest(
 				c.Method(),
 				c.OriginalURL(),
-				nil,
+				proxyRequestBody(c),
 			)
 			r.Host = host
+			r.RemoteAddr = visitorIP
+			if length := c.Request().Header.ContentLength(); length >= 0 {
+				r.ContentLength = int64(length)
+			} else {
+				r.ContentLength = -1 // Chunked or read until close: forward as chunked
+			}
 
 			// Copy headers from Fiber context
 			c.Request().Header.VisitAll(func(key, value []byte) {
 				r.Header.Add(string(key), string(value))
 			})
 
-			if err := serverProxy.ProxyToServer(w, r, tunnelInfo); err != nil {
-				log.Error().Err(err).Msg("Failed to proxy request")
+			err := serverProxy.ProxyToServer(w, r, tunnelInfo)
+			switch {
+			case errors.Is(err, proxy.ErrTunnelLocal):
+				// The owning server died and the client reconnected here: serve it locally
+				log.Info().Str("subdomain", subDomain).Str("request_id", requestID).Msg("Tunnel reconnected to this server, serving locally")
+			case err != nil:
+				log.Error().Err(err).Str("request_id", requestID).Msg("Failed to proxy request")
 				return sendPrettyError(c, fiber.StatusBadGateway,
 					"Proxy Error",
 					"Unable to forward your request to the target server. The remote tunnel server may be unavailable.")
-			}
-
-			// Copy response headers back to Fiber
-			for k, vals := range w.headers {
-				for _, v := range vals {
-					c.Response().Header.Add(k, v)
+			default:
+				// Copy response headers back to Fiber
+				for k, vals := range w.headers {
+					for _, v := range vals {
+						c.Response().Header.Add(k, v)
+					}
 				}
-			}
 
-			return nil
+				return nil
+			}
 		}
 
-		// Get client connection from local connection manager
-		client, exists := connMgr.GetClientBySubDomain(subDomain)
+		// Get client connection from local connection manager (one of the subdomain's replicas)
+		// (held briefly if its client just disconnected and is expected to reconnect)
+		client, exists := connMgr.SelectClient(c, subDomain)
+		if !exists && maintenance.Enabled {
+			return sendMaintenancePage(c, maintenance)
+		}
+		if !exists && connMgr.AwaitReconnect(subDomain) {
+			client, exists = connMgr.SelectClient(c, subDomain)
+		}
 		if !exists {
 			return sendPrettyError(c, fiber.StatusServiceUnavailable,
 				"Tunnel Not Active",
 				"This tunnel is currently not connected. Please start your tunnel client and try again.")
 		}
 
+		// Check the tunnel's own IP allow/deny lists
+		if !client.IPFilter.Allowed(visitorIP) {
+			return sendPrettyError(c, fiber.StatusForbidden,
+				"Access Denied",
+				"Your IP address is not allowed to access this tunnel.")
+		}
+
+		// Raw TCP tunnels are only reachable on their own port
+		if client.Protocol == protocol.ProtocolTCP {
+			return sendPrettyError(c, fiber.StatusNotFound,
+				"TCP Tunnel",
+				"This tunnel forwards raw TCP on its own port and doesn't serve HTTP on this hostname.")
+		}
+
+		// Enforce the tunnel's own body size limit using the declared length before forwarding
+		// (streamed bodies are also counted against it by the proxy handler)
+		if client.MaxBodySize > 0 && int64(c.Request().Header.ContentLength()) > client.MaxBodySize {
+			return sendPrettyError(c, fiber.StatusRequestEntityTooLarge,
+				"Request Too Large",
+				fmt.Sprintf("The request body exceeds this tunnel's maximum allowed size of %d bytes.", client.MaxBodySize))
+		}
+
+		// Shared dashboard traffic is gated by its own password and routed to the client's inspector
+		if path := c.Path(); client.InspectPassword != "" && (path == protocol.InspectPathPrefix || strings.HasPrefix(path, protocol.InspectPathPrefix+"/")) {
+			if !checkBasicAuthPassword(c, client.InspectPassword) {
+				c.Set("WWW-Authenticate", `Basic realm="TunGo Inspector", charset="UTF-8"`)
+				return sendPrettyError(c, fiber.StatusUnauthorized,
+					"Authentication Required",
+					"This dashboard is password protected. Please provide the dashboard password.")
+			}
+			c.Request().Header.Del("Authorization")
+			return proxyHandler.HandleInspectRequest(c, client)
+		}
+
+		// Enforce HTTP Basic Auth if client has set credentials
+		if client.BasicAuth != "" {
+			if !checkBasicAuth(c, client.BasicAuth) {
+				c.Set("WWW-Authenticate", `Basic realm="TunGo", charset="UTF-8"`)
+				return sendPrettyError(c, fiber.StatusUnauthorized,
+					"Authentication Required",
+					"This tunnel is protected with HTTP Basic Auth. Please provide valid credentials.")
+			}
+			// The header is kept for the client, which checks it again and strips it before the local server
+		}
+
+		// Have visitors log in with the tunnel's OAuth provider, the provider sending them back to the callback
+		if client.OAuth != nil && !oauthGate.Authorized(c, subDomain, client.OAuth) {
+			if c.Path() == server.OAuthCallbackPath {
+				next, err := oauthGate.Callback(c, subDomain, client.OAuth)
+				if errors.Is(err, server.ErrOAuthDenied) {
+					return sendPrettyError(c, fiber.StatusForbidden,
+						"Access Denied",
+						"Your account is not allowed to access this tunnel.")
+				}
+				if err != nil {
+					log.Warn().Err(err).Str("subdomain", subDomain).Str("request_id", requestID).Msg("OAuth login failed")
+					return sendPrettyError(c, fiber.StatusUnauthorized,
+						"Login Failed",
+						"Your login could not be completed. Please open the tunnel again to retry.")
+				}
+				return c.Redirect().Status(fiber.StatusSeeOther).To(next)
+			}
+
+			// Only browser page loads can be sent through the provider's login
+			if c.Method() != fiber.MethodGet || !strings.Contains(c.Get("Accept"), "text/html") {
+				return sendPrettyError(c, fiber.StatusUnauthorized,
+					"Login Required",
+					"This tunnel requires logging in. Please open it in a browser.")
+			}
+			loginURL, err := oauthGate.LoginURL(c, subDomain, client.OAuth, c.OriginalURL())
+			if err != nil {
+				return sendPrettyError(c, fiber.StatusServiceUnavailable,
+					"Login Unavailable",
+					"This tunnel requires logging in, but its login provider is not available on this server.")
+			}
+			return c.Redirect().Status(fiber.StatusFound).To(loginURL)
+		}
+
 		// Check password authentication if client has set one
 		if client.Password != "" {
 			authenticated := false
@@ -267,6 +684,31 @@ func main() {
 			}
 		}
 
+		// Warn browser visitors before they reach an anonymous tunnel
+		if controlServer.Config().AnonymousInterstitial && client.Anonymous {
+			if c.Path() == interstitialContinuePath && c.Method() == fiber.MethodPost {
+				c.Cookie(&fiber.Cookie{
+					Name:     "tungo-warning-" + subDomain,
+					Value:    "1",
+					Path:     "/",
+					MaxAge:   7 * 86400,
+					HTTPOnly: true,
+					Secure:   c.Scheme() == "https",
+					SameSite: "Lax",
+				})
+				next := c.FormValue("next")
+				if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+					next = "/"
+				}
+				return c.Redirect().Status(fiber.StatusSeeOther).To(next)
+			}
+
+			if needsInterstitial(c, subDomain) {
+				c.Set("Content-Type", "text/html; charset=utf-8")
+				return c.Status(fiber.StatusOK).SendString(getInterstitialHTML(host, c.OriginalURL()))
+			}
+		}
+
 		// Handle the request through the tunnel
 		return proxyHandler.HandleRequest(c, client)
 	})
@@ -274,36 +716,169 @@ func main() {
 	// Start proxy server
 	go func() {
 		addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
-		log.Info().Str("addr", addr).Msg("Proxy server listening")
-		if err := proxyApp.Listen(addr); err != nil {
+		ln, err := listen(cfg, addr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to listen for proxy server")
+		}
+		log.Info().Str("addr", addr).Bool("proxy_protocol", cfg.ProxyProtocol).Msg("Proxy server listening")
+		if err := proxyApp.Listener(ln); err != nil {
 			log.Fatal().Err(err).Msg("Proxy server failed")
 		}
 	}()
 
-	// Start metrics server
-	go func() {
-		metricsPort := 9090
-		http.Handle("/metrics", promhttp.Handler())
-		addr := fmt.Sprintf("%s:%d", cfg.Host, metricsPort)
-		log.Info().Str("addr", addr).Msg("Metrics server listening")
-		if err := http.ListenAndServe(addr, nil); err != nil {
-			log.Error().Err(err).Msg("Metrics server failed")
+	// Start HTTPS proxy listener
+	if cfg.TLSEnabled() {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load TLS certificate")
+		}
+
+		addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.TLSPort)
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
 		}
-	}()
+
+		if cfg.SNIRouting {
+			tcpLn, err := listen(cfg, addr)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to listen for HTTPS")
+			}
+
+			// Backend 0 is the control server, backend 1 the proxy
+			router := server.NewSNIRouter(tcpLn, tlsConfig, 2, func(serverName string) int {
+				switch {
+				case strings.EqualFold(serverName, cfg.ControlHost):
+					return 0
+				case tunnelSubDomain(strings.ToLower(serverName), controlServer.Config()) != "":
+					return 1
+				default:
+					return -1
+				}
+			}, log.Logger)
+			go func() {
+				log.Info().Str("addr", addr).Str("control_host", cfg.ControlHost).Msg("HTTPS SNI router listening")
+				if err := router.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+					log.Fatal().Err(err).Msg("HTTPS SNI router failed")
+				}
+			}()
+			go func() {
+				if err := controlApp.Listener(router.Listener(0), fiber.ListenConfig{DisableStartupMessage: true}); err != nil {
+					log.Fatal().Err(err).Msg("HTTPS control server failed")
+				}
+			}()
+			go func() {
+				if err := proxyApp.Listener(router.Listener(1), fiber.ListenConfig{DisableStartupMessage: true}); err != nil {
+					log.Fatal().Err(err).Msg("HTTPS proxy server failed")
+				}
+			}()
+		} else {
+			tcpLn, err := listen(cfg, addr)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to listen for HTTPS")
+			}
+			ln := tls.NewListener(tcpLn, tlsConfig)
+
+			go func() {
+				log.Info().Str("addr", addr).Bool("https_redirect", cfg.HTTPSRedirect).Msg("HTTPS proxy server listening")
+				if err := proxyApp.Listener(ln, fiber.ListenConfig{DisableStartupMessage: true}); err != nil {
+					log.Fatal().Err(err).Msg("HTTPS proxy server failed")
+				}
+			}()
+		}
+	}
+
+	// Start the mutual TLS listener for requests proxied from other servers (never behind PROXY protocol)
+	if clusterTLS != nil {
+		addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.ClusterPort)
+		tcpLn, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to listen for cluster traffic")
+		}
+		go func() {
+			log.Info().Str("addr", addr).Bool("generated_ca", cfg.ClusterTLSCertFile == "").Msg("Cluster TLS server listening")
+			if err := proxyApp.Listener(tls.NewListener(tcpLn, clusterTLS.ServerConfig()), fiber.ListenConfig{DisableStartupMessage: true}); err != nil {
+				log.Fatal().Err(err).Msg("Cluster TLS server failed")
+			}
+		}()
+	}
+
+	// Start the gRPC data plane for requests proxied from other servers, which hands each request
+	// to the proxy in-process (never behind PROXY protocol)
+	var dataPlane *proxy.DataPlaneServer
+	if dataPlanePool != nil {
+		inmemLn := fasthttputil.NewInmemoryListener()
+		inmemLn.SetLocalAddr(dataPlaneAddr)
+		go func() {
+			if err := proxyApp.Listener(inmemLn, fiber.ListenConfig{DisableStartupMessage: true}); err != nil {
+				log.Fatal().Err(err).Msg("Data plane proxy failed")
+			}
+		}()
+
+		var dataPlaneTLS *tls.Config
+		if clusterTLS != nil {
+			dataPlaneTLS = clusterTLS.ServerConfig()
+		}
+		dataPlane = proxy.NewDataPlaneServer(inmemLn.DialWithLocalAddr, dataPlaneTLS, slogger)
+
+		addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.DataPlanePort)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to listen for the data plane")
+		}
+		go func() {
+			log.Info().Str("addr", addr).Bool("cluster_tls", clusterTLS != nil).Msg("Data plane server listening")
+			if err := dataPlane.Serve(ln); err != nil {
+				log.Fatal().Err(err).Msg("Data plane server failed")
+			}
+		}()
+	}
+
+	// Start metrics server
+	if cfg.MetricsEnabled {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle(cfg.MetricsPath, requireBearerToken(cfg.MetricsToken, promhttp.Handler()))
+			addr := cfg.MetricsAddr()
+			log.Info().Str("addr", addr).Str("path", cfg.MetricsPath).Bool("token", cfg.MetricsToken != "").Msg("Metrics server listening")
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Error().Err(err).Msg("Metrics server failed")
+			}
+		}()
+	}
 
 	// Start load update goroutine
 	go func() {
+		sampler := server.NewLoadSampler(connMgr)
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			activeConns := connMgr.GetActiveConnectionsCount()
-			if err := datastore.UpdateServerLoad(activeConns); err != nil {
+			if err := datastore.UpdateServerLoad(sampler.Sample()); err != nil {
 				log.Warn().Err(err).Msg("Failed to update server load")
 			}
 		}
 	}()
 
+	// Share metered bandwidth through the registry so quotas hold across servers and restarts
+	go func() {
+		ticker := time.NewTicker(server.BandwidthSyncInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			connMgr.SyncBandwidth()
+		}
+	}()
+
+	// Reload the configuration on SIGHUP without dropping tunnels
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			reloadConfig(controlServer, connMgr, datastore)
+		}
+	}()
+
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -311,23 +886,145 @@ func main() {
 
 	log.Info().Msg("Shutting down server...")
 
-	// Graceful shutdown
+	// Graceful shutdown: move clients elsewhere and let in-flight requests finish
+	controlServer.Drain(cfg.ShutdownTimeout)
 
-	if err := controlApp.Shutdown(); err != nil {
-		log.Error().Err(err).Msg("Control server shutdown error")
+	if dataPlane != nil {
+		dataPlane.Stop(cfg.ShutdownTimeout)
+		dataPlanePool.Close()
+	}
+
+	if !cfg.SinglePort || cfg.SNIRouting {
+		if err := controlApp.Shutdown(); err != nil {
+			log.Error().Err(err).Msg("Control server shutdown error")
+		}
 	}
 
 	if err := proxyApp.Shutdown(); err != nil {
 		log.Error().Err(err).Msg("Proxy server shutdown error")
 	}
 
+	controlServer.Close()
+
+	// Keep the traffic metered since the last sync
+	connMgr.SyncBandwidth()
+
 	log.Info().Msg("Server stopped")
 }
 
+// reloadConfig re-reads the configuration and applies the settings that don't need a restart
+// (domain templates, limits, accounts, subdomain policy and log level); an invalid configuration is ignored
+func reloadConfig(controlServer *server.ControlServer, connMgr *server.ConnectionManager, datastore registry.Registry) {
+	next, err := config.LoadServerConfig("")
+	if err == nil {
+		err = next.Validate()
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reload configuration, keeping the current one")
+		return
+	}
+
+	current := controlServer.Config()
+	cfg, restart := current.Reload(next)
+
+	for _, account := range cfg.Accounts {
+		if err := datastore.SaveAccount(account.SecretKey, registryAccount(account)); err != nil {
+			log.Error().Err(err).Str("account", account.ID).Msg("Failed to save account")
+			continue
+		}
+		connMgr.UpdateAccountLimits(registryAccount(account))
+	}
+	// Revoke the keys of accounts removed from the configuration
+	for _, account := range current.Accounts {
+		if !slices.ContainsFunc(cfg.Accounts, func(a config.AccountConfig) bool { return a.SecretKey == account.SecretKey }) {
+			if err := datastore.DeleteAccount(account.SecretKey); err != nil {
+				log.Error().Err(err).Str("account", account.ID).Msg("Failed to delete account")
+			}
+		}
+	}
+
+	connMgr.SetMaxConnections(cfg.MaxConnections)
+	connMgr.SetCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown)
+	connMgr.SetReconnectGrace(cfg.ReconnectGrace)
+	connMgr.SetMaxStreams(cfg.MaxStreams)
+	connMgr.Bandwidth().SetQuota(server.BandwidthQuota{
+		DailyBytes:   cfg.BandwidthQuotaDaily,
+		MonthlyBytes: cfg.BandwidthQuotaMonthly,
+		Action:       cfg.BandwidthQuotaAction,
+		ThrottleRate: cfg.BandwidthThrottleRate,
+	})
+	setLogLevel(cfg.LogLevel)
+	controlServer.Reload(cfg)
+
+	if len(restart) > 0 {
+		log.Warn().Strs("settings", restart).Msg("Changed settings take effect after a restart")
+	}
+	log.Info().Str("domain", cfg.Domain).Int("accounts", len(cfg.Accounts)).Msg("Configuration reloaded")
+}
+
+// redisOptions returns the Redis deployment configured for the registry and cache
+func redisOptions(cfg *config.ServerConfig) registry.RedisOptions {
+	return registry.RedisOptions{
+		URL:              cfg.RedisURL,
+		Addrs:            cfg.RedisAddrs,
+		MasterName:       cfg.RedisMasterName,
+		Cluster:          cfg.RedisCluster,
+		Username:         cfg.RedisUsername,
+		Password:         cfg.RedisPassword,
+		SentinelPassword: cfg.RedisSentinelPassword,
+		DB:               cfg.RedisDB,
+
+		TLS:                   cfg.RedisTLS,
+		TLSCAFile:             cfg.RedisTLSCAFile,
+		TLSCertFile:           cfg.RedisTLSCertFile,
+		TLSKeyFile:            cfg.RedisTLSKeyFile,
+		TLSServerName:         cfg.RedisTLSServerName,
+		TLSInsecureSkipVerify: cfg.RedisTLSInsecureSkipVerify,
+
+		PoolSize:     cfg.RedisPoolSize,
+		MinIdleConns: cfg.RedisMinIdleConns,
+		DialTimeout:  cfg.RedisDialTimeout,
+		ReadTimeout:  cfg.RedisReadTimeout,
+		WriteTimeout: cfg.RedisWriteTimeout,
+	}
+}
+
+// registryTimings returns the configured registry TTLs and heartbeat interval
+func registryTimings(cfg *config.ServerConfig) registry.Timings {
+	return registry.Timings{
+		TunnelTTL:         cfg.RegistryTunnelTTL,
+		ServerTTL:         cfg.RegistryServerTTL,
+		HeartbeatInterval: cfg.RegistryHeartbeatInterval,
+		CacheTTL:          cfg.RegistryCacheTTL,
+	}
+}
+
+// registryAccount converts a configured account to its registry form
+func registryAccount(account config.AccountConfig) *registry.Account {
+	return &registry.Account{
+		ID:                account.ID,
+		MaxTunnels:        account.MaxTunnels,
+		SubDomainPrefixes: account.SubDomainPrefixes,
+		RateLimit:         account.RateLimit,
+		BandwidthDaily:    account.BandwidthDaily,
+		BandwidthMonthly:  account.BandwidthMonthly,
+		MaxStreams:        account.MaxStreams,
+	}
+}
+
 func setupLogger(cfg *config.ServerConfig) {
-	// Set log level
+	setLogLevel(cfg.LogLevel)
+
+	// Set log format
+	if cfg.LogFormat == "console" {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
+	}
+}
+
+// setLogLevel sets the global log level (info for unknown levels)
+func setLogLevel(logLevel string) {
 	var level zerolog.Level
-	switch cfg.LogLevel {
+	switch logLevel {
 	case "debug":
 		level = zerolog.DebugLevel
 	case "info":
@@ -342,11 +1039,6 @@ func setupLogger(cfg *config.ServerConfig) {
 		level = zerolog.InfoLevel
 	}
 	zerolog.SetGlobalLevel(level)
-
-	// Set log format
-	if cfg.LogFormat == "console" {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
-	}
 }
 
 func extractSubDomain(host, domainTemplate string) string {
@@ -376,6 +1068,147 @@ func extractSubDomain(host, domainTemplate string) string {
 	return subDomain
 }
 
+// tunnelSubDomain extracts the subdomain from a host on this server's node_domain or the shared domain
+// (node_domain first, as it is usually a subdomain of the shared domain)
+func tunnelSubDomain(host string, cfg *config.ServerConfig) string {
+	if cfg.NodeDomain != "" {
+		if subDomain := extractSubDomain(host, cfg.NodeDomain); subDomain != "" {
+			return subDomain
+		}
+	}
+	return extractSubDomain(host, cfg.Domain)
+}
+
+// nodeURL returns the request's URL on another server's host, keeping its scheme, port, path and query
+func nodeURL(c fiber.Ctx, nodeHost string) string {
+	host := nodeHost
+	if _, port, err := net.SplitHostPort(c.Host()); err == nil {
+		host = net.JoinHostPort(nodeHost, port)
+	}
+	return c.Scheme() + "://" + host + c.OriginalURL()
+}
+
+// listen opens a TCP listener on addr, requiring PROXY protocol v1/v2 headers when enabled
+func listen(cfg *config.ServerConfig, addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || !cfg.ProxyProtocol {
+		return ln, err
+	}
+	return &proxyproto.Listener{Listener: ln, ReadHeaderTimeout: 10 * time.Second}, nil
+}
+
+// controlPathLocal holds the control path a single-port control request arrived under (unset when it had none)
+const controlPathLocal = "tungo.control_path"
+
+// controlRequestPath reports whether a request on the shared port is for the control server in single-port mode,
+// returning the path to serve it under (with the control path prefix removed)
+func controlRequestPath(cfg *config.ServerConfig, host, path string) (string, bool) {
+	if cfg.ControlPath != "" {
+		if path == cfg.ControlPath {
+			return "/", true
+		}
+		if strings.HasPrefix(path, cfg.ControlPath+"/") {
+			return strings.TrimPrefix(path, cfg.ControlPath), true
+		}
+	}
+
+	if cfg.ControlHost != "" {
+		return path, strings.EqualFold(host, cfg.ControlHost)
+	}
+	// Without a control host, hosts that don't map to a tunnel serve the control routes
+	return path, cfg.ControlPath == "" && tunnelSubDomain(host, cfg) == ""
+}
+
+// checkBasicAuth verifies the request's Authorization header against "user:pass" credentials
+func checkBasicAuth(c fiber.Ctx, credentials string) bool {
+	auth := c.Get("Authorization")
+	if len(auth) < 6 || !strings.EqualFold(auth[:6], "basic ") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[6:]))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(decoded, []byte(credentials)) == 1
+}
+
+// dataPlaneAddr is the data plane's in-memory listener address, the local address of the requests it hands over
+var dataPlaneAddr net.Addr = &net.UnixAddr{Name: "tungo-data-plane", Net: "memory"}
+
+// fromClusterPeer reports whether a request was proxied by another server authenticated with mutual TLS,
+// on the cluster TLS port or through the data plane (only with cluster TLS, the data plane is open otherwise)
+func fromClusterPeer(c fiber.Ctx, clusterTLS bool) bool {
+	if !clusterTLS {
+		return false
+	}
+	if c.RequestCtx().LocalAddr() == dataPlaneAddr {
+		return true
+	}
+	state := c.RequestCtx().TLSConnectionState()
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+// hasAdminToken reports whether a control request carries the admin token, as "Authorization: Bearer <token>"
+// or ?token= (never true without a configured token)
+func hasAdminToken(c fiber.Ctx, token string) bool {
+	if token == "" {
+		return false
+	}
+	provided, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok {
+		provided = c.Query("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// requireBearerToken rejects requests without "Authorization: Bearer <token>" (no-op for an empty token)
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// interstitialContinuePath accepts the anonymous tunnel warning and sets the visited cookie
+const interstitialContinuePath = "/_tungo/continue"
+
+// needsInterstitial reports whether a request is a browser page load that hasn't seen the warning yet
+func needsInterstitial(c fiber.Ctx, subDomain string) bool {
+	if c.Method() != fiber.MethodGet || c.Get("x-tungo-skip-warning") != "" {
+		return false
+	}
+	if !strings.Contains(c.Get("Accept"), "text/html") {
+		return false
+	}
+	return c.Cookies("tungo-warning-"+subDomain) == ""
+}
+
+// checkBasicAuthPassword verifies only the password part of the request's Basic Auth credentials
+func checkBasicAuthPassword(c fiber.Ctx, password string) bool {
+	auth := c.Get("Authorization")
+	if len(auth) < 6 || !strings.EqualFold(auth[:6], "basic ") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[6:]))
+	if err != nil {
+		return false
+	}
+
+	_, provided, _ := strings.Cut(string(decoded), ":")
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(password)) == 1
+}
+
 // sendPrettyError sends a user-friendly HTML error response
 func sendPrettyError(c fiber.Ctx, status int, title, message string) error {
 	c.Set("Content-Type", "text/html; charset=utf-8")
@@ -460,6 +1293,112 @@ func sendPrettyError(c fiber.Ctx, status int, title, message string) error {
 	return c.Status(status).SendString(html)
 }
 
+// sendMaintenancePage tells a visitor the server is down for maintenance
+func sendMaintenancePage(c fiber.Ctx, maintenance server.Maintenance) error {
+	return sendPrettyError(c, fiber.StatusServiceUnavailable,
+		"Down for Maintenance",
+		html.EscapeString(maintenance.Notice()))
+}
+
+// getInterstitialHTML returns the warning page shown before visiting an anonymous tunnel
+func getInterstitialHTML(host, next string) string {
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>You are about to visit a developer tunnel - TunGo</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
+            min-height: 100vh;
+            display: flex;
+            justify-content: center;
+            align-items: center;
+            padding: 20px;
+        }
+        .warning-container {
+            background: white;
+            border-radius: 16px;
+            box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
+            padding: 48px 40px;
+            max-width: 520px;
+            width: 100%%;
+        }
+        .warning-icon {
+            font-size: 72px;
+            margin-bottom: 24px;
+            text-align: center;
+        }
+        h1 {
+            font-size: 26px;
+            color: #2d3748;
+            margin-bottom: 16px;
+            text-align: center;
+            font-weight: 700;
+        }
+        p {
+            color: #718096;
+            margin-bottom: 16px;
+            font-size: 15px;
+            line-height: 1.6;
+        }
+        .host {
+            font-family: 'Courier New', monospace;
+            color: #4c51bf;
+            font-weight: 600;
+            word-break: break-all;
+        }
+        .submit-btn {
+            width: 100%%;
+            margin-top: 16px;
+            padding: 14px 24px;
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
+            color: white;
+            border: none;
+            border-radius: 10px;
+            font-size: 16px;
+            font-weight: 600;
+            cursor: pointer;
+            box-shadow: 0 4px 12px rgba(102, 126, 234, 0.4);
+        }
+        .footer {
+            margin-top: 32px;
+            text-align: center;
+            color: #a0aec0;
+            font-size: 13px;
+        }
+        .footer a {
+            color: #667eea;
+            text-decoration: none;
+            font-weight: 600;
+        }
+    </style>
+</head>
+<body>
+    <div class="warning-container">
+        <div class="warning-icon">⚠️</div>
+        <h1>You are about to visit a developer tunnel</h1>
+        <p><span class="host">%s</span> is served from someone's computer through an anonymous TunGo tunnel.</p>
+        <p>Only continue if you trust the person who sent you this link. Never enter passwords, payment details or other sensitive information on a site you don't recognise.</p>
+        <form method="POST" action="%s">
+            <input type="hidden" name="next" value="%s">
+            <button type="submit" class="submit-btn">Continue</button>
+        </form>
+        <div class="footer">
+            Powered by <a href="https://github.com/sombochea/tungo" target="_blank">TunGo</a>
+        </div>
+    </div>
+</body>
+</html>`, html.EscapeString(host), interstitialContinuePath, html.EscapeString(next))
+}
+
 // getPasswordPromptHTML returns HTML for password authentication
 func getPasswordPromptHTML() string {
 	return `<!DOCTYPE html>
@@ -732,6 +1671,18 @@ func getPasswordPromptHTML() string {
 </html>`
 }
 
+// proxyRequestBody returns the request body to forward to another server,
+// read from the visitor as it arrives when the body is streamed
+func proxyRequestBody(c fiber.Ctx) io.Reader {
+	if stream := c.Request().BodyStream(); stream != nil {
+		return stream
+	}
+	if body := c.Body(); len(body) > 0 {
+		return bytes.NewReader(body)
+	}
+	return http.NoBody
+}
+
 // responseWriter is a wrapper to adapt fiber context to http.ResponseWriter
 type responseWriter struct {
 	c       fiber.Ctx
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// injectedErrorResponse answers a request failed by inject_error
+func injectedErrorResponse(status int) string {
+	return plainResponse(status, fmt.Sprintf("Injected by tungo: %d %s\n", status, http.StatusText(status)))
+}
+
+// injectFaults applies inject_latency and inject_error to a new request
+// It returns false when the request was failed (or ended during the delay) and must not be forwarded
+func (tc *TunnelClient) injectFaults(stream *LocalStream) bool {
+	if latency := tc.config.InjectLatency; latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-stream.Done:
+			return false
+		}
+	}
+
+	if tc.injectStatus != 0 && rand.Float64()*100 < tc.injectPercent {
+		tc.rejectRequest(stream, tc.injectStatus, injectedErrorResponse(tc.injectStatus))
+		return false
+	}
+	return true
+}
@@ -1,20 +1,31 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/sombochea/tungo/internal/client/introspect"
 	"github.com/sombochea/tungo/pkg/config"
 	"github.com/sombochea/tungo/pkg/protocol"
+	"github.com/sombochea/tungo/pkg/tracing"
 	"github.com/sombochea/tungo/pkg/version"
 )
 
@@ -38,11 +49,30 @@ type TunnelClient struct {
 	done             chan struct{}
 	closed           bool
 	closeMutex       sync.Mutex
-	serverInfo       *protocol.ServerHello
-	currentServerIdx int // Current server index in cluster
+	tunnels          []*Tunnel // The first one is the connection's own, the rest ride along in its hello
+	currentServerIdx int       // Current server index in cluster
 	serverList       []config.ServerNode
+	migrationTokens  map[string]string // Keyed by subdomain, presented to the server taking over the tunnels on the next connection
+	migrationMutex   sync.Mutex
+	expired          string             // Why the server closed the tunnel for good (idle or session expired)
+	timedOut         bool               // Whether the connection was dropped for missing heartbeats
+	captureBytes     int64              // In-flight capture buffer bytes (atomic)
+	localPool        *localPool         // Idle keep-alive connections to the local servers
+	requestLog       *RequestLog        // Optional file each served request is logged to
+	requestHandler   func(RequestEntry) // Optional callback for each served request, e.g. the TUI
+	injectStatus     int                // Status of injected errors (0 = none)
+	injectPercent    float64            // Percentage of requests failed with injectStatus
 }
 
+// maxResponseHeadBytes bounds the response head held back for the response header rules
+const maxResponseHeadBytes = 64 * 1024
+
+// writeWait bounds each write to the server, so a dead connection can't block the write pump
+const writeWait = 10 * time.Second
+
+// migrationGracePeriod bounds how long in-flight requests delay a migration to another server
+const migrationGracePeriod = 10 * time.Second
+
 // LocalStream represents a connection to the local server
 type LocalStream struct {
 	ID             protocol.StreamID
@@ -59,24 +89,87 @@ type LocalStream struct {
 	EndTime        time.Time // Track response end time
 	Method         string    // HTTP method
 	Path           string    // HTTP path
+	Proto          string    // HTTP version of the request line
 	SourceIP       string    // Client source IP
+	RequestID      string    // Edge-generated request ID (X-Request-ID)
 	StatusCode     int       // HTTP status code
 	firstRead      bool      // Track if we've done first read
+	internal       bool      // Shared dashboard traffic, not logged or captured
+	capturedBytes  int64     // Bytes held in capture buffers (atomic)
+	captureDropped int32     // Set when capture exceeded the memory budget (atomic)
+	// Bytes past the capture limit, left out of RequestData and ResponseData
+	requestTruncated  int64
+	responseTruncated int64
+	span              trace.Span               // Traces the request from the tunnel to the local server
+	tunnel            *Tunnel                  // The tunnel the stream came in on
+	route             *localRoute              // The path route the request went to (nil = the tunnel's local server)
+	webhook           *introspect.WebhookCheck // Signature check of a webhook delivery, shown in the dashboard
+
+	// Response head held back until complete for the response header rules
+	responseHead     []byte
+	responseHeadDone bool
+
+	// Response held back until its local URLs can be rewritten (rewrite_urls)
+	rewriteHeld []byte
+	rewriteDone bool
+
+	// Keep-alive: the local connection goes back to the pool when the stream ends if reusable is set
+	requestReusable atomic.Bool // The request was written whole and allows keep-alive
+	reusable        atomic.Bool
 }
 
 // NewTunnelClient creates a new tunnel client
 func NewTunnelClient(cfg *config.ClientConfig, logger zerolog.Logger) *TunnelClient {
+	injectStatus, injectPercent, _ := config.ParseInjectError(cfg.InjectError) // Checked by Validate
 	return &TunnelClient{
 		config:           cfg,
 		logger:           logger,
 		streams:          make(map[protocol.StreamID]*LocalStream),
+		tunnels:          newTunnels(cfg),
+		migrationTokens:  make(map[string]string),
 		send:             make(chan []byte, 256),
 		done:             make(chan struct{}),
 		currentServerIdx: 0,
-		serverList:       cfg.GetServerList(), // Get server list from config
+		serverList:       preferRegion(cfg.GetServerList(), cfg.Region, cfg.Zone), // Get server list from config
+		injectStatus:     injectStatus,
+		injectPercent:    injectPercent,
+		localPool:        newLocalPool(),
+	}
+}
+
+// SetRequestLog logs every request served through the tunnels to rl as well as the console
+func (tc *TunnelClient) SetRequestLog(rl *RequestLog) {
+	tc.requestLog = rl
+}
+
+// SetRequestHandler calls handler with every request served through the tunnels once it completes
+// Set it before Connect; handler runs on the stream's goroutine and should not block
+func (tc *TunnelClient) SetRequestHandler(handler func(RequestEntry)) {
+	tc.requestHandler = handler
+}
+
+// serverProximity ranks a server for a client in region and zone (lower is nearer)
+func serverProximity(serverRegion, serverZone, region, zone string) int {
+	switch {
+	case region == "" || serverRegion != region:
+		return 2
+	case zone == "" || serverZone != zone:
+		return 1
+	default:
+		return 0
 	}
 }
 
+// preferRegion returns the servers with those in the client's zone first, then the rest of its region
+func preferRegion(servers []config.ServerNode, region, zone string) []config.ServerNode {
+	ordered := append([]config.ServerNode(nil), servers...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return serverProximity(ordered[i].Region, ordered[i].Zone, region, zone) <
+			serverProximity(ordered[j].Region, ordered[j].Zone, region, zone)
+	})
+	return ordered
+}
+
 // Connect establishes a connection to the tunnel server
 func (tc *TunnelClient) Connect() error {
 	tc.connMutex.Lock()
@@ -109,6 +202,7 @@ func (tc *TunnelClient) Connect() error {
 	tc.closeMutex.Lock()
 	tc.closed = false
 	tc.closeMutex.Unlock()
+	tc.timedOut = false
 
 	// Clean up streams
 	tc.streamMux.Lock()
@@ -119,6 +213,7 @@ func (tc *TunnelClient) Connect() error {
 			close(stream.Done)
 		}
 		stream.LocalConn.Close()
+		atomic.AddInt64(&stream.tunnel.active, -1)
 	}
 	tc.streams = make(map[protocol.StreamID]*LocalStream)
 	tc.streamMux.Unlock()
@@ -127,7 +222,7 @@ func (tc *TunnelClient) Connect() error {
 	tc.send = make(chan []byte, 256)
 	tc.done = make(chan struct{})
 
-	// Note: We preserve tc.serverInfo to reuse subdomain on reconnection
+	// Note: We preserve each tunnel's serverInfo to reuse its subdomain on reconnection
 
 	// Get current server from cluster
 	currentServer := tc.serverList[tc.currentServerIdx]
@@ -141,7 +236,7 @@ func (tc *TunnelClient) Connect() error {
 	wsURL := url.URL{
 		Scheme: scheme,
 		Host:   fmt.Sprintf("%s:%d", currentServer.Host, currentServer.Port),
-		Path:   "/ws",
+		Path:   currentServer.Path + "/ws",
 	}
 
 	tc.logger.Info().
@@ -200,55 +295,120 @@ func (tc *TunnelClient) Connect() error {
 		return fmt.Errorf("failed to receive server hello: %w", err)
 	}
 
-	tc.logger.Info().
-		Str("subdomain", tc.serverInfo.SubDomain).
-		Str("hostname", tc.serverInfo.Hostname).
-		Msg("Tunnel established")
+	for _, tunnel := range tc.tunnels {
+		tc.logger.Info().
+			Str("tunnel", tunnel.Name()).
+			Str("subdomain", tunnel.serverInfo.SubDomain).
+			Str("hostname", tunnel.serverInfo.Hostname).
+			Msg("Tunnel established")
+	}
 
 	return nil
 }
 
-// sendClientHello sends the initial hello message to the server
+// sendClientHello sends the initial hello message to the server, carrying every tunnel's request
 func (tc *TunnelClient) sendClientHello() error {
-	var hello *protocol.ClientHello
+	hello := tc.tunnelHello(tc.tunnels[0])
+	for _, tunnel := range tc.tunnels[1:] {
+		hello.Tunnels = append(hello.Tunnels, *tc.tunnelHello(tunnel))
+	}
 
-	if tc.config.ReconnectToken != "" {
-		// Reconnecting with token
-		hello = protocol.NewReconnectHello(&protocol.ReconnectToken{
-			Token: tc.config.ReconnectToken,
-		})
-	} else {
-		// New connection or reconnection
-		var subDomain *string
+	// Present the migration tokens so the new server takes over the tunnels in place
+	tc.migrationMutex.Lock()
+	hello.MigrationToken = tc.migrationTokens[tc.tunnels[0].SubDomain()]
+	for i := range hello.Tunnels {
+		hello.Tunnels[i].MigrationToken = tc.migrationTokens[tc.tunnels[i+1].SubDomain()]
+	}
+	tc.migrationTokens = make(map[string]string)
+	tc.migrationMutex.Unlock()
 
-		// First check if we have a subdomain from previous connection
-		if tc.serverInfo != nil && tc.serverInfo.SubDomain != "" {
-			subDomain = &tc.serverInfo.SubDomain
-			tc.logger.Debug().Str("subdomain", *subDomain).Msg("Reusing subdomain from previous session")
-		} else if tc.config.SubDomain != "" {
-			// Use configured subdomain
-			subDomain = &tc.config.SubDomain
-		}
+	// Set client version
+	hello.SetClientVersion(version.GetShortVersion())
 
-		var secretKey *protocol.SecretKey
-		if tc.config.SecretKey != "" {
-			secretKey = &protocol.SecretKey{
-				Key: tc.config.SecretKey,
-			}
-		}
+	return tc.conn.WriteJSON(hello)
+}
 
-		hello = protocol.NewClientHello(subDomain, secretKey)
+// tunnelHello builds the hello requesting one tunnel
+func (tc *TunnelClient) tunnelHello(tunnel *Tunnel) *protocol.ClientHello {
+	// New connection or reconnection
+	var subDomain *string
+
+	// First check if we have a subdomain from previous connection
+	if tunnel.serverInfo != nil && tunnel.serverInfo.SubDomain != "" {
+		subDomain = &tunnel.serverInfo.SubDomain
+		tc.logger.Debug().Str("subdomain", *subDomain).Msg("Reusing subdomain from previous session")
+	} else if tunnel.config.SubDomain != "" {
+		// Use configured subdomain
+		subDomain = &tunnel.config.SubDomain
+	}
 
-		// Add password if configured
-		if tc.config.Password != "" {
-			hello.Password = &tc.config.Password
+	var secretKey *protocol.SecretKey
+	if tc.config.SecretKey != "" {
+		secretKey = &protocol.SecretKey{
+			Key: tc.config.SecretKey,
 		}
 	}
 
-	// Set client version
-	hello.SetClientVersion(version.GetShortVersion())
+	hello := protocol.NewClientHello(subDomain, secretKey)
 
-	return tc.conn.WriteJSON(hello)
+	// Present the token of the last session so the server hands the subdomain back to us alone
+	if tunnel.serverInfo != nil && tunnel.serverInfo.ReconnectToken != nil {
+		hello.ReconnectToken = tunnel.serverInfo.ReconnectToken
+	} else if tunnel == tc.tunnels[0] && tc.config.ReconnectToken != "" {
+		hello.ReconnectToken = &protocol.ReconnectToken{Token: tc.config.ReconnectToken}
+	}
+
+	// Ask for a public TCP port instead of an HTTP hostname
+	if tunnel.config.Protocol == protocol.ProtocolTCP {
+		hello.Protocol = protocol.ProtocolTCP
+	}
+
+	// Add password if configured
+	if tunnel.config.Password != "" {
+		hello.Password = &tunnel.config.Password
+	}
+
+	// Add basic auth credentials if configured, the client checks them again (see proxyToLocal)
+	if tunnel.config.BasicAuth != "" {
+		hello.BasicAuth = &tunnel.config.BasicAuth
+	}
+
+	// Have visitors log in with an OAuth provider at the edge if configured
+	if tc.config.OAuth != "" {
+		hello.OAuth = &protocol.OAuthPolicy{Provider: tc.config.OAuth, Allow: tc.config.OAuthAllow}
+	}
+
+	// Restrict visitor IPs if configured
+	hello.IPAllow = tc.config.IPAllow
+	hello.IPDeny = tc.config.IPDeny
+
+	// Limit request body size if configured
+	hello.MaxBodySize = tc.config.MaxBodySize
+
+	// Inject response headers at the edge if configured
+	hello.ResponseHeaders = tc.config.EdgeHeaders()
+
+	// Cache matching paths at the edge if configured
+	hello.CacheRules = tc.config.CacheRuleList()
+
+	// Pin visitors to one client of a shared subdomain if configured
+	hello.Affinity = tc.config.Affinity
+
+	// Describe the tunnel to the server's registry if configured
+	hello.Labels = tc.config.Labels
+
+	// Ask to be migrated to servers in the client's region
+	hello.Region = tc.config.Region
+
+	// Wait longer for slow local apps if configured
+	hello.ResponseTimeouts = tc.config.ResponseTimeoutOverrides()
+
+	// Share the dashboard through the tunnel if configured
+	if tc.config.ShareDashboard {
+		hello.InspectPassword = &tc.config.DashboardPassword
+	}
+
+	return hello
 }
 
 // receiveServerHello receives the server hello response
@@ -261,8 +421,14 @@ func (tc *TunnelClient) receiveServerHello() error {
 	if hello.Type != protocol.ServerHelloSuccess {
 		return fmt.Errorf("server rejected connection: %s - %s", hello.Type, hello.Error)
 	}
+	if len(hello.Tunnels) != len(tc.tunnels)-1 {
+		return fmt.Errorf("server opened %d of %d tunnels (servers before multi-tunnel support open only the first)", len(hello.Tunnels)+1, len(tc.tunnels))
+	}
 
-	tc.serverInfo = &hello
+	tc.tunnels[0].serverInfo = &hello
+	for i := range hello.Tunnels {
+		tc.tunnels[i+1].serverInfo = &hello.Tunnels[i]
+	}
 	return nil
 }
 
@@ -296,28 +462,47 @@ func (tc *TunnelClient) readPump() {
 
 	tc.logger.Info().Msg("readPump started")
 
+	// Any message or pong from the server proves the connection alive for another heartbeat timeout,
+	// so a connection dropped without a close (sleep, NAT timeout, network change) fails fast
+	timeout := tc.config.HeartbeatTimeout
+	tc.conn.SetReadDeadline(time.Now().Add(timeout))
+	tc.conn.SetPongHandler(func(string) error {
+		return tc.conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+
 	for {
 		var msg protocol.Message
 		tc.logger.Debug().Msg("Waiting to read WebSocket message...")
 		err := tc.conn.ReadJSON(&msg)
 		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				tc.logger.Warn().Dur("timeout", timeout).Msg("No heartbeat from the server, reconnecting")
+				tc.timedOut = true
+				return
+			}
 			// Log the actual error with full details
 			tc.logger.Error().
 				Err(err).
 				Str("error_type", fmt.Sprintf("%T", err)).
 				Bool("is_unexpected", websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure)).
 				Msg("WebSocket ReadJSON error")
+			if closeErr, ok := err.(*websocket.CloseError); ok && (closeErr.Code == protocol.CloseTunnelIdle || closeErr.Code == protocol.CloseSessionExpired) {
+				tc.expired = closeErr.Text
+			}
 			return
 		}
+		tc.conn.SetReadDeadline(time.Now().Add(timeout))
 
 		tc.logger.Debug().Str("type", string(msg.Type)).Msg("Received message")
 		tc.handleMessage(&msg)
 	}
 }
 
-// writePump writes messages to the WebSocket connection
+// writePump writes messages to the WebSocket connection, pinging the server
+// three times per heartbeat timeout so its pongs keep the read deadline moving
 func (tc *TunnelClient) writePump() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(tc.config.HeartbeatTimeout / 3)
 	defer ticker.Stop()
 	defer tc.logger.Info().Msg("writePump stopped")
 
@@ -326,6 +511,7 @@ func (tc *TunnelClient) writePump() {
 	for {
 		select {
 		case message, ok := <-tc.send:
+			tc.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				tc.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
@@ -337,11 +523,8 @@ func (tc *TunnelClient) writePump() {
 			}
 
 		case <-ticker.C:
-			// Send pong in response to ping
-			pongMsg, _ := protocol.NewMessage(protocol.MessageTypePong, "", nil)
-			data, _ := protocol.EncodeMessage(pongMsg)
-			if err := tc.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				tc.logger.Debug().Err(err).Msg("Failed to send pong")
+			if err := tc.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				tc.logger.Debug().Err(err).Msg("Failed to send ping")
 				return
 			}
 
@@ -389,12 +572,16 @@ func (tc *TunnelClient) handleMessage(msg *protocol.Message) {
 			return
 		}
 
+		// Never block the reader shared by all streams on one slow local app, nor drop a chunk mid-request:
+		// a stream that falls a whole queue behind is aborted
 		select {
 		case stream.DataChan <- dataMsg.Data:
 		case <-stream.Done:
 			tc.logger.Debug().Str("stream_id", msg.StreamID.String()).Msg("Stream closed while sending data")
 		default:
-			tc.logger.Warn().Str("stream_id", msg.StreamID.String()).Msg("Stream data channel full")
+			tc.logger.Warn().Str("stream_id", msg.StreamID.String()).Msg("Stream data channel full, aborting stream")
+			tc.sendStreamEnd(msg.StreamID)
+			tc.closeStream(msg.StreamID)
 		}
 
 	case protocol.MessageTypeEnd:
@@ -402,6 +589,37 @@ func (tc *TunnelClient) handleMessage(msg *protocol.Message) {
 		tc.logger.Debug().Str("stream_id", msg.StreamID.String()).Msg("Received stream end")
 		tc.closeStream(msg.StreamID)
 
+	case protocol.MessageTypeReconnect:
+		// Server is draining, pick another server for the next connection
+		var reconnectMsg protocol.ReconnectMessage
+		if err := msg.Unmarshal(&reconnectMsg); err != nil {
+			tc.logger.Error().Err(err).Msg("Failed to unmarshal reconnect message")
+			return
+		}
+		tc.handleReconnect(&reconnectMsg)
+
+	case protocol.MessageTypeMigrate:
+		// Server is handing the tunnel to a specific peer
+		var migrateMsg protocol.MigrateMessage
+		if err := msg.Unmarshal(&migrateMsg); err != nil {
+			tc.logger.Error().Err(err).Msg("Failed to unmarshal migrate message")
+			return
+		}
+		tc.handleMigrate(&migrateMsg)
+
+	case protocol.MessageTypeExpiring:
+		// Server will close the tunnel session soon
+		var expiringMsg protocol.ExpiringMessage
+		if err := msg.Unmarshal(&expiringMsg); err != nil {
+			tc.logger.Error().Err(err).Msg("Failed to unmarshal expiring message")
+			return
+		}
+		tc.logger.Warn().
+			Str("reason", expiringMsg.Reason).
+			Time("expires_at", expiringMsg.ExpiresAt).
+			Dur("remaining", time.Until(expiringMsg.ExpiresAt).Round(time.Second)).
+			Msg("Tunnel session is about to expire")
+
 	default:
 		tc.logger.Warn().Str("type", string(msg.Type)).Msg("Unknown message type")
 	}
@@ -414,11 +632,52 @@ func (tc *TunnelClient) handleInitStream(initMsg *protocol.InitStreamMessage) {
 		Str("protocol", initMsg.Protocol).
 		Msg("Initializing new stream")
 
-	// Connect to local server
-	localAddr := net.JoinHostPort(tc.config.LocalHost, fmt.Sprintf("%d", tc.config.LocalPort))
-	localConn, err := net.DialTimeout("tcp", localAddr, 5*time.Second)
+	// Enforce the concurrent local connection limit
+	if maxConns := tc.config.MaxLocalConns; maxConns > 0 && tc.GetActiveStreams() >= maxConns {
+		tc.logger.Warn().
+			Str("stream_id", initMsg.StreamID.String()).
+			Int("max_local_connections", maxConns).
+			Msg("Local connection limit reached, rejecting stream")
+		tc.sendStreamEnd(initMsg.StreamID)
+		return
+	}
+
+	// Connect to the tunnel's local server, or to the dashboard for shared inspector traffic
+	tunnel := tc.tunnelFor(initMsg.SubDomain)
+	localAddr := tunnel.LocalAddr()
+	internal := initMsg.Protocol == protocol.StreamProtocolInspect
+	if internal {
+		if !tc.config.ShareDashboard {
+			tc.logger.Warn().Str("stream_id", initMsg.StreamID.String()).Msg("Rejecting inspect stream, dashboard is not shared")
+			tc.sendStreamEnd(initMsg.StreamID)
+			return
+		}
+		localAddr = net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", tc.config.DashboardPort))
+	} else if !tunnel.limiter.allow() {
+		// Over the tunnel's rate limit: answer for the local server rather than dial it
+		tc.logger.Warn().
+			Str("stream_id", initMsg.StreamID.String()).
+			Str("tunnel", tunnel.Name()).
+			Str("rate_limit", tunnel.config.RateLimit).
+			Msg("Rate limit reached, rejecting stream")
+		if initMsg.Protocol != protocol.ProtocolTCP {
+			tc.sendStreamData(initMsg.StreamID, []byte(rateLimitedResponse))
+		}
+		tc.sendStreamEnd(initMsg.StreamID)
+		return
+	}
+
+	var localConn net.Conn
+	var err error
+	if internal {
+		localConn, err = net.DialTimeout("tcp", localAddr, 5*time.Second)
+	} else if len(tunnel.routes) > 0 && initMsg.Protocol != protocol.ProtocolTCP {
+		localConn = &routedConn{} // Dialed by proxyToLocal once the path is known
+	} else {
+		localConn, err = tc.dialLocal(tunnel)
+	}
 	if err != nil {
-		tc.logger.Error().Err(err).Msg("Failed to connect to local server")
+		tc.logger.Error().Err(err).Str("addr", localAddr).Msg("Failed to connect to local server")
 		tc.sendStreamEnd(initMsg.StreamID)
 		return
 	}
@@ -427,28 +686,87 @@ func (tc *TunnelClient) handleInitStream(initMsg *protocol.InitStreamMessage) {
 	stream := &LocalStream{
 		ID:             initMsg.StreamID,
 		LocalConn:      localConn,
-		DataChan:       make(chan []byte, 512), // Increased from 256 for better throughput
+		DataChan:       make(chan []byte, tc.streamQueueSize()),
 		Done:           make(chan struct{}),
 		RequestWritten: make(chan struct{}), // Signal channel
-		captureEnabled: tc.config.EnableDashboard,
+		captureEnabled: tc.config.EnableDashboard && !internal,
+		internal:       internal,
 		StartTime:      time.Now(), // Record start time
+		tunnel:         tunnel,
 	}
 
 	tc.addStream(stream)
 
+	// Raw TCP is relayed both ways as it comes, without waiting for a request
+	if initMsg.Protocol == protocol.ProtocolTCP {
+		go tc.proxyTCP(stream)
+		return
+	}
+
 	// Start both proxy goroutines
 	// proxyToLocal will write request data, then signal proxyFromLocal to read response
 	go tc.proxyToLocal(stream)
 	go tc.proxyFromLocal(stream)
 }
 
+// dialLocal connects to one of a tunnel's local instances, failing over to the next when one refuses
+func (tc *TunnelClient) dialLocal(tunnel *Tunnel) (net.Conn, error) {
+	var lastErr error
+	for _, upstream := range tunnel.upstreams.order() {
+		conn, err := tc.dialUpstream(tunnel, upstream.addr)
+		if err == nil {
+			if upstream.markUp() {
+				tc.logger.Info().Str("tunnel", tunnel.Name()).Str("addr", upstream.addr).Msg("Local instance is back")
+			}
+			return conn, nil
+		}
+		if upstream.markDown() && len(tunnel.upstreams.upstreams) > 1 {
+			tc.logger.Warn().Err(err).Str("tunnel", tunnel.Name()).Str("addr", upstream.addr).Msg("Local instance is down, failing over")
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dialUpstream connects to a local instance at addr, over TLS when the tunnel's local scheme is https
+// The visitor's plain HTTP is then written into the TLS session as-is
+func (tc *TunnelClient) dialUpstream(tunnel *Tunnel, addr string) (net.Conn, error) {
+	if tc.config.LocalKeepAlive {
+		if conn := tc.localPool.get(addr); conn != nil {
+			return conn, nil
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.config.LocalScheme != "https" {
+		return &localConn{Conn: conn, addr: addr}, nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: tc.config.LocalSkipVerify,
+	})
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with local server failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return &localConn{Conn: tlsConn, addr: addr}, nil
+}
+
 // proxyToLocal forwards data from the tunnel to the local server
 func (tc *TunnelClient) proxyToLocal(stream *LocalStream) {
 	defer func() {
-		tc.logger.Debug().Str("stream_id", stream.ID.String()).Msg("proxyToLocal finished")
+		tc.logger.Debug().Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("proxyToLocal finished")
 	}()
 
 	requestComplete := false
+	framing := &messageFraming{request: true}
 
 	for {
 		select {
@@ -494,6 +812,17 @@ func (tc *TunnelClient) proxyToLocal(stream *LocalStream) {
 							stream.Method = parts[0]
 							stream.Path = parts[1]
 						}
+						if len(parts) >= 3 {
+							stream.Proto = strings.TrimSuffix(parts[2], "\r")
+						}
+					}
+
+					// Pick up the edge's request ID for log correlation
+					for i := 1; i < len(lines); i++ {
+						if name, value, ok := strings.Cut(lines[i], ":"); ok && strings.EqualFold(name, protocol.RequestIDHeader) {
+							stream.RequestID = strings.TrimSpace(value)
+							break
+						}
 					}
 
 					// Parse headers to find X-Forwarded-For or X-Real-IP
@@ -517,24 +846,113 @@ func (tc *TunnelClient) proxyToLocal(stream *LocalStream) {
 				}
 			}
 
+			// Continue the edge's trace and hand the local server our span as its parent
+			if !requestComplete && !stream.internal {
+				data = tc.startStreamSpan(stream, data)
+			}
+
+			// Enforce the tunnel's Basic Auth here as well, in case the server doesn't, on the whole request head
+			if credentials := stream.tunnel.config.BasicAuth; !requestComplete && !stream.internal && credentials != "" {
+				var authorized bool
+				if data, authorized = readRequestHead(stream, data); !authorized {
+					return
+				}
+				if data, authorized = checkBasicAuth(data, credentials); !authorized {
+					tc.rejectRequest(stream, http.StatusUnauthorized, unauthorizedResponse)
+					return
+				}
+			}
+
+			// Hold webhook deliveries back until the whole body is in to check their signature
+			if verifier := stream.tunnel.webhook; !requestComplete && !stream.internal && verifier != nil {
+				var ok bool
+				if data, ok = readWholeRequest(stream, data); !ok {
+					return
+				}
+				stream.webhook = &introspect.WebhookCheck{Provider: verifier.provider}
+				if err := verifier.verify(data); err != nil {
+					stream.webhook.Error = err.Error()
+					tc.logger.Warn().Err(err).
+						Str("provider", verifier.provider).
+						Str("path", stream.Path).
+						Str("request_id", stream.RequestID).
+						Msg("Invalid webhook signature")
+					if tc.config.WebhookReject {
+						// Still show the rejected delivery in the dashboard, with its label
+						tc.captureAnswered(stream, data, invalidWebhookResponse)
+						tc.rejectRequest(stream, http.StatusUnauthorized, invalidWebhookResponse)
+						return
+					}
+				}
+			}
+
+			// Answer mocked paths from the config, the local server never sees them
+			if !requestComplete && !stream.internal && len(tc.config.Mocks) > 0 {
+				if mock := findMock(tc.config.Mocks, stream.Method, stream.Path); mock != nil {
+					response, status, err := mockResponse(mock)
+					if err != nil {
+						tc.logger.Error().Err(err).Str("path", stream.Path).Msg("Failed to read mock body file")
+						status = http.StatusInternalServerError
+						response = plainResponse(status, "Failed to read mock body file\n")
+					}
+					tc.captureAnswered(stream, data, response)
+					tc.rejectRequest(stream, status, response)
+					return
+				}
+			}
+
+			// Chaos testing: delay the request, then fail a share of them without reaching the local server
+			if !requestComplete && !stream.internal && !tc.injectFaults(stream) {
+				return
+			}
+
+			// Path routes: connect to the local target of the request's path
+			if routed, ok := stream.LocalConn.(*routedConn); ok && !requestComplete {
+				if data, ok = tc.connectRoute(stream, routed, data); !ok {
+					return
+				}
+			}
+
+			// Give local apps that check the Host the one they expect, then apply the request header rules
+			if !requestComplete && !stream.internal {
+				localAddr := stream.tunnel.LocalAddr()
+				if stream.route != nil {
+					localAddr = stream.route.addr
+				}
+				data = rewriteHostHeader(data, stream.tunnel.hostHeader(localAddr))
+				data = applyHeaderRules(data, tc.config.HeaderRules.Request)
+				if stream.tunnel.localURLs != nil {
+					data = applyHeaderRules(data, identityEncoding)
+				}
+			}
+
+			// Coalesce queued chunks into a single write to save syscalls
+			if tc.config.BatchWrites {
+				data = drainQueued(stream, data)
+			}
+
 			// Capture request data if dashboard is enabled
 			if stream.captureEnabled {
-				stream.RequestData = append(stream.RequestData, data...)
+				tc.captureChunk(stream, &stream.RequestData, &stream.requestTruncated, data)
 			}
 
 			// Write data to local server
 			n, err := stream.LocalConn.Write(data)
 			if err != nil {
-				tc.logger.Debug().Err(err).Str("stream_id", stream.ID.String()).Msg("Failed to write to local server")
+				tc.logger.Debug().Err(err).Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("Failed to write to local server")
 				return
 			}
 			stream.BytesSent += int64(n)
+			atomic.AddInt64(&stream.tunnel.bytesIn, int64(n))
+			if framing.feed(data) {
+				stream.requestReusable.Store(framing.keepAlive && !framing.extra)
+			}
 
 			// After first write, signal that request has been written
 			if !requestComplete {
 				requestComplete = true
 				close(stream.RequestWritten) // Signal immediately after first write
-				tc.logger.Debug().Str("stream_id", stream.ID.String()).Int("bytes", n).Msg("HTTP request written to local server, signaling reader")
+				tc.logger.Debug().Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Int("bytes", n).Msg("HTTP request written to local server, signaling reader")
 			}
 
 		case <-stream.Done:
@@ -543,11 +961,101 @@ func (tc *TunnelClient) proxyToLocal(stream *LocalStream) {
 	}
 }
 
+// connectRoute connects a stream on a tunnel with path routes to its path's route, or the tunnel's
+// own local server, stripping the route's prefix if asked. It answers 502 when that fails.
+func (tc *TunnelClient) connectRoute(stream *LocalStream, routed *routedConn, data []byte) ([]byte, bool) {
+	var conn net.Conn
+	var err error
+	addr := stream.tunnel.LocalAddr()
+	if route := findRoute(stream.tunnel.routes, stream.Path); route != nil {
+		stream.route, addr = route, route.addr
+		conn, err = tc.dialUpstream(stream.tunnel, addr)
+		if route.strip {
+			data = stripRoutePrefix(data, route.prefix)
+		}
+	} else {
+		conn, err = tc.dialLocal(stream.tunnel)
+	}
+	if err == nil {
+		err = routed.connect(conn)
+	}
+	if err != nil {
+		tc.logger.Error().Err(err).Str("addr", addr).Str("path", stream.Path).Msg("Failed to connect to local server")
+		tc.rejectRequest(stream, http.StatusBadGateway, plainResponse(http.StatusBadGateway, "Failed to connect to local server\n"))
+		return data, false
+	}
+	return data, true
+}
+
+// captureAnswered captures a request the client answers itself, with its response, for the dashboard
+func (tc *TunnelClient) captureAnswered(stream *LocalStream, request []byte, response string) {
+	if stream.captureEnabled {
+		tc.captureChunk(stream, &stream.RequestData, &stream.requestTruncated, request)
+		tc.captureChunk(stream, &stream.ResponseData, &stream.responseTruncated, []byte(response))
+	}
+}
+
+// readRequestHead adds the stream's next chunks to data until it holds the request head (or maxResponseHeadBytes)
+// It returns false if the stream ends first
+func readRequestHead(stream *LocalStream, data []byte) ([]byte, bool) {
+	for !bytes.Contains(data, []byte("\r\n\r\n")) && len(data) < maxResponseHeadBytes {
+		select {
+		case more, ok := <-stream.DataChan:
+			if !ok {
+				return data, false
+			}
+			data = append(data, more...)
+		case <-stream.Done:
+			return data, false
+		}
+	}
+	return data, true
+}
+
+// readWholeRequest adds the stream's next chunks to data until it holds the whole request (or maxWebhookRequestBytes)
+// It returns false if the stream ends first
+func readWholeRequest(stream *LocalStream, data []byte) ([]byte, bool) {
+	for !hasWholeRequest(data) {
+		select {
+		case more, ok := <-stream.DataChan:
+			if !ok {
+				return data, false
+			}
+			data = append(data, more...)
+		case <-stream.Done:
+			return data, false
+		}
+	}
+	return data, true
+}
+
+// rejectRequest answers a request with response (of the given status), never reaching the local server
+// Closing the local connection lets proxyFromLocal log the request and end the stream
+func (tc *TunnelClient) rejectRequest(stream *LocalStream, status int, response string) {
+	stream.StatusCode = status
+	stream.BytesRecv = int64(len(response))
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, stream.ID, &protocol.DataMessage{Data: []byte(response)})
+	if err == nil {
+		if data, err := protocol.EncodeMessage(msg); err == nil {
+			select {
+			case tc.send <- data:
+			case <-stream.Done:
+			case <-time.After(5 * time.Second):
+				tc.logger.Warn().Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("Send buffer full, timing out")
+			}
+		}
+	}
+
+	stream.LocalConn.Close()
+	close(stream.RequestWritten)
+}
+
 // proxyFromLocal forwards data from the local server to the tunnel
 func (tc *TunnelClient) proxyFromLocal(stream *LocalStream) {
 	defer func() {
 		// Log complete request/response in standard format
-		if stream.StatusCode > 0 && stream.Method != "" {
+		if stream.StatusCode > 0 && stream.Method != "" && !stream.internal {
 			// Use EndTime if set, otherwise use current time
 			endTime := stream.EndTime
 			if endTime.IsZero() {
@@ -577,17 +1085,61 @@ func (tc *TunnelClient) proxyFromLocal(stream *LocalStream) {
 				resetColor = "\033[0m"
 			}
 
-			// Format: [timestamp] source_ip "METHOD /path" status req_bytes res_bytes latency_ms
-			fmt.Printf("%s %s \"%s %s\" %s%d%s %d %d %dms\n",
-				timestamp, sourceIP, stream.Method, stream.Path,
+			requestID := stream.RequestID
+			if requestID == "" {
+				requestID = "-"
+			}
+
+			// Lines of clients with several tunnels start with the tunnel's name
+			prefix := ""
+			if name := stream.tunnel.Name(); name != "" {
+				prefix = "[" + name + "] "
+			}
+
+			// Format: [tunnel] [timestamp] source_ip "METHOD /path" status req_bytes res_bytes latency_ms request_id
+			fmt.Printf("%s%s %s \"%s %s\" %s%d%s %d %d %dms %s\n",
+				prefix, timestamp, sourceIP, stream.Method, stream.Path,
 				statusColor, stream.StatusCode, resetColor,
-				stream.BytesSent, stream.BytesRecv, latency.Milliseconds())
+				stream.BytesSent, stream.BytesRecv, latency.Milliseconds(), requestID)
+
+			entry := RequestEntry{
+				Time:      stream.StartTime,
+				Tunnel:    stream.tunnel.Name(),
+				SubDomain: stream.tunnel.SubDomain(),
+				RequestID: stream.RequestID,
+				VisitorIP: stream.SourceIP,
+				Method:    stream.Method,
+				Path:      stream.Path,
+				Proto:     stream.Proto,
+				Status:    stream.StatusCode,
+				BytesIn:   stream.BytesSent,
+				BytesOut:  stream.BytesRecv,
+				Latency:   latency,
+			}
+			tc.requestLog.log(entry)
+			if tc.requestHandler != nil {
+				tc.requestHandler(entry)
+			}
+		}
+
+		if stream.span != nil {
+			stream.span.SetAttributes(attribute.Int("http.response.status_code", stream.StatusCode))
+			if stream.StatusCode == 0 || stream.StatusCode >= 500 {
+				stream.span.SetStatus(codes.Error, "local server error")
+			}
+			stream.span.End()
 		}
 
 		// Capture the request/response if dashboard is enabled
-		if stream.captureEnabled && len(stream.RequestData) > 0 {
-			introspect.CaptureStream(stream.RequestData, stream.ResponseData)
+		if stream.captureEnabled && atomic.LoadInt32(&stream.captureDropped) == 0 && len(stream.RequestData) > 0 {
+			var localAddr string
+			if conn := stream.local(); conn != nil {
+				localAddr = conn.addr
+			}
+			introspect.CaptureStream(stream.RequestData, stream.ResponseData, stream.requestTruncated, stream.responseTruncated,
+				stream.webhook, stream.tunnel.Name(), localAddr)
 		}
+		atomic.AddInt64(&tc.captureBytes, -atomic.LoadInt64(&stream.capturedBytes))
 
 		tc.sendStreamEnd(stream.ID)
 		tc.closeStream(stream.ID)
@@ -600,13 +1152,16 @@ func (tc *TunnelClient) proxyFromLocal(stream *LocalStream) {
 	// Add small delay to ensure local server has processed the request
 	time.Sleep(10 * time.Millisecond)
 
-	tc.logger.Debug().Str("stream_id", stream.ID.String()).Msg("Request written, starting to read response")
+	tc.logger.Debug().Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("Request written, starting to read response")
 
 	// Get buffer from pool for high performance
 	bufPtr := bufferPool.Get().(*[]byte)
 	buf := *bufPtr
 	defer bufferPool.Put(bufPtr)
 
+	// Follow the response's framing to end the stream as soon as it is complete
+	framing := &messageFraming{method: stream.Method}
+
 	for {
 		select {
 		case <-stream.Done:
@@ -628,7 +1183,7 @@ func (tc *TunnelClient) proxyFromLocal(stream *LocalStream) {
 					if stream.BytesRecv > 0 {
 						// We've received data, mark end time and finish
 						stream.EndTime = time.Now()
-						tc.logger.Debug().Str("stream_id", stream.ID.String()).Msg("Read timeout, response complete")
+						tc.logger.Debug().Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("Read timeout, response complete")
 						return
 					}
 					// No data has been received yet, keep waiting
@@ -637,28 +1192,59 @@ func (tc *TunnelClient) proxyFromLocal(stream *LocalStream) {
 				if err == io.EOF {
 					// Normal end of response
 					stream.EndTime = time.Now()
-					tc.logger.Debug().Str("stream_id", stream.ID.String()).Msg("EOF received, response complete")
+					tc.logger.Debug().Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("EOF received, response complete")
 				} else {
-					tc.logger.Debug().Err(err).Str("stream_id", stream.ID.String()).Msg("Local connection closed")
+					tc.logger.Debug().Err(err).Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("Local connection closed")
 				}
 				return
 			}
 
 			if n > 0 {
+				chunk := buf[:n]
+				complete := framing.feed(chunk)
+
+				// Hold back the response head until it is complete, then apply the response header rules
+				if rules := tc.config.HeaderRules.Response; !stream.responseHeadDone && !stream.internal && !rules.Empty() {
+					stream.responseHead = append(stream.responseHead, chunk...)
+					isHTTP := bytes.HasPrefix(stream.responseHead, []byte("HTTP/")) || bytes.HasPrefix([]byte("HTTP/"), stream.responseHead)
+					if isHTTP && !bytes.Contains(stream.responseHead, []byte("\r\n\r\n")) && len(stream.responseHead) < maxResponseHeadBytes {
+						continue
+					}
+					chunk = stream.responseHead
+					if isHTTP {
+						chunk = applyHeaderRules(chunk, rules)
+					}
+					stream.responseHead = nil
+					stream.responseHeadDone = true
+				}
+
+				// Point the local server's absolute URLs at the public URL, holding back HTML to rewrite it whole
+				if stream.tunnel.localURLs != nil && !stream.rewriteDone && !stream.internal {
+					var done bool
+					stream.rewriteHeld = append(stream.rewriteHeld, chunk...)
+					if chunk, done = rewriteResponse(stream.rewriteHeld, stream.Method, stream.tunnel); !done {
+						continue
+					}
+					stream.rewriteHeld = nil
+					stream.rewriteDone = true
+				}
+				n = len(chunk)
+
 				if !stream.firstRead {
 					stream.firstRead = true
 				}
 				stream.BytesRecv += int64(n)
+				atomic.AddInt64(&stream.tunnel.bytesOut, int64(n))
 
 				// Capture response data if dashboard is enabled
 				if stream.captureEnabled {
-					stream.ResponseData = append(stream.ResponseData, buf[:n]...)
+					tc.captureChunk(stream, &stream.ResponseData, &stream.responseTruncated, chunk)
 				}
 
 				// Parse and log HTTP response status on first read
 				if stream.BytesRecv == int64(n) && n > 12 {
 					// This is the first chunk, try to extract status code
-					statusLine := string(buf[:n])
+					statusLine := string(chunk)
 					if len(statusLine) > 12 && statusLine[:5] == "HTTP/" {
 						// Find the end of the status line
 						endIdx := 0
@@ -701,12 +1287,13 @@ func (tc *TunnelClient) proxyFromLocal(stream *LocalStream) {
 
 				tc.logger.Debug().
 					Str("stream_id", stream.ID.String()).
+					Str("request_id", stream.RequestID).
 					Int("bytes_read", n).
 					Msg("Read from local server")
 
 				// Send data through tunnel - copy buffer to avoid data race
 				dataMsg := &protocol.DataMessage{
-					Data: append([]byte(nil), buf[:n]...), // Copy the buffer
+					Data: append([]byte(nil), chunk...), // Copy the buffer
 				}
 				msg, err := protocol.NewMessage(protocol.MessageTypeData, stream.ID, dataMsg)
 				if err != nil {
@@ -725,14 +1312,224 @@ func (tc *TunnelClient) proxyFromLocal(stream *LocalStream) {
 				case <-stream.Done:
 					return
 				case <-time.After(5 * time.Second):
-					tc.logger.Warn().Str("stream_id", stream.ID.String()).Msg("Send buffer full, timing out")
+					tc.logger.Warn().Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("Send buffer full, timing out")
+					return
+				}
+
+				// The whole response is in: keep the local connection for the next request if both sides allow it
+				if complete {
+					stream.EndTime = time.Now()
+					stream.reusable.Store(framing.keepAlive && !framing.extra && stream.requestReusable.Load())
+					tc.logger.Debug().Str("stream_id", stream.ID.String()).Str("request_id", stream.RequestID).Msg("Response complete")
+					return
+				}
+			}
+		}
+	}
+}
+
+// proxyTCP relays a raw TCP stream between the tunnel and the local service until either side closes it
+func (tc *TunnelClient) proxyTCP(stream *LocalStream) {
+	defer func() {
+		prefix := ""
+		if name := stream.tunnel.Name(); name != "" {
+			prefix = "[" + name + "] "
+		}
+		// Format: [tunnel] [timestamp] - "TCP" sent_bytes recv_bytes duration_ms
+		fmt.Printf("%s%s - \"TCP\" %d %d %dms\n",
+			prefix, stream.StartTime.Format("2006/01/02 15:04:05"),
+			atomic.LoadInt64(&stream.BytesSent), atomic.LoadInt64(&stream.BytesRecv),
+			time.Since(stream.StartTime).Milliseconds())
+
+		tc.sendStreamEnd(stream.ID)
+		tc.closeStream(stream.ID)
+	}()
+
+	// Tunnel to local service; closing the connection on failure ends the read loop below
+	go func() {
+		for {
+			select {
+			case data := <-stream.DataChan:
+				n, err := stream.LocalConn.Write(data)
+				atomic.AddInt64(&stream.BytesSent, int64(n))
+				atomic.AddInt64(&stream.tunnel.bytesIn, int64(n))
+				if err != nil {
+					stream.LocalConn.Close()
 					return
 				}
+			case <-stream.Done:
+				return
+			}
+		}
+	}()
+
+	bufPtr := bufferPool.Get().(*[]byte)
+	buf := *bufPtr
+	defer bufferPool.Put(bufPtr)
+
+	for {
+		n, err := stream.LocalConn.Read(buf)
+		if n > 0 {
+			atomic.AddInt64(&stream.BytesRecv, int64(n))
+			atomic.AddInt64(&stream.tunnel.bytesOut, int64(n))
+			msg, msgErr := protocol.NewMessage(protocol.MessageTypeData, stream.ID, &protocol.DataMessage{Data: buf[:n]})
+			if msgErr != nil {
+				tc.logger.Error().Err(msgErr).Msg("Failed to create data message")
+				return
+			}
+			data, msgErr := protocol.EncodeMessage(msg)
+			if msgErr != nil {
+				tc.logger.Error().Err(msgErr).Msg("Failed to encode message")
+				return
+			}
+
+			select {
+			case tc.send <- data:
+			case <-stream.Done:
+				return
+			case <-time.After(5 * time.Second):
+				tc.logger.Warn().Str("stream_id", stream.ID.String()).Msg("Send buffer full, timing out")
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				tc.logger.Debug().Err(err).Str("stream_id", stream.ID.String()).Msg("Local connection closed")
 			}
+			return
 		}
 	}
 }
 
+// startStreamSpan starts the stream's span from the trace context in the request headers
+// and rewrites those headers so the local server continues the trace from this span
+func (tc *TunnelClient) startStreamSpan(stream *LocalStream, data []byte) []byte {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		return data
+	}
+
+	lines := strings.Split(string(data[:headerEnd]), "\r\n")
+	headers := make(http.Header)
+	for _, line := range lines[1:] {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			headers.Add(name, strings.TrimSpace(value))
+		}
+	}
+
+	ctx := tracing.Extract(context.Background(), headers)
+	ctx, span := tracing.Tracer().Start(ctx, "tungo.client.stream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.HTTPAttributes(stream.Method, stream.Path, stream.tunnel.SubDomain())...),
+		trace.WithAttributes(
+			attribute.String("tungo.stream_id", stream.ID.String()),
+			attribute.String("tungo.request_id", stream.RequestID)))
+	stream.span = span
+	if !span.IsRecording() {
+		return data
+	}
+
+	// Replace the trace context headers with this span's
+	traceHeaders := make(http.Header)
+	tracing.Inject(ctx, traceHeaders)
+
+	var buf bytes.Buffer
+	buf.WriteString(lines[0])
+	buf.WriteString("\r\n")
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		if traceHeaders.Get(strings.TrimSpace(name)) != "" {
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	for name, values := range traceHeaders {
+		for _, value := range values {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+		}
+	}
+	buf.Write(data[headerEnd+2:])
+	return buf.Bytes()
+}
+
+// streamQueueSize returns the per-stream data queue size
+func (tc *TunnelClient) streamQueueSize() int {
+	if tc.config.StreamQueueSize > 0 {
+		return tc.config.StreamQueueSize
+	}
+	return 512
+}
+
+// reserveCapture accounts n capture bytes against the memory budget
+// Returns false once the stream's capture has been dropped for exceeding the budget
+func (tc *TunnelClient) reserveCapture(stream *LocalStream, n int) bool {
+	if atomic.LoadInt32(&stream.captureDropped) == 1 {
+		return false
+	}
+
+	total := atomic.AddInt64(&tc.captureBytes, int64(n))
+	if maxBytes := tc.config.MaxCaptureBytes; maxBytes > 0 && total > maxBytes {
+		atomic.AddInt64(&tc.captureBytes, -int64(n))
+		if atomic.CompareAndSwapInt32(&stream.captureDropped, 0, 1) {
+			tc.logger.Warn().
+				Str("stream_id", stream.ID.String()).
+				Int64("max_capture_bytes", maxBytes).
+				Msg("Capture memory budget exceeded, not capturing stream")
+		}
+		return false
+	}
+
+	atomic.AddInt64(&stream.capturedBytes, int64(n))
+	return true
+}
+
+// captureChunk appends data to a capture buffer up to the per-request capture limit, counting the bytes left out
+func (tc *TunnelClient) captureChunk(stream *LocalStream, buf *[]byte, truncated *int64, data []byte) {
+	keep := data
+	if limit := tc.config.CaptureLimit; limit > 0 && int64(len(*buf)+len(data)) > limit {
+		keep = data[:max(limit-int64(len(*buf)), 0)]
+	}
+	if len(keep) > 0 && tc.reserveCapture(stream, len(keep)) {
+		*buf = append(*buf, keep...)
+	}
+	*truncated += int64(len(data) - len(keep))
+}
+
+// drainQueued appends already-queued chunks to data, up to the size of one pooled buffer
+func drainQueued(stream *LocalStream, data []byte) []byte {
+	for len(data) < 32*1024 {
+		select {
+		case more, ok := <-stream.DataChan:
+			if !ok {
+				return data
+			}
+			data = append(data, more...)
+		default:
+			return data
+		}
+	}
+	return data
+}
+
+// sendStreamData sends data to the visitor of a stream the client doesn't track
+func (tc *TunnelClient) sendStreamData(streamID protocol.StreamID, payload []byte) {
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, streamID, &protocol.DataMessage{Data: payload})
+	if err != nil {
+		return
+	}
+	data, err := protocol.EncodeMessage(msg)
+	if err != nil {
+		return
+	}
+	select {
+	case tc.send <- data:
+	case <-tc.done:
+	case <-time.After(5 * time.Second):
+		tc.logger.Warn().Str("stream_id", streamID.String()).Msg("Send buffer full, timing out")
+	}
+}
+
 // sendStreamEnd sends a stream end message
 func (tc *TunnelClient) sendStreamEnd(streamID protocol.StreamID) {
 	msg, _ := protocol.NewMessage(protocol.MessageTypeEnd, streamID, nil)
@@ -751,6 +1548,8 @@ func (tc *TunnelClient) addStream(stream *LocalStream) {
 	tc.streamMux.Lock()
 	defer tc.streamMux.Unlock()
 	tc.streams[stream.ID] = stream
+	atomic.AddInt64(&stream.tunnel.requests, 1)
+	atomic.AddInt64(&stream.tunnel.active, 1)
 }
 
 // getStream retrieves a stream by ID
@@ -772,8 +1571,9 @@ func (tc *TunnelClient) closeStream(streamID protocol.StreamID) {
 	}
 
 	close(stream.Done)
-	stream.LocalConn.Close()
+	tc.releaseLocal(stream)
 	delete(tc.streams, streamID)
+	atomic.AddInt64(&stream.tunnel.active, -1)
 
 	tc.logger.Debug().
 		Str("stream_id", streamID.String()).
@@ -782,6 +1582,27 @@ func (tc *TunnelClient) closeStream(streamID protocol.StreamID) {
 		Msg("Stream closed")
 }
 
+// releaseLocal closes a stream's local connection, or keeps it for the next request
+// when the stream's exchange completed with keep-alive
+func (tc *TunnelClient) releaseLocal(stream *LocalStream) {
+	if conn := stream.local(); conn != nil && stream.reusable.Load() && tc.config.LocalKeepAlive {
+		tc.localPool.put(conn)
+		return
+	}
+	stream.LocalConn.Close()
+}
+
+// local returns the stream's connection to a local server, or nil for dashboard streams
+// and routed streams that never connected
+func (s *LocalStream) local() *localConn {
+	conn := s.LocalConn
+	if routed, ok := conn.(*routedConn); ok {
+		conn = routed.current()
+	}
+	local, _ := conn.(*localConn)
+	return local
+}
+
 // Close closes the client connection
 func (tc *TunnelClient) Close() error {
 	tc.closeMutex.Lock()
@@ -808,9 +1629,11 @@ func (tc *TunnelClient) Close() error {
 			close(stream.Done)
 		}
 		stream.LocalConn.Close()
+		atomic.AddInt64(&stream.tunnel.active, -1)
 	}
 	tc.streams = make(map[protocol.StreamID]*LocalStream)
 	tc.streamMux.Unlock()
+	tc.localPool.closeAll()
 
 	// Close WebSocket connection
 	if tc.conn != nil {
@@ -821,9 +1644,155 @@ func (tc *TunnelClient) Close() error {
 	return nil
 }
 
-// GetServerInfo returns the server information
+// handleReconnect adds the draining server's peers to the server list and selects one for the next connection
+// The current connection stays open so in-flight requests can finish; the server closes it once drained
+func (tc *TunnelClient) handleReconnect(msg *protocol.ReconnectMessage) {
+	// Pick the nearest peer, keeping the server's order among equally near ones
+	next, nearest := -1, 0
+	for _, peer := range msg.Servers {
+		idx := tc.addPeer(peer)
+		if idx < 0 || idx == tc.currentServerIdx {
+			continue
+		}
+		proximity := serverProximity(peer.Region, peer.Zone, tc.config.Region, tc.config.Zone)
+		if next == -1 || proximity < nearest {
+			next, nearest = idx, proximity
+		}
+	}
+
+	tc.logger.Warn().
+		Str("reason", msg.Reason).
+		Int("peers", len(msg.Servers)).
+		Msg("Server is draining, will reconnect once in-flight requests finish")
+
+	if next >= 0 {
+		tc.currentServerIdx = next
+		tc.logger.Info().
+			Str("server", fmt.Sprintf("%s:%d", tc.serverList[next].Host, tc.serverList[next].Port)).
+			Msg("Selected peer server for reconnection")
+	} else if len(tc.serverList) > 1 {
+		tc.RotateToNextServer()
+	}
+}
+
+// handleMigrate selects the server taking over the tunnel and disconnects once in-flight requests finish
+// (and every tunnel has its token), so the next connection presents the migration tokens and the tunnels
+// move without being unregistered
+func (tc *TunnelClient) handleMigrate(msg *protocol.MigrateMessage) {
+	idx := tc.addPeer(msg.Server)
+	if idx < 0 || msg.Token == "" {
+		tc.logger.Warn().
+			Str("server", fmt.Sprintf("%s:%d", msg.Server.Host, msg.Server.Port)).
+			Msg("Ignoring migration to unreachable server")
+		return
+	}
+
+	// Servers before multi-tunnel support don't name the tunnel
+	subDomain := msg.SubDomain
+	if subDomain == "" {
+		subDomain = tc.tunnels[0].SubDomain()
+	}
+
+	tc.currentServerIdx = idx
+	tc.migrationMutex.Lock()
+	tc.migrationTokens[subDomain] = msg.Token
+	first := len(tc.migrationTokens) == 1
+	tc.migrationMutex.Unlock()
+	tc.logger.Info().
+		Str("reason", msg.Reason).
+		Str("subdomain", subDomain).
+		Str("server", fmt.Sprintf("%s:%d", msg.Server.Host, msg.Server.Port)).
+		Msg("Migrating tunnel to peer server")
+
+	// The first token starts the wait; the rest of the connection's tokens follow right behind it
+	if !first {
+		return
+	}
+	conn := tc.conn
+	go func() {
+		deadline := time.Now().Add(migrationGracePeriod)
+		for (tc.GetActiveStreams() > 0 || tc.migrationTokenCount() < len(tc.tunnels)) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		conn.Close()
+	}()
+}
+
+// migrationTokenCount returns how many tunnels have a migration token for the next connection
+func (tc *TunnelClient) migrationTokenCount() int {
+	tc.migrationMutex.Lock()
+	defer tc.migrationMutex.Unlock()
+	return len(tc.migrationTokens)
+}
+
+// Expired returns why the server closed the tunnel for good, or "" if it didn't (an expired tunnel shouldn't be reconnected)
+func (tc *TunnelClient) Expired() string {
+	return tc.expired
+}
+
+// TimedOut reports whether the last connection was dropped because the server stopped answering
+// (it should be reconnected right away rather than after the retry interval)
+func (tc *TunnelClient) TimedOut() bool {
+	return tc.timedOut
+}
+
+// Migrating reports whether the next connection completes a migration to another server
+func (tc *TunnelClient) Migrating() bool {
+	return tc.migrationTokenCount() > 0
+}
+
+// addPeer adds a peer server to the server list and returns its index (-1 if it isn't reachable)
+func (tc *TunnelClient) addPeer(peer protocol.PeerServer) int {
+	// Skip peers that advertise a wildcard bind address
+	if ip := net.ParseIP(peer.Host); peer.Host == "" || peer.Port <= 0 || (ip != nil && ip.IsUnspecified()) {
+		return -1
+	}
+
+	current := tc.serverList[tc.currentServerIdx]
+	for i, existing := range tc.serverList {
+		if existing.Host == peer.Host && existing.Port == peer.Port {
+			return i
+		}
+	}
+	tc.serverList = append(tc.serverList, config.ServerNode{
+		Host:   peer.Host,
+		Port:   peer.Port,
+		Secure: current.Secure,
+		Path:   current.Path,
+		Region: peer.Region,
+		Zone:   peer.Zone,
+	})
+	return len(tc.serverList) - 1
+}
+
+// GetServerInfo returns the server information for the first tunnel
 func (tc *TunnelClient) GetServerInfo() *protocol.ServerHello {
-	return tc.serverInfo
+	return tc.tunnels[0].serverInfo
+}
+
+// Tunnels returns the client's tunnels in configuration order
+func (tc *TunnelClient) Tunnels() []*Tunnel {
+	return tc.tunnels
+}
+
+// tunnelFor returns the tunnel a stream for subDomain came in on (the first tunnel for servers that don't say)
+func (tc *TunnelClient) tunnelFor(subDomain string) *Tunnel {
+	for _, tunnel := range tc.tunnels {
+		if subDomain != "" && tunnel.SubDomain() == subDomain {
+			return tunnel
+		}
+	}
+	return tc.tunnels[0]
+}
+
+// tunnelNamed returns the tunnel with the given name (the first tunnel when none has it)
+func (tc *TunnelClient) tunnelNamed(name string) *Tunnel {
+	for _, tunnel := range tc.tunnels {
+		if tunnel.Name() == name {
+			return tunnel
+		}
+	}
+	return tc.tunnels[0]
 }
 
 // RotateToNextServer rotates to the next server in the cluster
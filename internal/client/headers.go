@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sombochea/tungo/pkg/config"
+)
+
+// editHead rewrites the header lines of the message head at the start of data
+// Data without a complete head is returned unchanged
+func editHead(data []byte, edit func(headers []string) []string) []byte {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		return data
+	}
+
+	lines := strings.Split(string(data[:headerEnd]), "\r\n")
+	var buf bytes.Buffer
+	buf.WriteString(lines[0])
+	buf.WriteString("\r\n")
+	for _, line := range edit(lines[1:]) {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	buf.Write(data[headerEnd+2:])
+	return buf.Bytes()
+}
+
+// headerName returns the field name of a header line
+func headerName(line string) string {
+	name, _, _ := strings.Cut(line, ":")
+	return strings.TrimSpace(name)
+}
+
+// rewriteHostHeader replaces the Host header of a request head, keeping the visitor's in X-Forwarded-Host
+func rewriteHostHeader(data []byte, host string) []byte {
+	if host == "" {
+		return data
+	}
+	return editHead(data, func(headers []string) []string {
+		originalHost, forwardedHost := "", false
+		edited := make([]string, 0, len(headers)+2)
+		for _, line := range headers {
+			switch name := headerName(line); {
+			case strings.EqualFold(name, "Host"):
+				_, value, _ := strings.Cut(line, ":")
+				originalHost = strings.TrimSpace(value)
+				continue
+			case strings.EqualFold(name, "X-Forwarded-Host"):
+				forwardedHost = true
+			}
+			edited = append(edited, line)
+		}
+		edited = append(edited, "Host: "+host)
+		if originalHost != "" && !forwardedHost {
+			edited = append(edited, "X-Forwarded-Host: "+originalHost)
+		}
+		return edited
+	})
+}
+
+// applyHeaderRules edits the headers of the message head at the start of data
+func applyHeaderRules(data []byte, rules config.HeaderRules) []byte {
+	if rules.Empty() {
+		return data
+	}
+	return editHead(data, func(headers []string) []string {
+		dropped := func(name string) bool {
+			if slices.ContainsFunc(rules.Remove, func(removed string) bool { return strings.EqualFold(removed, name) }) {
+				return true
+			}
+			for replaced := range rules.Replace {
+				if strings.EqualFold(replaced, name) {
+					return true
+				}
+			}
+			return false
+		}
+
+		edited := make([]string, 0, len(headers)+len(rules.Replace)+len(rules.Add))
+		for _, line := range headers {
+			if !dropped(headerName(line)) {
+				edited = append(edited, line)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(rules.Replace)) {
+			edited = append(edited, fmt.Sprintf("%s: %s", http.CanonicalHeaderKey(name), rules.Replace[name]))
+		}
+		for _, name := range slices.Sorted(maps.Keys(rules.Add)) {
+			edited = append(edited, fmt.Sprintf("%s: %s", http.CanonicalHeaderKey(name), rules.Add[name]))
+		}
+		return edited
+	})
+}
+
+// unauthorizedResponse asks visitors without valid Basic Auth credentials to log in
+const unauthorizedResponse = "HTTP/1.1 401 Unauthorized\r\n" +
+	"WWW-Authenticate: Basic realm=\"TunGo\", charset=\"UTF-8\"\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Length: 24\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"Authentication required\n"
+
+// checkBasicAuth verifies the Authorization header of a request head against "user:pass" credentials
+// It returns the request without the header, so the credentials don't leak to the local server
+func checkBasicAuth(data []byte, credentials string) ([]byte, bool) {
+	authorized := false
+	edited := editHead(data, func(headers []string) []string {
+		kept := make([]string, 0, len(headers))
+		for _, line := range headers {
+			if !strings.EqualFold(headerName(line), "Authorization") {
+				kept = append(kept, line)
+				continue
+			}
+			_, value, _ := strings.Cut(line, ":")
+			value = strings.TrimSpace(value)
+			if len(value) < 6 || !strings.EqualFold(value[:6], "basic ") {
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[6:]))
+			if err == nil && subtle.ConstantTimeCompare(decoded, []byte(credentials)) == 1 {
+				authorized = true
+			}
+		}
+		return kept
+	})
+	return edited, authorized
+}
@@ -0,0 +1,99 @@
+package introspect
+
+import (
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// hexPreviewBytes bounds the hex dump of a binary body, the whole body can be downloaded
+const hexPreviewBytes = 4096
+
+// binaryMediaTypes are shown as hex even when their bytes happen to be valid text
+var binaryMediaTypes = []string{
+	"image/", "audio/", "video/", "font/",
+	"application/octet-stream", "application/protobuf", "application/x-protobuf", "application/grpc",
+	"application/pdf", "application/zip", "application/gzip", "application/wasm",
+}
+
+// bodyExtensions name downloaded bodies by media type, others are saved as .bin
+var bodyExtensions = map[string]string{
+	"application/json": ".json", "application/xml": ".xml", "text/xml": ".xml", "text/html": ".html",
+	"text/plain": ".txt", "text/csv": ".csv", "application/pdf": ".pdf", "application/zip": ".zip",
+	"application/protobuf": ".pb", "application/x-protobuf": ".pb",
+	"image/png": ".png", "image/jpeg": ".jpg", "image/gif": ".gif", "image/webp": ".webp", "image/svg+xml": ".svg",
+}
+
+// isBinaryBody reports whether a body should be shown as hex rather than text
+func isBinaryBody(data []byte, mediaType string) bool {
+	for _, binary := range binaryMediaTypes {
+		if strings.HasPrefix(mediaType, binary) {
+			return true
+		}
+	}
+	if !utf8.Valid(data) {
+		return true
+	}
+	for _, c := range data {
+		if c < ' ' && c != '\n' && c != '\r' && c != '\t' || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// hexPreview dumps the start of a binary body, offsets and hex on the left and printable bytes on the right
+func hexPreview(data []byte) string {
+	return hex.Dump(data[:min(len(data), hexPreviewBytes)])
+}
+
+// handleBody downloads a captured body, decoded from its Content-Encoding:
+// /body/<id>/request or /body/<id>/response, with ?raw=1 for the bytes as captured.
+// Images are shown inline for the detail page's preview, everything else is an attachment.
+func (d *Dashboard) handleBody(w http.ResponseWriter, r *http.Request) {
+	id, part, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/body/"), "/")
+	req, ok := GetStore().Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data, headers, truncated := req.BodyData, req.Headers, req.BodyTruncated
+	switch part {
+	case "request":
+	case "response":
+		data, headers, truncated = req.ResponseData, req.ResponseHeaders, req.ResponseTruncated
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType := headerValue(headers, "Content-Type")
+	if encoding := headerValue(headers, "Content-Encoding"); encoding != "" {
+		if r.URL.Query().Get("raw") != "" {
+			contentType = "application/octet-stream" // Still encoded, a browser mustn't decode it
+		} else if decoded, ok := decodeBody(data, encoding, truncated > 0); ok {
+			data = decoded
+		}
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	// The body is the visitor's or the local server's, it must not run as the dashboard's page
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", contentType)
+	disposition := "attachment"
+	if strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml" {
+		disposition = "inline"
+	}
+	name := id + "-" + part + ".bin"
+	if extension, ok := bodyExtensions[mediaType]; ok {
+		name = id + "-" + part + extension
+	}
+	w.Header().Set("Content-Disposition", disposition+`; filename="`+name+`"`)
+	w.Write(data)
+}
@@ -0,0 +1,106 @@
+package introspect
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sombochea/tungo/pkg/protocol"
+)
+
+// curlSkipHeaders are left out of generated curl commands: curl sets the framing and Host itself,
+// and the forwarding headers and request ID are added again on the way through a tunnel
+var curlSkipHeaders = []string{
+	"Host", "Content-Length", "Transfer-Encoding", "Connection",
+	"X-Forwarded-For", "X-Real-IP", protocol.RequestIDHeader,
+}
+
+// curlCommand returns a curl command that sends a captured request again. It goes to the host the
+// visitor used, or to base (a scheme and host such as https://staging.example.com) when one is given.
+func curlCommand(req *Request, base string) string {
+	target := req.Path
+	host := ""
+	head, _, _ := bytes.Cut(req.EntireRequest, []byte("\r\n\r\n"))
+	lines := strings.Split(string(head), "\r\n")
+	if fields := strings.Fields(lines[0]); len(fields) == 3 {
+		target = fields[1]
+	}
+
+	var headers []string
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		switch {
+		case strings.EqualFold(name, "Host"):
+			if host == "" {
+				host = value
+			}
+		case strings.EqualFold(name, "X-Forwarded-Host"):
+			host = value // The visitor's Host, when the local server got a rewritten one
+		}
+		skip := false
+		for _, skipped := range curlSkipHeaders {
+			skip = skip || strings.EqualFold(name, skipped)
+		}
+		if !skip {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	if base == "" {
+		base = "http://" + host
+	}
+
+	var cmd strings.Builder
+	if req.BodyTruncated > 0 {
+		fmt.Fprintf(&cmd, "# The body was truncated when captured, this sends only its first %d bytes\n", len(req.BodyData))
+	}
+	cmd.WriteString("curl")
+	switch {
+	case req.Method == http.MethodHead:
+		cmd.WriteString(" --head")
+	case req.Method == http.MethodGet && len(req.BodyData) == 0,
+		req.Method == http.MethodPost && len(req.BodyData) > 0:
+		// curl's default for the request
+	default:
+		cmd.WriteString(" -X " + shellQuote(req.Method))
+	}
+	cmd.WriteString(" " + shellQuote(strings.TrimRight(base, "/")+target))
+	for _, header := range headers {
+		cmd.WriteString(" \\\n  -H " + shellQuote(header))
+	}
+	if len(req.BodyData) > 0 {
+		cmd.WriteString(" \\\n  --data-binary " + shellQuote(string(req.BodyData)))
+	}
+	return cmd.String()
+}
+
+// shellQuote quotes s for a POSIX shell, using $'...' escapes when it has bytes a terminal can't paste
+func shellQuote(s string) string {
+	printable := utf8.ValidString(s)
+	for i := 0; printable && i < len(s); i++ {
+		printable = s[i] >= ' ' && s[i] != 0x7f || s[i] == '\n' || s[i] == '\t'
+	}
+	if printable {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+
+	var quoted strings.Builder
+	quoted.WriteString("$'")
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' || c == '\'':
+			quoted.WriteString(`\` + string(c))
+		case c >= ' ' && c < 0x7f:
+			quoted.WriteByte(c)
+		default:
+			fmt.Fprintf(&quoted, `\x%02x`, c)
+		}
+	}
+	quoted.WriteString("'")
+	return quoted.String()
+}
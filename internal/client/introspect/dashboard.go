@@ -1,15 +1,21 @@
 package introspect
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"mime"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
+
+	"github.com/sombochea/tungo/pkg/protocol"
 )
 
 //go:embed templates/*.html
@@ -20,17 +26,24 @@ var staticFS embed.FS
 
 // Dashboard manages the introspection web interface
 type Dashboard struct {
-	addr      string
-	templates *template.Template
-	server    *http.Server
+	addr       string
+	templates  *template.Template
+	server     *http.Server
+	publicURLs func() []string // The tunnels' public URLs, shown with a copy button
+	replay     Replayer        // Sends captured requests again (nil = replay unavailable)
 }
 
+// Replayer sends a captured request again to the local server it went to and returns the raw response,
+// cut short at the capture limit with the bytes left out counted in truncated
+type Replayer func(req *Request) (response []byte, truncated int64, err error)
+
 // NewDashboard creates a new dashboard server
 func NewDashboard(port int) (*Dashboard, error) {
 	addr := fmt.Sprintf("0.0.0.0:%d", port)
 
 	// Parse templates with custom functions
 	funcMap := template.FuncMap{
+		"list": func(items ...string) []string { return items },
 		"div": func(a, b int) int {
 			if b == 0 {
 				return 0
@@ -50,14 +63,25 @@ func NewDashboard(port int) (*Dashboard, error) {
 	}
 
 	// Setup HTTP server
-	mux := http.NewServeMux()
+	routes := http.NewServeMux()
 
 	// Routes
-	mux.HandleFunc("/", d.handleIndex)
-	mux.HandleFunc("/detail/", d.handleDetail)
-	mux.HandleFunc("/replay/", d.handleReplay)
-	mux.HandleFunc("/api/requests", d.handleAPIRequests)
-	mux.Handle("/static/", http.FileServer(http.FS(staticFS)))
+	routes.HandleFunc("/", d.handleIndex)
+	routes.HandleFunc("/detail/", d.handleDetail)
+	routes.HandleFunc("/replay/", d.handleReplay)
+	routes.HandleFunc("/diff", d.handleDiff)
+	routes.HandleFunc("/body/", d.handleBody)
+	routes.HandleFunc("/api/requests", d.handleAPIRequests)
+	routes.HandleFunc("/api/requests/", d.handleAPICurl)
+	routes.HandleFunc("/api/events", d.handleEvents)
+	routes.HandleFunc("/export/har", d.handleExportHAR)
+	routes.HandleFunc("/export/har/", d.handleExportHAR)
+	routes.Handle("/static/", http.FileServer(http.FS(staticFS)))
+
+	// Shared dashboard traffic arrives through the tunnel under a reserved prefix
+	mux := http.NewServeMux()
+	mux.Handle("/", routes)
+	mux.Handle(protocol.InspectPathPrefix+"/", http.StripPrefix(protocol.InspectPathPrefix, withBasePath(protocol.InspectPathPrefix, routes)))
 
 	d.server = &http.Server{
 		Addr:    addr,
@@ -67,6 +91,22 @@ func NewDashboard(port int) (*Dashboard, error) {
 	return d, nil
 }
 
+// basePathKey is the context key holding the path prefix the dashboard is served under
+type basePathKey struct{}
+
+// withBasePath records the prefix a handler is mounted under so pages can build links
+func withBasePath(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), basePathKey{}, prefix)))
+	})
+}
+
+// basePath returns the prefix the current request is served under ("" when accessed locally)
+func basePath(r *http.Request) string {
+	prefix, _ := r.Context().Value(basePathKey{}).(string)
+	return prefix
+}
+
 // Start starts the dashboard server
 func (d *Dashboard) Start() error {
 	log.Info().Str("addr", d.addr).Msg("Starting introspection dashboard")
@@ -78,6 +118,16 @@ func (d *Dashboard) Start() error {
 	return nil
 }
 
+// SetPublicURLs sets how the dashboard learns the tunnels' public URLs, which change as the client reconnects
+func (d *Dashboard) SetPublicURLs(urls func() []string) {
+	d.publicURLs = urls
+}
+
+// SetReplayer sets how the dashboard replays captured requests
+func (d *Dashboard) SetReplayer(replay Replayer) {
+	d.replay = replay
+}
+
 // Stop stops the dashboard server
 func (d *Dashboard) Stop() error {
 	if d.server != nil {
@@ -93,15 +143,31 @@ func (d *Dashboard) handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	requests := GetStore().GetAll()
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	requests, total := filter.apply(GetStore().GetAll())
 
-	// Sort by completion time (most recent first)
-	sort.Slice(requests, func(i, j int) bool {
-		return requests[i].Completed.After(requests[j].Completed)
-	})
+	var publicURLs []string
+	if d.publicURLs != nil {
+		publicURLs = d.publicURLs()
+	}
 
 	data := map[string]interface{}{
-		"Requests": requests,
+		"Requests":   requests,
+		"Total":      total,
+		"Filter":     filter,
+		"ExportURL":  exportURL(basePath(r), r.URL.Query()),
+		"PublicURLs": publicURLs,
+		"BasePath":   basePath(r),
+	}
+	if filter.Page > 1 {
+		data["PrevURL"] = pageURL(basePath(r), r.URL.Query(), filter.Page-1)
+	}
+	if filter.Page*filter.PerPage < total {
+		data["NextURL"] = pageURL(basePath(r), r.URL.Query(), filter.Page+1)
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -128,8 +194,11 @@ func (d *Dashboard) handleDetail(w http.ResponseWriter, r *http.Request) {
 
 	data := map[string]interface{}{
 		"Request":  req,
-		"Incoming": parseBodyData(req.BodyData),
-		"Response": parseBodyData(req.ResponseData),
+		"Incoming": parseBodyData(req.BodyData, req.BodyTruncated, req.Headers),
+		"Response": parseBodyData(req.ResponseData, req.ResponseTruncated, req.ResponseHeaders),
+		"Edit":     editableRequest(req),
+		"Curl":     curlCommand(req, ""),
+		"BasePath": basePath(r),
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -139,7 +208,39 @@ func (d *Dashboard) handleDetail(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleReplay replays a captured request (placeholder for future implementation)
+// handleDiff compares two captured exchanges side by side, /diff?a=<id>&b=<id>
+func (d *Dashboard) handleDiff(w http.ResponseWriter, r *http.Request) {
+	idA, idB := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+	if idA == "" || idB == "" {
+		http.Error(w, "Select two requests to compare: /diff?a=<id>&b=<id>", http.StatusBadRequest)
+		return
+	}
+	a, ok := GetStore().Get(idA)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	b, ok := GetStore().Get(idB)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Diff":     diffExchanges(a, b),
+		"BasePath": basePath(r),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := d.templates.ExecuteTemplate(w, "diff.html", data); err != nil {
+		log.Error().Err(err).Msg("Failed to render diff template")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// handleReplay sends a captured request to the local server again, captures the new exchange
+// as a replay of the original and shows it. Posted from the edit form, the request is rebuilt
+// from its method, path, headers and body first.
 func (d *Dashboard) handleReplay(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -158,39 +259,213 @@ func (d *Dashboard) handleReplay(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if d.replay == nil {
+		http.Error(w, "Replay is not available", http.StatusServiceUnavailable)
+		return
+	}
 
-	// TODO: Implement replay functionality
-	// For now, just redirect back to home
-	log.Info().Str("id", req.ID).Str("path", req.Path).Msg("Replay request (not yet implemented)")
+	if r.FormValue("edit") != "" {
+		raw, err := buildRequest(replayForm{
+			Method:  r.FormValue("method"),
+			Target:  r.FormValue("target"),
+			Headers: r.FormValue("headers"),
+			Body:    r.FormValue("body"),
+			LFBody:  r.FormValue("lf_body") != "",
+		})
+		if err != nil {
+			http.Error(w, "Replay failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		edited := *req
+		edited.EntireRequest = raw
+		edited.Method = strings.TrimSpace(r.FormValue("method"))
+		edited.BodyTruncated = 0 // The form's body is sent whole
+		req = &edited
+	}
+
+	started := time.Now()
+	response, truncated, err := d.replay(req)
+	if err != nil {
+		log.Warn().Err(err).Str("id", req.ID).Str("path", req.Path).Msg("Replay failed")
+		http.Error(w, "Replay failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	replayed, ok := parseExchange(req.EntireRequest, response)
+	if !ok {
+		http.Error(w, "Replay failed: the captured request can't be parsed", http.StatusBadGateway)
+		return
+	}
+	replayed.IsReplay = true
+	replayed.ReplayOf = req.ID
+	replayed.Started = started
+	replayed.ResponseTruncated = truncated
+	replayed.Tunnel = req.Tunnel
+	replayed.LocalAddr = req.LocalAddr
+	GetStore().Add(replayed)
+	ConsoleLog(replayed.Method, replayed.Path, replayed.Status)
+
+	log.Info().Str("id", req.ID).Str("replay_id", replayed.ID).Str("path", req.Path).Int("status", replayed.Status).Msg("Replayed request")
+	http.Redirect(w, r, basePath(r)+"/detail/"+replayed.ID, http.StatusSeeOther)
 }
 
-// handleAPIRequests returns requests as JSON
+// handleAPIRequests returns a page of requests as JSON, most recent first, filtered like the list
+// X-Total-Count says how many requests match
 func (d *Dashboard) handleAPIRequests(w http.ResponseWriter, r *http.Request) {
-	requests := GetStore().GetAll()
-
-	// Sort by completion time (most recent first)
-	sort.Slice(requests, func(i, j int) bool {
-		return requests[i].Completed.After(requests[j].Completed)
-	})
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	requests, total := filter.apply(GetStore().GetAll())
 
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(requests)
 }
 
+// handleAPICurl returns a curl command for a captured request at /api/requests/<id>/curl.
+// The base query parameter sends it to another environment instead, such as ?base=https://staging.example.com
+func (d *Dashboard) handleAPICurl(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/requests/"), "/curl")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	req, ok := GetStore().Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	base := r.URL.Query().Get("base")
+	if base != "" {
+		u, err := url.Parse(base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, fmt.Sprintf("invalid base %q: use a scheme and host such as https://staging.example.com", base), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, curlCommand(req, base))
+}
+
+// handleExportHAR downloads captured requests as a HAR file: /export/har/<id> for one request,
+// /export/har for every request matching the list's filters
+func (d *Dashboard) handleExportHAR(w http.ResponseWriter, r *http.Request) {
+	var requests []*Request
+	name := "tungo-" + time.Now().Format("20060102-150405") + ".har"
+	if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/export/har"), "/"); id != "" {
+		req, ok := GetStore().Get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		requests = []*Request{req}
+		name = "tungo-" + id + ".har"
+	} else {
+		filter, err := parseFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, req := range GetStore().GetAll() {
+			if filter.match(req) {
+				requests = append(requests, req)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(buildHAR(requests))
+}
+
+// eventsKeepAlive is how often an idle event stream gets a comment, so proxies keep it open
+const eventsKeepAlive = 15 * time.Second
+
+// handleEvents streams each newly captured request as a server-sent "request" event (JSON, as in /api/requests)
+func (d *Dashboard) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	requests, unsubscribe := GetStore().Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case req := <-requests:
+			data, err := json.Marshal(req)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: request\ndata: %s\n\n", data)
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
 // BodyData represents parsed body data for display
 type BodyData struct {
-	DataType string
-	Content  string
-	Raw      string
+	DataType    string // json, binary or unknown
+	Content     string
+	Raw         string
+	Encoding    string // Content-Encoding the body was decoded from ("" when shown as captured)
+	EncodedSize int    // Captured size of a decoded body
+	Size        int
+	ContentType string
+	HexBytes    int  // Bytes of a binary body in its hex dump
+	Image       bool // A binary body the detail page can preview
 }
 
-// parseBodyData attempts to parse body data (JSON, etc.)
-func parseBodyData(data []byte) BodyData {
-	body := BodyData{
-		DataType: "unknown",
-		Raw:      string(data),
+// parseBodyData attempts to parse body data (JSON, etc.) given its headers
+// Compressed bodies are decoded by their Content-Encoding, the captured bytes stay in the request.
+// Binary bodies are shown as a hex dump of their start rather than raw bytes.
+// Bodies cut short by the capture limit are shown raw, ending with a truncation marker
+func parseBodyData(data []byte, truncated int64, headers [][2]string) BodyData {
+	body := BodyData{DataType: "unknown", ContentType: headerValue(headers, "Content-Type")}
+	contentEncoding := headerValue(headers, "Content-Encoding")
+	if contentEncoding != "" && !strings.EqualFold(contentEncoding, "identity") && len(data) > 0 {
+		if decoded, ok := decodeBody(data, contentEncoding, truncated > 0); ok {
+			body.Encoding, body.EncodedSize = contentEncoding, len(data)
+			data = decoded
+		}
+	}
+	body.Size = len(data)
+	body.Raw = string(data)
+
+	mediaType, _, _ := mime.ParseMediaType(body.ContentType)
+	if len(data) > 0 && isBinaryBody(data, mediaType) {
+		body.DataType = "binary"
+		body.Image = strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml"
+		body.Raw = hexPreview(data)
+		body.HexBytes = min(len(data), hexPreviewBytes)
+	}
+
+	if truncated > 0 {
+		body.Raw += fmt.Sprintf("\n\n[truncated: %d more bytes not captured]", truncated)
+		return body
+	}
+	if body.DataType == "binary" {
+		return body
 	}
 
 	if len(data) == 0 {
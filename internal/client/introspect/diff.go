@@ -0,0 +1,207 @@
+package introspect
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Kinds of difference between two exchanges, as the diff view colors them
+const (
+	diffSame    = "same"
+	diffChanged = "changed"
+	diffRemoved = "removed" // Only in the first exchange
+	diffAdded   = "added"   // Only in the second exchange
+)
+
+// maxDiffCells bounds the line diff's table, larger changes are shown as replaced wholesale
+const maxDiffCells = 1 << 20
+
+// exchangeDiff compares two captured exchanges side by side, such as a failed request and its retry
+type exchangeDiff struct {
+	A, B   *Request
+	Fields []fieldSection // The overview, then request and response headers
+	Bodies []bodySection  // Request and response bodies
+}
+
+type fieldSection struct {
+	Title string
+	Rows  []fieldDiff
+}
+
+type bodySection struct {
+	Title string
+	Rows  []diffLine
+}
+
+// fieldDiff is a named value in both exchanges
+type fieldDiff struct {
+	Name        string
+	Left, Right string
+	Kind        string
+}
+
+// diffLine is a row of a side-by-side body diff, Left or Right is empty where a line was added or removed
+type diffLine struct {
+	Left, Right string
+	Kind        string
+}
+
+// diffExchanges compares exchange a with exchange b
+func diffExchanges(a, b *Request) exchangeDiff {
+	overview := []fieldDiff{
+		compareField("Method", a.Method, b.Method),
+		compareField("Path", a.Path, b.Path),
+		compareField("Status", fmt.Sprintf("%d %s", a.Status, http.StatusText(a.Status)), fmt.Sprintf("%d %s", b.Status, http.StatusText(b.Status))),
+		compareField("Duration", a.Elapsed(), b.Elapsed()),
+		compareField("Request size", fmt.Sprintf("%d bytes", len(a.BodyData)), fmt.Sprintf("%d bytes", len(b.BodyData))),
+		compareField("Response size", fmt.Sprintf("%d bytes", len(a.ResponseData)), fmt.Sprintf("%d bytes", len(b.ResponseData))),
+	}
+	return exchangeDiff{
+		A: a,
+		B: b,
+		Fields: []fieldSection{
+			{Title: "Overview", Rows: overview},
+			{Title: "Request Headers", Rows: diffHeaders(a.Headers, b.Headers)},
+			{Title: "Response Headers", Rows: diffHeaders(a.ResponseHeaders, b.ResponseHeaders)},
+		},
+		Bodies: []bodySection{
+			{Title: "Request Body", Rows: diffLines(diffableBody(a.BodyData, a.BodyTruncated, a.Headers), diffableBody(b.BodyData, b.BodyTruncated, b.Headers))},
+			{Title: "Response Body", Rows: diffLines(
+				diffableBody(a.ResponseData, a.ResponseTruncated, a.ResponseHeaders),
+				diffableBody(b.ResponseData, b.ResponseTruncated, b.ResponseHeaders),
+			)},
+		},
+	}
+}
+
+func compareField(name, left, right string) fieldDiff {
+	kind := diffSame
+	if left != right {
+		kind = diffChanged
+	}
+	return fieldDiff{Name: name, Left: left, Right: right, Kind: kind}
+}
+
+// diffHeaders compares headers by name, repeated headers joined, in the order they first appear
+func diffHeaders(a, b [][2]string) []fieldDiff {
+	var names []string
+	left, right := map[string][]string{}, map[string][]string{}
+	collect := func(headers [][2]string, values map[string][]string) {
+		for _, header := range headers {
+			name := http.CanonicalHeaderKey(header[0])
+			if _, seen := left[name]; !seen {
+				if _, seen := right[name]; !seen {
+					names = append(names, name)
+				}
+			}
+			values[name] = append(values[name], header[1])
+		}
+	}
+	collect(a, left)
+	collect(b, right)
+
+	diffs := make([]fieldDiff, 0, len(names))
+	for _, name := range names {
+		l, inLeft := left[name]
+		r, inRight := right[name]
+		diff := compareField(name, strings.Join(l, ", "), strings.Join(r, ", "))
+		switch {
+		case !inRight:
+			diff.Kind = diffRemoved
+		case !inLeft:
+			diff.Kind = diffAdded
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+// diffableBody returns a body's lines, decoded and JSON indented so changes land on their own lines.
+// Binary bodies are compared by their hex dumps.
+func diffableBody(data []byte, truncated int64, headers [][2]string) []string {
+	body := parseBodyData(data, truncated, headers)
+	text := body.Raw
+	if body.DataType == "json" && body.Content != "" {
+		text = body.Content
+	}
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines aligns two bodies' lines on their longest common subsequence. Removed lines followed by
+// added ones are paired up as changed, so edits read across the two sides.
+func diffLines(a, b []string) []diffLine {
+	// Common lines at either end are kept out of the table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var rows []diffLine
+	for _, line := range a[:prefix] {
+		rows = append(rows, diffLine{Left: line, Right: line, Kind: diffSame})
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	var removed, added []string
+	flush := func() {
+		for i := 0; i < len(removed) || i < len(added); i++ {
+			switch {
+			case i >= len(added):
+				rows = append(rows, diffLine{Left: removed[i], Kind: diffRemoved})
+			case i >= len(removed):
+				rows = append(rows, diffLine{Right: added[i], Kind: diffAdded})
+			default:
+				rows = append(rows, diffLine{Left: removed[i], Right: added[i], Kind: diffChanged})
+			}
+		}
+		removed, added = nil, nil
+	}
+
+	if (len(midA)+1)*(len(midB)+1) > maxDiffCells {
+		removed, added = midA, midB
+	} else {
+		// lcs[i][j] is the longest common subsequence of midA[i:] and midB[j:]
+		lcs := make([][]int32, len(midA)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(midB)+1)
+		}
+		for i := len(midA) - 1; i >= 0; i-- {
+			for j := len(midB) - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(midA) || j < len(midB) {
+			switch {
+			case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+				flush()
+				rows = append(rows, diffLine{Left: midA[i], Right: midB[j], Kind: diffSame})
+				i, j = i+1, j+1
+			case j == len(midB) || (i < len(midA) && lcs[i+1][j] >= lcs[i][j+1]):
+				removed = append(removed, midA[i])
+				i++
+			default:
+				added = append(added, midB[j])
+				j++
+			}
+		}
+	}
+	flush()
+
+	for _, line := range a[len(a)-suffix:] {
+		rows = append(rows, diffLine{Left: line, Right: line, Kind: diffSame})
+	}
+	return rows
+}
@@ -0,0 +1,52 @@
+package introspect
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// maxDecodedBody bounds a decompressed body, so a small capture can't expand without limit
+const maxDecodedBody = 16 << 20
+
+// decodeBody undoes a body's Content-Encoding (gzip, deflate or br, in the order listed) for display.
+// A body cut short by the capture limit decodes as far as it was captured. It reports false when an
+// encoding is unknown or the body doesn't decode, the captured bytes are then shown as they are.
+func decodeBody(data []byte, contentEncoding string, truncated bool) ([]byte, bool) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- { // The last coding listed was applied last
+		var reader io.Reader
+		var err error
+		switch strings.ToLower(strings.TrimSpace(codings[i])) {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			reader, err = gzip.NewReader(bytes.NewReader(data))
+		case "deflate":
+			// Meant to be zlib wrapped, though some servers send raw deflate
+			if reader, err = zlib.NewReader(bytes.NewReader(data)); err != nil {
+				reader, err = flate.NewReader(bytes.NewReader(data)), nil
+			}
+		case "br":
+			reader = brotli.NewReader(bytes.NewReader(data))
+		default:
+			return nil, false
+		}
+		if err != nil {
+			return nil, false
+		}
+
+		decoded, err := io.ReadAll(io.LimitReader(reader, maxDecodedBody))
+		if err != nil && !(truncated && errors.Is(err, io.ErrUnexpectedEOF)) {
+			return nil, false
+		}
+		data = decoded
+	}
+	return data, true
+}
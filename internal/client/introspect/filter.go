@@ -0,0 +1,165 @@
+package introspect
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// requestFilter selects captured requests for the list and /api/requests, from query parameters:
+// method, status (a class such as 4xx, or a code), path (substring), since and until (RFC 3339,
+// or a duration ago such as 15m), page and per_page
+type requestFilter struct {
+	Method  string
+	Status  string
+	Path    string
+	Since   string
+	Until   string
+	Page    int
+	PerPage int
+
+	sinceTime time.Time
+	untilTime time.Time
+}
+
+// parseFilter reads a filter from query parameters
+func parseFilter(query url.Values) (requestFilter, error) {
+	f := requestFilter{
+		Method:  strings.ToUpper(strings.TrimSpace(query.Get("method"))),
+		Status:  strings.ToLower(strings.TrimSpace(query.Get("status"))),
+		Path:    strings.TrimSpace(query.Get("path")),
+		Since:   strings.TrimSpace(query.Get("since")),
+		Until:   strings.TrimSpace(query.Get("until")),
+		Page:    1,
+		PerPage: defaultPerPage,
+	}
+
+	if f.Status != "" {
+		if _, _, ok := statusRange(f.Status); !ok {
+			return f, fmt.Errorf("invalid status %q: use a class such as 4xx or a code such as 404", f.Status)
+		}
+	}
+	var err error
+	if f.sinceTime, err = parseFilterTime(f.Since); err != nil {
+		return f, fmt.Errorf("invalid since: %w", err)
+	}
+	if f.untilTime, err = parseFilterTime(f.Until); err != nil {
+		return f, fmt.Errorf("invalid until: %w", err)
+	}
+	if page := query.Get("page"); page != "" {
+		if f.Page, err = strconv.Atoi(page); err != nil || f.Page < 1 {
+			return f, fmt.Errorf("invalid page %q", page)
+		}
+	}
+	if perPage := query.Get("per_page"); perPage != "" {
+		if f.PerPage, err = strconv.Atoi(perPage); err != nil || f.PerPage < 1 {
+			return f, fmt.Errorf("invalid per_page %q", perPage)
+		}
+		f.PerPage = min(f.PerPage, maxPerPage)
+	}
+	return f, nil
+}
+
+// parseFilterTime reads an RFC 3339 time, or a duration before now ("" = no bound)
+func parseFilterTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", value)
+	}
+	return t, nil
+}
+
+// statusRange returns the codes a status filter covers: 4xx is 400 to 499, 404 is just 404
+func statusRange(status string) (int, int, bool) {
+	if len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5' {
+		low := int(status[0]-'0') * 100
+		return low, low + 99, true
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 100 || code > 599 {
+		return 0, 0, false
+	}
+	return code, code, true
+}
+
+// Active reports whether the filter narrows the list
+func (f requestFilter) Active() bool {
+	return f.Method != "" || f.Status != "" || f.Path != "" || f.Since != "" || f.Until != ""
+}
+
+func (f requestFilter) match(req *Request) bool {
+	if f.Method != "" && req.Method != f.Method {
+		return false
+	}
+	if f.Status != "" {
+		low, high, _ := statusRange(f.Status)
+		if req.Status < low || req.Status > high {
+			return false
+		}
+	}
+	if f.Path != "" && !strings.Contains(strings.ToLower(req.Path), strings.ToLower(f.Path)) {
+		return false
+	}
+	if !f.sinceTime.IsZero() && req.Completed.Before(f.sinceTime) {
+		return false
+	}
+	if !f.untilTime.IsZero() && req.Completed.After(f.untilTime) {
+		return false
+	}
+	return true
+}
+
+// apply returns the filter's page of requests, most recent first, and how many requests match
+func (f requestFilter) apply(requests []*Request) ([]*Request, int) {
+	matched := []*Request{} // Encoded as [] when nothing matches
+	for _, req := range requests {
+		if f.match(req) {
+			matched = append(matched, req)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Completed.After(matched[j].Completed)
+	})
+
+	start := min((f.Page-1)*f.PerPage, len(matched))
+	end := min(start+f.PerPage, len(matched))
+	return matched[start:end], len(matched)
+}
+
+// pageURL returns the list's URL for another page, keeping the filter
+func pageURL(base string, query url.Values, page int) string {
+	q := url.Values{}
+	for key, values := range query {
+		q[key] = values
+	}
+	q.Set("page", strconv.Itoa(page))
+	return base + "/?" + q.Encode()
+}
+
+// exportURL returns the HAR export's URL for the list's filter, across all pages
+func exportURL(base string, query url.Values) string {
+	q := url.Values{}
+	for key, values := range query {
+		if key != "page" && key != "per_page" {
+			q[key] = values
+		}
+	}
+	if len(q) == 0 {
+		return base + "/export/har"
+	}
+	return base + "/export/har?" + q.Encode()
+}
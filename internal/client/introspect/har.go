@@ -0,0 +1,220 @@
+package introspect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sombochea/tungo/pkg/version"
+)
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/), as browser devtools import it
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"` // Milliseconds
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harCookie  `json:"cookies"`
+	Headers     []harNVP     `json:"headers"`
+	QueryString []harNVP     `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harCookie `json:"cookies"`
+	Headers     []harNVP    `json:"headers"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type harNVP struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size        int    `json:"size"`
+	Compression int    `json:"compression,omitempty"` // Bytes saved by the Content-Encoding
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"` // base64 for binary bodies
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// buildHAR converts captured requests to a HAR file, oldest first
+func buildHAR(requests []*Request) harFile {
+	sorted := append([]*Request(nil), requests...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Started.Before(sorted[j].Started) })
+
+	entries := make([]harEntry, 0, len(sorted))
+	for _, req := range sorted {
+		entries = append(entries, harEntryFor(req))
+	}
+	return harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "tungo", Version: version.Version},
+		Entries: entries,
+	}}
+}
+
+func harEntryFor(req *Request) harEntry {
+	elapsed := float64(req.Completed.Sub(req.Started).Microseconds()) / 1000
+	entry := harEntry{
+		StartedDateTime: req.Started.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            elapsed,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.Path,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harCookie{},
+			Headers:     harHeaders(req.Headers),
+			QueryString: []harNVP{},
+			HeadersSize: -1,
+			BodySize:    len(req.BodyData),
+		},
+		Response: harResponse{
+			Status:      req.Status,
+			StatusText:  http.StatusText(req.Status),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harCookie{},
+			Headers:     harHeaders(req.ResponseHeaders),
+			HeadersSize: -1,
+			BodySize:    len(req.ResponseData),
+		},
+		Timings: harTimings{Wait: elapsed},
+	}
+	if req.IsReplay {
+		entry.Comment = "Replay of " + req.ReplayOf
+	}
+
+	// The raw request has what the parsed capture lacks: the host, query string and cookies
+	if httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.EntireRequest))); err == nil {
+		u := url.URL{Scheme: "http", Host: httpReq.Host, Path: httpReq.URL.Path, RawQuery: httpReq.URL.RawQuery}
+		entry.Request.URL = u.String()
+		entry.Request.HTTPVersion = httpReq.Proto
+		entry.Request.Headers = append(entry.Request.Headers, harNVP{Name: "Host", Value: httpReq.Host})
+		for _, param := range strings.Split(httpReq.URL.RawQuery, "&") { // In order, unlike URL.Query
+			name, value, _ := strings.Cut(param, "=")
+			if name == "" {
+				continue
+			}
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if unescaped, err := url.QueryUnescape(value); err == nil {
+				value = unescaped
+			}
+			entry.Request.QueryString = append(entry.Request.QueryString, harNVP{Name: name, Value: value})
+		}
+		for _, cookie := range httpReq.Cookies() {
+			entry.Request.Cookies = append(entry.Request.Cookies, harCookie{Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+	if len(req.BodyData) > 0 {
+		entry.Request.PostData = &harPostData{MimeType: headerValue(req.Headers, "Content-Type"), Text: string(req.BodyData)}
+	}
+
+	responseHeader := http.Header{}
+	for _, header := range req.ResponseHeaders {
+		responseHeader.Add(header[0], header[1])
+	}
+	for _, cookie := range (&http.Response{Header: responseHeader}).Cookies() {
+		entry.Response.Cookies = append(entry.Response.Cookies, harCookie{
+			Name: cookie.Name, Value: cookie.Value, Path: cookie.Path, Domain: cookie.Domain,
+			HTTPOnly: cookie.HttpOnly, Secure: cookie.Secure,
+		})
+	}
+	entry.Response.RedirectURL = responseHeader.Get("Location")
+
+	// HAR content is the decoded body, bodySize stays what was received
+	content := req.ResponseData
+	if encoding := responseHeader.Get("Content-Encoding"); encoding != "" && len(content) > 0 {
+		if decoded, ok := decodeBody(content, encoding, req.ResponseTruncated > 0); ok {
+			content = decoded
+		}
+	}
+	contentType := responseHeader.Get("Content-Type")
+	entry.Response.Content = harContent{Size: len(content), Compression: max(len(content)-len(req.ResponseData), 0), MimeType: contentType}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); utf8.Valid(content) && mediaType != "application/octet-stream" {
+		entry.Response.Content.Text = string(content)
+	} else {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(content)
+		entry.Response.Content.Encoding = "base64"
+	}
+	return entry
+}
+
+func harHeaders(headers [][2]string) []harNVP {
+	nvps := make([]harNVP, 0, len(headers))
+	for _, header := range headers {
+		nvps = append(nvps, harNVP{Name: header[0], Value: header[1]})
+	}
+	return nvps
+}
+
+// headerValue returns the first value of a captured header
+func headerValue(headers [][2]string, name string) string {
+	for _, header := range headers {
+		if http.CanonicalHeaderKey(header[0]) == http.CanonicalHeaderKey(name) {
+			return header[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,207 @@
+package introspect
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// captureBucket holds the persisted requests, keyed by completion time then ID so the oldest come first
+var captureBucket = []byte("requests")
+
+const (
+	persistQueue = 1024 // Captured requests waiting to be written, more are only kept in memory
+	persistBatch = 128  // Most requests written in one transaction
+)
+
+// persistence writes captured requests to a bbolt file in the background, within the retention limits
+type persistence struct {
+	db       *bolt.DB
+	queue    chan *Request
+	done     chan struct{}
+	maxCount int           // 0 = no limit
+	maxAge   time.Duration // 0 = no limit
+	mu       sync.Mutex    // Guards count and serializes writes
+	count    int           // Requests in the file
+}
+
+// OpenStore backs the global request store with the bbolt file at path, so captures survive restarts.
+// The requests it holds are loaded and new ones are written to it, keeping the newest maxCount
+// no older than maxAge (0 = no limit).
+func OpenStore(path string, maxCount int, maxAge time.Duration) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create capture file directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("capture file %s is in use by another client", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %w", err)
+	}
+
+	p := &persistence{
+		db:       db,
+		queue:    make(chan *Request, persistQueue),
+		done:     make(chan struct{}),
+		maxCount: maxCount,
+		maxAge:   maxAge,
+	}
+	var loaded []*Request
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(captureBucket)
+		if err != nil {
+			return err
+		}
+		p.count = b.Stats().KeyN
+		if p.count, _, err = p.prune(b, p.count); err != nil {
+			return err
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var req Request
+			if json.Unmarshal(v, &req) == nil {
+				loaded = append(loaded, &req)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to load capture file: %w", err)
+	}
+
+	globalStore.mu.Lock()
+	for _, req := range loaded {
+		globalStore.insert(req) // Oldest first, so the ring keeps the newest
+	}
+	globalStore.persist = p
+	globalStore.mu.Unlock()
+
+	go p.run()
+	log.Info().Str("path", path).Int("requests", len(loaded)).Msg("Loaded captured requests")
+	return nil
+}
+
+// CloseStore writes the captured requests still queued and closes the capture file
+func CloseStore() {
+	globalStore.mu.Lock()
+	p := globalStore.persist
+	globalStore.persist = nil
+	globalStore.mu.Unlock()
+	if p == nil {
+		return
+	}
+	close(p.queue)
+	<-p.done
+	p.db.Close()
+}
+
+// captureKey orders requests by completion time, the ID keeps keys unique
+func captureKey(req *Request) []byte {
+	key := make([]byte, 8, 8+len(req.ID))
+	binary.BigEndian.PutUint64(key, uint64(req.Completed.UnixNano()))
+	return append(key, req.ID...)
+}
+
+// run writes queued requests in batches until the queue is closed
+func (p *persistence) run() {
+	defer close(p.done)
+	for req := range p.queue {
+		batch := []*Request{req}
+	drain:
+		for len(batch) < persistBatch {
+			select {
+			case more, ok := <-p.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, more)
+			default:
+				break drain
+			}
+		}
+		if err := p.write(batch); err != nil {
+			log.Warn().Err(err).Int("requests", len(batch)).Msg("Failed to persist captured requests")
+		}
+	}
+}
+
+// write stores a batch of requests and drops those past the retention limits, from memory too
+func (p *persistence) write(batch []*Request) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var count int
+	var removed []string
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(captureBucket)
+		count = p.count
+		for _, req := range batch {
+			data, err := json.Marshal(req)
+			if err != nil {
+				continue
+			}
+			if err := b.Put(captureKey(req), data); err != nil {
+				return err
+			}
+			count++
+		}
+		var err error
+		count, removed, err = p.prune(b, count)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	p.count = count
+	globalStore.remove(removed)
+	return nil
+}
+
+// prune drops the oldest requests past the retention limits, returning how many are left and the IDs dropped
+func (p *persistence) prune(b *bolt.Bucket, count int) (int, []string, error) {
+	var removed []string
+	cutoff := time.Now().Add(-p.maxAge).UnixNano()
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.First() {
+		overCount := p.maxCount > 0 && count > p.maxCount
+		tooOld := p.maxAge > 0 && len(k) >= 8 && int64(binary.BigEndian.Uint64(k)) < cutoff
+		if !overCount && !tooOld {
+			break
+		}
+		if len(k) > 8 {
+			removed = append(removed, string(k[8:]))
+		}
+		if err := c.Delete(); err != nil {
+			return count, removed, err
+		}
+		count--
+	}
+	return count, removed, nil
+}
+
+// clear empties the capture file
+func (p *persistence) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(captureBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(captureBucket)
+		return err
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to clear capture file")
+		return
+	}
+	p.count = 0
+}
@@ -0,0 +1,77 @@
+package introspect
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// replayForm is a captured request as the edit and replay form shows it
+type replayForm struct {
+	Method  string
+	Target  string // Path and query
+	Headers string // One "Name: value" per line, in the order the local server got them
+	Body    string
+	// Browsers send textarea line breaks as CRLF: bodies that had bare LFs get them back
+	LFBody bool
+}
+
+// editableRequest fills the replay form from a captured request
+func editableRequest(req *Request) replayForm {
+	form := replayForm{Method: req.Method, Target: req.Path, Body: string(req.BodyData)}
+	form.LFBody = !bytes.Contains(req.BodyData, []byte("\r\n"))
+	head, _, _ := bytes.Cut(req.EntireRequest, []byte("\r\n\r\n"))
+	lines := strings.Split(string(head), "\r\n")
+	if fields := strings.Fields(lines[0]); len(fields) == 3 {
+		form.Target = fields[1]
+	}
+	var headers []string
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+			continue // Set from the body when the request is rebuilt
+		}
+		headers = append(headers, line)
+	}
+	form.Headers = strings.Join(headers, "\n")
+	return form
+}
+
+// buildRequest rebuilds a raw HTTP/1.1 request from the replay form, with a Content-Length for the body
+func buildRequest(form replayForm) ([]byte, error) {
+	method := strings.TrimSpace(form.Method)
+	if method == "" || strings.ContainsAny(method, " \t") {
+		return nil, fmt.Errorf("invalid method %q", form.Method)
+	}
+	target := strings.TrimSpace(form.Target)
+	if !strings.HasPrefix(target, "/") || strings.ContainsAny(target, " \t") {
+		return nil, fmt.Errorf("invalid path %q: it must start with / and have no spaces", form.Target)
+	}
+
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "%s %s HTTP/1.1\r\n", method, target)
+	for _, line := range strings.Split(form.Headers, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header line %q: use Name: value", line)
+		}
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+			continue
+		}
+		fmt.Fprintf(&raw, "%s: %s\r\n", name, strings.TrimSpace(value))
+	}
+	if form.LFBody {
+		form.Body = strings.ReplaceAll(form.Body, "\r\n", "\n")
+	}
+	if len(form.Body) > 0 || method == "POST" || method == "PUT" || method == "PATCH" {
+		fmt.Fprintf(&raw, "Content-Length: %d\r\n", len(form.Body))
+	}
+	raw.WriteString("\r\n")
+	raw.WriteString(form.Body)
+	return raw.Bytes(), nil
+}
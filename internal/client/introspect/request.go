@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 )
 
 // Request represents a captured HTTP request/response pair
@@ -22,9 +23,22 @@ type Request struct {
 	BodyData        []byte
 	ResponseHeaders [][2]string
 	ResponseData    []byte
-	Started         time.Time
-	Completed       time.Time
-	EntireRequest   []byte
+	// Bytes of the request and response past the client's capture limit, not captured
+	BodyTruncated     int64
+	ResponseTruncated int64
+	Started           time.Time
+	Completed         time.Time
+	EntireRequest     []byte
+	Webhook           *WebhookCheck // Signature check of a webhook delivery (nil when not checked)
+	Tunnel            string        // Name of the tunnel the request came in on ("" for an unnamed tunnel)
+	LocalAddr         string        // The local server the request went to ("" when it never reached one)
+	ReplayOf          string        // ID of the captured request this one replays
+}
+
+// WebhookCheck is the result of checking a webhook delivery's signature
+type WebhookCheck struct {
+	Provider string // stripe, github or shopify
+	Error    string // Why the signature is invalid (empty when valid)
 }
 
 // Elapsed returns the duration of the request as a formatted string
@@ -38,12 +52,21 @@ func (r *Request) Elapsed() string {
 
 // RequestStore holds captured requests in memory
 type RequestStore struct {
-	mu       sync.RWMutex
-	requests map[string]*Request
+	mu          sync.RWMutex
+	requests    map[string]*Request
+	subscribers map[chan *Request]struct{} // Live views, sent each request as it is added
+	persist     *persistence               // Capture file the requests are also written to (nil = memory only)
+	// Ring of the kept requests' IDs, the oldest is evicted when a new one takes its slot (nil = unlimited)
+	ring []string
+	next int
 }
 
+// subscriberBuffer bounds the requests queued for a slow subscriber, more are dropped
+const subscriberBuffer = 64
+
 var globalStore = &RequestStore{
-	requests: make(map[string]*Request),
+	requests:    make(map[string]*Request),
+	subscribers: make(map[chan *Request]struct{}),
 }
 
 // GetStore returns the global request store
@@ -51,11 +74,49 @@ func GetStore() *RequestStore {
 	return globalStore
 }
 
+// SetLimit keeps only the newest n requests in memory, evicting the oldest (0 = unlimited)
+// It is set before requests are captured, the store is emptied
+func (rs *RequestStore) SetLimit(n int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.requests = make(map[string]*Request)
+	rs.ring, rs.next = nil, 0
+	if n > 0 {
+		rs.ring = make([]string, n)
+	}
+}
+
 // Add adds a request to the store
 func (rs *RequestStore) Add(req *Request) {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
-	rs.requests[req.ID] = req
+	rs.insert(req)
+	if rs.persist != nil {
+		select {
+		case rs.persist.queue <- req:
+		default:
+			log.Warn().Str("id", req.ID).Msg("Capture file writes are behind, request kept in memory only")
+		}
+	}
+	for sub := range rs.subscribers {
+		select {
+		case sub <- req:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving each request added from now on, and a function ending the subscription
+func (rs *RequestStore) Subscribe() (<-chan *Request, func()) {
+	sub := make(chan *Request, subscriberBuffer)
+	rs.mu.Lock()
+	rs.subscribers[sub] = struct{}{}
+	rs.mu.Unlock()
+	return sub, func() {
+		rs.mu.Lock()
+		delete(rs.subscribers, sub)
+		rs.mu.Unlock()
+	}
 }
 
 // Get retrieves a request by ID
@@ -78,22 +139,74 @@ func (rs *RequestStore) GetAll() []*Request {
 	return requests
 }
 
-// Clear removes all requests
-func (rs *RequestStore) Clear() {
+// insert keeps req in memory, evicting the oldest request when the ring is full
+func (rs *RequestStore) insert(req *Request) {
+	if rs.ring != nil {
+		if oldest := rs.ring[rs.next]; oldest != "" {
+			delete(rs.requests, oldest)
+		}
+		rs.ring[rs.next] = req.ID
+		rs.next = (rs.next + 1) % len(rs.ring)
+	}
+	rs.requests[req.ID] = req
+}
+
+// remove drops requests by ID
+func (rs *RequestStore) remove(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
+	for _, id := range ids {
+		delete(rs.requests, id)
+	}
+}
+
+// Clear removes all requests, from the capture file too
+func (rs *RequestStore) Clear() {
+	rs.mu.Lock()
 	rs.requests = make(map[string]*Request)
+	if rs.ring != nil {
+		rs.ring, rs.next = make([]string, len(rs.ring)), 0
+	}
+	p := rs.persist
+	rs.mu.Unlock()
+	if p != nil {
+		p.clear()
+	}
 }
 
 // CaptureStream captures HTTP request and response data from raw bytes
-func CaptureStream(requestData, responseData []byte) {
+// Either may be cut short by the capture limit, with the bytes left out counted in the truncated sizes
+// webhook labels webhook deliveries with their signature check (nil for other requests)
+func CaptureStream(requestData, responseData []byte, requestTruncated, responseTruncated int64, webhook *WebhookCheck, tunnel, localAddr string) {
+	req, ok := parseExchange(requestData, responseData)
+	if !ok {
+		return // Silently ignore unparseable requests
+	}
+	req.BodyTruncated = requestTruncated
+	req.ResponseTruncated = responseTruncated
+	req.Webhook = webhook
+	req.Tunnel = tunnel
+	req.LocalAddr = localAddr
+
+	// Store the request
+	GetStore().Add(req)
+
+	// Log to console
+	ConsoleLog(req.Method, req.Path, req.Status)
+}
+
+// parseExchange builds a request record from a raw request and response
+func parseExchange(requestData, responseData []byte) (*Request, bool) {
 	started := time.Now()
 
 	// Parse request
 	reqReader := bufio.NewReader(bytes.NewReader(requestData))
 	httpReq, err := http.ReadRequest(reqReader)
 	if err != nil {
-		return // Silently ignore unparseable requests
+		return nil, false
 	}
 
 	// Read request body
@@ -138,8 +251,7 @@ func CaptureStream(requestData, responseData []byte) {
 		}
 	}
 
-	// Create request record
-	req := &Request{
+	return &Request{
 		ID:              uuid.New().String(),
 		Status:          status,
 		IsReplay:        false,
@@ -152,11 +264,5 @@ func CaptureStream(requestData, responseData []byte) {
 		Started:         started,
 		Completed:       time.Now(),
 		EntireRequest:   requestData,
-	}
-
-	// Store the request
-	GetStore().Add(req)
-
-	// Log to console
-	ConsoleLog(httpReq.Method, httpReq.URL.Path, status)
+	}, true
 }
@@ -0,0 +1,239 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxIdleLocalConns = 16               // Idle keep-alive connections kept per local address
+	localIdleTimeout  = 30 * time.Second // Idle connections older than this are closed rather than reused
+	maxFramingLine    = 4096             // Longest chunk-size or trailer line followed
+)
+
+// localConn is a connection to a local server at addr, which goes back to the pool
+// once its exchange completes with keep-alive
+type localConn struct {
+	net.Conn
+	addr  string
+	since time.Time // When it went idle
+}
+
+// localPool keeps idle keep-alive connections to the local servers, newest first per address
+type localPool struct {
+	mutex sync.Mutex
+	idle  map[string][]*localConn
+}
+
+func newLocalPool() *localPool {
+	return &localPool{idle: make(map[string][]*localConn)}
+}
+
+// get returns an idle connection to addr that is still open, or nil
+func (p *localPool) get(addr string) *localConn {
+	for {
+		p.mutex.Lock()
+		conns := p.idle[addr]
+		if len(conns) == 0 {
+			p.mutex.Unlock()
+			return nil
+		}
+		conn := conns[len(conns)-1]
+		p.idle[addr] = conns[:len(conns)-1]
+		p.mutex.Unlock()
+
+		if time.Since(conn.since) < localIdleTimeout && isOpen(conn) {
+			return conn
+		}
+		conn.Close()
+	}
+}
+
+// put keeps conn for the next request to its address, closing it if the pool is full
+func (p *localPool) put(conn *localConn) {
+	conn.SetDeadline(time.Time{})
+	conn.since = time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.idle[conn.addr]) >= maxIdleLocalConns {
+		conn.Close()
+		return
+	}
+	p.idle[conn.addr] = append(p.idle[conn.addr], conn)
+}
+
+// closeAll closes every idle connection
+func (p *localPool) closeAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for addr, conns := range p.idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
+
+// isOpen reports whether an idle connection is still open: a local server that closed it
+// answers a read with EOF right away, one keeping it open makes the read time out
+func isOpen(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// States of a message's framing
+const (
+	framingHead       = iota
+	framingLength     // In a body of known length
+	framingChunkSize  // In a chunk-size line
+	framingChunkData  // In a chunk's data
+	framingChunkEnd   // In the CRLF after a chunk's data
+	framingTrailer    // In the trailer, until an empty line
+	framingDone       // The message is complete
+	framingUntilClose // The message ends when the connection closes
+)
+
+// messageFraming follows the framing of an HTTP/1.x request or response as it passes,
+// to tell where it ends so the local connection can carry the next exchange
+type messageFraming struct {
+	request   bool
+	method    string // Of the request a response answers, HEAD responses have no body
+	state     int
+	buf       []byte // The head so far, or a partial chunk-size or trailer line
+	remaining int64  // Bytes left in the body or chunk
+	keepAlive bool   // Whether the message allows reusing the connection
+	extra     bool   // Bytes arrived past the end of the message
+}
+
+// feed follows data through the message and reports whether it is complete
+func (f *messageFraming) feed(data []byte) bool {
+	for len(data) > 0 {
+		switch f.state {
+		case framingHead:
+			f.buf = append(f.buf, data...)
+			end := bytes.Index(f.buf, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(f.buf) > maxResponseHeadBytes {
+					f.untilClose()
+				}
+				return false
+			}
+			data = f.buf[end+4:]
+			head := f.buf[:end+4]
+			f.buf = nil
+			f.parseHead(head)
+
+		case framingLength, framingChunkData, framingChunkEnd:
+			n := min(int64(len(data)), f.remaining)
+			f.remaining -= n
+			data = data[n:]
+			if f.remaining > 0 {
+				break
+			}
+			switch f.state {
+			case framingLength:
+				f.state = framingDone
+			case framingChunkData:
+				f.state, f.remaining = framingChunkEnd, 2
+			case framingChunkEnd:
+				f.state = framingChunkSize
+			}
+
+		case framingChunkSize, framingTrailer:
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				f.buf = append(f.buf, data...)
+				if len(f.buf) > maxFramingLine {
+					f.untilClose()
+				}
+				return false
+			}
+			line := strings.TrimSpace(string(append(f.buf, data[:i]...)))
+			f.buf = nil
+			data = data[i+1:]
+			if f.state == framingTrailer {
+				if line == "" {
+					f.state = framingDone
+				}
+				break
+			}
+			sizeField, _, _ := strings.Cut(line, ";")
+			size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+			switch {
+			case err != nil || size < 0:
+				f.untilClose()
+			case size == 0:
+				f.state = framingTrailer
+			default:
+				f.state, f.remaining = framingChunkData, size
+			}
+
+		case framingDone:
+			f.extra = true
+			return true
+
+		case framingUntilClose:
+			return false
+		}
+	}
+	return f.state == framingDone
+}
+
+// parseHead sets the body's framing from a complete head
+func (f *messageFraming) parseHead(head []byte) {
+	reader := bufio.NewReader(bytes.NewReader(head))
+	var length int64
+	var chunked, close, http11 bool
+	if f.request {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			f.untilClose()
+			return
+		}
+		f.method = req.Method
+		length, chunked, close, http11 = req.ContentLength, len(req.TransferEncoding) > 0, req.Close, req.ProtoAtLeast(1, 1)
+	} else {
+		resp, err := http.ReadResponse(reader, &http.Request{Method: f.method})
+		if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+			f.untilClose()
+			return
+		}
+		if resp.StatusCode < 200 {
+			return // Interim response (100 Continue), the real one follows
+		}
+		length, chunked, close, http11 = resp.ContentLength, len(resp.TransferEncoding) > 0, resp.Close, resp.ProtoAtLeast(1, 1)
+		if f.method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+			length, chunked = 0, false
+		}
+	}
+
+	f.keepAlive = http11 && !close
+	switch {
+	case chunked:
+		f.state = framingChunkSize
+	case length == 0:
+		f.state = framingDone
+	case length > 0:
+		f.state, f.remaining = framingLength, length
+	default:
+		f.untilClose()
+	}
+}
+
+func (f *messageFraming) untilClose() {
+	f.state = framingUntilClose
+	f.keepAlive = false
+	f.buf = nil
+}
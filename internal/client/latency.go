@@ -0,0 +1,72 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sombochea/tungo/pkg/config"
+)
+
+// probeTimeout bounds each server's latency probe; servers that don't answer in time count as unreachable
+const probeTimeout = 2 * time.Second
+
+// probeLatency measures how long a TCP connection to each server takes, concurrently (-1 when unreachable)
+func probeLatency(servers []config.ServerNode) []time.Duration {
+	rtts := make([]time.Duration, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(server.Host, strconv.Itoa(server.Port)), probeTimeout)
+			if err != nil {
+				rtts[i] = -1
+				return
+			}
+			rtts[i] = time.Since(start)
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	return rtts
+}
+
+// SelectFastestServer probes the cluster's servers and makes the best one current: the nearest by
+// region and zone, then the one with the lowest round-trip time. With skipCurrent (on failover)
+// the current server is left out. It returns false if no server answered.
+func (tc *TunnelClient) SelectFastestServer(skipCurrent bool) bool {
+	rtts := probeLatency(tc.serverList)
+	best := -1
+	for i, server := range tc.serverList {
+		if rtts[i] < 0 || (skipCurrent && i == tc.currentServerIdx) {
+			continue
+		}
+		tc.logger.Debug().
+			Str("server", fmt.Sprintf("%s:%d", server.Host, server.Port)).
+			Dur("rtt", rtts[i]).
+			Msg("Probed server latency")
+		if best >= 0 {
+			proximity := serverProximity(server.Region, server.Zone, tc.config.Region, tc.config.Zone)
+			bestProximity := serverProximity(tc.serverList[best].Region, tc.serverList[best].Zone, tc.config.Region, tc.config.Zone)
+			if proximity > bestProximity || (proximity == bestProximity && rtts[i] >= rtts[best]) {
+				continue
+			}
+		}
+		best = i
+	}
+	if best < 0 {
+		return false
+	}
+
+	tc.currentServerIdx = best
+	tc.logger.Info().
+		Str("server", fmt.Sprintf("%s:%d", tc.serverList[best].Host, tc.serverList[best].Port)).
+		Str("region", tc.serverList[best].Region).
+		Dur("rtt", rtts[best]).
+		Msg("Selected fastest server")
+	return true
+}
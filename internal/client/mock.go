@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sombochea/tungo/pkg/config"
+)
+
+// plainResponse builds a raw HTTP response with a plain text body
+func plainResponse(status int, body string) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"%s", status, http.StatusText(status), len(body), body)
+}
+
+// findMock returns the first mock rule matching a request, or nil
+func findMock(mocks []config.MockRuleConfig, method, target string) *config.MockRuleConfig {
+	requestPath, _, _ := strings.Cut(target, "?")
+	for i, mock := range mocks {
+		if mock.Method != "" && !strings.EqualFold(mock.Method, method) {
+			continue
+		}
+		matched := requestPath == mock.Path
+		if strings.Contains(mock.Path, "*") {
+			matched, _ = path.Match(mock.Path, requestPath)
+		}
+		if matched {
+			return &mocks[i]
+		}
+	}
+	return nil
+}
+
+// mockResponse builds the raw HTTP response of a mock rule, with its status
+func mockResponse(mock *config.MockRuleConfig) (string, int, error) {
+	status := mock.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := mock.Body
+	contentType := "text/plain; charset=utf-8"
+	if mock.BodyFile != "" {
+		data, err := os.ReadFile(mock.BodyFile)
+		if err != nil {
+			return "", 0, err
+		}
+		body = string(data)
+		if byExtension := mime.TypeByExtension(filepath.Ext(mock.BodyFile)); byExtension != "" {
+			contentType = byExtension
+		}
+	}
+
+	headers := map[string]string{"Content-Type": contentType}
+	for name, value := range mock.Headers {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	headers["Content-Length"] = fmt.Sprintf("%d", len(body))
+	headers["Connection"] = "close"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, headers[name])
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return b.String(), status, nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitedResponse answers visitors over the tunnel's rate limit without reaching the local server
+const rateLimitedResponse = "HTTP/1.1 429 Too Many Requests\r\n" +
+	"Retry-After: 1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Length: 18\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"Too many requests\n"
+
+// rateLimiter is a token bucket allowing count streams per period, all of them in a burst
+type rateLimiter struct {
+	capacity float64
+	rate     float64 // Tokens per second
+	tokens   float64
+	lastFill time.Time
+	mutex    sync.Mutex
+}
+
+// newRateLimiter creates a rate limiter for count streams per period (nil, i.e. unlimited, if count is not positive)
+func newRateLimiter(count int, period time.Duration) *rateLimiter {
+	if count <= 0 || period <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		capacity: float64(count),
+		rate:     float64(count) / period.Seconds(),
+		tokens:   float64(count),
+		lastFill: time.Now(),
+	}
+}
+
+// allow consumes a token if one is available
+func (rl *rateLimiter) allow() bool {
+	if rl == nil {
+		return true
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	rl.tokens += now.Sub(rl.lastFill).Seconds() * rl.rate
+	if rl.tokens > rl.capacity {
+		rl.tokens = rl.capacity
+	}
+	rl.lastFill = now
+
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sombochea/tungo/internal/client/introspect"
+)
+
+// replayTimeout bounds a replayed request's round trip to the local server
+const replayTimeout = 30 * time.Second
+
+// Replay sends a request captured by the dashboard to the local server it went to, and returns the
+// raw response cut short at the capture limit. The capture holds the request as the local server saw
+// it, with the Host and header rules already applied, so it is written as-is.
+func (tc *TunnelClient) Replay(req *introspect.Request) ([]byte, int64, error) {
+	if req.BodyTruncated > 0 {
+		return nil, 0, fmt.Errorf("the request body was not captured whole (%d bytes over the capture limit)", req.BodyTruncated)
+	}
+
+	tunnel := tc.tunnelNamed(req.Tunnel)
+	var conn net.Conn
+	var err error
+	if req.LocalAddr != "" {
+		conn, err = tc.dialUpstream(tunnel, req.LocalAddr)
+	} else {
+		conn, err = tc.dialLocal(tunnel)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to connect to local server: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(replayTimeout))
+	if _, err := conn.Write(req.EntireRequest); err != nil {
+		return nil, 0, fmt.Errorf("failed to write to local server: %w", err)
+	}
+
+	// Read until the response's framing says it is complete, or the local server closes
+	var response []byte
+	var truncated int64
+	framing := &messageFraming{method: req.Method}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		keep := buf[:n]
+		if limit := tc.config.CaptureLimit; limit > 0 && int64(len(response)+n) > limit {
+			keep = buf[:max(limit-int64(len(response)), 0)]
+		}
+		response = append(response, keep...)
+		truncated += int64(n - len(keep))
+		if framing.feed(buf[:n]) || errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read from local server: %w", err)
+		}
+	}
+	if len(response) == 0 {
+		return nil, 0, errors.New("the local server closed the connection without a response")
+	}
+	return response, truncated, nil
+}
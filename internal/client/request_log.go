@@ -0,0 +1,175 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Request log formats
+const (
+	RequestLogJSON = "json" // One JSON object per request
+	RequestLogCLF  = "clf"  // Common Log Format, as written by web servers
+)
+
+// RequestEntry describes one request served through a tunnel, for the request log and request handlers
+type RequestEntry struct {
+	Time      time.Time
+	Tunnel    string
+	SubDomain string
+	RequestID string
+	VisitorIP string
+	Method    string
+	Path      string
+	Proto     string
+	Status    int
+	BytesIn   int64 // Request bytes written to the local server
+	BytesOut  int64 // Response bytes read from it
+	Latency   time.Duration
+}
+
+// RequestLog writes one line per request to a file, rotating it once it grows past a size
+type RequestLog struct {
+	format string
+	file   *rotatingFile
+	json   zerolog.Logger
+}
+
+// NewRequestLog opens path for a request log in format, keeping maxBackups rotated files
+// of up to maxSize bytes each (maxSize 0 never rotates)
+func NewRequestLog(path, format string, maxSize int64, maxBackups int) (*RequestLog, error) {
+	if format != RequestLogJSON && format != RequestLogCLF {
+		return nil, fmt.Errorf("invalid request log format: %s (must be json or clf)", format)
+	}
+	file, err := openRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestLog{
+		format: format,
+		file:   file,
+		json:   zerolog.New(file),
+	}, nil
+}
+
+// log writes an entry (no-op on a nil log)
+func (rl *RequestLog) log(entry RequestEntry) {
+	if rl == nil {
+		return
+	}
+
+	if rl.format == RequestLogCLF {
+		visitorIP := entry.VisitorIP
+		if visitorIP == "" {
+			visitorIP = "-"
+		}
+		proto := entry.Proto
+		if proto == "" {
+			proto = "HTTP/1.1"
+		}
+		fmt.Fprintf(rl.file, "%s - - [%s] \"%s %s %s\" %d %d\n",
+			visitorIP, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method, entry.Path, proto, entry.Status, entry.BytesOut)
+		return
+	}
+
+	event := rl.json.Log().
+		Time("time", entry.Time).
+		Str("subdomain", entry.SubDomain).
+		Str("request_id", entry.RequestID).
+		Str("visitor_ip", entry.VisitorIP).
+		Str("method", entry.Method).
+		Str("path", entry.Path).
+		Int("status", entry.Status).
+		Int64("bytes_in", entry.BytesIn).
+		Int64("bytes_out", entry.BytesOut).
+		Float64("latency_ms", float64(entry.Latency.Microseconds())/1000)
+	if entry.Tunnel != "" {
+		event = event.Str("tunnel", entry.Tunnel)
+	}
+	event.Send()
+}
+
+// Close closes the log file
+func (rl *RequestLog) Close() error {
+	if rl == nil {
+		return nil
+	}
+	return rl.file.Close()
+}
+
+// rotatingFile appends to a file, renaming it to path.1 (and older ones to path.2, ...) once it reaches maxSize
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	mutex      sync.Mutex
+}
+
+var _ io.Writer = (*rotatingFile)(nil)
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open request log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open request log file: %w", err)
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if it would take the file past maxSize
+// Each log line is written in one call, so lines never straddle files
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups along, dropping the oldest, and starts a new file (caller holds the lock)
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	if rf.maxBackups <= 0 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		os.Rename(rf.path, rf.path+".1")
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.file.Close()
+}
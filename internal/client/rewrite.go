@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sombochea/tungo/pkg/config"
+)
+
+// maxRewriteBytes bounds the HTML responses held back to rewrite their local URLs
+// Larger ones only get their headers rewritten
+const maxRewriteBytes = 4 << 20
+
+// identityEncoding asks local servers for uncompressed responses, so HTML bodies can be rewritten
+var identityEncoding = config.HeaderRules{Remove: []string{"Accept-Encoding"}}
+
+// localURLPattern matches absolute and protocol-relative URLs of a tunnel's local server:
+// http://localhost:3000, https://127.0.0.1:3000 or //localhost:3000, on any of its local ports
+func localURLPattern(tunnel config.TunnelConfig) *regexp.Regexp {
+	hosts := []string{"localhost", "127.0.0.1", "[::1]", "0.0.0.0"}
+	if tunnel.LocalHost != "" && tunnel.LocalHost != "localhost" {
+		hosts = append(hosts, tunnel.LocalHost)
+	}
+	for i, host := range hosts {
+		hosts[i] = regexp.QuoteMeta(host)
+	}
+	var ports []string
+	for _, port := range append([]int{tunnel.LocalPort}, tunnel.LocalPorts...) {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return regexp.MustCompile(`(?i)(https?:)?//(` + strings.Join(hosts, "|") + `):(` + strings.Join(ports, "|") + `)\b`)
+}
+
+// rewriteLocalURLs replaces the tunnel's local URLs in data with its public URL
+func rewriteLocalURLs(data []byte, tunnel *Tunnel) []byte {
+	publicURL, err := url.Parse(tunnel.PublicURL())
+	if err != nil || publicURL.Host == "" {
+		return data
+	}
+	origin := []byte(publicURL.Scheme + "://" + publicURL.Host)
+	relative := []byte("//" + publicURL.Host)
+	return tunnel.localURLs.ReplaceAllFunc(data, func(match []byte) []byte {
+		if bytes.HasPrefix(match, []byte("//")) {
+			return relative
+		}
+		return origin
+	})
+}
+
+// rewriteResponse rewrites the local URLs in a response, which data holds from its start
+// It returns false while more of the response is needed: the rest of the head, or the rest of
+// an HTML body (uncompressed, of a known length, up to maxRewriteBytes)
+func rewriteResponse(data []byte, method string, tunnel *Tunnel) ([]byte, bool) {
+	if !bytes.HasPrefix(data, []byte("HTTP/")) && !bytes.HasPrefix([]byte("HTTP/"), data) {
+		return data, true // Not HTTP, e.g. an upgraded connection
+	}
+	headEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headEnd < 0 {
+		if len(data) < maxResponseHeadBytes {
+			return data, false
+		}
+		return data, true
+	}
+	head, body := data[:headEnd+4], data[headEnd+4:]
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), &http.Request{Method: method})
+	if err != nil {
+		return data, true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	chunked := len(resp.TransferEncoding) > 0
+	if mediaType != "text/html" || method == http.MethodHead || resp.Header.Get("Content-Encoding") != "" ||
+		(resp.ContentLength < 0 && !chunked) || resp.ContentLength > maxRewriteBytes {
+		return append(rewriteLocalURLs(head, tunnel), body...), true
+	}
+
+	whole, err := io.ReadAll(resp.Body)
+	if errors.Is(err, io.ErrUnexpectedEOF) && len(data) < maxRewriteBytes {
+		return data, false
+	}
+	if err != nil {
+		return append(rewriteLocalURLs(head, tunnel), body...), true
+	}
+
+	// The body changes length: drop the framing headers for a Content-Length of the rewritten body
+	whole = rewriteLocalURLs(whole, tunnel)
+	var rewritten bytes.Buffer
+	lines := strings.Split(string(rewriteLocalURLs(head[:headEnd], tunnel)), "\r\n")
+	for _, line := range lines {
+		name, _, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+			continue
+		}
+		rewritten.WriteString(line + "\r\n")
+	}
+	fmt.Fprintf(&rewritten, "Content-Length: %d\r\n\r\n", len(whole))
+	rewritten.Write(whole)
+	return rewritten.Bytes(), true
+}
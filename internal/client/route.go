@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sombochea/tungo/pkg/config"
+)
+
+// localRoute is a path route of a tunnel, resolved to its target's address
+type localRoute struct {
+	prefix string // Without a trailing slash ("" for a route of /)
+	addr   string
+	strip  bool
+}
+
+// newRoutes resolves a tunnel's path routes, longest prefix first
+func newRoutes(tunnel config.TunnelConfig) []*localRoute {
+	routes := make([]*localRoute, 0, len(tunnel.Routes))
+	for _, route := range tunnel.Routes {
+		host := route.LocalHost
+		if host == "" {
+			host = tunnel.LocalHost
+		}
+		routes = append(routes, &localRoute{
+			prefix: strings.TrimSuffix(route.Path, "/"),
+			addr:   net.JoinHostPort(host, strconv.Itoa(route.LocalPort)),
+			strip:  route.StripPrefix,
+		})
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	return routes
+}
+
+// findRoute returns the route for a request target, or nil for the tunnel's own local server
+func findRoute(routes []*localRoute, target string) *localRoute {
+	requestPath, _, _ := strings.Cut(target, "?")
+	for _, route := range routes {
+		if requestPath == route.prefix || strings.HasPrefix(requestPath, route.prefix+"/") {
+			return route
+		}
+	}
+	return nil
+}
+
+// stripRoutePrefix removes the route's prefix from the request line at the start of data
+func stripRoutePrefix(data []byte, prefix string) []byte {
+	start := bytes.IndexByte(data, ' ') + 1
+	if start == 0 || !bytes.HasPrefix(data[start:], []byte(prefix)) {
+		return data
+	}
+	rest := data[start+len(prefix):]
+	stripped := make([]byte, 0, len(data))
+	stripped = append(stripped, data[:start]...)
+	if len(rest) == 0 || rest[0] != '/' {
+		stripped = append(stripped, '/') // /api?x=1 becomes /?x=1
+	}
+	return append(stripped, rest...)
+}
+
+// routedConn is the local connection of a stream on a tunnel with path routes, which can
+// only be dialed once the request line is in. Until then reads fail and deadlines are ignored.
+type routedConn struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+var _ net.Conn = (*routedConn)(nil)
+
+// connect sets the connection to the route's target, closing it if the stream already ended
+func (c *routedConn) connect(conn net.Conn) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		conn.Close()
+		return net.ErrClosed
+	}
+	c.conn = conn
+	return nil
+}
+
+func (c *routedConn) current() net.Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn
+}
+
+func (c *routedConn) Read(p []byte) (int, error) {
+	if conn := c.current(); conn != nil {
+		return conn.Read(p)
+	}
+	return 0, net.ErrClosed
+}
+
+func (c *routedConn) Write(p []byte) (int, error) {
+	if conn := c.current(); conn != nil {
+		return conn.Write(p)
+	}
+	return 0, net.ErrClosed
+}
+
+func (c *routedConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+func (c *routedConn) LocalAddr() net.Addr {
+	if conn := c.current(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *routedConn) RemoteAddr() net.Addr {
+	if conn := c.current(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *routedConn) SetDeadline(t time.Time) error {
+	if conn := c.current(); conn != nil {
+		return conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *routedConn) SetReadDeadline(t time.Time) error {
+	if conn := c.current(); conn != nil {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *routedConn) SetWriteDeadline(t time.Time) error {
+	if conn := c.current(); conn != nil {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
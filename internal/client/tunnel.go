@@ -0,0 +1,125 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sombochea/tungo/pkg/config"
+	"github.com/sombochea/tungo/pkg/protocol"
+)
+
+// Tunnel is one local service exposed over the client's connection
+type Tunnel struct {
+	config     config.TunnelConfig
+	serverInfo *protocol.ServerHello // The server's answer for this tunnel on the last connection
+	requests   int64                 // Streams served since the client started (atomic)
+	active     int64                 // Streams in flight (atomic)
+	bytesIn    int64                 // Bytes written to the local service (atomic)
+	bytesOut   int64                 // Bytes read from the local service (atomic)
+	limiter    *rateLimiter          // Throttles streams to the local server (nil = unlimited)
+	webhook    *webhookVerifier      // Checks webhook signatures (nil = none)
+	upstreams  *upstreamPool         // The local instances streams are spread over
+	routes     []*localRoute         // Path prefixes served by other local targets, longest first
+	localURLs  *regexp.Regexp        // Matches the local server's URLs, with rewrite_urls (nil = off)
+}
+
+// newTunnels creates the tunnels configured for a client
+func newTunnels(cfg *config.ClientConfig) []*Tunnel {
+	configs := cfg.TunnelList()
+	tunnels := make([]*Tunnel, len(configs))
+	for i, tunnelConfig := range configs {
+		count, period, _ := config.ParseRateLimit(tunnelConfig.RateLimit) // Checked by Validate
+		ports := append([]int{tunnelConfig.LocalPort}, tunnelConfig.LocalPorts...)
+		tunnels[i] = &Tunnel{
+			config:    tunnelConfig,
+			limiter:   newRateLimiter(count, period),
+			webhook:   newWebhookVerifier(tunnelConfig.WebhookVerify),
+			upstreams: newUpstreamPool(tunnelConfig.LocalHost, ports),
+			routes:    newRoutes(tunnelConfig),
+		}
+		if cfg.RewriteURLs {
+			tunnels[i].localURLs = localURLPattern(tunnelConfig)
+		}
+	}
+	return tunnels
+}
+
+// Name returns the tunnel's name from the tunnels list ("" for the single tunnel of a plain config)
+func (t *Tunnel) Name() string {
+	return t.config.Name
+}
+
+// LocalAddr returns the address of the local service (its first instance with local_ports)
+func (t *Tunnel) LocalAddr() string {
+	return net.JoinHostPort(t.config.LocalHost, fmt.Sprintf("%d", t.config.LocalPort))
+}
+
+// LocalURL returns the local service's address with the tunnel's scheme
+func (t *Tunnel) LocalURL() string {
+	if t.config.Protocol == protocol.ProtocolTCP {
+		return "tcp://" + t.LocalAddr()
+	}
+	if t.config.LocalScheme == "https" {
+		return "https://" + t.LocalAddr()
+	}
+	return "http://" + t.LocalAddr()
+}
+
+// hostHeader returns the Host to send the local server at addr, or "" to keep the visitor's
+func (t *Tunnel) hostHeader(addr string) string {
+	switch {
+	case t.config.HostHeader == "rewrite":
+		return addr
+	case strings.HasPrefix(t.config.HostHeader, "custom:"):
+		return strings.TrimPrefix(t.config.HostHeader, "custom:")
+	default:
+		return ""
+	}
+}
+
+// SubDomain returns the subdomain the server assigned, or the requested one before the first connection
+func (t *Tunnel) SubDomain() string {
+	if t.serverInfo != nil && t.serverInfo.SubDomain != "" {
+		return t.serverInfo.SubDomain
+	}
+	return t.config.SubDomain
+}
+
+// ServerInfo returns the server's answer for this tunnel (nil before the first connection)
+func (t *Tunnel) ServerInfo() *protocol.ServerHello {
+	return t.serverInfo
+}
+
+// PublicURL returns the tunnel's public URL, falling back to its hostname
+func (t *Tunnel) PublicURL() string {
+	if t.serverInfo == nil {
+		return ""
+	}
+	if t.serverInfo.PublicURL != "" {
+		return t.serverInfo.PublicURL
+	}
+	return fmt.Sprintf("http://%s", t.serverInfo.Hostname)
+}
+
+// Requests returns how many streams the tunnel has served
+func (t *Tunnel) Requests() int64 {
+	return atomic.LoadInt64(&t.requests)
+}
+
+// ActiveStreams returns the tunnel's streams in flight
+func (t *Tunnel) ActiveStreams() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+// BytesIn returns how many bytes visitors have sent the local service through the tunnel
+func (t *Tunnel) BytesIn() int64 {
+	return atomic.LoadInt64(&t.bytesIn)
+}
+
+// BytesOut returns how many bytes the local service has sent back through the tunnel
+func (t *Tunnel) BytesOut() int64 {
+	return atomic.LoadInt64(&t.bytesOut)
+}
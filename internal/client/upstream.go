@@ -0,0 +1,63 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamRetryAfter is how long a local instance that refused a connection is passed over
+const upstreamRetryAfter = 5 * time.Second
+
+// upstream is one local instance of a tunnel's app
+type upstream struct {
+	addr      string
+	downUntil atomic.Int64 // Unix nanoseconds until which it is passed over after a failed dial
+}
+
+// markDown passes the instance over for upstreamRetryAfter, reporting whether it was up before
+func (u *upstream) markDown() bool {
+	return u.downUntil.Swap(time.Now().Add(upstreamRetryAfter).UnixNano()) < time.Now().UnixNano()
+}
+
+// markUp reports whether the instance was down before
+func (u *upstream) markUp() bool {
+	return u.downUntil.Swap(0) != 0
+}
+
+// upstreamPool spreads a tunnel's streams round-robin over the local instances of its app
+// (local_port and local_ports), so one can restart while the others keep the tunnel usable
+type upstreamPool struct {
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+func newUpstreamPool(host string, ports []int) *upstreamPool {
+	pool := &upstreamPool{}
+	for _, port := range ports {
+		pool.upstreams = append(pool.upstreams, &upstream{addr: net.JoinHostPort(host, strconv.Itoa(port))})
+	}
+	return pool
+}
+
+// order returns the instances to try for a stream: those up from the next in turn,
+// then those passed over as a last resort
+func (p *upstreamPool) order() []*upstream {
+	if len(p.upstreams) == 1 {
+		return p.upstreams
+	}
+	start := int(p.next.Add(1) - 1)
+	now := time.Now().UnixNano()
+	up := make([]*upstream, 0, len(p.upstreams))
+	var down []*upstream
+	for i := range p.upstreams {
+		u := p.upstreams[(start+i)%len(p.upstreams)]
+		if u.downUntil.Load() > now {
+			down = append(down, u)
+		} else {
+			up = append(up, u)
+		}
+	}
+	return append(up, down...)
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sombochea/tungo/pkg/config"
+)
+
+// maxWebhookRequestBytes bounds how much of a request is held back to check its signature
+// Larger requests are forwarded unverified (or rejected with webhook_reject)
+const maxWebhookRequestBytes = 1 << 20
+
+// stripeTolerance is how old a Stripe signature's timestamp may be, as in Stripe's own libraries
+const stripeTolerance = 5 * time.Minute
+
+// invalidWebhookResponse answers webhook deliveries with a bad signature when webhook_reject is set
+const invalidWebhookResponse = "HTTP/1.1 401 Unauthorized\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Length: 26\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"Invalid webhook signature\n"
+
+// webhookVerifier checks the signatures a webhook provider puts on its deliveries
+type webhookVerifier struct {
+	provider string
+	secret   []byte
+}
+
+// newWebhookVerifier creates a verifier for a "provider:secret" setting (nil if empty)
+func newWebhookVerifier(value string) *webhookVerifier {
+	provider, secret, err := config.ParseWebhookVerify(value)
+	if err != nil || provider == "" {
+		return nil // Checked by Validate
+	}
+	return &webhookVerifier{provider: provider, secret: []byte(secret)}
+}
+
+// hasWholeRequest reports whether data holds a whole request, head and body
+// Requests that can't be parsed count as complete, they fail verification
+func hasWholeRequest(data []byte) bool {
+	if len(data) >= maxWebhookRequestBytes {
+		return true
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	_, err = io.Copy(io.Discard, req.Body)
+	return !errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// verify checks the signature of the request in data, which holds its head and whole body
+func (v *webhookVerifier) verify(data []byte) error {
+	if len(data) >= maxWebhookRequestBytes {
+		return fmt.Errorf("request too large to verify")
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return fmt.Errorf("malformed request: %w", err)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return fmt.Errorf("malformed request body: %w", err)
+	}
+
+	switch v.provider {
+	case config.WebhookStripe:
+		return v.verifyStripe(req.Header.Get("Stripe-Signature"), body, time.Now())
+	case config.WebhookGitHub:
+		signature, ok := strings.CutPrefix(req.Header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			return fmt.Errorf("missing X-Hub-Signature-256 header")
+		}
+		return v.compareHex(signature, body)
+	case config.WebhookShopify:
+		signature := req.Header.Get("X-Shopify-Hmac-Sha256")
+		if signature == "" {
+			return fmt.Errorf("missing X-Shopify-Hmac-Sha256 header")
+		}
+		expected, err := base64.StdEncoding.DecodeString(signature)
+		if err != nil || !hmac.Equal(expected, v.sign(body)) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown webhook provider: %s", v.provider)
+}
+
+// verifyStripe checks a Stripe-Signature header ("t=<timestamp>,v1=<hex>,...") signing "<timestamp>.<body>"
+func (v *webhookVerifier) verifyStripe(header string, body []byte, now time.Time) error {
+	if header == "" {
+		return fmt.Errorf("missing Stripe-Signature header")
+	}
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return fmt.Errorf("malformed Stripe-Signature header")
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > stripeTolerance || age < -stripeTolerance {
+		return fmt.Errorf("timestamp outside the %s tolerance", stripeTolerance)
+	}
+
+	payload := append([]byte(timestamp+"."), body...)
+	for _, signature := range signatures {
+		if v.compareHex(signature, payload) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature mismatch")
+}
+
+// compareHex checks a hex HMAC-SHA256 signature of payload
+func (v *webhookVerifier) compareHex(signature string, payload []byte) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, v.sign(payload)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func (v *webhookVerifier) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
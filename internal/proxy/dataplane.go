@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The data plane carries requests between cluster servers as gRPC streams, many of them
+// multiplexed over one connection per peer. A stream opens with a head frame from each side
+// (the request, then the response) followed by data frames carrying the bodies; each side
+// ends its half by closing the stream.
+
+const (
+	dataPlaneService = "tungo.DataPlane"
+	dataPlaneMethod  = "/" + dataPlaneService + "/Stream"
+
+	// dataPlaneChunkSize is the largest body chunk sent in a single data frame
+	dataPlaneChunkSize = 32 * 1024
+)
+
+// frameKind identifies what a data plane frame carries
+type frameKind byte
+
+const (
+	frameHead frameKind = iota + 1 // JSON-encoded request or response head
+	frameData                      // Raw body bytes
+)
+
+// frame is one message on a data plane stream
+type frame struct {
+	kind    frameKind
+	payload []byte
+}
+
+// frameCodec encodes frames as their kind byte followed by the payload, so bodies aren't re-encoded
+type frameCodec struct{}
+
+func (frameCodec) Name() string { return "tungo-frame" }
+
+func (frameCodec) Marshal(v any) ([]byte, error) {
+	f, ok := v.(*frame)
+	if !ok {
+		return nil, fmt.Errorf("frame codec cannot marshal %T", v)
+	}
+	return append([]byte{byte(f.kind)}, f.payload...), nil
+}
+
+func (frameCodec) Unmarshal(data []byte, v any) error {
+	f, ok := v.(*frame)
+	if !ok {
+		return fmt.Errorf("frame codec cannot unmarshal into %T", v)
+	}
+	if len(data) == 0 {
+		return errors.New("empty frame")
+	}
+	f.kind = frameKind(data[0])
+	f.payload = append([]byte(nil), data[1:]...) // gRPC reuses data once we return
+	return nil
+}
+
+func init() {
+	encoding.RegisterCodec(frameCodec{})
+}
+
+// requestHead opens a stream: the request for the owning server to serve
+type requestHead struct {
+	Method        string      `json:"method"`
+	URI           string      `json:"uri"` // Path and query
+	Host          string      `json:"host"`
+	Header        http.Header `json:"header"`
+	ContentLength int64       `json:"content_length"` // -1 if unknown
+}
+
+// responseHead is the owning server's answer, sent before the response body
+type responseHead struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+}
+
+// frameStream is either side of a data plane stream
+type frameStream interface {
+	SendMsg(m any) error
+	RecvMsg(m any) error
+}
+
+// dataPlaneHandler is implemented by DataPlaneServer for the hand-written service description
+type dataPlaneHandler interface {
+	serveStream(stream grpc.ServerStream) error
+}
+
+var dataPlaneStreamDesc = grpc.StreamDesc{
+	StreamName:    "Stream",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+var dataPlaneServiceDesc = grpc.ServiceDesc{
+	ServiceName: dataPlaneService,
+	HandlerType: (*dataPlaneHandler)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    dataPlaneStreamDesc.StreamName,
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return srv.(dataPlaneHandler).serveStream(stream)
+		},
+	}},
+}
+
+// remoteAddrKey carries the peer server's address to the in-process dialer
+type remoteAddrKey struct{}
+
+// DataPlaneServer serves streams opened by other servers, handing each request to this server's proxy in-process
+type DataPlaneServer struct {
+	grpc   *grpc.Server
+	health *health.Server
+	local  *http.Transport
+	logger *slog.Logger
+}
+
+// NewDataPlaneServer creates a data plane server that reaches the local proxy through dial,
+// which is given the peer server's address so the proxy sees it as the remote address
+// A non-nil tlsConfig requires mutual TLS from peers
+func NewDataPlaneServer(dial func(remote net.Addr) (net.Conn, error), tlsConfig *tls.Config, logger *slog.Logger) *DataPlaneServer {
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             dataPlaneKeepalive / 2,
+			PermitWithoutStream: true,
+		}),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	s := &DataPlaneServer{
+		grpc:   grpc.NewServer(opts...),
+		health: health.NewServer(),
+		logger: logger,
+		local: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				remote, _ := ctx.Value(remoteAddrKey{}).(net.Addr)
+				return dial(remote)
+			},
+			DisableKeepAlives:  true, // Each connection carries one peer's address
+			DisableCompression: true,
+		},
+	}
+	s.grpc.RegisterService(&dataPlaneServiceDesc, s)
+	healthpb.RegisterHealthServer(s.grpc, s.health)
+	s.health.SetServingStatus(dataPlaneService, healthpb.HealthCheckResponse_SERVING)
+	return s
+}
+
+// Serve accepts peer connections on ln until Stop is called
+func (s *DataPlaneServer) Serve(ln net.Listener) error {
+	return s.grpc.Serve(ln)
+}
+
+// Stop reports the data plane as not serving so peers stop sending, then waits up to timeout for open streams
+func (s *DataPlaneServer) Stop(timeout time.Duration) {
+	s.health.SetServingStatus(dataPlaneService, healthpb.HealthCheckResponse_NOT_SERVING)
+
+	done := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.grpc.Stop()
+	}
+}
+
+// serveStream serves one request from a peer server through the local proxy
+func (s *DataPlaneServer) serveStream(stream grpc.ServerStream) error {
+	var first frame
+	if err := stream.RecvMsg(&first); err != nil {
+		return err
+	}
+	var head requestHead
+	if first.kind != frameHead || json.Unmarshal(first.payload, &head) != nil {
+		return status.Error(codes.InvalidArgument, "stream must open with a request head")
+	}
+
+	// Feed the request body from the peer's data frames as they arrive
+	body, bodyWriter := io.Pipe()
+	defer body.Close()
+	go func() {
+		bodyWriter.CloseWithError(receiveBody(stream, bodyWriter))
+	}()
+
+	ctx := stream.Context()
+	if p, ok := peer.FromContext(ctx); ok {
+		ctx = context.WithValue(ctx, remoteAddrKey{}, p.Addr)
+	}
+	req, err := http.NewRequestWithContext(ctx, head.Method, "http://"+head.Host+head.URI, body)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid request head: %v", err)
+	}
+	req.Host = head.Host
+	req.Header = head.Header
+	req.ContentLength = head.ContentLength
+	if head.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+
+	resp, err := s.local.RoundTrip(req)
+	if err != nil {
+		s.logger.Error("Failed to serve data plane stream", "error", err, "host", head.Host)
+		return status.Errorf(codes.Unavailable, "failed to serve request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respHead, err := json.Marshal(responseHead{StatusCode: resp.StatusCode, Header: resp.Header})
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to encode response head: %v", err)
+	}
+	if err := stream.SendMsg(&frame{kind: frameHead, payload: respHead}); err != nil {
+		return err
+	}
+	return sendBody(stream, resp.Body)
+}
+
+// receiveBody writes the data frames of a stream to w until the sender closes its half
+func receiveBody(stream frameStream, w io.Writer) error {
+	for {
+		var f frame
+		if err := stream.RecvMsg(&f); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if f.kind != frameData {
+			return status.Error(codes.InvalidArgument, "unexpected frame in body")
+		}
+		if _, err := w.Write(f.payload); err != nil {
+			return err
+		}
+	}
+}
+
+// sendBody sends r as data frames on a stream
+func sendBody(stream frameStream, r io.Reader) error {
+	buf := make([]byte, dataPlaneChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.SendMsg(&frame{kind: frameData, payload: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
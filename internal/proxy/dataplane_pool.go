@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	dataPlaneScheme          = "grpc"           // URL scheme ServerProxy uses for data plane targets
+	dataPlaneKeepalive       = 30 * time.Second // Idle connections are pinged this often
+	dataPlaneHealthInterval  = 5 * time.Second
+	dataPlaneHealthTimeout   = 2 * time.Second
+	dataPlanePeerIdleTimeout = 5 * time.Minute // Connections to peers unused this long are closed
+)
+
+// DataPlanePool keeps one gRPC connection per peer server, health checked in the background,
+// and sends requests over it as an http.RoundTripper
+type DataPlanePool struct {
+	creds  credentials.TransportCredentials
+	logger *slog.Logger
+
+	mutex sync.Mutex
+	peers map[string]*dataPlanePeer // Keyed by host:port
+	stop  chan struct{}
+}
+
+// dataPlanePeer is the pooled connection to one peer server
+type dataPlanePeer struct {
+	conn     *grpc.ClientConn
+	healthy  atomic.Bool
+	lastUsed atomic.Int64 // Unix nanoseconds
+}
+
+// NewDataPlanePool creates a pool of peer connections (mutual TLS with a non-nil tlsConfig)
+func NewDataPlanePool(tlsConfig *tls.Config, logger *slog.Logger) *DataPlanePool {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	p := &DataPlanePool{
+		creds:  creds,
+		logger: logger,
+		peers:  make(map[string]*dataPlanePeer),
+		stop:   make(chan struct{}),
+	}
+	go p.checkHealth()
+	return p
+}
+
+// Close closes every peer connection
+func (p *DataPlanePool) Close() {
+	close(p.stop)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for addr, peer := range p.peers {
+		peer.conn.Close()
+		delete(p.peers, addr)
+	}
+}
+
+// RoundTrip sends a request to the peer at req.URL.Host over a new stream on its pooled connection
+func (p *DataPlanePool) RoundTrip(req *http.Request) (*http.Response, error) {
+	peer, err := p.peer(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if !peer.healthy.Load() {
+		return nil, fmt.Errorf("data plane of %s failed its health check", req.URL.Host)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	stream, err := peer.conn.NewStream(ctx, &dataPlaneStreamDesc, dataPlaneMethod, grpc.CallContentSubtype(frameCodec{}.Name()))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	head, err := json.Marshal(requestHead{
+		Method:        req.Method,
+		URI:           req.URL.RequestURI(),
+		Host:          req.Host,
+		Header:        req.Header,
+		ContentLength: req.ContentLength,
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to encode request head: %w", err)
+	}
+	if err := stream.SendMsg(&frame{kind: frameHead, payload: head}); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Stream the body while waiting for the response, which may start before the body is done
+	go func() {
+		if req.Body != nil && req.Body != http.NoBody {
+			err := sendBody(stream, req.Body)
+			req.Body.Close()
+			if err != nil {
+				cancel()
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+
+	var first frame
+	if err := stream.RecvMsg(&first); err != nil {
+		cancel()
+		return nil, err
+	}
+	var respHead responseHead
+	if first.kind != frameHead || json.Unmarshal(first.payload, &respHead) != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid response head from %s", req.URL.Host)
+	}
+
+	contentLength := int64(-1)
+	if length, err := strconv.ParseInt(respHead.Header.Get("Content-Length"), 10, 64); err == nil {
+		contentLength = length
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", respHead.StatusCode, http.StatusText(respHead.StatusCode)),
+		StatusCode:    respHead.StatusCode,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        respHead.Header,
+		ContentLength: contentLength,
+		Body:          &frameReader{stream: stream, cancel: cancel},
+		Request:       req,
+	}, nil
+}
+
+// peer returns the pooled connection to addr, creating it on first use
+func (p *DataPlanePool) peer(addr string) (*dataPlanePeer, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	peer, exists := p.peers[addr]
+	if !exists {
+		conn, err := grpc.NewClient("passthrough:///"+addr,
+			grpc.WithTransportCredentials(p.creds),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                dataPlaneKeepalive,
+				Timeout:             10 * time.Second,
+				PermitWithoutStream: true,
+			}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create data plane connection to %s: %w", addr, err)
+		}
+		peer = &dataPlanePeer{conn: conn}
+		peer.healthy.Store(true) // Until a check says otherwise
+		p.peers[addr] = peer
+		p.logger.Info("Opened data plane connection", "peer", addr)
+	}
+	peer.lastUsed.Store(time.Now().UnixNano())
+	return peer, nil
+}
+
+// checkHealth periodically checks every peer's health service and closes connections that went unused
+func (p *DataPlanePool) checkHealth() {
+	ticker := time.NewTicker(dataPlaneHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mutex.Lock()
+		peers := make(map[string]*dataPlanePeer, len(p.peers))
+		for addr, peer := range p.peers {
+			if time.Since(time.Unix(0, peer.lastUsed.Load())) > dataPlanePeerIdleTimeout {
+				peer.conn.Close()
+				delete(p.peers, addr)
+				p.logger.Info("Closed idle data plane connection", "peer", addr)
+				continue
+			}
+			peers[addr] = peer
+		}
+		p.mutex.Unlock()
+
+		for addr, peer := range peers {
+			healthy := p.check(peer)
+			if peer.healthy.Swap(healthy) != healthy {
+				p.logger.Warn("Data plane peer health changed", "peer", addr, "healthy", healthy)
+			}
+		}
+	}
+}
+
+// check asks a peer's health service whether its data plane is serving
+func (p *DataPlanePool) check(peer *dataPlanePeer) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), dataPlaneHealthTimeout)
+	defer cancel()
+
+	resp, err := healthpb.NewHealthClient(peer.conn).Check(ctx, &healthpb.HealthCheckRequest{Service: dataPlaneService})
+	return err == nil && resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+}
+
+// frameReader reads a response body from the data frames of a stream
+type frameReader struct {
+	stream  grpc.ClientStream
+	cancel  context.CancelFunc
+	pending []byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		var f frame
+		if err := r.stream.RecvMsg(&f); err != nil {
+			return 0, err // io.EOF once the peer has sent the whole body
+		}
+		if f.kind != frameData {
+			return 0, fmt.Errorf("unexpected frame in response body")
+		}
+		r.pending = f.payload
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Close abandons the rest of the response, cancelling the stream
+func (r *frameReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+var _ io.ReadCloser = (*frameReader)(nil)
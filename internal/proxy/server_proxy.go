@@ -1,6 +1,9 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,7 +12,13 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/sombochea/tungo/internal/registry"
+	"github.com/sombochea/tungo/pkg/protocol"
+	"github.com/sombochea/tungo/pkg/tracing"
 )
 
 var (
@@ -20,6 +29,12 @@ var (
 		},
 		[]string{"status"},
 	)
+	proxyRetries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tungo_proxy_retries_total",
+			Help: "Total number of proxied requests retried against a tunnel's new server",
+		},
+	)
 	proxyLatency = promauto.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "tungo_proxy_latency_seconds",
@@ -29,18 +44,25 @@ var (
 	)
 )
 
+// ErrTunnelLocal is returned when a tunnel whose server failed has reconnected to this server
+var ErrTunnelLocal = errors.New("tunnel reconnected to this server")
+
 // ServerProxy handles proxying requests to other servers in the cluster
 type ServerProxy struct {
 	registry registry.Registry
 	logger   *slog.Logger
 	client   *http.Client
+	tls      bool // Proxy over mutual TLS to each server's cluster port
+	grpc     bool // Proxy over the data plane to servers that advertise one
 }
 
 // NewServerProxy creates a new server-to-server proxy with connection pooling
-func NewServerProxy(reg registry.Registry, logger *slog.Logger) *ServerProxy {
+// A non-nil tlsConfig sends requests over mutual TLS to the owning server's cluster port
+func NewServerProxy(reg registry.Registry, tlsConfig *tls.Config, logger *slog.Logger) *ServerProxy {
 	return &ServerProxy{
 		registry: reg,
 		logger:   logger,
+		tls:      tlsConfig != nil,
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 			Transport: &http.Transport{
@@ -50,17 +72,119 @@ func NewServerProxy(reg registry.Registry, logger *slog.Logger) *ServerProxy {
 				IdleConnTimeout:     90 * time.Second, // Keep connections alive
 				DisableKeepAlives:   false,            // Enable connection reuse
 				DisableCompression:  false,
+				TLSClientConfig:     tlsConfig,
 			},
 		},
 	}
 }
 
+// SetDataPlane sends requests over the gRPC data plane to servers that advertise a data port
+func (p *ServerProxy) SetDataPlane(pool *DataPlanePool) {
+	p.client.Transport.(*http.Transport).RegisterProtocol(dataPlaneScheme, pool)
+	p.grpc = true
+}
+
 // ProxyToServer proxies an HTTP request to another server that owns the tunnel
+// If the owner can't be reached, the tunnel is looked up again and the request retried once
+// against its new owner; ErrTunnelLocal means the tunnel has reconnected to this server
 func (p *ServerProxy) ProxyToServer(w http.ResponseWriter, r *http.Request, tunnelInfo *registry.TunnelInfo) error {
+	requestID := r.Header.Get(protocol.RequestIDHeader)
+
+	// Trace the hop to the owning server
+	ctx := tracing.Extract(r.Context(), r.Header)
+	ctx, span := tracing.Tracer().Start(ctx, "tungo.server_proxy",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.HTTPAttributes(r.Method, r.URL.Path, tunnelInfo.Subdomain)...),
+		trace.WithAttributes(attribute.String("tungo.target_server", tunnelInfo.ServerID)))
+	defer span.End()
+
+	// Track whether the body was sent, since a streamed body can only be retried if it wasn't
+	var body *trackedBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &trackedBody{ReadCloser: r.Body}
+	}
+
+	resp, err := p.send(ctx, r, requestBody(body), tunnelInfo)
+	if err != nil {
+		retryBody, replayable := body.replay(r)
+		var moved *registry.TunnelInfo
+		if replayable {
+			moved, err = p.failover(tunnelInfo, err)
+		}
+		if moved != nil {
+			proxyRetries.Inc()
+			p.logger.Warn("Retrying proxied request against the tunnel's new server",
+				"subdomain", tunnelInfo.Subdomain,
+				"request_id", requestID,
+				"failed_server", tunnelInfo.ServerID,
+				"target_server", moved.ServerID)
+			span.SetAttributes(attribute.String("tungo.retry_server", moved.ServerID))
+			tunnelInfo = moved
+			resp, err = p.send(ctx, r, retryBody, tunnelInfo)
+		}
+	}
+
+	if err != nil {
+		proxyRequests.WithLabelValues("error").Inc()
+		span.SetStatus(codes.Error, err.Error())
+		if errors.Is(err, ErrTunnelLocal) {
+			return err
+		}
+		return fmt.Errorf("failed to proxy request: %w", err)
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	// Copy response headers
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	// Add proxy response headers
+	w.Header().Set("X-TunGo-Proxied-By", tunnelInfo.ServerID)
+
+	// Copy status code
+	w.WriteHeader(resp.StatusCode)
+
+	// Copy response body
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		proxyRequests.WithLabelValues("error").Inc()
+		p.logger.Error("Failed to copy proxy response", "error", err, "request_id", requestID)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to copy proxy response: %w", err)
+	}
+
+	proxyRequests.WithLabelValues("success").Inc()
+
+	p.logger.Debug("Successfully proxied request",
+		"subdomain", tunnelInfo.Subdomain,
+		"request_id", requestID,
+		"status", resp.StatusCode,
+		"target_server", tunnelInfo.ServerID)
+
+	return nil
+}
+
+// send makes one attempt at proxying the request to the tunnel's server
+func (p *ServerProxy) send(ctx context.Context, r *http.Request, body io.Reader, tunnelInfo *registry.TunnelInfo) (*http.Response, error) {
 	// Build the target URL
-	targetURL := fmt.Sprintf("http://%s:%d%s",
+	scheme, port := "http", tunnelInfo.ProxyPort
+	switch {
+	case p.grpc && tunnelInfo.DataPort != 0:
+		scheme, port = dataPlaneScheme, tunnelInfo.DataPort
+	case p.tls:
+		if tunnelInfo.ClusterPort == 0 {
+			return nil, fmt.Errorf("server %s does not accept cluster TLS", tunnelInfo.ServerID)
+		}
+		scheme, port = "https", tunnelInfo.ClusterPort
+	}
+	targetURL := fmt.Sprintf("%s://%s:%d%s",
+		scheme,
 		tunnelInfo.ServerHost,
-		tunnelInfo.ProxyPort,
+		port,
 		r.URL.Path)
 
 	if r.URL.RawQuery != "" {
@@ -69,17 +193,19 @@ func (p *ServerProxy) ProxyToServer(w http.ResponseWriter, r *http.Request, tunn
 
 	p.logger.Info("Proxying request to remote server",
 		"subdomain", tunnelInfo.Subdomain,
+		"request_id", r.Header.Get(protocol.RequestIDHeader),
 		"target_server", tunnelInfo.ServerID,
 		"target_url", targetURL,
 		"method", r.Method,
 		"path", r.URL.Path)
 
 	// Create the proxy request
-	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
+	proxyReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, body)
 	if err != nil {
-		proxyRequests.WithLabelValues("error").Inc()
-		return fmt.Errorf("failed to create proxy request: %w", err)
+		return nil, fmt.Errorf("failed to create proxy request: %w", err)
 	}
+	proxyReq.ContentLength = r.ContentLength // Unknown (-1) bodies are sent chunked
+	proxyReq.Host = r.Host                   // The owning server routes by the visitor's subdomain
 
 	// Copy headers
 	for key, values := range r.Header {
@@ -93,49 +219,73 @@ func (p *ServerProxy) ProxyToServer(w http.ResponseWriter, r *http.Request, tunn
 	proxyReq.Header.Set("X-Forwarded-Proto", "http")
 	proxyReq.Header.Set("X-TunGo-Proxy", "true")
 	proxyReq.Header.Set("X-Original-Host", r.Host)
+	tracing.Inject(ctx, proxyReq.Header)
 
 	// Execute the request with latency tracking
 	start := time.Now()
 	resp, err := p.client.Do(proxyReq)
 	proxyLatency.Observe(time.Since(start).Seconds())
+	return resp, err
+}
 
-	if err != nil {
-		proxyRequests.WithLabelValues("error").Inc()
-		return fmt.Errorf("failed to proxy request: %w", err)
+// failover looks the tunnel up again after its server failed with err, returning the server
+// it has moved to, ErrTunnelLocal if it moved here, or err if it hasn't moved
+func (p *ServerProxy) failover(stale *registry.TunnelInfo, err error) (*registry.TunnelInfo, error) {
+	p.registry.InvalidateTunnel(stale.Subdomain)
+	fresh, lookupErr := p.registry.GetTunnel(stale.Subdomain)
+	if lookupErr != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	if local, _ := p.registry.IsLocalTunnel(stale.Subdomain); local {
+		return nil, ErrTunnelLocal
 	}
-
-	// Add proxy response headers
-	w.Header().Set("X-TunGo-Proxied-By", tunnelInfo.ServerID)
-
-	// Copy status code
-	w.WriteHeader(resp.StatusCode)
-
-	// Copy response body
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		proxyRequests.WithLabelValues("error").Inc()
-		p.logger.Error("Failed to copy proxy response", "error", err)
-		return fmt.Errorf("failed to copy proxy response: %w", err)
+	if fresh.ServerID == stale.ServerID && fresh.ServerHost == stale.ServerHost &&
+		fresh.ProxyPort == stale.ProxyPort && fresh.ClusterPort == stale.ClusterPort && fresh.DataPort == stale.DataPort {
+		return nil, err
 	}
+	return fresh, nil
+}
 
-	proxyRequests.WithLabelValues("success").Inc()
+// trackedBody records whether a request body has been read
+// Close is a no-op: the body belongs to the incoming request, and a failed attempt must not close it before a retry
+type trackedBody struct {
+	io.ReadCloser
+	read bool
+}
 
-	p.logger.Debug("Successfully proxied request",
-		"subdomain", tunnelInfo.Subdomain,
-		"status", resp.StatusCode,
-		"target_server", tunnelInfo.ServerID)
+func (b *trackedBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.ReadCloser.Read(p)
+}
 
+func (b *trackedBody) Close() error {
 	return nil
 }
 
+// requestBody returns the body to send (nil for requests without one)
+func requestBody(b *trackedBody) io.Reader {
+	if b == nil {
+		return http.NoBody
+	}
+	return b
+}
+
+// replay returns the body for retrying r after a failed attempt,
+// or false if the body was streamed and already partly sent
+func (b *trackedBody) replay(r *http.Request) (io.Reader, bool) {
+	switch {
+	case b == nil:
+		return http.NoBody, true
+	case !b.read:
+		return b, true
+	case r.GetBody != nil:
+		body, err := r.GetBody()
+		return body, err == nil
+	default:
+		return nil, false
+	}
+}
+
 // ShouldProxy determines if a request should be proxied to another server
 func (p *ServerProxy) ShouldProxy(subdomain string) (bool, *registry.TunnelInfo, error) {
 	// Check if tunnel exists in registry
@@ -0,0 +1,1166 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Consul KV key prefixes
+	consulTunnelPrefix      = "tungo/tunnels/"
+	consulServerPrefix      = "tungo/servers/"
+	consulAccountPrefix     = "tungo/accounts/"
+	consulMigrationPrefix   = "tungo/migrations/"
+	consulReservationPrefix = "tungo/reservations/"
+	consulUsagePrefix       = "tungo/usage/"
+	consulLeaderKey         = "tungo/leader"
+	consulClusterCAKey      = "tungo/cluster/ca"
+
+	// Catalog service names
+	consulServerService = "tungo"
+	consulTunnelService = "tungo-tunnel"
+
+	// consulEventName is the user event carrying lifecycle events for external consumers
+	consulEventName = "tungo-tunnel-event"
+
+	// consulTimeout bounds regular Consul API calls
+	consulTimeout = 5 * time.Second
+	// consulWatchWait is how long a blocking query waits for tunnel changes
+	consulWatchWait = time.Minute
+	// consulUsageSweepInterval is how often the leader deletes expired usage counters
+	consulUsageSweepInterval = time.Hour
+)
+
+var (
+	errConsulNotFound = errors.New("not found")
+	errConsulConflict = errors.New("transaction rolled back")
+	errConsulHeld     = errors.New("held by another session")
+)
+
+// ConsulRegistry manages tunnel state across multiple servers using Consul
+// Tunnels and servers are KV entries held by this server's TTL session, so they disappear when the server dies,
+// and both are registered as services so they appear in Consul's catalog
+type ConsulRegistry struct {
+	address  string // Base URL of the Consul agent's HTTP API
+	token    string // ACL token (optional)
+	client   *http.Client
+	serverID string
+	logger   *slog.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timings  Timings
+
+	// Session holding this server's KV entries, renewed by the heartbeat
+	session      string
+	sessionMutex sync.RWMutex
+
+	// Tunnels held by this server, re-acquired if the session has to be recreated
+	held      map[string]*TunnelInfo
+	heldMutex sync.Mutex
+
+	// Local cache for tunnel lookups, cleared whenever a tunnel changes
+	cache      map[string]*cacheEntry
+	cacheMutex sync.RWMutex
+	stats      lookupStats
+
+	// Cluster leadership, held through a session lock
+	leadership leadership
+
+	// When the leader last swept expired usage counters (heartbeat goroutine only)
+	usageSweptAt time.Time
+}
+
+// consulKV is an entry returned by the KV API
+type consulKV struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+	Session     string
+}
+
+// consulTxnOp is a KV operation in a Consul transaction
+type consulTxnOp struct {
+	KV consulTxnKV
+}
+
+// consulTxnKV is the KV part of a transaction operation
+type consulTxnKV struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+// consulMigration is the value stored for a pending migration token (Consul KV entries don't expire)
+type consulMigration struct {
+	Subdomain string    `json:"subdomain"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// consulUsage is the value stored for a usage counter (Consul KV entries don't expire)
+type consulUsage struct {
+	Total     int64     `json:"total"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewConsulRegistry creates a registry backed by the Consul agent at address
+func NewConsulRegistry(address, token string, timings Timings, serverID string, logger *slog.Logger) (*ConsulRegistry, error) {
+	timings = timings.withDefaults()
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	registry := &ConsulRegistry{
+		address:    strings.TrimRight(address, "/"),
+		token:      token,
+		client:     &http.Client{},
+		serverID:   serverID,
+		logger:     logger,
+		ctx:        ctx,
+		cancel:     cancel,
+		held:       make(map[string]*TunnelInfo),
+		cache:      make(map[string]*cacheEntry),
+		timings:    timings,
+		leadership: leadership{lease: timings.ServerTTL},
+	}
+
+	// Test connection
+	if err := registry.Ping(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to connect to Consul: %w", err)
+	}
+
+	if err := registry.createSession(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	logger.Info("Connected to Consul", "address", registry.address, "server_id", serverID)
+
+	// Drop cached lookups whenever a tunnel changes
+	go registry.watchTunnels()
+
+	return registry, nil
+}
+
+// RegisterTunnel registers a tunnel, replacing any entry another server holds for the subdomain
+func (r *ConsulRegistry) RegisterTunnel(info *TunnelInfo) error {
+	info.ServerID = r.serverID
+	info.LastSeenAt = time.Now()
+
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = time.Now()
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tunnel info: %w", err)
+	}
+
+	key := consulTunnelPrefix + info.Subdomain
+	if err := r.txn([]consulTxnOp{
+		{KV: consulTxnKV{Verb: "delete", Key: key}},
+		{KV: consulTxnKV{Verb: "lock", Key: key, Value: data, Session: r.currentSession()}},
+	}); err != nil {
+		return fmt.Errorf("failed to register tunnel: %w", err)
+	}
+
+	r.hold(info)
+	r.invalidateCache(info.Subdomain)
+
+	r.logger.Info("Registered tunnel",
+		"subdomain", info.Subdomain,
+		"server_id", info.ServerID,
+		"client_id", info.ClientID)
+
+	return nil
+}
+
+// GetTunnel retrieves tunnel information from the registry (with local caching)
+func (r *ConsulRegistry) GetTunnel(subdomain string) (*TunnelInfo, error) {
+	if cached := r.getCached(subdomain); cached != nil {
+		r.stats.hit()
+		return cached, nil
+	}
+
+	start := time.Now()
+	entry, err := r.kvGet(consulTunnelPrefix + subdomain)
+	r.stats.miss(time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tunnel: %w", err)
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("tunnel not found: %s", subdomain)
+	}
+
+	var info TunnelInfo
+	if err := json.Unmarshal(entry.Value, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tunnel info: %w", err)
+	}
+
+	r.setCached(subdomain, &info)
+
+	return &info, nil
+}
+
+// UnregisterTunnel removes a tunnel from the registry
+func (r *ConsulRegistry) UnregisterTunnel(subdomain string) error {
+	if err := r.kvDelete(consulTunnelPrefix + subdomain); err != nil {
+		return fmt.Errorf("failed to unregister tunnel: %w", err)
+	}
+
+	r.release(subdomain)
+	r.invalidateCache(subdomain)
+
+	r.logger.Info("Unregistered tunnel", "subdomain", subdomain, "server_id", r.serverID)
+	return nil
+}
+
+// RefreshTunnel rewrites a tunnel's metadata (its lifetime is bound to the session)
+// Locking a key this server's session already holds just updates its value
+func (r *ConsulRegistry) RefreshTunnel(info *TunnelInfo) error {
+	info.ServerID = r.serverID
+	info.LastSeenAt = time.Now()
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tunnel info: %w", err)
+	}
+
+	key := consulTunnelPrefix + info.Subdomain
+	if err := r.txn([]consulTxnOp{
+		{KV: consulTxnKV{Verb: "lock", Key: key, Value: data, Session: r.currentSession()}},
+	}); err != nil {
+		if errors.Is(err, errConsulConflict) {
+			r.release(info.Subdomain)
+			return ErrTunnelMoved
+		}
+		return fmt.Errorf("failed to refresh tunnel: %w", err)
+	}
+
+	// Already in the catalog, only the copy re-acquired with a new session changes
+	r.heldMutex.Lock()
+	r.held[info.Subdomain] = info
+	r.heldMutex.Unlock()
+	r.invalidateCache(info.Subdomain)
+	return nil
+}
+
+// GetAllTunnels returns all active tunnels across all servers
+func (r *ConsulRegistry) GetAllTunnels() ([]*TunnelInfo, error) {
+	entries, err := r.kvList(consulTunnelPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnels: %w", err)
+	}
+
+	tunnels := make([]*TunnelInfo, 0, len(entries))
+	for _, entry := range entries {
+		var info TunnelInfo
+		if err := json.Unmarshal(entry.Value, &info); err != nil {
+			r.logger.Warn("Failed to unmarshal tunnel info", "key", entry.Key, "error", err)
+			continue
+		}
+		tunnels = append(tunnels, &info)
+	}
+
+	return tunnels, nil
+}
+
+// IsLocalTunnel checks if a tunnel belongs to this server
+func (r *ConsulRegistry) IsLocalTunnel(subdomain string) (bool, error) {
+	info, err := r.GetTunnel(subdomain)
+	if err != nil {
+		return false, err
+	}
+	return info.ServerID == r.serverID, nil
+}
+
+// CreateMigration issues a one-time token letting another server take over a tunnel
+// The token isn't held by this server's session so it outlives the draining server
+func (r *ConsulRegistry) CreateMigration(subdomain string) (string, error) {
+	r.sweepMigrations()
+
+	token, err := newMigrationToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate migration token: %w", err)
+	}
+
+	data, err := json.Marshal(&consulMigration{
+		Subdomain: subdomain,
+		ExpiresAt: time.Now().Add(migrationTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal migration: %w", err)
+	}
+
+	if _, err := r.do(http.MethodPut, "/v1/kv/"+consulMigrationPrefix+token, nil, data, nil); err != nil {
+		return "", fmt.Errorf("failed to create migration: %w", err)
+	}
+
+	return token, nil
+}
+
+// CompleteMigration consumes a migration token and registers the tunnel on this server,
+// replacing the previous server's entry without the tunnel ever being unregistered
+func (r *ConsulRegistry) CompleteMigration(token string, info *TunnelInfo) error {
+	entry, err := r.kvGet(consulMigrationPrefix + token)
+	if err != nil {
+		return fmt.Errorf("failed to complete migration: %w", err)
+	}
+	if entry == nil {
+		return ErrMigrationInvalid
+	}
+
+	var migration consulMigration
+	if err := json.Unmarshal(entry.Value, &migration); err != nil {
+		return ErrMigrationInvalid
+	}
+	if migration.Subdomain != info.Subdomain || time.Now().After(migration.ExpiresAt) {
+		return ErrMigrationInvalid
+	}
+
+	info.ServerID = r.serverID
+	info.LastSeenAt = time.Now()
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = time.Now()
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tunnel info: %w", err)
+	}
+
+	// Consuming the token only succeeds once; the old server's entry is replaced in the same step
+	key := consulTunnelPrefix + info.Subdomain
+	err = r.txn([]consulTxnOp{
+		{KV: consulTxnKV{Verb: "delete-cas", Key: entry.Key, Index: entry.ModifyIndex}},
+		{KV: consulTxnKV{Verb: "delete", Key: key}},
+		{KV: consulTxnKV{Verb: "lock", Key: key, Value: data, Session: r.currentSession()}},
+	})
+	if errors.Is(err, errConsulConflict) {
+		return ErrMigrationInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("failed to complete migration: %w", err)
+	}
+
+	r.hold(info)
+	r.invalidateCache(info.Subdomain)
+
+	r.logger.Info("Migrated tunnel",
+		"subdomain", info.Subdomain,
+		"server_id", info.ServerID,
+		"client_id", info.ClientID)
+
+	return nil
+}
+
+// sweepMigrations deletes migration tokens that expired unclaimed
+func (r *ConsulRegistry) sweepMigrations() {
+	entries, err := r.kvList(consulMigrationPrefix)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		var migration consulMigration
+		if err := json.Unmarshal(entry.Value, &migration); err == nil && now.Before(migration.ExpiresAt) {
+			continue
+		}
+		r.kvDelete(entry.Key)
+	}
+}
+
+// RegisterServer registers this server in the cluster and in Consul's catalog
+func (r *ConsulRegistry) RegisterServer(info *ServerInfo) error {
+	if err := r.putServer(info); err != nil {
+		return err
+	}
+
+	service := map[string]interface{}{
+		"ID":      r.serverServiceID(),
+		"Name":    consulServerService,
+		"Address": serviceAddress(info.Host),
+		"Port":    info.ProxyPort,
+		"Meta": map[string]string{
+			"server_id":    r.serverID,
+			"control_port": strconv.Itoa(info.ControlPort),
+		},
+		"Check": map[string]interface{}{
+			"CheckID":                        r.serverCheckID(),
+			"TTL":                            r.timings.ServerTTL.String(),
+			"DeregisterCriticalServiceAfter": "1m",
+		},
+	}
+	if _, err := r.do(http.MethodPut, "/v1/agent/service/register", nil, service, nil); err != nil {
+		return fmt.Errorf("failed to register server service: %w", err)
+	}
+	r.passCheck()
+
+	return nil
+}
+
+// putServer stores this server's info, held by its session
+func (r *ConsulRegistry) putServer(info *ServerInfo) error {
+	info.ServerID = r.serverID
+	info.LastHeartbeat = time.Now()
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal server info: %w", err)
+	}
+
+	if err := r.kvAcquire(consulServerPrefix+r.serverID, data); err != nil {
+		return fmt.Errorf("failed to register server: %w", err)
+	}
+
+	return nil
+}
+
+// GetServer retrieves information about a specific server
+func (r *ConsulRegistry) GetServer(serverID string) (*ServerInfo, error) {
+	entry, err := r.kvGet(consulServerPrefix + serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server: %w", err)
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("server not found: %s", serverID)
+	}
+
+	var info ServerInfo
+	if err := json.Unmarshal(entry.Value, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal server info: %w", err)
+	}
+
+	return &info, nil
+}
+
+// GetAllServers returns all active servers in the cluster
+func (r *ConsulRegistry) GetAllServers() ([]*ServerInfo, error) {
+	entries, err := r.kvList(consulServerPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %w", err)
+	}
+
+	servers := make([]*ServerInfo, 0, len(entries))
+	for _, entry := range entries {
+		var info ServerInfo
+		if err := json.Unmarshal(entry.Value, &info); err != nil {
+			r.logger.Warn("Failed to unmarshal server info", "key", entry.Key, "error", err)
+			continue
+		}
+		servers = append(servers, &info)
+	}
+
+	return servers, nil
+}
+
+// GetServersInRegion returns the servers that declared region
+func (r *ConsulRegistry) GetServersInRegion(region string) ([]*ServerInfo, error) {
+	servers, err := r.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+	return serversInRegion(servers, region), nil
+}
+
+// StartHeartbeat keeps this server's session and catalog health check alive
+func (r *ConsulRegistry) StartHeartbeat(serverInfo *ServerInfo) {
+	go func() {
+		ticker := time.NewTicker(r.timings.HeartbeatInterval)
+		defer ticker.Stop()
+
+		r.campaign()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.renewSession(); err != nil {
+					r.logger.Error("Failed to renew Consul session", "error", err)
+					r.leadership.set(false, r.logger, r.serverID)
+					continue
+				}
+				if err := r.putServer(serverInfo); err != nil {
+					r.logger.Error("Failed to send heartbeat", "error", err)
+					continue
+				}
+				r.passCheck()
+				r.campaign()
+				if r.IsLeader() && time.Since(r.usageSweptAt) >= consulUsageSweepInterval {
+					r.usageSweptAt = time.Now()
+					r.sweepUsage()
+				}
+			}
+		}
+	}()
+
+	r.logger.Info("Started heartbeat", "interval", r.timings.HeartbeatInterval)
+}
+
+// campaign runs one election round by locking the leader key with this server's session
+// The lock lasts as long as the session, so a dead leader's lock is freed when its session expires
+func (r *ConsulRegistry) campaign() {
+	err := r.kvAcquire(consulLeaderKey, []byte(r.serverID))
+	if err != nil && !errors.Is(err, errConsulHeld) {
+		r.logger.Warn("Failed to campaign for leadership", "error", err)
+	}
+	r.leadership.set(err == nil, r.logger, r.serverID)
+}
+
+// IsLeader reports whether this server currently leads the cluster
+func (r *ConsulRegistry) IsLeader() bool {
+	return r.leadership.isLeader()
+}
+
+// GetLeastLoadedServer returns the server with the lowest load score
+func (r *ConsulRegistry) GetLeastLoadedServer() (*ServerInfo, error) {
+	servers, err := r.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers available")
+	}
+
+	return leastLoaded(servers), nil
+}
+
+// UpdateServerLoad records this server's current load
+func (r *ConsulRegistry) UpdateServerLoad(load ServerLoad) error {
+	info, err := r.GetServer(r.serverID)
+	if err != nil {
+		return err
+	}
+
+	info.apply(load)
+	return r.putServer(info)
+}
+
+// SaveAccount stores an account under the hash of its secret key
+func (r *ConsulRegistry) SaveAccount(secretKey string, account *Account) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal account: %w", err)
+	}
+
+	if _, err := r.do(http.MethodPut, "/v1/kv/"+consulAccountPrefix+accountKey(secretKey), nil, data, nil); err != nil {
+		return fmt.Errorf("failed to save account: %w", err)
+	}
+
+	return nil
+}
+
+// GetAccount retrieves the account for a secret key
+func (r *ConsulRegistry) GetAccount(secretKey string) (*Account, error) {
+	entry, err := r.kvGet(consulAccountPrefix + accountKey(secretKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var account Account
+	if err := json.Unmarshal(entry.Value, &account); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal account: %w", err)
+	}
+	return &account, nil
+}
+
+// DeleteAccount removes the account for a secret key
+func (r *ConsulRegistry) DeleteAccount(secretKey string) error {
+	if err := r.kvDelete(consulAccountPrefix + accountKey(secretKey)); err != nil {
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+	return nil
+}
+
+// ReserveSubdomain stores a reservation; it isn't held by this server's session so it survives restarts
+func (r *ConsulRegistry) ReserveSubdomain(reservation *Reservation) error {
+	data, err := json.Marshal(reservation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reservation: %w", err)
+	}
+
+	if _, err := r.do(http.MethodPut, "/v1/kv/"+consulReservationPrefix+reservation.Subdomain, nil, data, nil); err != nil {
+		return fmt.Errorf("failed to save reservation: %w", err)
+	}
+
+	return nil
+}
+
+// GetReservation retrieves the reservation for a subdomain, deleting it once expired (Consul KV has no TTLs)
+func (r *ConsulRegistry) GetReservation(subdomain string) (*Reservation, error) {
+	entry, err := r.kvGet(consulReservationPrefix + subdomain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservation: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var reservation Reservation
+	if err := json.Unmarshal(entry.Value, &reservation); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reservation: %w", err)
+	}
+	if reservation.Expired() {
+		r.kvDelete(entry.Key)
+		return nil, nil
+	}
+	return &reservation, nil
+}
+
+// DeleteReservation releases a subdomain reservation
+func (r *ConsulRegistry) DeleteReservation(subdomain string) error {
+	if err := r.kvDelete(consulReservationPrefix + subdomain); err != nil {
+		return fmt.Errorf("failed to delete reservation: %w", err)
+	}
+	return nil
+}
+
+// PublishEvent fires a Consul user event for external consumers (payloads are limited to 512 bytes by default)
+func (r *ConsulRegistry) PublishEvent(payload []byte) error {
+	_, err := r.do(http.MethodPut, "/v1/event/fire/"+consulEventName, nil, payload, nil)
+	return err
+}
+
+// consulEvent is a user event returned by the event API
+type consulEvent struct {
+	ID      string
+	Payload []byte
+}
+
+// SubscribeEvents delivers lifecycle events fired by any server, watching the agent's event list
+// Events fired before subscribing are not replayed; the watch ends within consulWatchWait once stopped
+func (r *ConsulRegistry) SubscribeEvents(handler func(payload []byte)) (func(), error) {
+	var events []consulEvent
+	query := url.Values{"name": {consulEventName}}
+	header, err := r.do(http.MethodGet, "/v1/event/list", query, nil, &events)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to events: %w", err)
+	}
+
+	seen := make(map[string]bool, len(events))
+	for _, event := range events {
+		seen[event.ID] = true
+	}
+
+	stop := make(chan struct{})
+	go r.watchEvents(header.Get("X-Consul-Index"), seen, handler, stop)
+
+	var once sync.Once
+	return func() { once.Do(func() { close(stop) }) }, nil
+}
+
+// watchEvents delivers user events as they appear in the agent's event list
+func (r *ConsulRegistry) watchEvents(index string, seen map[string]bool, handler func(payload []byte), stop chan struct{}) {
+	for {
+		var events []consulEvent
+		query := url.Values{"name": {consulEventName}, "index": {index}, "wait": {consulWatchWait.String()}}
+		header, err := r.doWithTimeout(consulWatchWait+consulTimeout, http.MethodGet, "/v1/event/list", query, nil, &events)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.logger.Warn("Failed to watch events", "error", err)
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		// The list is the agent's most recent events, so forget the IDs that fell out of it
+		current := make(map[string]bool, len(events))
+		for _, event := range events {
+			current[event.ID] = true
+			if !seen[event.ID] {
+				handler(event.Payload)
+			}
+		}
+		seen = current
+		index = header.Get("X-Consul-Index")
+	}
+}
+
+// GetCacheStats returns cache hit/miss statistics
+func (r *ConsulRegistry) GetCacheStats() CacheStats {
+	return r.stats.snapshot()
+}
+
+// InvalidateTunnel drops the cached lookup for a subdomain
+func (r *ConsulRegistry) InvalidateTunnel(subdomain string) {
+	r.invalidateCache(subdomain)
+}
+
+// Ping checks that the Consul cluster is reachable and has a leader
+func (r *ConsulRegistry) Ping() error {
+	var leader string
+	if _, err := r.do(http.MethodGet, "/v1/status/leader", nil, nil, &leader); err != nil {
+		return err
+	}
+	if leader == "" {
+		return fmt.Errorf("consul cluster has no leader")
+	}
+	return nil
+}
+
+// Close removes this server and its tunnels from Consul
+func (r *ConsulRegistry) Close() error {
+	defer r.cancel()
+
+	r.heldMutex.Lock()
+	subdomains := make([]string, 0, len(r.held))
+	for subdomain := range r.held {
+		subdomains = append(subdomains, subdomain)
+	}
+	r.heldMutex.Unlock()
+	for _, subdomain := range subdomains {
+		r.do(http.MethodPut, "/v1/agent/service/deregister/"+r.tunnelServiceID(subdomain), nil, nil, nil)
+	}
+
+	if _, err := r.do(http.MethodPut, "/v1/agent/service/deregister/"+r.serverServiceID(), nil, nil, nil); err != nil {
+		r.logger.Warn("Failed to deregister server service", "error", err)
+	}
+
+	// Destroying the session deletes the server and tunnel entries it holds, and frees the leader lock
+	r.leadership.resign(r.logger, r.serverID)
+	if _, err := r.do(http.MethodPut, "/v1/session/destroy/"+r.currentSession(), nil, nil, nil); err != nil {
+		r.logger.Warn("Failed to destroy Consul session", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// createSession creates the TTL session holding this server's entries
+func (r *ConsulRegistry) createSession() error {
+	var created struct {
+		ID string
+	}
+	if _, err := r.do(http.MethodPut, "/v1/session/create", nil, map[string]string{
+		"Name":      "tungo-" + r.serverID,
+		"TTL":       r.timings.ServerTTL.String(),
+		"Behavior":  "delete", // Entries vanish with the session instead of lingering unlocked
+		"LockDelay": "0s",     // Let a replacement server take over tunnels immediately
+	}, &created); err != nil {
+		return fmt.Errorf("failed to create Consul session: %w", err)
+	}
+
+	r.sessionMutex.Lock()
+	r.session = created.ID
+	r.sessionMutex.Unlock()
+	return nil
+}
+
+// renewSession extends the session, recreating it if Consul already invalidated it
+func (r *ConsulRegistry) renewSession() error {
+	_, err := r.do(http.MethodPut, "/v1/session/renew/"+r.currentSession(), nil, nil, nil)
+	if !errors.Is(err, errConsulNotFound) {
+		return err
+	}
+
+	r.logger.Warn("Consul session expired, re-registering tunnels")
+	if err := r.createSession(); err != nil {
+		return err
+	}
+
+	// Take back the tunnels that no other server claimed in the meantime
+	r.heldMutex.Lock()
+	tunnels := make([]*TunnelInfo, 0, len(r.held))
+	for _, info := range r.held {
+		tunnels = append(tunnels, info)
+	}
+	r.heldMutex.Unlock()
+
+	for _, info := range tunnels {
+		data, err := json.Marshal(info)
+		if err != nil {
+			continue
+		}
+		key := consulTunnelPrefix + info.Subdomain
+		if err := r.txn([]consulTxnOp{
+			{KV: consulTxnKV{Verb: "check-not-exists", Key: key}},
+			{KV: consulTxnKV{Verb: "lock", Key: key, Value: data, Session: r.currentSession()}},
+		}); err != nil {
+			r.logger.Warn("Failed to re-register tunnel", "subdomain", info.Subdomain, "error", err)
+			r.release(info.Subdomain)
+		}
+	}
+	return nil
+}
+
+// currentSession returns the ID of this server's session
+func (r *ConsulRegistry) currentSession() string {
+	r.sessionMutex.RLock()
+	defer r.sessionMutex.RUnlock()
+	return r.session
+}
+
+// passCheck reports this server as healthy to its catalog health check
+func (r *ConsulRegistry) passCheck() {
+	if _, err := r.do(http.MethodPut, "/v1/agent/check/pass/"+r.serverCheckID(), nil, nil, nil); err != nil {
+		r.logger.Warn("Failed to update Consul health check", "error", err)
+	}
+}
+
+// hold tracks a tunnel registered by this server and adds it to Consul's catalog
+func (r *ConsulRegistry) hold(info *TunnelInfo) {
+	r.heldMutex.Lock()
+	r.held[info.Subdomain] = info
+	r.heldMutex.Unlock()
+
+	service := map[string]interface{}{
+		"ID":      r.tunnelServiceID(info.Subdomain),
+		"Name":    consulTunnelService,
+		"Address": serviceAddress(info.ServerHost),
+		"Tags":    []string{info.Subdomain},
+		"Port":    info.ProxyPort,
+		"Meta": map[string]string{
+			"subdomain": info.Subdomain,
+			"server_id": r.serverID,
+			"client_id": info.ClientID,
+		},
+		// Healthy as long as the server serving it is
+		"Check": map[string]string{
+			"CheckID":      r.tunnelServiceID(info.Subdomain) + "-alias",
+			"AliasService": r.serverServiceID(),
+		},
+	}
+	if _, err := r.do(http.MethodPut, "/v1/agent/service/register", nil, service, nil); err != nil {
+		r.logger.Warn("Failed to register tunnel service", "subdomain", info.Subdomain, "error", err)
+	}
+}
+
+// release stops tracking a tunnel and removes it from Consul's catalog
+func (r *ConsulRegistry) release(subdomain string) {
+	r.heldMutex.Lock()
+	_, held := r.held[subdomain]
+	delete(r.held, subdomain)
+	r.heldMutex.Unlock()
+
+	if !held {
+		return
+	}
+	if _, err := r.do(http.MethodPut, "/v1/agent/service/deregister/"+r.tunnelServiceID(subdomain), nil, nil, nil); err != nil {
+		r.logger.Warn("Failed to deregister tunnel service", "subdomain", subdomain, "error", err)
+	}
+}
+
+// serviceAddress returns the address to register a service under ("" for wildcard bind addresses, so the agent's is used)
+func serviceAddress(host string) string {
+	if host == "0.0.0.0" || host == "::" {
+		return ""
+	}
+	return host
+}
+
+// serverServiceID is this server's catalog service ID
+func (r *ConsulRegistry) serverServiceID() string {
+	return consulServerService + "-" + r.serverID
+}
+
+// serverCheckID is the TTL health check of this server's catalog service
+func (r *ConsulRegistry) serverCheckID() string {
+	return r.serverServiceID() + "-ttl"
+}
+
+// tunnelServiceID is the catalog service ID of a tunnel served here (unique per server so migrations can overlap)
+func (r *ConsulRegistry) tunnelServiceID(subdomain string) string {
+	return consulTunnelService + "-" + r.serverID + "-" + subdomain
+}
+
+// watchTunnels clears the lookup cache whenever a tunnel changes, using Consul blocking queries
+func (r *ConsulRegistry) watchTunnels() {
+	index := "0"
+	for {
+		query := url.Values{"keys": {""}, "index": {index}, "wait": {consulWatchWait.String()}}
+		header, err := r.doWithTimeout(consulWatchWait+consulTimeout, http.MethodGet, "/v1/kv/"+consulTunnelPrefix, query, nil, nil)
+		if r.ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, errConsulNotFound) {
+			r.logger.Warn("Failed to watch tunnels", "error", err)
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		if next := header.Get("X-Consul-Index"); next != "" && next != index {
+			r.clearCache()
+			index = next
+		}
+	}
+}
+
+// getCached retrieves a tunnel from local cache
+func (r *ConsulRegistry) getCached(subdomain string) *TunnelInfo {
+	r.cacheMutex.RLock()
+	defer r.cacheMutex.RUnlock()
+
+	entry, exists := r.cache[subdomain]
+	if !exists || time.Now().After(entry.expiresAt) {
+		return nil
+	}
+	return entry.tunnel
+}
+
+// setCached stores a tunnel in local cache
+func (r *ConsulRegistry) setCached(subdomain string, tunnel *TunnelInfo) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	r.cache[subdomain] = &cacheEntry{
+		tunnel:    tunnel,
+		expiresAt: time.Now().Add(r.timings.CacheTTL),
+	}
+}
+
+// invalidateCache removes a tunnel from local cache
+func (r *ConsulRegistry) invalidateCache(subdomain string) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	delete(r.cache, subdomain)
+}
+
+// clearCache empties the local cache
+func (r *ConsulRegistry) clearCache() {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	r.cache = make(map[string]*cacheEntry)
+}
+
+// AddUsage increments usage counters with check-and-set writes, retrying when another server updated one first
+func (r *ConsulRegistry) AddUsage(counters []UsageCounter) ([]int64, error) {
+	totals := make([]int64, len(counters))
+	for i, counter := range counters {
+		total, err := r.addUsage(counter)
+		if err != nil {
+			return nil, err
+		}
+		totals[i] = total
+	}
+	return totals, nil
+}
+
+// addUsage increments one usage counter, returning its total
+func (r *ConsulRegistry) addUsage(counter UsageCounter) (int64, error) {
+	key := consulUsagePrefix + counter.Key
+	for attempt := 0; attempt < usageRetries; attempt++ {
+		entry, err := r.kvGet(key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get usage: %w", err)
+		}
+
+		var usage consulUsage
+		var index uint64 // 0 only creates the key if it doesn't exist
+		if entry != nil {
+			index = entry.ModifyIndex
+			if json.Unmarshal(entry.Value, &usage) != nil || time.Now().After(usage.ExpiresAt) {
+				usage = consulUsage{}
+			}
+		}
+		if counter.Delta == 0 {
+			return usage.Total, nil
+		}
+
+		usage.Total += counter.Delta
+		usage.ExpiresAt = time.Now().Add(counter.TTL)
+		data, err := json.Marshal(usage)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal usage: %w", err)
+		}
+		var written bool
+		if _, err := r.do(http.MethodPut, "/v1/kv/"+key, url.Values{"cas": {strconv.FormatUint(index, 10)}}, data, &written); err != nil {
+			return 0, fmt.Errorf("failed to add usage: %w", err)
+		}
+		if written {
+			return usage.Total, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to add usage: %s kept changing", counter.Key)
+}
+
+// sweepUsage deletes usage counters that expired, unless another server updated them since they were read
+func (r *ConsulRegistry) sweepUsage() {
+	entries, err := r.kvList(consulUsagePrefix)
+	if err != nil {
+		r.logger.Warn("Failed to list usage counters", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		var usage consulUsage
+		if err := json.Unmarshal(entry.Value, &usage); err == nil && now.Before(usage.ExpiresAt) {
+			continue
+		}
+		r.txn([]consulTxnOp{
+			{KV: consulTxnKV{Verb: "delete-cas", Key: entry.Key, Index: entry.ModifyIndex}},
+		})
+	}
+}
+
+// InitClusterCA stores ca unless another server stored a CA first (check-and-set on a missing key),
+// and returns the stored one
+func (r *ConsulRegistry) InitClusterCA(ca *ClusterCA) (*ClusterCA, error) {
+	data, err := json.Marshal(ca)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cluster CA: %w", err)
+	}
+	if _, err := r.do(http.MethodPut, "/v1/kv/"+consulClusterCAKey, url.Values{"cas": {"0"}}, data, nil); err != nil {
+		return nil, fmt.Errorf("failed to save cluster CA: %w", err)
+	}
+
+	entry, err := r.kvGet(consulClusterCAKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster CA: %w", err)
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("cluster CA was deleted")
+	}
+
+	var clusterCA ClusterCA
+	if err := json.Unmarshal(entry.Value, &clusterCA); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cluster CA: %w", err)
+	}
+	return &clusterCA, nil
+}
+
+// kvGet reads a KV entry (nil if it doesn't exist)
+func (r *ConsulRegistry) kvGet(key string) (*consulKV, error) {
+	var entries []consulKV
+	_, err := r.do(http.MethodGet, "/v1/kv/"+key, nil, nil, &entries)
+	if errors.Is(err, errConsulNotFound) || (err == nil && len(entries) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entries[0], nil
+}
+
+// kvList reads every KV entry under a prefix
+func (r *ConsulRegistry) kvList(prefix string) ([]consulKV, error) {
+	var entries []consulKV
+	_, err := r.do(http.MethodGet, "/v1/kv/"+prefix, url.Values{"recurse": {""}}, nil, &entries)
+	if errors.Is(err, errConsulNotFound) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// kvAcquire writes a KV entry held by this server's session
+func (r *ConsulRegistry) kvAcquire(key string, value []byte) error {
+	var acquired bool
+	if _, err := r.do(http.MethodPut, "/v1/kv/"+key, url.Values{"acquire": {r.currentSession()}}, value, &acquired); err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("%s is %w", key, errConsulHeld)
+	}
+	return nil
+}
+
+// kvDelete deletes a KV entry
+func (r *ConsulRegistry) kvDelete(key string) error {
+	_, err := r.do(http.MethodDelete, "/v1/kv/"+key, nil, nil, nil)
+	return err
+}
+
+// txn applies KV operations atomically, returning errConsulConflict if any of them fails
+func (r *ConsulRegistry) txn(ops []consulTxnOp) error {
+	_, err := r.do(http.MethodPut, "/v1/txn", nil, ops, nil)
+	return err
+}
+
+// do calls the Consul HTTP API with the default timeout
+func (r *ConsulRegistry) do(method, path string, query url.Values, body, out interface{}) (http.Header, error) {
+	return r.doWithTimeout(consulTimeout, method, path, query, body, out)
+}
+
+// doWithTimeout calls the Consul HTTP API, sending body ([]byte as is, anything else as JSON)
+// and decoding a JSON response into out
+func (r *ConsulRegistry) doWithTimeout(timeout time.Duration, method, path string, query url.Values, body, out interface{}) (http.Header, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, timeout)
+	defer cancel()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	target := r.address + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("X-Consul-Token", r.token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		io.Copy(io.Discard, resp.Body)
+		return resp.Header, errConsulNotFound
+	case resp.StatusCode == http.StatusConflict && path == "/v1/txn":
+		io.Copy(io.Discard, resp.Body)
+		return resp.Header, errConsulConflict
+	case resp.StatusCode != http.StatusOK:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.Header, fmt.Errorf("consul returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.Header, fmt.Errorf("failed to decode consul response: %w", err)
+		}
+	}
+	return resp.Header, nil
+}
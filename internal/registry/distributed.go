@@ -2,9 +2,14 @@ package registry
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,17 +28,48 @@ type TunnelInfo struct {
 	LastSeenAt  time.Time `json:"last_seen_at"`
 	ProxyPort   int       `json:"proxy_port"`
 	ControlPort int       `json:"control_port"`
+	ClusterPort int       `json:"cluster_port,omitempty"` // Mutual TLS port for proxying from other servers (0 = plain HTTP on ProxyPort)
+	NodeHost    string    `json:"node_host,omitempty"`    // The tunnel's host on its own server's node_domain, for redirects
+	DataPort    int       `json:"data_port,omitempty"`    // gRPC data plane port for proxying from other servers (0 = HTTP)
+	AccountID   string    `json:"account_id,omitempty"`
+
+	// Client metadata, refreshed periodically by the owning server
+	ClientVersion     string            `json:"client_version,omitempty"`
+	Authenticated     bool              `json:"authenticated"` // Connected with a secret key rather than anonymously
+	PasswordProtected bool              `json:"password_protected"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	BytesServed       int64             `json:"bytes_served"`       // Request and response bytes proxied for the subdomain
+	IPAllow           []string          `json:"ip_allow,omitempty"` // The tunnel's visitor IP lists, checked by the server a visitor reaches
+	IPDeny            []string          `json:"ip_deny,omitempty"`
+}
+
+// Account holds per-tenant limits (zero values mean unlimited)
+type Account struct {
+	ID                string   `json:"id"`
+	MaxTunnels        int      `json:"max_tunnels"`
+	SubDomainPrefixes []string `json:"subdomain_prefixes,omitempty"` // Subdomains must start with one of these
+	RateLimit         int      `json:"rate_limit"`                   // Requests per second across the account's tunnels
+	BandwidthDaily    int64    `json:"bandwidth_daily"`
+	BandwidthMonthly  int64    `json:"bandwidth_monthly"`
+	MaxStreams        int      `json:"max_streams,omitempty"` // Concurrent streams per tunnel client (0 = server default)
 }
 
 // ServerInfo stores information about a server in the cluster
 type ServerInfo struct {
-	ServerID          string    `json:"server_id"`
-	Host              string    `json:"host"`
-	ProxyPort         int       `json:"proxy_port"`
-	ControlPort       int       `json:"control_port"`
-	LastHeartbeat     time.Time `json:"last_heartbeat"`
-	ActiveTunnels     int       `json:"active_tunnels"`
-	ActiveConnections int       `json:"active_connections"` // For load-aware routing
+	ServerID      string    `json:"server_id"`
+	Host          string    `json:"host"`
+	ProxyPort     int       `json:"proxy_port"`
+	ControlPort   int       `json:"control_port"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	ActiveTunnels int       `json:"active_tunnels"`
+	Region        string    `json:"region,omitempty"` // Where the server runs, for geo-aware routing
+	Zone          string    `json:"zone,omitempty"`   // Availability zone within the region
+	// Load reported with heartbeats, weighed by LoadScore for load-aware routing
+	ActiveConnections int     `json:"active_connections"`
+	ActiveStreams     int     `json:"active_streams"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+	CPUPercent        float64 `json:"cpu_percent"`
+	MemoryBytes       uint64  `json:"memory_bytes"`
 }
 
 // cacheEntry represents a cached tunnel lookup
@@ -42,17 +78,148 @@ type cacheEntry struct {
 	expiresAt time.Time
 }
 
+// RedisOptions selects the Redis deployment: a single node by URL, a Redis Cluster, or Sentinel-managed failover
+// Credentials, TLS and pool settings override what the URL specifies (zero values keep the URL's or go-redis defaults)
+type RedisOptions struct {
+	URL              string   // Single node (redis:// or rediss://)
+	Addrs            []string // Cluster nodes, or sentinels when MasterName is set
+	MasterName       string   // Sentinel master name
+	Cluster          bool     // Treat a single address as a cluster endpoint
+	Username         string   // ACL user
+	Password         string
+	SentinelPassword string
+	DB               int // Single node and Sentinel only
+
+	// TLS (also enabled by a rediss:// URL)
+	TLS                   bool
+	TLSCAFile             string // Verify the server against this CA instead of the system roots
+	TLSCertFile           string // Client certificate for mutual TLS
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	// Connection pool
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// Enabled reports whether any Redis deployment is configured
+func (o RedisOptions) Enabled() bool {
+	return o.URL != "" || len(o.Addrs) > 0
+}
+
+// NewRedisClient connects to the Redis deployment described by opts
+func NewRedisClient(opts RedisOptions) (redis.UniversalClient, error) {
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.URL != "" {
+		single, err := redis.ParseURL(opts.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+		}
+		if opts.Username != "" {
+			single.Username = opts.Username
+		}
+		if opts.Password != "" {
+			single.Password = opts.Password
+		}
+		if opts.DB != 0 {
+			single.DB = opts.DB
+		}
+		if tlsConfig != nil {
+			if tlsConfig.ServerName == "" {
+				tlsConfig.ServerName, _, _ = net.SplitHostPort(single.Addr)
+			}
+			single.TLSConfig = tlsConfig
+		}
+		if opts.PoolSize > 0 {
+			single.PoolSize = opts.PoolSize
+		}
+		if opts.MinIdleConns > 0 {
+			single.MinIdleConns = opts.MinIdleConns
+		}
+		if opts.DialTimeout > 0 {
+			single.DialTimeout = opts.DialTimeout
+		}
+		if opts.ReadTimeout > 0 {
+			single.ReadTimeout = opts.ReadTimeout
+		}
+		if opts.WriteTimeout > 0 {
+			single.WriteTimeout = opts.WriteTimeout
+		}
+		return redis.NewClient(single), nil
+	}
+
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:            opts.Addrs,
+		MasterName:       opts.MasterName,
+		IsClusterMode:    opts.Cluster,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		SentinelPassword: opts.SentinelPassword,
+		DB:               opts.DB,
+		TLSConfig:        tlsConfig,
+		PoolSize:         opts.PoolSize,
+		MinIdleConns:     opts.MinIdleConns,
+		DialTimeout:      opts.DialTimeout,
+		ReadTimeout:      opts.ReadTimeout,
+		WriteTimeout:     opts.WriteTimeout,
+	}), nil
+}
+
+// tlsConfig builds the TLS configuration for Redis connections (nil when TLS is off)
+func (o RedisOptions) tlsConfig() (*tls.Config, error) {
+	if !o.TLS && !strings.HasPrefix(o.URL, "rediss://") {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.TLSServerName,
+		InsecureSkipVerify: o.TLSInsecureSkipVerify,
+	}
+	if o.TLSCAFile != "" {
+		pem, err := os.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis CA file %s", o.TLSCAFile)
+		}
+	}
+	if o.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
 // DistributedRegistry manages tunnel state across multiple servers using Redis
 type DistributedRegistry struct {
-	client   *redis.Client
+	client   redis.UniversalClient
+	cluster  bool // Keys touched together carry hash tags so they share a cluster slot
 	serverID string
 	logger   *slog.Logger
 	ctx      context.Context
+	timings  Timings
 
 	// Local cache for tunnel lookups
 	cache      map[string]*cacheEntry
 	cacheMutex sync.RWMutex
-	cacheTTL   time.Duration
+	stats      lookupStats
+
+	// Cluster leadership, held through a lease key
+	leadership leadership
 
 	// Pub/Sub for cache invalidation
 	pubsub *redis.PubSub
@@ -65,28 +232,32 @@ type DistributedRegistry struct {
 type registryMetrics struct {
 	redisOps       *prometheus.CounterVec
 	redisLatency   prometheus.Histogram
-	cacheHits      prometheus.Counter
-	cacheMisses    prometheus.Counter
-	tunnelCount    prometheus.Gauge
-	serverCount    prometheus.Gauge
 	pubsubMessages prometheus.Counter
 }
 
 const (
 	// Redis key prefixes
-	tunnelPrefix = "tunnel:"
-	serverPrefix = "server:"
+	tunnelPrefix      = "tunnel:"
+	serverPrefix      = "server:"
+	accountPrefix     = "account:"
+	migrationPrefix   = "migration:"
+	reservationPrefix = "reservation:"
+	usagePrefix       = "usage:"
+	leaderKey         = "cluster:leader"
+	clusterCAKey      = "cluster:ca"
 
 	// Redis Pub/Sub channels
 	tunnelUpdateChannel = "tunnel:updates"
+	tunnelEventChannel  = "tunnel:events" // Lifecycle events for external consumers
 
-	// Expiration times
-	tunnelTTL         = 30 * time.Second // Tunnels expire if not refreshed
-	serverTTL         = 10 * time.Second // Servers expire if heartbeat stops
-	heartbeatInterval = 5 * time.Second
+	// Default expiration times (see Timings)
+	defaultTunnelTTL         = 30 * time.Second
+	defaultServerTTL         = 10 * time.Second
+	defaultHeartbeatInterval = 5 * time.Second
+	defaultCacheTTL          = 2 * time.Second
 
-	// Cache settings
-	defaultCacheTTL = 2 * time.Second // Local cache TTL
+	// scanBatchSize is the SCAN count hint and the number of keys fetched per MGET when listing
+	scanBatchSize = 500
 )
 
 // initMetrics initializes Prometheus metrics
@@ -106,30 +277,6 @@ func initMetrics() *registryMetrics {
 				Buckets: prometheus.DefBuckets,
 			},
 		),
-		cacheHits: promauto.NewCounter(
-			prometheus.CounterOpts{
-				Name: "tungo_cache_hits_total",
-				Help: "Total number of cache hits",
-			},
-		),
-		cacheMisses: promauto.NewCounter(
-			prometheus.CounterOpts{
-				Name: "tungo_cache_misses_total",
-				Help: "Total number of cache misses",
-			},
-		),
-		tunnelCount: promauto.NewGauge(
-			prometheus.GaugeOpts{
-				Name: "tungo_tunnels_active",
-				Help: "Number of active tunnels",
-			},
-		),
-		serverCount: promauto.NewGauge(
-			prometheus.GaugeOpts{
-				Name: "tungo_servers_active",
-				Help: "Number of active servers in cluster",
-			},
-		),
 		pubsubMessages: promauto.NewCounter(
 			prometheus.CounterOpts{
 				Name: "tungo_pubsub_messages_total",
@@ -140,13 +287,13 @@ func initMetrics() *registryMetrics {
 }
 
 // NewDistributedRegistry creates a new distributed registry
-func NewDistributedRegistry(redisURL, serverID string, logger *slog.Logger) (*DistributedRegistry, error) {
-	opts, err := redis.ParseURL(redisURL)
+func NewDistributedRegistry(opts RedisOptions, timings Timings, serverID string, logger *slog.Logger) (*DistributedRegistry, error) {
+	timings = timings.withDefaults()
+
+	client, err := NewRedisClient(opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+		return nil, err
 	}
-
-	client := redis.NewClient(opts)
 	ctx := context.Background()
 
 	// Test connection
@@ -154,20 +301,27 @@ func NewDistributedRegistry(redisURL, serverID string, logger *slog.Logger) (*Di
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	logger.Info("Connected to Redis", "url", redisURL, "server_id", serverID)
+	_, cluster := client.(*redis.ClusterClient)
+	logger.Info("Connected to Redis",
+		"addrs", redisAddrs(opts),
+		"cluster", cluster,
+		"sentinel_master", opts.MasterName,
+		"server_id", serverID)
 
 	// Initialize pub/sub for cache invalidation
 	pubsub := client.Subscribe(ctx, tunnelUpdateChannel)
 
 	registry := &DistributedRegistry{
-		client:   client,
-		serverID: serverID,
-		logger:   logger,
-		ctx:      ctx,
-		cache:    make(map[string]*cacheEntry),
-		cacheTTL: defaultCacheTTL,
-		pubsub:   pubsub,
-		metrics:  initMetrics(),
+		client:     client,
+		cluster:    cluster,
+		serverID:   serverID,
+		logger:     logger,
+		ctx:        ctx,
+		cache:      make(map[string]*cacheEntry),
+		timings:    timings,
+		leadership: leadership{lease: timings.ServerTTL},
+		pubsub:     pubsub,
+		metrics:    initMetrics(),
 	}
 
 	// Start pub/sub listener for cache invalidation
@@ -179,6 +333,33 @@ func NewDistributedRegistry(redisURL, serverID string, logger *slog.Logger) (*Di
 	return registry, nil
 }
 
+// redisAddrs describes the configured Redis addresses for logging (without credentials)
+func redisAddrs(opts RedisOptions) []string {
+	if opts.URL == "" {
+		return opts.Addrs
+	}
+	if parsed, err := redis.ParseURL(opts.URL); err == nil {
+		return []string{parsed.Addr}
+	}
+	return nil
+}
+
+// tunnelKey returns the Redis key of a tunnel
+func (r *DistributedRegistry) tunnelKey(subdomain string) string {
+	if r.cluster {
+		return tunnelPrefix + "{" + subdomain + "}"
+	}
+	return tunnelPrefix + subdomain
+}
+
+// migrationKey returns the Redis key of a migration token, in the same cluster slot as its tunnel
+func (r *DistributedRegistry) migrationKey(subdomain, token string) string {
+	if r.cluster {
+		return migrationPrefix + "{" + subdomain + "}:" + token
+	}
+	return migrationPrefix + token
+}
+
 // RegisterTunnel registers a tunnel in the distributed registry
 func (r *DistributedRegistry) RegisterTunnel(info *TunnelInfo) error {
 	info.ServerID = r.serverID
@@ -194,10 +375,10 @@ func (r *DistributedRegistry) RegisterTunnel(info *TunnelInfo) error {
 		return fmt.Errorf("failed to marshal tunnel info: %w", err)
 	}
 
-	key := tunnelPrefix + info.Subdomain
+	key := r.tunnelKey(info.Subdomain)
 
 	start := time.Now()
-	if err := r.client.Set(r.ctx, key, data, tunnelTTL).Err(); err != nil {
+	if err := r.client.Set(r.ctx, key, data, r.timings.TunnelTTL).Err(); err != nil {
 		r.metrics.redisOps.WithLabelValues("register_tunnel", "error").Inc()
 		return fmt.Errorf("failed to register tunnel: %w", err)
 	}
@@ -220,17 +401,17 @@ func (r *DistributedRegistry) RegisterTunnel(info *TunnelInfo) error {
 func (r *DistributedRegistry) GetTunnel(subdomain string) (*TunnelInfo, error) {
 	// Check local cache first
 	if cached := r.getCached(subdomain); cached != nil {
-		r.metrics.cacheHits.Inc()
+		r.stats.hit()
 		return cached, nil
 	}
-	r.metrics.cacheMisses.Inc()
 
 	// Cache miss, fetch from Redis
-	key := tunnelPrefix + subdomain
+	key := r.tunnelKey(subdomain)
 
 	start := time.Now()
 	data, err := r.client.Get(r.ctx, key).Result()
 	r.metrics.redisLatency.Observe(time.Since(start).Seconds())
+	r.stats.miss(time.Since(start))
 
 	if err == redis.Nil {
 		r.metrics.redisOps.WithLabelValues("get_tunnel", "not_found").Inc()
@@ -255,7 +436,7 @@ func (r *DistributedRegistry) GetTunnel(subdomain string) (*TunnelInfo, error) {
 
 // UnregisterTunnel removes a tunnel from the registry
 func (r *DistributedRegistry) UnregisterTunnel(subdomain string) error {
-	key := tunnelPrefix + subdomain
+	key := r.tunnelKey(subdomain)
 
 	start := time.Now()
 	if err := r.client.Del(r.ctx, key).Err(); err != nil {
@@ -273,15 +454,110 @@ func (r *DistributedRegistry) UnregisterTunnel(subdomain string) error {
 	return nil
 }
 
-// RefreshTunnel updates the last seen time for a tunnel
-func (r *DistributedRegistry) RefreshTunnel(subdomain string) error {
-	info, err := r.GetTunnel(subdomain)
+// completeMigrationScript consumes a migration token and overwrites the tunnel entry in one step
+// Returns 1 on success, 0 for an unknown token and -1 for a token issued for another subdomain
+var completeMigrationScript = redis.NewScript(`
+local subdomain = redis.call('GET', KEYS[1])
+if not subdomain then return 0 end
+if subdomain ~= ARGV[1] then return -1 end
+redis.call('DEL', KEYS[1])
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// CreateMigration issues a one-time token letting another server take over a tunnel
+func (r *DistributedRegistry) CreateMigration(subdomain string) (string, error) {
+	token, err := newMigrationToken()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("failed to generate migration token: %w", err)
+	}
+
+	if err := r.client.Set(r.ctx, r.migrationKey(subdomain, token), subdomain, migrationTTL).Err(); err != nil {
+		r.metrics.redisOps.WithLabelValues("create_migration", "error").Inc()
+		return "", fmt.Errorf("failed to create migration: %w", err)
 	}
+	r.metrics.redisOps.WithLabelValues("create_migration", "success").Inc()
+
+	return token, nil
+}
 
+// CompleteMigration consumes a migration token and registers the tunnel on this server,
+// replacing the previous server's entry without the tunnel ever being unregistered
+func (r *DistributedRegistry) CompleteMigration(token string, info *TunnelInfo) error {
+	info.ServerID = r.serverID
 	info.LastSeenAt = time.Now()
-	return r.RegisterTunnel(info)
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = time.Now()
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tunnel info: %w", err)
+	}
+
+	start := time.Now()
+	result, err := completeMigrationScript.Run(r.ctx, r.client,
+		[]string{r.migrationKey(info.Subdomain, token), r.tunnelKey(info.Subdomain)},
+		info.Subdomain, data, r.timings.TunnelTTL.Milliseconds()).Int()
+	if err != nil {
+		r.metrics.redisOps.WithLabelValues("complete_migration", "error").Inc()
+		return fmt.Errorf("failed to complete migration: %w", err)
+	}
+	r.metrics.redisLatency.Observe(time.Since(start).Seconds())
+	if result != 1 {
+		r.metrics.redisOps.WithLabelValues("complete_migration", "not_found").Inc()
+		return ErrMigrationInvalid
+	}
+	r.metrics.redisOps.WithLabelValues("complete_migration", "success").Inc()
+
+	// Invalidate cache and notify other servers
+	r.invalidateCache(info.Subdomain)
+	r.publishUpdate(info.Subdomain, "register")
+
+	r.logger.Info("Migrated tunnel",
+		"subdomain", info.Subdomain,
+		"server_id", info.ServerID,
+		"client_id", info.ClientID)
+
+	return nil
+}
+
+// refreshTunnelScript rewrites a tunnel entry unless another server owns it
+// Returns 1 on success and 0 if the entry belongs to another server
+var refreshTunnelScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and cjson.decode(current).server_id ~= ARGV[1] then return 0 end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// RefreshTunnel rewrites a tunnel's metadata and extends its TTL
+func (r *DistributedRegistry) RefreshTunnel(info *TunnelInfo) error {
+	info.ServerID = r.serverID
+	info.LastSeenAt = time.Now()
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tunnel info: %w", err)
+	}
+
+	start := time.Now()
+	result, err := refreshTunnelScript.Run(r.ctx, r.client,
+		[]string{r.tunnelKey(info.Subdomain)},
+		r.serverID, data, r.timings.TunnelTTL.Milliseconds()).Int()
+	if err != nil {
+		r.metrics.redisOps.WithLabelValues("refresh_tunnel", "error").Inc()
+		return fmt.Errorf("failed to refresh tunnel: %w", err)
+	}
+	r.metrics.redisLatency.Observe(time.Since(start).Seconds())
+	if result != 1 {
+		r.metrics.redisOps.WithLabelValues("refresh_tunnel", "moved").Inc()
+		return ErrTunnelMoved
+	}
+	r.metrics.redisOps.WithLabelValues("refresh_tunnel", "success").Inc()
+
+	r.invalidateCache(info.Subdomain)
+	return nil
 }
 
 // RegisterServer registers this server in the cluster
@@ -295,7 +571,7 @@ func (r *DistributedRegistry) RegisterServer(info *ServerInfo) error {
 	}
 
 	key := serverPrefix + r.serverID
-	if err := r.client.Set(r.ctx, key, data, serverTTL).Err(); err != nil {
+	if err := r.client.Set(r.ctx, key, data, r.timings.ServerTTL).Err(); err != nil {
 		return fmt.Errorf("failed to register server: %w", err)
 	}
 
@@ -323,64 +599,131 @@ func (r *DistributedRegistry) GetServer(serverID string) (*ServerInfo, error) {
 
 // GetAllServers returns all active servers in the cluster
 func (r *DistributedRegistry) GetAllServers() ([]*ServerInfo, error) {
-	pattern := serverPrefix + "*"
-	keys, err := r.client.Keys(r.ctx, pattern).Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get server keys: %w", err)
-	}
-
-	servers := make([]*ServerInfo, 0, len(keys))
-	for _, key := range keys {
-		data, err := r.client.Get(r.ctx, key).Result()
-		if err != nil {
-			continue // Skip expired or deleted keys
-		}
-
+	servers := make([]*ServerInfo, 0)
+	err := r.scanValues(serverPrefix+"*", func(key, data string) {
 		var info ServerInfo
 		if err := json.Unmarshal([]byte(data), &info); err != nil {
 			r.logger.Warn("Failed to unmarshal server info", "key", key, "error", err)
-			continue
+			return
 		}
-
 		servers = append(servers, &info)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %w", err)
 	}
 
 	return servers, nil
 }
 
-// GetAllTunnels returns all active tunnels across all servers
-func (r *DistributedRegistry) GetAllTunnels() ([]*TunnelInfo, error) {
-	pattern := tunnelPrefix + "*"
-	keys, err := r.client.Keys(r.ctx, pattern).Result()
+// GetServersInRegion returns the servers that declared region
+func (r *DistributedRegistry) GetServersInRegion(region string) ([]*ServerInfo, error) {
+	servers, err := r.GetAllServers()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get tunnel keys: %w", err)
+		return nil, err
 	}
+	return serversInRegion(servers, region), nil
+}
 
-	tunnels := make([]*TunnelInfo, 0, len(keys))
-	for _, key := range keys {
-		data, err := r.client.Get(r.ctx, key).Result()
-		if err != nil {
-			continue // Skip expired or deleted keys
-		}
-
+// GetAllTunnels returns all active tunnels across all servers
+func (r *DistributedRegistry) GetAllTunnels() ([]*TunnelInfo, error) {
+	tunnels := make([]*TunnelInfo, 0)
+	err := r.scanValues(tunnelPrefix+"*", func(key, data string) {
 		var info TunnelInfo
 		if err := json.Unmarshal([]byte(data), &info); err != nil {
 			r.logger.Warn("Failed to unmarshal tunnel info", "key", key, "error", err)
-			continue
+			return
 		}
-
 		tunnels = append(tunnels, &info)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnels: %w", err)
 	}
 
 	return tunnels, nil
 }
 
-// StartHeartbeat starts sending periodic heartbeats for this server
+// scanValues calls fn with the value of every key matching pattern
+// Keys are walked with SCAN rather than KEYS so large keyspaces don't block Redis, on every master of a cluster
+func (r *DistributedRegistry) scanValues(pattern string, fn func(key, data string)) error {
+	start := time.Now()
+	defer func() { r.metrics.redisLatency.Observe(time.Since(start).Seconds()) }()
+
+	var err error
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		// Masters are scanned concurrently
+		var mutex sync.Mutex
+		err = cluster.ForEachMaster(r.ctx, func(ctx context.Context, node *redis.Client) error {
+			return r.scanNode(node, pattern, func(key, data string) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				fn(key, data)
+			})
+		})
+	} else {
+		err = r.scanNode(r.client, pattern, fn)
+	}
+	if err != nil {
+		r.metrics.redisOps.WithLabelValues("scan", "error").Inc()
+		return err
+	}
+	r.metrics.redisOps.WithLabelValues("scan", "success").Inc()
+
+	return nil
+}
+
+// scanNode scans one Redis node, fetching values in pipelined batches (MGET can't span cluster slots)
+func (r *DistributedRegistry) scanNode(client redis.UniversalClient, pattern string, fn func(key, data string)) error {
+	keys := make([]string, 0, scanBatchSize)
+	fetch := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		pipe := client.Pipeline()
+		gets := make([]*redis.StringCmd, len(keys))
+		for i, key := range keys {
+			gets[i] = pipe.Get(r.ctx, key)
+		}
+		if _, err := pipe.Exec(r.ctx); err != nil && err != redis.Nil {
+			return err
+		}
+		for i, get := range gets {
+			if data, err := get.Result(); err == nil { // Skip expired or deleted keys
+				fn(keys[i], data)
+			}
+		}
+		keys = keys[:0]
+		return nil
+	}
+
+	// SCAN may return a key more than once
+	seen := make(map[string]struct{})
+	iter := client.Scan(r.ctx, 0, pattern, scanBatchSize).Iterator()
+	for iter.Next(r.ctx) {
+		key := iter.Val()
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+		if len(keys) == scanBatchSize {
+			if err := fetch(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return fetch()
+}
+
+// StartHeartbeat starts sending periodic heartbeats for this server and campaigning for leadership
 func (r *DistributedRegistry) StartHeartbeat(serverInfo *ServerInfo) {
 	go func() {
-		ticker := time.NewTicker(heartbeatInterval)
+		ticker := time.NewTicker(r.timings.HeartbeatInterval)
 		defer ticker.Stop()
 
+		r.campaign()
 		for {
 			select {
 			case <-r.ctx.Done():
@@ -389,15 +732,63 @@ func (r *DistributedRegistry) StartHeartbeat(serverInfo *ServerInfo) {
 				if err := r.RegisterServer(serverInfo); err != nil {
 					r.logger.Error("Failed to send heartbeat", "error", err)
 				}
+				r.campaign()
 			}
 		}
 	}()
 
-	r.logger.Info("Started heartbeat", "interval", heartbeatInterval)
+	r.logger.Info("Started heartbeat", "interval", r.timings.HeartbeatInterval)
+}
+
+// campaignScript renews the leader lease if this server holds it, or takes it if nobody does
+// Returns 1 if this server is the leader
+var campaignScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then return 1 end
+return 0
+`)
+
+// resignScript deletes the leader lease if this server holds it
+var resignScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0
+`)
+
+// campaign runs one election round (a failed round gives up leadership)
+func (r *DistributedRegistry) campaign() {
+	result, err := campaignScript.Run(r.ctx, r.client, []string{leaderKey}, r.serverID, r.timings.ServerTTL.Milliseconds()).Int()
+	if err != nil {
+		r.metrics.redisOps.WithLabelValues("campaign", "error").Inc()
+		r.logger.Warn("Failed to campaign for leadership", "error", err)
+	}
+	r.leadership.set(err == nil && result == 1, r.logger, r.serverID)
+}
+
+// IsLeader reports whether this server currently leads the cluster
+func (r *DistributedRegistry) IsLeader() bool {
+	return r.leadership.isLeader()
+}
+
+// Ping checks that Redis is reachable
+func (r *DistributedRegistry) Ping() error {
+	ctx, cancel := context.WithTimeout(r.ctx, 2*time.Second)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
 }
 
 // Close closes the Redis connection
 func (r *DistributedRegistry) Close() error {
+	// Hand leadership over without waiting for the lease to expire
+	if r.leadership.isLeader() {
+		if err := resignScript.Run(r.ctx, r.client, []string{leaderKey}, r.serverID).Err(); err != nil {
+			r.logger.Warn("Failed to resign leadership", "error", err)
+		}
+		r.leadership.resign(r.logger, r.serverID)
+	}
+
 	// Unregister this server
 	key := serverPrefix + r.serverID
 	if err := r.client.Del(r.ctx, key).Err(); err != nil {
@@ -446,7 +837,7 @@ func (r *DistributedRegistry) setCached(subdomain string, tunnel *TunnelInfo) {
 
 	r.cache[subdomain] = &cacheEntry{
 		tunnel:    tunnel,
-		expiresAt: time.Now().Add(r.cacheTTL),
+		expiresAt: time.Now().Add(r.timings.CacheTTL),
 	}
 }
 
@@ -466,6 +857,191 @@ func (r *DistributedRegistry) publishUpdate(subdomain, action string) {
 	}
 }
 
+// SaveAccount stores an account under the hash of its secret key
+func (r *DistributedRegistry) SaveAccount(secretKey string, account *Account) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal account: %w", err)
+	}
+
+	if err := r.client.Set(r.ctx, accountPrefix+accountKey(secretKey), data, 0).Err(); err != nil {
+		r.metrics.redisOps.WithLabelValues("save_account", "error").Inc()
+		return fmt.Errorf("failed to save account: %w", err)
+	}
+	r.metrics.redisOps.WithLabelValues("save_account", "success").Inc()
+
+	return nil
+}
+
+// GetAccount retrieves the account for a secret key
+func (r *DistributedRegistry) GetAccount(secretKey string) (*Account, error) {
+	data, err := r.client.Get(r.ctx, accountPrefix+accountKey(secretKey)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		r.metrics.redisOps.WithLabelValues("get_account", "error").Inc()
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	r.metrics.redisOps.WithLabelValues("get_account", "success").Inc()
+
+	var account Account
+	if err := json.Unmarshal([]byte(data), &account); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal account: %w", err)
+	}
+	return &account, nil
+}
+
+// DeleteAccount removes the account for a secret key
+func (r *DistributedRegistry) DeleteAccount(secretKey string) error {
+	if err := r.client.Del(r.ctx, accountPrefix+accountKey(secretKey)).Err(); err != nil {
+		r.metrics.redisOps.WithLabelValues("delete_account", "error").Inc()
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+	r.metrics.redisOps.WithLabelValues("delete_account", "success").Inc()
+
+	return nil
+}
+
+// ReserveSubdomain stores a reservation, expiring it with the key when it has an expiry
+func (r *DistributedRegistry) ReserveSubdomain(reservation *Reservation) error {
+	data, err := json.Marshal(reservation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reservation: %w", err)
+	}
+
+	var ttl time.Duration
+	if !reservation.ExpiresAt.IsZero() {
+		if ttl = time.Until(reservation.ExpiresAt); ttl <= 0 {
+			return r.DeleteReservation(reservation.Subdomain)
+		}
+	}
+
+	if err := r.client.Set(r.ctx, reservationPrefix+reservation.Subdomain, data, ttl).Err(); err != nil {
+		r.metrics.redisOps.WithLabelValues("reserve_subdomain", "error").Inc()
+		return fmt.Errorf("failed to save reservation: %w", err)
+	}
+	r.metrics.redisOps.WithLabelValues("reserve_subdomain", "success").Inc()
+
+	return nil
+}
+
+// GetReservation retrieves the reservation for a subdomain
+func (r *DistributedRegistry) GetReservation(subdomain string) (*Reservation, error) {
+	data, err := r.client.Get(r.ctx, reservationPrefix+subdomain).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		r.metrics.redisOps.WithLabelValues("get_reservation", "error").Inc()
+		return nil, fmt.Errorf("failed to get reservation: %w", err)
+	}
+	r.metrics.redisOps.WithLabelValues("get_reservation", "success").Inc()
+
+	var reservation Reservation
+	if err := json.Unmarshal([]byte(data), &reservation); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reservation: %w", err)
+	}
+	if reservation.Expired() {
+		return nil, nil
+	}
+	return &reservation, nil
+}
+
+// DeleteReservation releases a subdomain reservation
+func (r *DistributedRegistry) DeleteReservation(subdomain string) error {
+	if err := r.client.Del(r.ctx, reservationPrefix+subdomain).Err(); err != nil {
+		r.metrics.redisOps.WithLabelValues("delete_reservation", "error").Inc()
+		return fmt.Errorf("failed to delete reservation: %w", err)
+	}
+	r.metrics.redisOps.WithLabelValues("delete_reservation", "success").Inc()
+
+	return nil
+}
+
+// AddUsage increments usage counters in one pipeline, restarting the TTL of those that changed
+func (r *DistributedRegistry) AddUsage(counters []UsageCounter) ([]int64, error) {
+	if len(counters) == 0 {
+		return nil, nil
+	}
+
+	// Reads use GET so a counter that was never written isn't created without a TTL
+	pipe := r.client.Pipeline()
+	cmds := make([]redis.Cmder, len(counters))
+	for i, counter := range counters {
+		key := usagePrefix + counter.Key
+		if counter.Delta == 0 {
+			cmds[i] = pipe.Get(r.ctx, key)
+			continue
+		}
+		cmds[i] = pipe.IncrBy(r.ctx, key, counter.Delta)
+		pipe.Expire(r.ctx, key, counter.TTL)
+	}
+	if _, err := pipe.Exec(r.ctx); err != nil && err != redis.Nil {
+		r.metrics.redisOps.WithLabelValues("add_usage", "error").Inc()
+		return nil, fmt.Errorf("failed to add usage: %w", err)
+	}
+	r.metrics.redisOps.WithLabelValues("add_usage", "success").Inc()
+
+	totals := make([]int64, len(counters))
+	for i, cmd := range cmds {
+		switch cmd := cmd.(type) {
+		case *redis.IntCmd:
+			totals[i] = cmd.Val()
+		case *redis.StringCmd:
+			totals[i], _ = cmd.Int64() // Zero for a counter that doesn't exist
+		}
+	}
+	return totals, nil
+}
+
+// InitClusterCA stores ca unless another server stored a CA first, and returns the stored one
+func (r *DistributedRegistry) InitClusterCA(ca *ClusterCA) (*ClusterCA, error) {
+	data, err := json.Marshal(ca)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cluster CA: %w", err)
+	}
+	if err := r.client.SetNX(r.ctx, clusterCAKey, data, 0).Err(); err != nil {
+		r.metrics.redisOps.WithLabelValues("init_cluster_ca", "error").Inc()
+		return nil, fmt.Errorf("failed to save cluster CA: %w", err)
+	}
+
+	stored, err := r.client.Get(r.ctx, clusterCAKey).Result()
+	if err != nil {
+		r.metrics.redisOps.WithLabelValues("init_cluster_ca", "error").Inc()
+		return nil, fmt.Errorf("failed to get cluster CA: %w", err)
+	}
+	r.metrics.redisOps.WithLabelValues("init_cluster_ca", "success").Inc()
+
+	var clusterCA ClusterCA
+	if err := json.Unmarshal([]byte(stored), &clusterCA); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cluster CA: %w", err)
+	}
+	return &clusterCA, nil
+}
+
+// PublishEvent publishes a lifecycle event for external consumers
+func (r *DistributedRegistry) PublishEvent(payload []byte) error {
+	return r.client.Publish(r.ctx, tunnelEventChannel, payload).Err()
+}
+
+// SubscribeEvents delivers lifecycle events published by any server on a dedicated Pub/Sub connection
+func (r *DistributedRegistry) SubscribeEvents(handler func(payload []byte)) (func(), error) {
+	pubsub := r.client.Subscribe(r.ctx, tunnelEventChannel)
+	if _, err := pubsub.Receive(r.ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to events: %w", err)
+	}
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			handler([]byte(msg.Payload))
+		}
+	}()
+
+	return func() { pubsub.Close() }, nil
+}
+
 // listenForUpdates listens for tunnel updates via Pub/Sub and invalidates cache
 func (r *DistributedRegistry) listenForUpdates() {
 	ch := r.pubsub.Channel()
@@ -514,7 +1090,7 @@ func (r *DistributedRegistry) cleanupCache() {
 	}
 }
 
-// GetLeastLoadedServer returns the server with the lowest active connections
+// GetLeastLoadedServer returns the server with the lowest load score
 func (r *DistributedRegistry) GetLeastLoadedServer() (*ServerInfo, error) {
 	servers, err := r.GetAllServers()
 	if err != nil {
@@ -525,21 +1101,11 @@ func (r *DistributedRegistry) GetLeastLoadedServer() (*ServerInfo, error) {
 		return nil, fmt.Errorf("no servers available")
 	}
 
-	var leastLoaded *ServerInfo
-	minConnections := int(^uint(0) >> 1) // Max int
-
-	for i := range servers {
-		if servers[i].ActiveConnections < minConnections {
-			minConnections = servers[i].ActiveConnections
-			leastLoaded = servers[i] // servers[i] is already a pointer
-		}
-	}
-
-	return leastLoaded, nil
+	return leastLoaded(servers), nil
 }
 
-// UpdateServerLoad updates the active connections count for this server
-func (r *DistributedRegistry) UpdateServerLoad(activeConnections int) error {
+// UpdateServerLoad records this server's current load
+func (r *DistributedRegistry) UpdateServerLoad(load ServerLoad) error {
 	key := serverPrefix + r.serverID
 
 	data, err := r.client.Get(r.ctx, key).Result()
@@ -552,7 +1118,7 @@ func (r *DistributedRegistry) UpdateServerLoad(activeConnections int) error {
 		return fmt.Errorf("failed to unmarshal server info: %w", err)
 	}
 
-	info.ActiveConnections = activeConnections
+	info.apply(load)
 	info.LastHeartbeat = time.Now()
 
 	newData, err := json.Marshal(&info)
@@ -560,7 +1126,7 @@ func (r *DistributedRegistry) UpdateServerLoad(activeConnections int) error {
 		return fmt.Errorf("failed to marshal server info: %w", err)
 	}
 
-	if err := r.client.Set(r.ctx, key, newData, serverTTL).Err(); err != nil {
+	if err := r.client.Set(r.ctx, key, newData, r.timings.ServerTTL).Err(); err != nil {
 		return fmt.Errorf("failed to update server load: %w", err)
 	}
 
@@ -568,8 +1134,11 @@ func (r *DistributedRegistry) UpdateServerLoad(activeConnections int) error {
 }
 
 // GetCacheStats returns cache hit/miss statistics
-func (r *DistributedRegistry) GetCacheStats() (hits, misses int, hitRate float64) {
-	// Note: In production, you'd want to track these properly
-	// For now, this is a placeholder - metrics are exported via Prometheus
-	return 0, 0, 0.0
+func (r *DistributedRegistry) GetCacheStats() CacheStats {
+	return r.stats.snapshot()
+}
+
+// InvalidateTunnel drops the cached lookup for a subdomain
+func (r *DistributedRegistry) InvalidateTunnel(subdomain string) {
+	r.invalidateCache(subdomain)
 }
@@ -11,17 +11,42 @@ import (
 type InMemoryRegistry struct {
     serverID      string
     logger        *slog.Logger
+    timings       Timings
     tunnels       map[string]*TunnelInfo
     tunnelsMutex  sync.RWMutex
     servers       map[string]*ServerInfo
     serversMutex  sync.RWMutex
-    lookups       int
-    hits          int
+    accounts      map[string]*Account
+    accountsMutex sync.RWMutex
+    reservations  map[string]*Reservation
+    reserveMutex  sync.RWMutex
+    clusterCA     *ClusterCA
+    clusterCAMu   sync.Mutex
+    migrations    map[string]pendingMigration // Keyed by token
+    migrationsMu  sync.Mutex
+    usage         map[string]usageValue
+    usageMu       sync.Mutex
+    stats         lookupStats
     heartbeatStop chan struct{}
+    subscribers   map[int]func(payload []byte)
+    nextSub       int
+    subscribersMu sync.RWMutex
+}
+
+// pendingMigration is an unclaimed migration token
+type pendingMigration struct {
+    subdomain string
+    expiresAt time.Time
+}
+
+// usageValue is a usage counter and when it expires
+type usageValue struct {
+    total     int64
+    expiresAt time.Time
 }
 
 // NewInMemoryRegistry creates a new in-memory registry
-func NewInMemoryRegistry(serverID string, logger interface{}) (*InMemoryRegistry, error) {
+func NewInMemoryRegistry(timings Timings, serverID string, logger interface{}) (*InMemoryRegistry, error) {
     slogger, ok := logger.(*slog.Logger)
     if !ok {
         slogger = slog.Default()
@@ -32,9 +57,15 @@ func NewInMemoryRegistry(serverID string, logger interface{}) (*InMemoryRegistry
     registry := &InMemoryRegistry{
         serverID:      serverID,
         logger:        slogger,
+        timings:       timings.withDefaults(),
         tunnels:       make(map[string]*TunnelInfo),
         servers:       make(map[string]*ServerInfo),
+        accounts:      make(map[string]*Account),
+        reservations:  make(map[string]*Reservation),
+        migrations:    make(map[string]pendingMigration),
+        usage:         make(map[string]usageValue),
         heartbeatStop: make(chan struct{}),
+        subscribers:   make(map[int]func(payload []byte)),
     }
 
     go registry.cleanupExpiredTunnels()
@@ -60,19 +91,20 @@ func (r *InMemoryRegistry) RegisterTunnel(info *TunnelInfo) error {
 
 // GetTunnel retrieves tunnel information
 func (r *InMemoryRegistry) GetTunnel(subdomain string) (*TunnelInfo, error) {
+    start := time.Now()
     r.tunnelsMutex.RLock()
     defer r.tunnelsMutex.RUnlock()
 
-    r.lookups++
-
+    // Everything is in memory, so lookups of known tunnels count as hits
     tunnel, exists := r.tunnels[subdomain]
     if !exists {
+        r.stats.miss(time.Since(start))
         return nil, fmt.Errorf("tunnel not found: %s", subdomain)
     }
 
-    r.hits++
+    r.stats.hit()
 
-    if time.Since(tunnel.LastSeenAt) > tunnelTTL {
+    if time.Since(tunnel.LastSeenAt) > r.timings.TunnelTTL {
         return nil, fmt.Errorf("tunnel expired: %s", subdomain)
     }
 
@@ -89,17 +121,16 @@ func (r *InMemoryRegistry) UnregisterTunnel(subdomain string) error {
     return nil
 }
 
-// RefreshTunnel updates the last seen timestamp
-func (r *InMemoryRegistry) RefreshTunnel(subdomain string) error {
+// RefreshTunnel replaces a tunnel's metadata and updates its last seen timestamp
+func (r *InMemoryRegistry) RefreshTunnel(info *TunnelInfo) error {
     r.tunnelsMutex.Lock()
     defer r.tunnelsMutex.Unlock()
 
-    tunnel, exists := r.tunnels[subdomain]
-    if !exists {
-        return fmt.Errorf("tunnel not found: %s", subdomain)
-    }
+    info.ServerID = r.serverID
+    info.LastSeenAt = time.Now()
 
-    tunnel.LastSeenAt = time.Now()
+    refreshed := *info
+    r.tunnels[info.Subdomain] = &refreshed
     return nil
 }
 
@@ -112,7 +143,7 @@ func (r *InMemoryRegistry) GetAllTunnels() ([]*TunnelInfo, error) {
     now := time.Now()
 
     for _, tunnel := range r.tunnels {
-        if now.Sub(tunnel.LastSeenAt) <= tunnelTTL {
+        if now.Sub(tunnel.LastSeenAt) <= r.timings.TunnelTTL {
             tunnels = append(tunnels, tunnel)
         }
     }
@@ -166,10 +197,139 @@ func (r *InMemoryRegistry) GetAllServers() ([]*ServerInfo, error) {
     return servers, nil
 }
 
+// GetServersInRegion returns the servers that declared region
+func (r *InMemoryRegistry) GetServersInRegion(region string) ([]*ServerInfo, error) {
+    servers, err := r.GetAllServers()
+    if err != nil {
+        return nil, err
+    }
+    return serversInRegion(servers, region), nil
+}
+
+// SaveAccount stores an account under the hash of its secret key
+func (r *InMemoryRegistry) SaveAccount(secretKey string, account *Account) error {
+    r.accountsMutex.Lock()
+    defer r.accountsMutex.Unlock()
+
+    r.accounts[accountKey(secretKey)] = account
+    return nil
+}
+
+// GetAccount retrieves the account for a secret key
+func (r *InMemoryRegistry) GetAccount(secretKey string) (*Account, error) {
+    r.accountsMutex.RLock()
+    defer r.accountsMutex.RUnlock()
+
+    return r.accounts[accountKey(secretKey)], nil
+}
+
+// DeleteAccount removes the account for a secret key
+func (r *InMemoryRegistry) DeleteAccount(secretKey string) error {
+    r.accountsMutex.Lock()
+    defer r.accountsMutex.Unlock()
+
+    delete(r.accounts, accountKey(secretKey))
+    return nil
+}
+
+// ReserveSubdomain stores a reservation (lost on restart, like everything in memory)
+func (r *InMemoryRegistry) ReserveSubdomain(reservation *Reservation) error {
+    r.reserveMutex.Lock()
+    defer r.reserveMutex.Unlock()
+
+    r.reservations[reservation.Subdomain] = reservation
+    return nil
+}
+
+// GetReservation retrieves the reservation for a subdomain
+func (r *InMemoryRegistry) GetReservation(subdomain string) (*Reservation, error) {
+    r.reserveMutex.Lock()
+    defer r.reserveMutex.Unlock()
+
+    reservation, exists := r.reservations[subdomain]
+    if !exists {
+        return nil, nil
+    }
+    if reservation.Expired() {
+        delete(r.reservations, subdomain)
+        return nil, nil
+    }
+    return reservation, nil
+}
+
+// DeleteReservation releases a subdomain reservation
+func (r *InMemoryRegistry) DeleteReservation(subdomain string) error {
+    r.reserveMutex.Lock()
+    defer r.reserveMutex.Unlock()
+
+    delete(r.reservations, subdomain)
+    return nil
+}
+
+// AddUsage increments usage counters, restarting the TTL of those that changed
+func (r *InMemoryRegistry) AddUsage(counters []UsageCounter) ([]int64, error) {
+    r.usageMu.Lock()
+    defer r.usageMu.Unlock()
+
+    now := time.Now()
+    totals := make([]int64, len(counters))
+    for i, counter := range counters {
+        value, exists := r.usage[counter.Key]
+        if exists && now.After(value.expiresAt) {
+            value = usageValue{}
+        }
+        if counter.Delta != 0 {
+            value.total += counter.Delta
+            value.expiresAt = now.Add(counter.TTL)
+            r.usage[counter.Key] = value
+        }
+        totals[i] = value.total
+    }
+    return totals, nil
+}
+
+// InitClusterCA stores ca unless one was stored already, and returns the stored one
+func (r *InMemoryRegistry) InitClusterCA(ca *ClusterCA) (*ClusterCA, error) {
+    r.clusterCAMu.Lock()
+    defer r.clusterCAMu.Unlock()
+
+    if r.clusterCA == nil {
+        r.clusterCA = ca
+    }
+    return r.clusterCA, nil
+}
+
+// PublishEvent delivers an event to this server's subscribers (there are no other servers to notify)
+func (r *InMemoryRegistry) PublishEvent(payload []byte) error {
+    r.subscribersMu.RLock()
+    defer r.subscribersMu.RUnlock()
+
+    for _, handler := range r.subscribers {
+        handler(payload)
+    }
+    return nil
+}
+
+// SubscribeEvents registers a handler for published events
+func (r *InMemoryRegistry) SubscribeEvents(handler func(payload []byte)) (func(), error) {
+    r.subscribersMu.Lock()
+    defer r.subscribersMu.Unlock()
+
+    r.nextSub++
+    id := r.nextSub
+    r.subscribers[id] = handler
+
+    return func() {
+        r.subscribersMu.Lock()
+        defer r.subscribersMu.Unlock()
+        delete(r.subscribers, id)
+    }, nil
+}
+
 // StartHeartbeat starts periodic heartbeat updates
 func (r *InMemoryRegistry) StartHeartbeat(serverInfo *ServerInfo) {
     go func() {
-        ticker := time.NewTicker(heartbeatInterval)
+        ticker := time.NewTicker(r.timings.HeartbeatInterval)
         defer ticker.Stop()
 
         for {
@@ -205,28 +365,60 @@ func (r *InMemoryRegistry) GetLeastLoadedServer() (*ServerInfo, error) {
     return nil, fmt.Errorf("no servers available")
 }
 
-// UpdateServerLoad updates the active connections count
-func (r *InMemoryRegistry) UpdateServerLoad(activeConnections int) error {
+// UpdateServerLoad records this server's current load
+func (r *InMemoryRegistry) UpdateServerLoad(load ServerLoad) error {
     r.serversMutex.Lock()
     defer r.serversMutex.Unlock()
 
     if server, exists := r.servers[r.serverID]; exists {
-        server.ActiveConnections = activeConnections
+        server.apply(load)
     }
 
     return nil
 }
 
-// GetCacheStats returns cache statistics
-func (r *InMemoryRegistry) GetCacheStats() (hits, misses int, hitRate float64) {
-    if r.lookups == 0 {
-        return 0, 0, 0.0
+// IsLeader always reports true since a single server is its own cluster
+func (r *InMemoryRegistry) IsLeader() bool {
+    return true
+}
+
+// GetCacheStats returns tunnel lookup statistics
+func (r *InMemoryRegistry) GetCacheStats() CacheStats {
+    return r.stats.snapshot()
+}
+
+// InvalidateTunnel is a no-op: lookups are never cached in memory
+func (r *InMemoryRegistry) InvalidateTunnel(subdomain string) {}
+
+// CreateMigration issues a one-time token letting another server take over a tunnel
+func (r *InMemoryRegistry) CreateMigration(subdomain string) (string, error) {
+    token, err := newMigrationToken()
+    if err != nil {
+        return "", fmt.Errorf("failed to generate migration token: %w", err)
     }
 
-    misses = r.lookups - r.hits
-    hitRate = float64(r.hits) / float64(r.lookups) * 100
+    r.migrationsMu.Lock()
+    defer r.migrationsMu.Unlock()
+    r.migrations[token] = pendingMigration{subdomain: subdomain, expiresAt: time.Now().Add(migrationTTL)}
+    return token, nil
+}
+
+// CompleteMigration consumes a migration token and registers the tunnel
+func (r *InMemoryRegistry) CompleteMigration(token string, info *TunnelInfo) error {
+    r.migrationsMu.Lock()
+    migration, exists := r.migrations[token]
+    delete(r.migrations, token)
+    r.migrationsMu.Unlock()
 
-    return r.hits, misses, hitRate
+    if !exists || time.Now().After(migration.expiresAt) || migration.subdomain != info.Subdomain {
+        return ErrMigrationInvalid
+    }
+    return r.RegisterTunnel(info)
+}
+
+// Ping always succeeds for the in-memory registry
+func (r *InMemoryRegistry) Ping() error {
+    return nil
 }
 
 // Close cleans up resources
@@ -236,7 +428,7 @@ func (r *InMemoryRegistry) Close() error {
     return nil
 }
 
-// cleanupExpiredTunnels periodically removes expired tunnels
+// cleanupExpiredTunnels periodically removes expired tunnels and usage counters
 func (r *InMemoryRegistry) cleanupExpiredTunnels() {
     ticker := time.NewTicker(10 * time.Second)
     defer ticker.Stop()
@@ -247,13 +439,21 @@ func (r *InMemoryRegistry) cleanupExpiredTunnels() {
             r.tunnelsMutex.Lock()
             now := time.Now()
             for subdomain, tunnel := range r.tunnels {
-                if now.Sub(tunnel.LastSeenAt) > tunnelTTL {
+                if now.Sub(tunnel.LastSeenAt) > r.timings.TunnelTTL {
                     delete(r.tunnels, subdomain)
                     r.logger.Info("Tunnel expired and removed", "subdomain", subdomain)
                 }
             }
             r.tunnelsMutex.Unlock()
 
+            r.usageMu.Lock()
+            for key, value := range r.usage {
+                if now.After(value.expiresAt) {
+                    delete(r.usage, key)
+                }
+            }
+            r.usageMu.Unlock()
+
         case <-r.heartbeatStop:
             return
         }
@@ -0,0 +1,37 @@
+package registry
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// leadership tracks whether this server currently leads the cluster
+type leadership struct {
+	leader atomic.Bool
+	lease  time.Duration // How long the leader's lease lasts without renewal (renewed every heartbeat)
+}
+
+// set records the outcome of an election round, logging changes
+func (l *leadership) set(leader bool, logger *slog.Logger, serverID string) {
+	if l.leader.Swap(leader) == leader {
+		return
+	}
+	if leader {
+		logger.Info("Became cluster leader", "server_id", serverID, "lease", l.lease)
+	} else {
+		logger.Warn("Lost cluster leadership", "server_id", serverID)
+	}
+}
+
+// resign gives up leadership when the server shuts down
+func (l *leadership) resign(logger *slog.Logger, serverID string) {
+	if l.leader.Swap(false) {
+		logger.Info("Resigned cluster leadership", "server_id", serverID)
+	}
+}
+
+// isLeader reports whether this server holds the leader lease
+func (l *leadership) isLeader() bool {
+	return l.leader.Load()
+}
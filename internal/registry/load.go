@@ -0,0 +1,49 @@
+package registry
+
+// Weights of each load signal in a server's load score, chosen so that a few hundred
+// clients, a few MB/s or a busy CPU each weigh roughly the same
+const (
+	loadWeightConnection = 1.0  // Per connected client
+	loadWeightStream     = 2.0  // Per in-flight stream
+	loadWeightMBPerSec   = 20.0 // Per MB/s proxied
+	loadWeightCPU        = 5.0  // Per percent of CPU
+	loadWeightMemoryMB   = 0.1  // Per MB of memory
+)
+
+// ServerLoad is a server's load as reported with its heartbeats
+type ServerLoad struct {
+	ActiveConnections int
+	ActiveStreams     int
+	BytesPerSecond    float64
+	CPUPercent        float64 // Of the CPUs available to the server
+	MemoryBytes       uint64
+}
+
+// apply records a load report on the server's entry
+func (s *ServerInfo) apply(load ServerLoad) {
+	s.ActiveConnections = load.ActiveConnections
+	s.ActiveStreams = load.ActiveStreams
+	s.BytesPerSecond = load.BytesPerSecond
+	s.CPUPercent = load.CPUPercent
+	s.MemoryBytes = load.MemoryBytes
+}
+
+// LoadScore weighs the server's reported load into one number (lower is less loaded)
+func (s *ServerInfo) LoadScore() float64 {
+	return float64(s.ActiveConnections)*loadWeightConnection +
+		float64(s.ActiveStreams)*loadWeightStream +
+		s.BytesPerSecond/(1<<20)*loadWeightMBPerSec +
+		s.CPUPercent*loadWeightCPU +
+		float64(s.MemoryBytes)/(1<<20)*loadWeightMemoryMB
+}
+
+// leastLoaded returns the server with the lowest load score (nil if there are none)
+func leastLoaded(servers []*ServerInfo) *ServerInfo {
+	var least *ServerInfo
+	for _, server := range servers {
+		if least == nil || server.LoadScore() < least.LoadScore() {
+			least = server
+		}
+	}
+	return least
+}
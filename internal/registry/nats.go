@@ -0,0 +1,981 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// JetStream KV buckets
+	natsTunnelBucket      = "tungo_tunnels"
+	natsServerBucket      = "tungo_servers"
+	natsAccountBucket     = "tungo_accounts"
+	natsMigrationBucket   = "tungo_migrations"
+	natsReservationBucket = "tungo_reservations"
+	natsLeaderBucket      = "tungo_leader"
+	natsClusterBucket     = "tungo_cluster"
+	natsUsageBucket       = "tungo_usage"
+
+	// natsLeaderKey holds the leader's server ID, expiring with the bucket TTL unless renewed
+	natsLeaderKey = "leader"
+
+	// natsClusterCAKey holds the cluster CA in natsClusterBucket
+	natsClusterCAKey = "ca"
+
+	// NATS subjects
+	natsUpdateSubject = "tungo.tunnel.updates" // Cache invalidation between servers
+	natsEventSubject  = "tungo.tunnel.events"  // Lifecycle events for external consumers
+
+	// JetStream API error codes
+	natsErrStreamNotFound    = 10059
+	natsErrNoMessageFound    = 10037
+	natsErrWrongLastSequence = 10071
+)
+
+// errNATSConflict is returned when a KV write expecting a revision finds another one
+var errNATSConflict = errors.New("nats: wrong last sequence")
+
+// NATSRegistry manages tunnel state across multiple servers using NATS JetStream KV buckets,
+// with core NATS subjects for cache invalidation and lifecycle events
+type NATSRegistry struct {
+	conn     *natsConn
+	serverID string
+	logger   *slog.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timings  Timings
+
+	// Tunnels registered here, rewritten by the heartbeat so they outlive the bucket TTL
+	held         map[string]*natsHeldTunnel
+	heldMutex    sync.Mutex
+	rewriteMutex sync.Mutex // Serializes compare-and-set rewrites so they never conflict with each other
+
+	// Local cache for tunnel lookups
+	cache      map[string]*cacheEntry
+	cacheMutex sync.RWMutex
+	stats      lookupStats
+
+	// Cluster leadership, held through a compare-and-set lease key
+	leadership     leadership
+	leaderRevision atomic.Uint64 // Revision of this server's lease (0 when not leading)
+}
+
+// natsHeldTunnel is a tunnel registered by this server and the revision it last wrote
+type natsHeldTunnel struct {
+	info     *TunnelInfo
+	revision uint64
+}
+
+// natsKVEntry is the current value of a KV key
+type natsKVEntry struct {
+	Value    []byte
+	Revision uint64
+}
+
+// jsError is the error part of a JetStream API response
+type jsError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code"`
+	Description string `json:"description"`
+}
+
+func (e *jsError) Error() string {
+	return fmt.Sprintf("jetstream: %s (%d)", e.Description, e.ErrCode)
+}
+
+// NewNATSRegistry creates a registry backed by the NATS server at natsURL (JetStream must be enabled)
+func NewNATSRegistry(natsURL string, timings Timings, serverID string, logger *slog.Logger) (*NATSRegistry, error) {
+	timings = timings.withDefaults()
+	conn, err := dialNATS(natsURL, "tungo-"+serverID, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	registry := &NATSRegistry{
+		conn:       conn,
+		serverID:   serverID,
+		logger:     logger,
+		ctx:        ctx,
+		cancel:     cancel,
+		held:       make(map[string]*natsHeldTunnel),
+		cache:      make(map[string]*cacheEntry),
+		timings:    timings,
+		leadership: leadership{lease: timings.ServerTTL},
+	}
+
+	// Create the buckets on first use; entries expire unless rewritten
+	for bucket, ttl := range map[string]time.Duration{
+		natsTunnelBucket:      timings.TunnelTTL,
+		natsServerBucket:      timings.ServerTTL,
+		natsAccountBucket:     0,
+		natsMigrationBucket:   migrationTTL,
+		natsReservationBucket: 0, // Reservations carry their own expiry
+		natsLeaderBucket:      timings.ServerTTL,
+		natsClusterBucket:     0,
+		natsUsageBucket:       MaxUsageTTL, // KV entries can't expire individually, so every counter lasts this long
+	} {
+		if err := registry.ensureBucket(bucket, ttl); err != nil {
+			cancel()
+			conn.close()
+			return nil, fmt.Errorf("failed to create %s bucket: %w", bucket, err)
+		}
+	}
+
+	// Invalidate cached lookups when other servers change tunnels
+	if _, err := conn.subscribe(natsUpdateSubject, registry.handleUpdate); err != nil {
+		cancel()
+		conn.close()
+		return nil, fmt.Errorf("failed to subscribe to tunnel updates: %w", err)
+	}
+
+	logger.Info("Connected to NATS", "url", conn.url.Redacted(), "server_id", serverID)
+
+	return registry, nil
+}
+
+// RegisterTunnel registers a tunnel in the registry
+func (r *NATSRegistry) RegisterTunnel(info *TunnelInfo) error {
+	info.ServerID = r.serverID
+	info.LastSeenAt = time.Now()
+
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = time.Now()
+	}
+
+	revision, err := r.putJSON(natsTunnelBucket, info.Subdomain, info, nil)
+	if err != nil {
+		return fmt.Errorf("failed to register tunnel: %w", err)
+	}
+	r.hold(info, revision)
+
+	// Invalidate cache and notify other servers
+	r.invalidateCache(info.Subdomain)
+	r.publishUpdate(info.Subdomain, "register")
+
+	r.logger.Info("Registered tunnel",
+		"subdomain", info.Subdomain,
+		"server_id", info.ServerID,
+		"client_id", info.ClientID)
+
+	return nil
+}
+
+// GetTunnel retrieves tunnel information from the registry (with local caching)
+func (r *NATSRegistry) GetTunnel(subdomain string) (*TunnelInfo, error) {
+	if cached := r.getCached(subdomain); cached != nil {
+		r.stats.hit()
+		return cached, nil
+	}
+
+	start := time.Now()
+	entry, err := r.kvGet(natsTunnelBucket, subdomain)
+	r.stats.miss(time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tunnel: %w", err)
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("tunnel not found: %s", subdomain)
+	}
+
+	var info TunnelInfo
+	if err := json.Unmarshal(entry.Value, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tunnel info: %w", err)
+	}
+
+	r.setCached(subdomain, &info)
+
+	return &info, nil
+}
+
+// UnregisterTunnel removes a tunnel from the registry
+func (r *NATSRegistry) UnregisterTunnel(subdomain string) error {
+	if err := r.kvDelete(natsTunnelBucket, subdomain, 0); err != nil {
+		return fmt.Errorf("failed to unregister tunnel: %w", err)
+	}
+	r.release(subdomain)
+
+	// Invalidate cache and notify other servers
+	r.invalidateCache(subdomain)
+	r.publishUpdate(subdomain, "unregister")
+
+	r.logger.Info("Unregistered tunnel", "subdomain", subdomain, "server_id", r.serverID)
+	return nil
+}
+
+// RefreshTunnel rewrites the metadata of a tunnel registered here
+func (r *NATSRegistry) RefreshTunnel(info *TunnelInfo) error {
+	r.rewriteMutex.Lock()
+	defer r.rewriteMutex.Unlock()
+
+	r.heldMutex.Lock()
+	tunnel, held := r.held[info.Subdomain]
+	r.heldMutex.Unlock()
+	if !held {
+		return ErrTunnelMoved
+	}
+
+	info.ServerID = r.serverID
+	info.LastSeenAt = time.Now()
+
+	revision, err := r.putJSON(natsTunnelBucket, info.Subdomain, info, map[string]string{
+		"Nats-Expected-Last-Subject-Sequence": strconv.FormatUint(tunnel.revision, 10),
+	})
+	if errors.Is(err, errNATSConflict) {
+		r.release(info.Subdomain)
+		return ErrTunnelMoved
+	}
+	if err != nil {
+		return fmt.Errorf("failed to refresh tunnel: %w", err)
+	}
+
+	r.heldMutex.Lock()
+	if current, exists := r.held[info.Subdomain]; exists && current == tunnel {
+		tunnel.info = info
+		tunnel.revision = revision
+	}
+	r.heldMutex.Unlock()
+
+	r.invalidateCache(info.Subdomain)
+	return nil
+}
+
+// GetAllTunnels returns all active tunnels across all servers
+func (r *NATSRegistry) GetAllTunnels() ([]*TunnelInfo, error) {
+	entries, err := r.kvList(natsTunnelBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnels: %w", err)
+	}
+
+	tunnels := make([]*TunnelInfo, 0, len(entries))
+	for key, entry := range entries {
+		var info TunnelInfo
+		if err := json.Unmarshal(entry.Value, &info); err != nil {
+			r.logger.Warn("Failed to unmarshal tunnel info", "key", key, "error", err)
+			continue
+		}
+		tunnels = append(tunnels, &info)
+	}
+
+	return tunnels, nil
+}
+
+// IsLocalTunnel checks if a tunnel belongs to this server
+func (r *NATSRegistry) IsLocalTunnel(subdomain string) (bool, error) {
+	info, err := r.GetTunnel(subdomain)
+	if err != nil {
+		return false, err
+	}
+	return info.ServerID == r.serverID, nil
+}
+
+// CreateMigration issues a one-time token letting another server take over a tunnel
+func (r *NATSRegistry) CreateMigration(subdomain string) (string, error) {
+	token, err := newMigrationToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate migration token: %w", err)
+	}
+
+	if _, err := r.kvPut(natsMigrationBucket, token, []byte(subdomain), nil); err != nil {
+		return "", fmt.Errorf("failed to create migration: %w", err)
+	}
+
+	return token, nil
+}
+
+// CompleteMigration consumes a migration token and registers the tunnel on this server,
+// replacing the previous server's entry without the tunnel ever being unregistered
+func (r *NATSRegistry) CompleteMigration(token string, info *TunnelInfo) error {
+	entry, err := r.kvGet(natsMigrationBucket, token)
+	if err != nil {
+		return fmt.Errorf("failed to complete migration: %w", err)
+	}
+	if entry == nil || string(entry.Value) != info.Subdomain {
+		return ErrMigrationInvalid
+	}
+
+	// Deleting the exact revision read succeeds for only one server
+	err = r.kvDelete(natsMigrationBucket, token, entry.Revision)
+	if errors.Is(err, errNATSConflict) {
+		return ErrMigrationInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("failed to complete migration: %w", err)
+	}
+
+	info.ServerID = r.serverID
+	info.LastSeenAt = time.Now()
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = time.Now()
+	}
+
+	revision, err := r.putJSON(natsTunnelBucket, info.Subdomain, info, nil)
+	if err != nil {
+		return fmt.Errorf("failed to complete migration: %w", err)
+	}
+	r.hold(info, revision)
+
+	// Invalidate cache and notify other servers
+	r.invalidateCache(info.Subdomain)
+	r.publishUpdate(info.Subdomain, "register")
+
+	r.logger.Info("Migrated tunnel",
+		"subdomain", info.Subdomain,
+		"server_id", info.ServerID,
+		"client_id", info.ClientID)
+
+	return nil
+}
+
+// RegisterServer registers this server in the cluster
+func (r *NATSRegistry) RegisterServer(info *ServerInfo) error {
+	info.ServerID = r.serverID
+	info.LastHeartbeat = time.Now()
+
+	if _, err := r.putJSON(natsServerBucket, r.serverID, info, nil); err != nil {
+		return fmt.Errorf("failed to register server: %w", err)
+	}
+	return nil
+}
+
+// GetServer retrieves information about a specific server
+func (r *NATSRegistry) GetServer(serverID string) (*ServerInfo, error) {
+	entry, err := r.kvGet(natsServerBucket, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server: %w", err)
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("server not found: %s", serverID)
+	}
+
+	var info ServerInfo
+	if err := json.Unmarshal(entry.Value, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal server info: %w", err)
+	}
+
+	return &info, nil
+}
+
+// GetAllServers returns all active servers in the cluster
+func (r *NATSRegistry) GetAllServers() ([]*ServerInfo, error) {
+	entries, err := r.kvList(natsServerBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %w", err)
+	}
+
+	servers := make([]*ServerInfo, 0, len(entries))
+	for key, entry := range entries {
+		var info ServerInfo
+		if err := json.Unmarshal(entry.Value, &info); err != nil {
+			r.logger.Warn("Failed to unmarshal server info", "key", key, "error", err)
+			continue
+		}
+		servers = append(servers, &info)
+	}
+
+	return servers, nil
+}
+
+// GetServersInRegion returns the servers that declared region
+func (r *NATSRegistry) GetServersInRegion(region string) ([]*ServerInfo, error) {
+	servers, err := r.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+	return serversInRegion(servers, region), nil
+}
+
+// StartHeartbeat starts sending periodic heartbeats for this server and its tunnels
+func (r *NATSRegistry) StartHeartbeat(serverInfo *ServerInfo) {
+	go func() {
+		ticker := time.NewTicker(r.timings.HeartbeatInterval)
+		defer ticker.Stop()
+
+		r.campaign()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.RegisterServer(serverInfo); err != nil {
+					r.logger.Error("Failed to send heartbeat", "error", err)
+				}
+				r.refreshHeld()
+				r.campaign()
+			}
+		}
+	}()
+
+	r.logger.Info("Started heartbeat", "interval", r.timings.HeartbeatInterval)
+}
+
+// campaign runs one election round: the leader rewrites its lease at the revision it last wrote,
+// and other servers can only create the lease once it has expired or been purged
+func (r *NATSRegistry) campaign() {
+	revision, err := r.kvPut(natsLeaderBucket, natsLeaderKey, []byte(r.serverID), map[string]string{
+		"Nats-Expected-Last-Subject-Sequence": strconv.FormatUint(r.leaderRevision.Load(), 10),
+	})
+	if err != nil {
+		if !errors.Is(err, errNATSConflict) {
+			r.logger.Warn("Failed to campaign for leadership", "error", err)
+		}
+		revision = 0
+	}
+	r.leaderRevision.Store(revision)
+	r.leadership.set(err == nil, r.logger, r.serverID)
+}
+
+// IsLeader reports whether this server currently leads the cluster
+func (r *NATSRegistry) IsLeader() bool {
+	return r.leadership.isLeader()
+}
+
+// refreshHeld rewrites this server's tunnels before they expire, dropping any another server took over
+func (r *NATSRegistry) refreshHeld() {
+	r.rewriteMutex.Lock()
+	defer r.rewriteMutex.Unlock()
+
+	r.heldMutex.Lock()
+	held := make([]*natsHeldTunnel, 0, len(r.held))
+	for _, tunnel := range r.held {
+		held = append(held, tunnel)
+	}
+	r.heldMutex.Unlock()
+
+	for _, tunnel := range held {
+		info := *tunnel.info
+		info.LastSeenAt = time.Now()
+
+		revision, err := r.putJSON(natsTunnelBucket, info.Subdomain, &info, map[string]string{
+			"Nats-Expected-Last-Subject-Sequence": strconv.FormatUint(tunnel.revision, 10),
+		})
+		if errors.Is(err, errNATSConflict) {
+			r.logger.Info("Tunnel was taken over by another server", "subdomain", info.Subdomain)
+			r.release(info.Subdomain)
+			continue
+		}
+		if err != nil {
+			r.logger.Warn("Failed to refresh tunnel", "subdomain", info.Subdomain, "error", err)
+			continue
+		}
+
+		r.heldMutex.Lock()
+		if current, exists := r.held[info.Subdomain]; exists && current == tunnel {
+			tunnel.revision = revision
+		}
+		r.heldMutex.Unlock()
+	}
+}
+
+// GetLeastLoadedServer returns the server with the lowest load score
+func (r *NATSRegistry) GetLeastLoadedServer() (*ServerInfo, error) {
+	servers, err := r.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers available")
+	}
+
+	return leastLoaded(servers), nil
+}
+
+// UpdateServerLoad records this server's current load
+func (r *NATSRegistry) UpdateServerLoad(load ServerLoad) error {
+	info, err := r.GetServer(r.serverID)
+	if err != nil {
+		return err
+	}
+
+	info.apply(load)
+	return r.RegisterServer(info)
+}
+
+// SaveAccount stores an account under the hash of its secret key
+func (r *NATSRegistry) SaveAccount(secretKey string, account *Account) error {
+	if _, err := r.putJSON(natsAccountBucket, accountKey(secretKey), account, nil); err != nil {
+		return fmt.Errorf("failed to save account: %w", err)
+	}
+	return nil
+}
+
+// GetAccount retrieves the account for a secret key
+func (r *NATSRegistry) GetAccount(secretKey string) (*Account, error) {
+	entry, err := r.kvGet(natsAccountBucket, accountKey(secretKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var account Account
+	if err := json.Unmarshal(entry.Value, &account); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal account: %w", err)
+	}
+	return &account, nil
+}
+
+// DeleteAccount removes the account for a secret key
+func (r *NATSRegistry) DeleteAccount(secretKey string) error {
+	if err := r.kvDelete(natsAccountBucket, accountKey(secretKey), 0); err != nil {
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+	return nil
+}
+
+// ReserveSubdomain stores a reservation
+func (r *NATSRegistry) ReserveSubdomain(reservation *Reservation) error {
+	if _, err := r.putJSON(natsReservationBucket, reservation.Subdomain, reservation, nil); err != nil {
+		return fmt.Errorf("failed to save reservation: %w", err)
+	}
+	return nil
+}
+
+// GetReservation retrieves the reservation for a subdomain, deleting it once expired
+func (r *NATSRegistry) GetReservation(subdomain string) (*Reservation, error) {
+	entry, err := r.kvGet(natsReservationBucket, subdomain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservation: %w", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var reservation Reservation
+	if err := json.Unmarshal(entry.Value, &reservation); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reservation: %w", err)
+	}
+	if reservation.Expired() {
+		// Only delete the revision we read, in case the owner renewed it meanwhile
+		r.kvDelete(natsReservationBucket, subdomain, entry.Revision)
+		return nil, nil
+	}
+	return &reservation, nil
+}
+
+// DeleteReservation releases a subdomain reservation
+func (r *NATSRegistry) DeleteReservation(subdomain string) error {
+	if err := r.kvDelete(natsReservationBucket, subdomain, 0); err != nil {
+		return fmt.Errorf("failed to delete reservation: %w", err)
+	}
+	return nil
+}
+
+// InitClusterCA stores ca unless another server stored a CA first, and returns the stored one
+func (r *NATSRegistry) InitClusterCA(ca *ClusterCA) (*ClusterCA, error) {
+	_, err := r.putJSON(natsClusterBucket, natsClusterCAKey, ca, map[string]string{
+		"Nats-Expected-Last-Subject-Sequence": "0", // Only if the key was never written
+	})
+	if err != nil && !errors.Is(err, errNATSConflict) {
+		return nil, fmt.Errorf("failed to save cluster CA: %w", err)
+	}
+
+	entry, err := r.kvGet(natsClusterBucket, natsClusterCAKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster CA: %w", err)
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("cluster CA was deleted")
+	}
+
+	var clusterCA ClusterCA
+	if err := json.Unmarshal(entry.Value, &clusterCA); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cluster CA: %w", err)
+	}
+	return &clusterCA, nil
+}
+
+// AddUsage increments usage counters with compare-and-set writes, retrying when another server updated one first
+// Every counter expires MaxUsageTTL after it last changed, whatever its TTL
+func (r *NATSRegistry) AddUsage(counters []UsageCounter) ([]int64, error) {
+	totals := make([]int64, len(counters))
+	for i, counter := range counters {
+		total, err := r.addUsage(counter.Key, counter.Delta)
+		if err != nil {
+			return nil, err
+		}
+		totals[i] = total
+	}
+	return totals, nil
+}
+
+// addUsage increments one usage counter, returning its total
+func (r *NATSRegistry) addUsage(key string, delta int64) (int64, error) {
+	for attempt := 0; attempt < usageRetries; attempt++ {
+		entry, err := r.kvGet(natsUsageBucket, key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get usage: %w", err)
+		}
+
+		var total int64
+		var revision uint64 // 0 expects the key was never written or has expired
+		if entry != nil {
+			total, _ = strconv.ParseInt(string(entry.Value), 10, 64)
+			revision = entry.Revision
+		}
+		if delta == 0 {
+			return total, nil
+		}
+
+		total += delta
+		_, err = r.kvPut(natsUsageBucket, key, []byte(strconv.FormatInt(total, 10)), map[string]string{
+			"Nats-Expected-Last-Subject-Sequence": strconv.FormatUint(revision, 10),
+		})
+		if errors.Is(err, errNATSConflict) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to add usage: %w", err)
+		}
+		return total, nil
+	}
+	return 0, fmt.Errorf("failed to add usage: %s kept changing", key)
+}
+
+// PublishEvent publishes a lifecycle event for external consumers
+func (r *NATSRegistry) PublishEvent(payload []byte) error {
+	return r.conn.publish(natsEventSubject, "", nil, payload)
+}
+
+// SubscribeEvents delivers lifecycle events published by any server
+func (r *NATSRegistry) SubscribeEvents(handler func(payload []byte)) (func(), error) {
+	sid, err := r.conn.subscribe(natsEventSubject, func(msg *natsMsg) {
+		handler(msg.Data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to events: %w", err)
+	}
+
+	return func() {
+		if err := r.conn.unsubscribe(sid); err != nil {
+			r.logger.Warn("Failed to unsubscribe from events", "error", err)
+		}
+	}, nil
+}
+
+// GetCacheStats returns cache hit/miss statistics
+func (r *NATSRegistry) GetCacheStats() CacheStats {
+	return r.stats.snapshot()
+}
+
+// InvalidateTunnel drops the cached lookup for a subdomain
+func (r *NATSRegistry) InvalidateTunnel(subdomain string) {
+	r.invalidateCache(subdomain)
+}
+
+// Ping checks that NATS is reachable and JetStream is available
+func (r *NATSRegistry) Ping() error {
+	var info struct {
+		Error *jsError `json:"error"`
+	}
+	if err := r.jsRequest("$JS.API.INFO", nil, &info); err != nil {
+		return err
+	}
+	if info.Error != nil {
+		return info.Error
+	}
+	return nil
+}
+
+// Close unregisters this server and closes the NATS connection
+func (r *NATSRegistry) Close() error {
+	r.cancel()
+
+	if err := r.kvDelete(natsServerBucket, r.serverID, 0); err != nil {
+		r.logger.Warn("Failed to unregister server", "error", err)
+	}
+
+	// Purge the lease so another server can take over without waiting for it to expire
+	if r.leadership.isLeader() {
+		var purged struct {
+			Error *jsError `json:"error"`
+		}
+		request := map[string]string{"filter": "$KV." + natsLeaderBucket + "." + natsLeaderKey}
+		err := r.jsRequest("$JS.API.STREAM.PURGE.KV_"+natsLeaderBucket, request, &purged)
+		if err == nil && purged.Error != nil {
+			err = purged.Error
+		}
+		if err != nil {
+			r.logger.Warn("Failed to resign leadership", "error", err)
+		}
+		r.leadership.resign(r.logger, r.serverID)
+	}
+
+	return r.conn.close()
+}
+
+// hold tracks a tunnel registered by this server
+func (r *NATSRegistry) hold(info *TunnelInfo, revision uint64) {
+	r.heldMutex.Lock()
+	defer r.heldMutex.Unlock()
+	r.held[info.Subdomain] = &natsHeldTunnel{info: info, revision: revision}
+}
+
+// release stops refreshing a tunnel
+func (r *NATSRegistry) release(subdomain string) {
+	r.heldMutex.Lock()
+	defer r.heldMutex.Unlock()
+	delete(r.held, subdomain)
+}
+
+// publishUpdate publishes a tunnel update to other servers
+func (r *NATSRegistry) publishUpdate(subdomain, action string) {
+	if err := r.conn.publish(natsUpdateSubject, "", nil, []byte(action+":"+subdomain)); err != nil {
+		r.logger.Warn("Failed to publish update", "error", err, "subdomain", subdomain)
+	}
+}
+
+// handleUpdate invalidates the cache for a tunnel another server changed ("action:subdomain")
+func (r *NATSRegistry) handleUpdate(msg *natsMsg) {
+	if _, subdomain, ok := strings.Cut(string(msg.Data), ":"); ok && subdomain != "" {
+		r.invalidateCache(subdomain)
+	}
+}
+
+// getCached retrieves a tunnel from local cache
+func (r *NATSRegistry) getCached(subdomain string) *TunnelInfo {
+	r.cacheMutex.RLock()
+	defer r.cacheMutex.RUnlock()
+
+	entry, exists := r.cache[subdomain]
+	if !exists || time.Now().After(entry.expiresAt) {
+		return nil
+	}
+	return entry.tunnel
+}
+
+// setCached stores a tunnel in local cache
+func (r *NATSRegistry) setCached(subdomain string, tunnel *TunnelInfo) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	// Drop expired entries rather than running a cleanup goroutine
+	now := time.Now()
+	for name, entry := range r.cache {
+		if now.After(entry.expiresAt) {
+			delete(r.cache, name)
+		}
+	}
+
+	r.cache[subdomain] = &cacheEntry{
+		tunnel:    tunnel,
+		expiresAt: now.Add(r.timings.CacheTTL),
+	}
+}
+
+// invalidateCache removes a tunnel from local cache
+func (r *NATSRegistry) invalidateCache(subdomain string) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	delete(r.cache, subdomain)
+}
+
+// ensureBucket creates a KV bucket's backing stream, or updates its TTL if it exists with another (ttl 0 keeps entries forever)
+func (r *NATSRegistry) ensureBucket(bucket string, ttl time.Duration) error {
+	var info struct {
+		Config map[string]interface{} `json:"config"`
+		Error  *jsError               `json:"error"`
+	}
+	if err := r.jsRequest("$JS.API.STREAM.INFO.KV_"+bucket, nil, &info); err != nil {
+		return err
+	}
+
+	// Same stream layout as the NATS clients' KV buckets, keeping only the latest value per key
+	duplicateWindow := 2 * time.Minute
+	if ttl > 0 && ttl < duplicateWindow {
+		duplicateWindow = ttl
+	}
+
+	if info.Error == nil {
+		// Apply a changed TTL to the existing bucket
+		if maxAge, _ := info.Config["max_age"].(float64); int64(maxAge) == int64(ttl) {
+			return nil
+		}
+		info.Config["max_age"] = int64(ttl)
+		info.Config["duplicate_window"] = int64(duplicateWindow)
+		var updated struct {
+			Error *jsError `json:"error"`
+		}
+		if err := r.jsRequest("$JS.API.STREAM.UPDATE.KV_"+bucket, info.Config, &updated); err != nil {
+			return err
+		}
+		if updated.Error != nil {
+			return updated.Error
+		}
+		r.logger.Info("Updated NATS KV bucket TTL", "bucket", bucket, "ttl", ttl)
+		return nil
+	}
+	if info.Error.ErrCode != natsErrStreamNotFound {
+		return info.Error
+	}
+
+	config := map[string]interface{}{
+		"name":                 "KV_" + bucket,
+		"subjects":             []string{"$KV." + bucket + ".>"},
+		"retention":            "limits",
+		"max_consumers":        -1,
+		"max_msgs":             -1,
+		"max_bytes":            -1,
+		"max_msg_size":         -1,
+		"max_msgs_per_subject": 1,
+		"max_age":              int64(ttl),
+		"duplicate_window":     int64(duplicateWindow),
+		"storage":              "file",
+		"discard":              "new",
+		"num_replicas":         1,
+		"allow_rollup_hdrs":    true,
+		"deny_delete":          true,
+		"allow_direct":         true,
+	}
+	var created struct {
+		Error *jsError `json:"error"`
+	}
+	if err := r.jsRequest("$JS.API.STREAM.CREATE.KV_"+bucket, config, &created); err != nil {
+		return err
+	}
+	if created.Error != nil {
+		return created.Error
+	}
+
+	r.logger.Info("Created NATS KV bucket", "bucket", bucket, "ttl", ttl)
+	return nil
+}
+
+// putJSON stores a JSON-encoded value, returning its revision
+func (r *NATSRegistry) putJSON(bucket, key string, value interface{}, header map[string]string) (uint64, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return r.kvPut(bucket, key, data, header)
+}
+
+// kvPut stores a value, returning its revision (errNATSConflict if an expected revision header doesn't match)
+func (r *NATSRegistry) kvPut(bucket, key string, value []byte, header map[string]string) (uint64, error) {
+	reply, err := r.conn.request("$KV."+bucket+"."+key, header, value)
+	if err != nil {
+		return 0, err
+	}
+
+	var ack struct {
+		Sequence uint64   `json:"seq"`
+		Error    *jsError `json:"error"`
+	}
+	if err := json.Unmarshal(reply.Data, &ack); err != nil {
+		return 0, fmt.Errorf("invalid JetStream ack: %w", err)
+	}
+	if ack.Error != nil {
+		if ack.Error.ErrCode == natsErrWrongLastSequence {
+			return 0, errNATSConflict
+		}
+		return 0, ack.Error
+	}
+	return ack.Sequence, nil
+}
+
+// kvDelete writes a delete marker for a key, only if its revision is still expected (0 = any)
+func (r *NATSRegistry) kvDelete(bucket, key string, expected uint64) error {
+	header := map[string]string{"KV-Operation": "DEL"}
+	if expected > 0 {
+		header["Nats-Expected-Last-Subject-Sequence"] = strconv.FormatUint(expected, 10)
+	}
+	_, err := r.kvPut(bucket, key, nil, header)
+	return err
+}
+
+// kvGet reads the current value of a key (nil if it doesn't exist or was deleted)
+func (r *NATSRegistry) kvGet(bucket, key string) (*natsKVEntry, error) {
+	var resp struct {
+		Message *struct {
+			Sequence uint64 `json:"seq"`
+			Header   []byte `json:"hdrs"`
+			Data     []byte `json:"data"`
+		} `json:"message"`
+		Error *jsError `json:"error"`
+	}
+	request := map[string]string{"last_by_subj": "$KV." + bucket + "." + key}
+	if err := r.jsRequest("$JS.API.STREAM.MSG.GET.KV_"+bucket, request, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		if resp.Error.ErrCode == natsErrNoMessageFound {
+			return nil, nil
+		}
+		return nil, resp.Error
+	}
+	if resp.Message == nil {
+		return nil, nil
+	}
+
+	// Deletes and purges leave a marker as the key's latest value
+	if len(resp.Message.Header) > 0 {
+		_, header := parseNATSHeader(resp.Message.Header)
+		if op := header.Get("KV-Operation"); op == "DEL" || op == "PURGE" {
+			return nil, nil
+		}
+	}
+
+	return &natsKVEntry{Value: resp.Message.Data, Revision: resp.Message.Sequence}, nil
+}
+
+// kvList reads the current value of every key in a bucket
+func (r *NATSRegistry) kvList(bucket string) (map[string]*natsKVEntry, error) {
+	var info struct {
+		State struct {
+			Subjects map[string]uint64 `json:"subjects"`
+		} `json:"state"`
+		Error *jsError `json:"error"`
+	}
+	prefix := "$KV." + bucket + "."
+	request := map[string]string{"subjects_filter": prefix + ">"}
+	if err := r.jsRequest("$JS.API.STREAM.INFO.KV_"+bucket, request, &info); err != nil {
+		return nil, err
+	}
+	if info.Error != nil {
+		return nil, info.Error
+	}
+
+	entries := make(map[string]*natsKVEntry, len(info.State.Subjects))
+	for subject := range info.State.Subjects {
+		key := strings.TrimPrefix(subject, prefix)
+		entry, err := r.kvGet(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries[key] = entry
+		}
+	}
+	return entries, nil
+}
+
+// jsRequest calls the JetStream API, decoding the JSON response into out
+func (r *NATSRegistry) jsRequest(subject string, request, out interface{}) error {
+	var data []byte
+	if request != nil {
+		var err error
+		if data, err = json.Marshal(request); err != nil {
+			return err
+		}
+	}
+
+	reply, err := r.conn.request(subject, nil, data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(reply.Data, out); err != nil {
+		return fmt.Errorf("invalid JetStream response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// natsTimeout bounds connecting to NATS and waiting for replies
+const natsTimeout = 5 * time.Second
+
+var (
+	errNATSDisconnected = errors.New("nats: not connected")
+	errNATSTimeout      = errors.New("nats: request timed out")
+	errNATSNoResponders = errors.New("nats: no responders (is JetStream enabled?)")
+)
+
+// natsMsg is a message received from NATS
+type natsMsg struct {
+	Subject string
+	Reply   string
+	Status  string // Status code of header-only replies, e.g. "503" for no responders
+	Header  textproto.MIMEHeader
+	Data    []byte
+}
+
+// natsSub is a subscription, restored after reconnecting
+type natsSub struct {
+	subject string
+	handler func(*natsMsg) // Called from the read loop, so it must not block
+}
+
+// natsConn is a minimal NATS client: publish, subscribe and request/reply with headers,
+// reconnecting and restoring its subscriptions when the connection drops
+type natsConn struct {
+	url    *url.URL
+	name   string
+	logger *slog.Logger
+
+	mutex   sync.Mutex // Guards conn, writer and subs
+	conn    net.Conn
+	writer  *bufio.Writer
+	subs    map[int64]*natsSub
+	nextSID int64
+
+	// Request/reply over a single wildcard inbox subscription
+	inbox          string
+	requests       map[string]chan *natsMsg
+	requestsMutex  sync.Mutex
+	nextRequestID  int64
+	closed         chan struct{}
+	closeOnce      sync.Once
+	reconnectDelay time.Duration
+}
+
+// dialNATS connects to the NATS server at rawURL (nats:// or tls://, with optional user:pass or token credentials)
+func dialNATS(rawURL, name string, logger *slog.Logger) (*natsConn, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "nats://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS URL: %w", err)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	inboxID := make([]byte, 8)
+	if _, err := rand.Read(inboxID); err != nil {
+		return nil, err
+	}
+
+	nc := &natsConn{
+		url:            u,
+		name:           name,
+		logger:         logger,
+		subs:           make(map[int64]*natsSub),
+		inbox:          "_INBOX." + hex.EncodeToString(inboxID),
+		requests:       make(map[string]chan *natsMsg),
+		closed:         make(chan struct{}),
+		reconnectDelay: time.Second,
+	}
+	if _, err := nc.subscribe(nc.inbox+".*", nc.handleReply); err != nil {
+		return nil, err
+	}
+	if err := nc.connect(); err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
+
+// connect opens the connection, authenticates and restores subscriptions
+func (nc *natsConn) connect() error {
+	conn, err := net.DialTimeout("tcp", nc.url.Host, natsTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to read NATS server info: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting: %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		Headers     bool `json:"headers"`
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(line[5:]), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid NATS server info: %w", err)
+	}
+	if !info.Headers {
+		conn.Close()
+		return fmt.Errorf("NATS server doesn't support headers (2.2 or later required)")
+	}
+
+	if nc.url.Scheme == "tls" || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: nc.url.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return fmt.Errorf("NATS TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"protocol":      1,
+		"lang":          "go",
+		"version":       "tungo",
+		"name":          nc.name,
+	}
+	if user := nc.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			options["user"] = user.Username()
+			options["pass"] = pass
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	data, _ := json.Marshal(options)
+
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "CONNECT %s\r\nPING\r\n", data)
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// The server answers the PING once CONNECT is accepted, or reports why it wasn't
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return fmt.Errorf("NATS rejected the connection: %s", strings.Trim(line[4:], " '"))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	nc.mutex.Lock()
+	nc.conn = conn
+	nc.writer = writer
+	for sid, sub := range nc.subs {
+		fmt.Fprintf(writer, "SUB %s %d\r\n", sub.subject, sid)
+	}
+	err = writer.Flush()
+	nc.mutex.Unlock()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	go nc.readLoop(conn, reader)
+	return nil
+}
+
+// readLoop dispatches incoming messages until the connection drops, then reconnects
+func (nc *natsConn) readLoop(conn net.Conn, reader *bufio.Reader) {
+	err := nc.read(reader)
+
+	nc.mutex.Lock()
+	if nc.conn == conn {
+		nc.conn = nil
+		nc.writer = nil
+	}
+	nc.mutex.Unlock()
+	conn.Close()
+
+	select {
+	case <-nc.closed:
+		return
+	default:
+	}
+
+	nc.logger.Warn("NATS connection lost, reconnecting", "error", err)
+	for {
+		select {
+		case <-nc.closed:
+			return
+		case <-time.After(nc.reconnectDelay):
+		}
+		if err := nc.connect(); err != nil {
+			nc.logger.Warn("Failed to reconnect to NATS", "error", err)
+			continue
+		}
+		nc.logger.Info("Reconnected to NATS")
+		return
+	}
+}
+
+// read parses protocol operations until an error occurs
+func (nc *natsConn) read(reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+
+		switch strings.ToUpper(op) {
+		case "MSG":
+			// MSG <subject> <sid> [reply] <size>
+			fields := strings.Fields(args)
+			if len(fields) < 3 {
+				return fmt.Errorf("malformed MSG: %q", args)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("malformed MSG: %q", args)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return err
+			}
+			msg := &natsMsg{Subject: fields[0], Data: payload[:size]}
+			if len(fields) == 4 {
+				msg.Reply = fields[2]
+			}
+			nc.dispatch(fields[1], msg)
+
+		case "HMSG":
+			// HMSG <subject> <sid> [reply] <header size> <total size>
+			fields := strings.Fields(args)
+			if len(fields) < 4 {
+				return fmt.Errorf("malformed HMSG: %q", args)
+			}
+			headerSize, err1 := strconv.Atoi(fields[len(fields)-2])
+			totalSize, err2 := strconv.Atoi(fields[len(fields)-1])
+			if err1 != nil || err2 != nil || headerSize > totalSize {
+				return fmt.Errorf("malformed HMSG: %q", args)
+			}
+			payload := make([]byte, totalSize+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return err
+			}
+			msg := &natsMsg{Subject: fields[0], Data: payload[headerSize:totalSize]}
+			if len(fields) == 5 {
+				msg.Reply = fields[2]
+			}
+			msg.Status, msg.Header = parseNATSHeader(payload[:headerSize])
+			nc.dispatch(fields[1], msg)
+
+		case "PING":
+			nc.write("PONG\r\n")
+
+		case "-ERR":
+			nc.logger.Warn("NATS error", "error", strings.Trim(args, " '"))
+		}
+	}
+}
+
+// parseNATSHeader parses a "NATS/1.0 [status]" header block
+func parseNATSHeader(block []byte) (string, textproto.MIMEHeader) {
+	statusLine, rest, _ := bytes.Cut(block, []byte("\r\n"))
+	var status string
+	if fields := strings.Fields(string(statusLine)); len(fields) > 1 {
+		status = fields[1]
+	}
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(rest))).ReadMIMEHeader()
+	return status, header
+}
+
+// dispatch hands a message to its subscription's handler
+func (nc *natsConn) dispatch(sid string, msg *natsMsg) {
+	id, err := strconv.ParseInt(sid, 10, 64)
+	if err != nil {
+		return
+	}
+	nc.mutex.Lock()
+	sub := nc.subs[id]
+	nc.mutex.Unlock()
+	if sub != nil {
+		sub.handler(msg)
+	}
+}
+
+// write sends raw protocol data
+func (nc *natsConn) write(data string) error {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	if nc.writer == nil {
+		return errNATSDisconnected
+	}
+	nc.writer.WriteString(data)
+	return nc.writer.Flush()
+}
+
+// subscribe registers a handler for a subject
+func (nc *natsConn) subscribe(subject string, handler func(*natsMsg)) (int64, error) {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	nc.nextSID++
+	sid := nc.nextSID
+	nc.subs[sid] = &natsSub{subject: subject, handler: handler}
+
+	// Subscriptions made while disconnected are sent on reconnect
+	if nc.writer == nil {
+		return sid, nil
+	}
+	fmt.Fprintf(nc.writer, "SUB %s %d\r\n", subject, sid)
+	return sid, nc.writer.Flush()
+}
+
+// unsubscribe removes a subscription
+func (nc *natsConn) unsubscribe(sid int64) error {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	delete(nc.subs, sid)
+	if nc.writer == nil {
+		return nil
+	}
+	fmt.Fprintf(nc.writer, "UNSUB %d\r\n", sid)
+	return nc.writer.Flush()
+}
+
+// publish sends a message, with headers if any are given
+func (nc *natsConn) publish(subject, reply string, header map[string]string, data []byte) error {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	if nc.writer == nil {
+		return errNATSDisconnected
+	}
+
+	if reply != "" {
+		reply = " " + reply
+	}
+	if len(header) == 0 {
+		fmt.Fprintf(nc.writer, "PUB %s%s %d\r\n", subject, reply, len(data))
+	} else {
+		var block strings.Builder
+		block.WriteString("NATS/1.0\r\n")
+		for key, value := range header {
+			block.WriteString(key + ": " + value + "\r\n")
+		}
+		block.WriteString("\r\n")
+		fmt.Fprintf(nc.writer, "HPUB %s%s %d %d\r\n%s", subject, reply, block.Len(), block.Len()+len(data), block.String())
+	}
+	nc.writer.Write(data)
+	nc.writer.WriteString("\r\n")
+	return nc.writer.Flush()
+}
+
+// request publishes a message and waits for its reply
+func (nc *natsConn) request(subject string, header map[string]string, data []byte) (*natsMsg, error) {
+	id := strconv.FormatInt(atomic.AddInt64(&nc.nextRequestID, 1), 10)
+	replies := make(chan *natsMsg, 1)
+
+	nc.requestsMutex.Lock()
+	nc.requests[id] = replies
+	nc.requestsMutex.Unlock()
+	defer func() {
+		nc.requestsMutex.Lock()
+		delete(nc.requests, id)
+		nc.requestsMutex.Unlock()
+	}()
+
+	if err := nc.publish(subject, nc.inbox+"."+id, header, data); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(natsTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-replies:
+		if msg.Status == "503" {
+			return nil, errNATSNoResponders
+		}
+		return msg, nil
+	case <-timer.C:
+		return nil, errNATSTimeout
+	case <-nc.closed:
+		return nil, errNATSDisconnected
+	}
+}
+
+// handleReply routes a reply to the request waiting for it
+func (nc *natsConn) handleReply(msg *natsMsg) {
+	id := msg.Subject[strings.LastIndexByte(msg.Subject, '.')+1:]
+
+	nc.requestsMutex.Lock()
+	replies, exists := nc.requests[id]
+	nc.requestsMutex.Unlock()
+
+	if exists {
+		select {
+		case replies <- msg:
+		default:
+		}
+	}
+}
+
+// close closes the connection for good
+func (nc *natsConn) close() error {
+	nc.closeOnce.Do(func() {
+		close(nc.closed)
+	})
+
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	if nc.conn == nil {
+		return nil
+	}
+	nc.writer.Flush()
+	err := nc.conn.Close()
+	nc.conn = nil
+	nc.writer = nil
+	return err
+}
@@ -0,0 +1,36 @@
+package registry
+
+import "sort"
+
+// serversInRegion returns the servers that declared region
+func serversInRegion(servers []*ServerInfo, region string) []*ServerInfo {
+	var inRegion []*ServerInfo
+	for _, server := range servers {
+		if server.Region == region {
+			inRegion = append(inRegion, server)
+		}
+	}
+	return inRegion
+}
+
+// PreferRegion orders servers for a client in region and zone: servers in the same zone first,
+// then the rest of the region, then other regions, each by load score
+// An empty region or zone matches nothing, leaving the order to load alone
+func PreferRegion(servers []*ServerInfo, region, zone string) {
+	proximity := func(server *ServerInfo) int {
+		switch {
+		case region == "" || server.Region != region:
+			return 2
+		case zone == "" || server.Zone != zone:
+			return 1
+		default:
+			return 0
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		if pi, pj := proximity(servers[i]), proximity(servers[j]); pi != pj {
+			return pi < pj
+		}
+		return servers[i].LoadScore() < servers[j].LoadScore()
+	})
+}
@@ -1,16 +1,37 @@
 package registry
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"log/slog"
+	"time"
 )
 
+// migrationTTL is how long a migration token stays valid for the client to reach its new server
+const migrationTTL = 60 * time.Second
+
+// MaxUsageTTL bounds how long a usage counter outlives its last update (NATS expires every counter after it)
+const MaxUsageTTL = 35 * 24 * time.Hour
+
+// usageRetries bounds check-and-set attempts on a usage counter other servers keep updating
+const usageRetries = 10
+
+// ErrMigrationInvalid is returned when a migration token is unknown, expired or issued for another subdomain
+var ErrMigrationInvalid = errors.New("invalid or expired migration token")
+
+// ErrTunnelMoved is returned when refreshing a tunnel another server has taken over
+var ErrTunnelMoved = errors.New("tunnel is registered on another server")
+
 // Registry is the interface that all registry implementations must satisfy
 type Registry interface {
 	// Tunnel operations
 	RegisterTunnel(info *TunnelInfo) error
 	GetTunnel(subdomain string) (*TunnelInfo, error)
 	UnregisterTunnel(subdomain string) error
-	RefreshTunnel(subdomain string) error
+	RefreshTunnel(info *TunnelInfo) error // Rewrites a tunnel's metadata and last seen time (ErrTunnelMoved if another server owns it)
 	GetAllTunnels() ([]*TunnelInfo, error)
 	IsLocalTunnel(subdomain string) (bool, error)
 
@@ -18,34 +39,183 @@ type Registry interface {
 	RegisterServer(info *ServerInfo) error
 	GetServer(serverID string) (*ServerInfo, error)
 	GetAllServers() ([]*ServerInfo, error)
+	GetServersInRegion(region string) ([]*ServerInfo, error)
 	StartHeartbeat(serverInfo *ServerInfo)
-	GetLeastLoadedServer() (*ServerInfo, error)
-	UpdateServerLoad(activeConnections int) error
+	GetLeastLoadedServer() (*ServerInfo, error) // Lowest LoadScore
+	UpdateServerLoad(load ServerLoad) error
+
+	// Migration operations (handing a tunnel to another server)
+	CreateMigration(subdomain string) (string, error)       // Issues a one-time token for the tunnel's next server
+	CompleteMigration(token string, info *TunnelInfo) error // Consumes the token and registers the tunnel here in one step
+
+	// Account operations (keyed by the account's secret key)
+	SaveAccount(secretKey string, account *Account) error
+	GetAccount(secretKey string) (*Account, error) // Returns nil if no account exists for the key
+	DeleteAccount(secretKey string) error
+
+	// Reservation operations (a subdomain held for one secret key across disconnects and restarts)
+	ReserveSubdomain(reservation *Reservation) error
+	GetReservation(subdomain string) (*Reservation, error) // Returns nil if the subdomain is not reserved or the reservation expired
+	DeleteReservation(subdomain string) error
+
+	// Usage counters (cluster-wide byte counts behind bandwidth quotas, surviving restarts)
+	AddUsage(counters []UsageCounter) ([]int64, error) // Adds each Delta, restarting the TTL of counters that change; returns their totals in order
+
+	// Cluster CA (signs the certificates servers present to each other for mutual TLS)
+	InitClusterCA(ca *ClusterCA) (*ClusterCA, error) // Stores ca unless the cluster already has one; returns the cluster's CA
+
+	// Event operations
+	PublishEvent(payload []byte) error
+	SubscribeEvents(handler func(payload []byte)) (func(), error) // Receives events published by any server until the returned func is called
 
 	// Cache operations
-	GetCacheStats() (hits, misses int, hitRate float64)
+	GetCacheStats() CacheStats
+	InvalidateTunnel(subdomain string) // Drops the cached lookup so the next GetTunnel reads the datastore
+
+	// Leadership (exactly one server runs cluster-wide housekeeping, elected during heartbeats)
+	IsLeader() bool
 
 	// Lifecycle
+	Ping() error // Checks that the backing store is reachable
 	Close() error
 }
 
+// Reservation holds a subdomain for the owner of a secret key, or for the holder of a reconnect token
+type Reservation struct {
+	Subdomain          string    `json:"subdomain"`
+	OwnerKeyHash       string    `json:"owner_key_hash"`                 // Hash of the owner's secret key (raw keys are never stored), empty for anonymous clients
+	ReconnectTokenHash string    `json:"reconnect_token_hash,omitempty"` // Hash of the last reconnect token issued for the subdomain
+	CreatedAt          time.Time `json:"created_at"`
+	ExpiresAt          time.Time `json:"expires_at"` // Zero means the reservation never expires
+}
+
+// NewReservation reserves subdomain for secretKey for ttl (0 = forever)
+func NewReservation(subdomain, secretKey string, ttl time.Duration) *Reservation {
+	now := time.Now()
+	reservation := &Reservation{
+		Subdomain: subdomain,
+		CreatedAt: now,
+	}
+	if secretKey != "" {
+		reservation.OwnerKeyHash = accountKey(secretKey)
+	}
+	if ttl > 0 {
+		reservation.ExpiresAt = now.Add(ttl)
+	}
+	return reservation
+}
+
+// WithReconnectToken lets the holder of token claim the reservation too
+func (r *Reservation) WithReconnectToken(token string) *Reservation {
+	r.ReconnectTokenHash = accountKey(token)
+	return r
+}
+
+// OwnedBy reports whether secretKey owns the reservation
+func (r *Reservation) OwnedBy(secretKey string) bool {
+	if r.OwnerKeyHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.OwnerKeyHash), []byte(accountKey(secretKey))) == 1
+}
+
+// HeldBy reports whether token is the reconnect token last issued for the reservation
+func (r *Reservation) HeldBy(token string) bool {
+	if r.ReconnectTokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.ReconnectTokenHash), []byte(accountKey(token))) == 1
+}
+
+// Expired reports whether the reservation has lapsed
+func (r *Reservation) Expired() bool {
+	return !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt)
+}
+
+// UsageCounter is an increment to a cluster-wide counter, which expires TTL after it last changed
+type UsageCounter struct {
+	Key   string        // Letters, digits, '-', '_' and '/' (valid in every backend's key space)
+	Delta int64         // Zero reads the counter without touching its TTL
+	TTL   time.Duration // At most MaxUsageTTL
+}
+
+// ClusterCA is the certificate authority generated by the first server to enable cluster TLS
+// Anyone who can read the registry can issue certificates from it
+type ClusterCA struct {
+	CertPEM   string    `json:"cert_pem"`
+	KeyPEM    string    `json:"key_pem"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Timings controls how quickly the registry notices vanished tunnels and servers
+// Shorter TTLs detect failures sooner at the cost of more datastore writes
+type Timings struct {
+	TunnelTTL         time.Duration // Tunnels expire if not refreshed
+	ServerTTL         time.Duration // Servers and the leader's lease expire if heartbeats stop
+	HeartbeatInterval time.Duration // How often servers heartbeat (must be below ServerTTL)
+	CacheTTL          time.Duration // How long tunnel lookups are cached locally
+}
+
+// DefaultTimings returns the timings used when none are configured
+func DefaultTimings() Timings {
+	return Timings{
+		TunnelTTL:         defaultTunnelTTL,
+		ServerTTL:         defaultServerTTL,
+		HeartbeatInterval: defaultHeartbeatInterval,
+		CacheTTL:          defaultCacheTTL,
+	}
+}
+
+// withDefaults fills unset timings with their defaults
+func (t Timings) withDefaults() Timings {
+	defaults := DefaultTimings()
+	if t.TunnelTTL <= 0 {
+		t.TunnelTTL = defaults.TunnelTTL
+	}
+	if t.ServerTTL <= 0 {
+		t.ServerTTL = defaults.ServerTTL
+	}
+	if t.HeartbeatInterval <= 0 {
+		t.HeartbeatInterval = defaults.HeartbeatInterval
+	}
+	if t.CacheTTL <= 0 {
+		t.CacheTTL = defaults.CacheTTL
+	}
+	return t
+}
+
 // TunnelInfo stores information about a tunnel in the registry
 // (already defined in distributed.go but kept here for reference)
 
 // ServerInfo stores information about a server in the cluster
 // (already defined in distributed.go but kept here for reference)
 
-// NewRegistry creates a registry based on the provided Redis URL
-// If redisURL is empty, returns an in-memory registry
+// NewRegistry creates a registry based on the provided Redis options
+// If no Redis deployment is configured, returns an in-memory registry
 // Otherwise, returns a distributed Redis-backed registry
-func NewRegistry(redisURL, serverID string, logger interface{}) (Registry, error) {
+func NewRegistry(redisOpts RedisOptions, timings Timings, serverID string, logger interface{}) (Registry, error) {
 	slogger, ok := logger.(*slog.Logger)
 	if !ok {
 		slogger = slog.Default()
 	}
 
-	if redisURL == "" {
-		return NewInMemoryRegistry(serverID, slogger)
+	if !redisOpts.Enabled() {
+		return NewInMemoryRegistry(timings, serverID, slogger)
+	}
+	return NewDistributedRegistry(redisOpts, timings, serverID, slogger)
+}
+
+// newMigrationToken generates a random migration token
+func newMigrationToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return NewDistributedRegistry(redisURL, serverID, slogger)
+	return hex.EncodeToString(b), nil
+}
+
+// accountKey hashes a secret key so raw keys are never stored in the registry
+func accountKey(secretKey string) string {
+	hash := sha256.Sum256([]byte(secretKey))
+	return hex.EncodeToString(hash[:])
 }
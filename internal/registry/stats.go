@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Tunnel lookup metrics, shared by every registry implementation
+var (
+	cacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tungo_cache_hits_total",
+		Help: "Total number of tunnel lookups served from the registry cache",
+	})
+	cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tungo_cache_misses_total",
+		Help: "Total number of tunnel lookups that missed the registry cache",
+	})
+	lookupLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tungo_registry_lookup_seconds",
+		Help:    "Latency of tunnel lookups that missed the registry cache",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// CacheStats summarizes a registry's tunnel lookups
+type CacheStats struct {
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hit_rate"`        // Fraction of lookups served from the cache (0-1)
+	MissLatencyMs float64 `json:"miss_latency_ms"` // Average latency of lookups that missed the cache
+}
+
+// lookupStats counts tunnel lookups (safe for concurrent use)
+type lookupStats struct {
+	hits      int64
+	misses    int64
+	missNanos int64
+}
+
+// hit records a lookup served from the cache
+func (s *lookupStats) hit() {
+	atomic.AddInt64(&s.hits, 1)
+	cacheHitsTotal.Inc()
+}
+
+// miss records a lookup that had to reach the backing store
+func (s *lookupStats) miss(latency time.Duration) {
+	atomic.AddInt64(&s.misses, 1)
+	atomic.AddInt64(&s.missNanos, int64(latency))
+	cacheMissesTotal.Inc()
+	lookupLatency.Observe(latency.Seconds())
+}
+
+// snapshot returns the current statistics
+func (s *lookupStats) snapshot() CacheStats {
+	stats := CacheStats{
+		Hits:   atomic.LoadInt64(&s.hits),
+		Misses: atomic.LoadInt64(&s.misses),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	if stats.Misses > 0 {
+		stats.MissLatencyMs = float64(atomic.LoadInt64(&s.missNanos)) / float64(stats.Misses) / float64(time.Millisecond)
+	}
+	return stats
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// maxLoggedBodyBytes caps how much of each body is included when body logging is enabled
+const maxLoggedBodyBytes = 4096
+
+// AccessLogEntry describes a single proxied request
+type AccessLogEntry struct {
+	SubDomain    string
+	StreamID     string
+	RequestID    string
+	Method       string
+	Path         string
+	Status       int
+	BytesIn      int
+	BytesOut     int
+	Latency      time.Duration
+	VisitorIP    string
+	Cache        string // Edge cache result (HIT or MISS), empty if the cache wasn't consulted
+	RequestBody  []byte
+	ResponseBody []byte
+}
+
+// AccessLogger emits one structured log line per proxied request
+type AccessLogger struct {
+	logger    zerolog.Logger
+	logBodies bool
+	file      *os.File
+}
+
+// NewAccessLogger creates an access logger writing to filePath, or to logger if filePath is empty
+func NewAccessLogger(logger zerolog.Logger, filePath string, logBodies bool) (*AccessLogger, error) {
+	al := &AccessLogger{
+		logger:    logger.With().Str("log", "access").Logger(),
+		logBodies: logBodies,
+	}
+
+	if filePath != "" {
+		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log file: %w", err)
+		}
+		al.file = file
+		al.logger = zerolog.New(file).With().Timestamp().Logger()
+	}
+
+	return al, nil
+}
+
+// Log writes an access log entry (no-op on a nil logger)
+func (al *AccessLogger) Log(entry AccessLogEntry) {
+	if al == nil {
+		return
+	}
+
+	// Access logs are emitted regardless of the configured log level
+	event := al.logger.Log().
+		Str("subdomain", entry.SubDomain).
+		Str("stream_id", entry.StreamID).
+		Str("request_id", entry.RequestID).
+		Str("method", entry.Method).
+		Str("path", entry.Path).
+		Int("status", entry.Status).
+		Int("bytes_in", entry.BytesIn).
+		Int("bytes_out", entry.BytesOut).
+		Float64("latency_ms", float64(entry.Latency.Microseconds())/1000).
+		Str("visitor_ip", entry.VisitorIP)
+
+	if entry.Cache != "" {
+		event = event.Str("cache", entry.Cache)
+	}
+
+	if al.logBodies {
+		event = event.
+			Str("request_body", truncateBody(entry.RequestBody)).
+			Str("response_body", truncateBody(entry.ResponseBody))
+	}
+
+	event.Msg("request")
+}
+
+// Close closes the access log file if one is open
+func (al *AccessLogger) Close() error {
+	if al == nil || al.file == nil {
+		return nil
+	}
+	return al.file.Close()
+}
+
+// truncateBody returns at most maxLoggedBodyBytes of a body as a string
+func truncateBody(body []byte) string {
+	if len(body) > maxLoggedBodyBytes {
+		return string(body[:maxLoggedBodyBytes]) + "...(truncated)"
+	}
+	return string(body)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/sombochea/tungo/internal/registry"
+)
+
+// AccountLimits enforces an account's request rate and bandwidth caps across all of its tunnels on this server
+type AccountLimits struct {
+	ID        string
+	Rate      *RateLimiter    // Nil when the account has no rate limit
+	Bandwidth *BandwidthMeter // Usage is keyed by account ID
+	rateLimit int             // Requests per second Rate was created for
+	rateMutex sync.RWMutex    // Guards Rate, replaced when the account's limit is reloaded
+}
+
+// NewAccountLimits creates the limiters for an account, sharing its bandwidth usage through store
+func NewAccountLimits(account *registry.Account, store registry.Registry) *AccountLimits {
+	return &AccountLimits{
+		ID:        account.ID,
+		Rate:      NewRateLimiter(account.RateLimit),
+		Bandwidth: NewBandwidthMeter(accountQuota(account), store, accountUsageScope),
+		rateLimit: account.RateLimit,
+	}
+}
+
+// Update applies an account's reloaded limits, keeping its metered bandwidth usage
+func (al *AccountLimits) Update(account *registry.Account) {
+	al.Bandwidth.SetQuota(accountQuota(account))
+
+	al.rateMutex.Lock()
+	defer al.rateMutex.Unlock()
+	if account.RateLimit != al.rateLimit {
+		al.Rate = NewRateLimiter(account.RateLimit)
+		al.rateLimit = account.RateLimit
+	}
+}
+
+// accountQuota returns the bandwidth quota of an account
+func accountQuota(account *registry.Account) BandwidthQuota {
+	return BandwidthQuota{
+		DailyBytes:   account.BandwidthDaily,
+		MonthlyBytes: account.BandwidthMonthly,
+		Action:       QuotaActionReject,
+	}
+}
+
+// Allow consumes a request from the account's rate limit (always true for a nil receiver)
+func (al *AccountLimits) Allow() bool {
+	if al == nil {
+		return true
+	}
+	al.rateMutex.RLock()
+	defer al.rateMutex.RUnlock()
+	return al.Rate.Allow()
+}
+
+// Exceeded reports whether the account is over its daily or monthly bandwidth cap
+func (al *AccountLimits) Exceeded() bool {
+	if al == nil {
+		return false
+	}
+	return al.Bandwidth.Exceeded(al.ID)
+}
+
+// Record adds traffic to the account's bandwidth usage
+func (al *AccountLimits) Record(bytesIn, bytesOut int64) {
+	if al == nil {
+		return
+	}
+	al.Bandwidth.Record(al.ID, bytesIn, bytesOut)
+}
@@ -0,0 +1,340 @@
+package admin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sombochea/tungo/internal/registry"
+	"github.com/sombochea/tungo/internal/server"
+)
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+const (
+	// sampleInterval is how often per-subdomain traffic is sampled for graphs
+	sampleInterval = 10 * time.Second
+	// historySize is the number of samples kept per subdomain
+	historySize = 60
+	// authCookie holds the hashed admin token for browser sessions
+	authCookie = "tungo-admin"
+	// MountPathHeader is set by the server to the path the dashboard is mounted at, as the browser sees it
+	// (the session cookie is scoped to it); requests without it are assumed to be under /admin
+	MountPathHeader = "X-Tungo-Admin-Path"
+)
+
+// Dashboard serves the server admin web UI
+type Dashboard struct {
+	token     string
+	connMgr   *server.ConnectionManager
+	proxy     *server.ProxyHandler
+	registry  registry.Registry
+	templates *template.Template
+	handler   http.Handler
+
+	// Per-subdomain traffic samples (bytes per interval), oldest first
+	history      map[string][]int64
+	lastTotals   map[string]int64
+	historyMutex sync.RWMutex
+	stop         chan struct{}
+}
+
+// TrafficSeries is the sampled traffic of a subdomain
+type TrafficSeries struct {
+	SubDomain string  `json:"subdomain"`
+	Samples   []int64 `json:"samples"`
+	Total     int64   `json:"total"`
+}
+
+// Stats is everything shown on the admin dashboard
+type Stats struct {
+	Clients []server.ClientSummary `json:"clients"`
+	Servers []*registry.ServerInfo `json:"servers"`
+	Traffic []TrafficSeries        `json:"traffic"`
+	Errors  []server.ErrorEvent    `json:"errors"`
+
+	Maintenance server.Maintenance `json:"maintenance"`
+}
+
+// NewDashboard creates a new admin dashboard protected by token
+func NewDashboard(token string, connMgr *server.ConnectionManager, proxy *server.ProxyHandler, reg registry.Registry) (*Dashboard, error) {
+	funcMap := template.FuncMap{
+		"sparkline": sparkline,
+		"bytes":     formatBytes,
+		"since": func(t time.Time) string {
+			return time.Since(t).Round(time.Second).String()
+		},
+	}
+
+	tmpl, err := template.New("").Funcs(funcMap).ParseFS(templatesFS, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse admin templates: %w", err)
+	}
+
+	d := &Dashboard{
+		token:      token,
+		connMgr:    connMgr,
+		proxy:      proxy,
+		registry:   reg,
+		templates:  tmpl,
+		history:    make(map[string][]int64),
+		lastTotals: make(map[string]int64),
+		stop:       make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.handleIndex)
+	mux.HandleFunc("/api/stats", d.handleAPIStats)
+	mux.HandleFunc("/api/maintenance", d.handleAPIMaintenance)
+	d.handler = d.requireToken(mux)
+
+	return d, nil
+}
+
+// Handler returns the dashboard's HTTP handler (expects paths relative to its mount point)
+func (d *Dashboard) Handler() http.Handler {
+	return d.handler
+}
+
+// Start begins sampling per-subdomain traffic for graphs
+func (d *Dashboard) Start() {
+	go func() {
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.sample()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops traffic sampling
+func (d *Dashboard) Stop() {
+	close(d.stop)
+}
+
+// sample records the traffic of each registered subdomain since the previous sample, forgetting released ones
+func (d *Dashboard) sample() {
+	usage := d.connMgr.Bandwidth().Snapshot()
+	registered := make(map[string]bool)
+	for _, subDomain := range d.connMgr.ListSubDomains() {
+		registered[subDomain] = true
+	}
+
+	d.historyMutex.Lock()
+	defer d.historyMutex.Unlock()
+
+	for subDomain := range d.lastTotals {
+		if !registered[subDomain] {
+			delete(d.lastTotals, subDomain)
+			delete(d.history, subDomain)
+		}
+	}
+
+	for subDomain, u := range usage {
+		if !registered[subDomain] {
+			continue
+		}
+		total := u.BytesIn + u.BytesOut
+		last, seen := d.lastTotals[subDomain]
+		d.lastTotals[subDomain] = total
+		if !seen {
+			continue // The first sample is the baseline, not traffic in the last interval
+		}
+		delta := total - last
+
+		samples := append(d.history[subDomain], delta)
+		if len(samples) > historySize {
+			samples = samples[len(samples)-historySize:]
+		}
+		d.history[subDomain] = samples
+	}
+}
+
+// requireToken rejects requests without the admin token (header, query or session cookie)
+func (d *Dashboard) requireToken(next http.Handler) http.Handler {
+	expected := fmt.Sprintf("%x", sha256.Sum256([]byte(d.token)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if provided == "" {
+			provided = r.URL.Query().Get("token")
+		}
+
+		if provided != "" {
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(d.token)) == 1 {
+				path := r.Header.Get(MountPathHeader)
+				if path == "" {
+					path = "/admin"
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     authCookie,
+					Value:    expected,
+					Path:     path,
+					MaxAge:   86400,
+					HttpOnly: true,
+					SameSite: http.SameSiteStrictMode,
+				})
+				next.ServeHTTP(w, r)
+				return
+			}
+		} else if cookie, err := r.Cookie(authCookie); err == nil &&
+			subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(expected)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Error(w, "Unauthorized: admin token required (?token=... or Authorization: Bearer ...)", http.StatusUnauthorized)
+	})
+}
+
+// collectStats gathers the current dashboard data
+func (d *Dashboard) collectStats() *Stats {
+	clients := d.connMgr.ListClients()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].SubDomain < clients[j].SubDomain
+	})
+
+	servers, err := d.registry.GetAllServers()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to list cluster servers")
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ServerID < servers[j].ServerID
+	})
+
+	d.historyMutex.RLock()
+	traffic := make([]TrafficSeries, 0, len(d.history))
+	for subDomain, samples := range d.history {
+		series := TrafficSeries{
+			SubDomain: subDomain,
+			Samples:   append([]int64(nil), samples...),
+			Total:     d.lastTotals[subDomain],
+		}
+		traffic = append(traffic, series)
+	}
+	d.historyMutex.RUnlock()
+	sort.Slice(traffic, func(i, j int) bool {
+		return traffic[i].Total > traffic[j].Total
+	})
+
+	return &Stats{
+		Clients: clients,
+		Servers: servers,
+		Traffic: traffic,
+		Errors:  d.proxy.RecentErrors(),
+
+		Maintenance: d.connMgr.Maintenance(),
+	}
+}
+
+// handleIndex renders the dashboard page
+func (d *Dashboard) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := d.templates.ExecuteTemplate(w, "index.html", d.collectStats()); err != nil {
+		log.Error().Err(err).Msg("Failed to render admin template")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// handleAPIStats returns dashboard data as JSON
+func (d *Dashboard) handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.collectStats())
+}
+
+// handleAPIMaintenance returns the maintenance mode (GET) or changes it (POST with a JSON body,
+// or a form from the dashboard which is then redirected back to the overview)
+func (d *Dashboard) handleAPIMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var maintenance server.Maintenance
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&maintenance); err != nil {
+				http.Error(w, "Invalid maintenance JSON", http.StatusBadRequest)
+				return
+			}
+		} else {
+			maintenance = server.Maintenance{
+				Enabled:     r.FormValue("enabled") == "true",
+				Message:     r.FormValue("message"),
+				KeepTunnels: r.FormValue("keep_tunnels") == "true",
+			}
+			d.connMgr.SetMaintenance(maintenance)
+			// Set directly: http.Redirect would resolve it against the path without the /admin mount point
+			w.Header().Set("Location", "../")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		d.connMgr.SetMaintenance(maintenance)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.connMgr.Maintenance())
+}
+
+// sparkline renders samples as SVG polyline points scaled to a 120x30 box
+func sparkline(samples []int64) string {
+	if len(samples) == 0 {
+		return ""
+	}
+
+	var peak int64 = 1
+	for _, v := range samples {
+		if v > peak {
+			peak = v
+		}
+	}
+
+	step := 120.0
+	if len(samples) > 1 {
+		step = 120.0 / float64(len(samples)-1)
+	}
+
+	points := make([]string, 0, len(samples))
+	for i, v := range samples {
+		y := 30 - float64(v)/float64(peak)*28
+		points = append(points, fmt.Sprintf("%.1f,%.1f", float64(i)*step, y))
+	}
+	return strings.Join(points, " ")
+}
+
+// formatBytes renders a byte count in human-readable units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
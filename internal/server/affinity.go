@@ -0,0 +1,93 @@
+package server
+
+import (
+	"hash/fnv"
+	"slices"
+
+	"github.com/gofiber/fiber/v3"
+
+	"github.com/sombochea/tungo/pkg/protocol"
+)
+
+// Session affinity modes for subdomains served by several clients
+const (
+	AffinityCookie = "cookie" // Pin visitors with a cookie naming their client
+	AffinityIP     = "ip"     // Pin visitors by a hash of their IP (remapped when replicas change)
+)
+
+// affinityCookiePrefix names the cookie pinning a visitor to a client (followed by the subdomain)
+const affinityCookiePrefix = "tungo-affinity-"
+
+// SelectClient picks the client serving a visitor request, honouring the tunnel's session affinity
+// Visitors are only moved to another client when theirs disconnects or its circuit breaker opens
+func (cm *ConnectionManager) SelectClient(c fiber.Ctx, subDomain string) (*ClientConnection, bool) {
+	switch cm.affinity(subDomain) {
+	case AffinityCookie:
+		cookieName := affinityCookiePrefix + subDomain
+		if client, ok := cm.pinnedClient(subDomain, protocol.ClientID(c.Cookies(cookieName))); ok {
+			return client, true
+		}
+
+		client, ok := cm.GetClientBySubDomain(subDomain)
+		if ok {
+			c.Cookie(&fiber.Cookie{
+				Name:     cookieName,
+				Value:    client.ID.String(),
+				Path:     "/",
+				HTTPOnly: true,
+				Secure:   c.Scheme() == "https",
+				SameSite: "Lax",
+			})
+		}
+		return client, ok
+	case AffinityIP:
+		return cm.hashedClient(subDomain, VisitorIP(c))
+	default:
+		return cm.GetClientBySubDomain(subDomain)
+	}
+}
+
+// affinity returns the session affinity mode of a subdomain
+func (cm *ConnectionManager) affinity(subDomain string) string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	if replicas, exists := cm.subdomains[subDomain]; exists {
+		return replicas.affinity
+	}
+	return ""
+}
+
+// pinnedClient returns the subdomain's client with the given ID if it's connected and accepting requests
+func (cm *ConnectionManager) pinnedClient(subDomain string, clientID protocol.ClientID) (*ClientConnection, bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	replicas, exists := cm.subdomains[subDomain]
+	if !exists || clientID == "" || !slices.Contains(replicas.clients, clientID) {
+		return nil, false
+	}
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return nil, false
+	}
+	if allowed, _ := client.Breaker.Allow(); !allowed {
+		return nil, false
+	}
+	return client, true
+}
+
+// hashedClient returns the subdomain's client chosen by hashing key, skipping clients that aren't accepting requests
+func (cm *ConnectionManager) hashedClient(subDomain, key string) (*ClientConnection, bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	replicas, exists := cm.subdomains[subDomain]
+	if !exists {
+		return nil, false
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	client, _ := cm.pickReplica(replicas, int(hash.Sum32()%uint32(len(replicas.clients))))
+	return client, client != nil
+}
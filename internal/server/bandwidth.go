@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sombochea/tungo/internal/registry"
+)
+
+// Bandwidth quota actions
+const (
+	QuotaActionReject   = "reject"
+	QuotaActionThrottle = "throttle"
+)
+
+// Scopes of the bandwidth counters kept in the registry
+const (
+	tunnelUsageScope  = "tunnels"
+	accountUsageScope = "accounts"
+)
+
+// BandwidthSyncInterval is how often metered traffic is added to the registry and usage refreshed from it
+const BandwidthSyncInterval = 5 * time.Second
+
+// bandwidthIdleTTL is how long a subdomain's usage stays cached after its last traffic
+const bandwidthIdleTTL = 10 * time.Minute
+
+// BandwidthQuota configures per-tunnel byte allowances (zero limits mean unlimited)
+type BandwidthQuota struct {
+	DailyBytes   int64
+	MonthlyBytes int64
+	Action       string // QuotaActionReject or QuotaActionThrottle
+	ThrottleRate int64  // Bytes per second once a throttled tunnel exceeds its quota
+}
+
+// BandwidthUsage holds metered traffic for a subdomain
+// With a registry, the totals are the cluster's as of the last sync plus this server's traffic since
+type BandwidthUsage struct {
+	BytesIn      int64 `json:"bytes_in"`
+	BytesOut     int64 `json:"bytes_out"`
+	DailyBytes   int64 `json:"daily_bytes"`
+	MonthlyBytes int64 `json:"monthly_bytes"`
+	day          string
+	month        string
+	pendingIn    int64 // Traffic not yet added to the registry
+	pendingOut   int64
+	lastActive   time.Time
+}
+
+// BandwidthMeter tracks bytes in/out per subdomain and checks them against a quota
+// Usage is keyed by subdomain so it survives client reconnections, and kept in the registry
+// so every server enforces the same quota and restarts don't reset it
+type BandwidthMeter struct {
+	quota     BandwidthQuota
+	usage     map[string]*BandwidthUsage
+	mutex     sync.Mutex
+	total     atomic.Int64      // Bytes in and out across all subdomains
+	store     registry.Registry // Holds the cluster-wide counters (nil keeps usage on this server)
+	scope     string            // Prefix of the meter's counter keys
+	syncMutex sync.Mutex        // Serializes Sync
+}
+
+// NewBandwidthMeter creates a new bandwidth meter sharing its usage through store under scope (nil store keeps it local)
+func NewBandwidthMeter(quota BandwidthQuota, store registry.Registry, scope string) *BandwidthMeter {
+	return &BandwidthMeter{
+		quota: quota,
+		usage: make(map[string]*BandwidthUsage),
+		store: store,
+		scope: scope,
+	}
+}
+
+// SetQuota replaces the quota, keeping metered usage
+func (m *BandwidthMeter) SetQuota(quota BandwidthQuota) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.quota = quota
+}
+
+// Record adds traffic for a subdomain, rolling daily/monthly windows as needed
+func (m *BandwidthMeter) Record(subDomain string, bytesIn, bytesOut int64) {
+	m.total.Add(bytesIn + bytesOut)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	usage := m.current(subDomain)
+	usage.BytesIn += bytesIn
+	usage.BytesOut += bytesOut
+	usage.DailyBytes += bytesIn + bytesOut
+	usage.MonthlyBytes += bytesIn + bytesOut
+	usage.pendingIn += bytesIn
+	usage.pendingOut += bytesOut
+	usage.lastActive = time.Now()
+}
+
+// Sync adds the traffic metered since the last sync to the registry and refreshes usage from the cluster-wide totals,
+// then drops subdomains idle for bandwidthIdleTTL (their usage is read back from the registry if they return)
+func (m *BandwidthMeter) Sync() error {
+	if m.store == nil {
+		return nil
+	}
+	m.syncMutex.Lock()
+	defer m.syncMutex.Unlock()
+
+	// Take the pending traffic of every cached subdomain, four counters each
+	type flush struct {
+		usage      *BandwidthUsage
+		in, out    int64
+		day, month string
+	}
+	m.mutex.Lock()
+	now := time.Now()
+	flushes := make([]flush, 0, len(m.usage))
+	counters := make([]registry.UsageCounter, 0, 4*len(m.usage))
+	for subDomain := range m.usage {
+		usage := m.current(subDomain)
+		if usage.pendingIn == 0 && usage.pendingOut == 0 && now.Sub(usage.lastActive) >= bandwidthIdleTTL {
+			delete(m.usage, subDomain)
+			continue
+		}
+
+		flushes = append(flushes, flush{usage: usage, in: usage.pendingIn, out: usage.pendingOut, day: usage.day, month: usage.month})
+		key := m.scope + "/" + usageKeyName(subDomain)
+		counters = append(counters,
+			registry.UsageCounter{Key: key + "/in", Delta: usage.pendingIn, TTL: registry.MaxUsageTTL},
+			registry.UsageCounter{Key: key + "/out", Delta: usage.pendingOut, TTL: registry.MaxUsageTTL},
+			registry.UsageCounter{Key: key + "/day/" + usage.day, Delta: usage.pendingIn + usage.pendingOut, TTL: 48 * time.Hour},
+			registry.UsageCounter{Key: key + "/month/" + usage.month, Delta: usage.pendingIn + usage.pendingOut, TTL: registry.MaxUsageTTL},
+		)
+		usage.pendingIn, usage.pendingOut = 0, 0
+	}
+	m.mutex.Unlock()
+
+	if len(counters) == 0 {
+		return nil
+	}
+	totals, err := m.store.AddUsage(counters)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err != nil {
+		// Keep the traffic for the next sync
+		for _, f := range flushes {
+			f.usage.pendingIn += f.in
+			f.usage.pendingOut += f.out
+		}
+		return err
+	}
+
+	// Entries are only dropped by Sync, so each flushed one is still cached
+	for i, f := range flushes {
+		total := totals[4*i : 4*i+4]
+		pending := f.usage.pendingIn + f.usage.pendingOut
+		f.usage.BytesIn = total[0] + f.usage.pendingIn
+		f.usage.BytesOut = total[1] + f.usage.pendingOut
+		if f.usage.day == f.day {
+			f.usage.DailyBytes = total[2] + pending
+		}
+		if f.usage.month == f.month {
+			f.usage.MonthlyBytes = total[3] + pending
+		}
+	}
+	return nil
+}
+
+// usageKeyName returns name if it is safe in a registry key, or a hash of it otherwise
+func usageKeyName(name string) string {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			sum := sha256.Sum256([]byte(name))
+			return hex.EncodeToString(sum[:16])
+		}
+	}
+	return name
+}
+
+// Usage returns a snapshot of a subdomain's metered traffic
+func (m *BandwidthMeter) Usage(subDomain string) BandwidthUsage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return *m.current(subDomain)
+}
+
+// TotalBytes returns the bytes metered across all subdomains since the server started
+func (m *BandwidthMeter) TotalBytes() int64 {
+	return m.total.Load()
+}
+
+// Snapshot returns the metered traffic of every subdomain
+func (m *BandwidthMeter) Snapshot() map[string]BandwidthUsage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	snapshot := make(map[string]BandwidthUsage, len(m.usage))
+	for subDomain := range m.usage {
+		snapshot[subDomain] = *m.current(subDomain)
+	}
+	return snapshot
+}
+
+// Exceeded reports whether a subdomain is over its daily or monthly quota
+func (m *BandwidthMeter) Exceeded(subDomain string) bool {
+	quota := m.getQuota()
+	if quota.DailyBytes <= 0 && quota.MonthlyBytes <= 0 {
+		return false
+	}
+
+	usage := m.Usage(subDomain)
+	if quota.DailyBytes > 0 && usage.DailyBytes >= quota.DailyBytes {
+		return true
+	}
+	return quota.MonthlyBytes > 0 && usage.MonthlyBytes >= quota.MonthlyBytes
+}
+
+// Throttles reports whether over-quota traffic is slowed down rather than rejected
+func (m *BandwidthMeter) Throttles() bool {
+	quota := m.getQuota()
+	return quota.Action == QuotaActionThrottle && quota.ThrottleRate > 0
+}
+
+// ThrottleDelay returns how long sending n bytes should take at the throttle rate
+func (m *BandwidthMeter) ThrottleDelay(n int) time.Duration {
+	rate := m.getQuota().ThrottleRate
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(int64(n) * int64(time.Second) / rate)
+}
+
+// getQuota returns the current quota
+func (m *BandwidthMeter) getQuota() BandwidthQuota {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.quota
+}
+
+// current returns the usage entry for a subdomain, resetting expired windows (caller holds the lock)
+func (m *BandwidthMeter) current(subDomain string) *BandwidthUsage {
+	now := time.Now().UTC()
+	day := now.Format("2006-01-02")
+	month := now.Format("2006-01")
+
+	usage, exists := m.usage[subDomain]
+	if !exists {
+		usage = &BandwidthUsage{day: day, month: month, lastActive: now}
+		m.usage[subDomain] = usage
+	}
+
+	if usage.day != day {
+		usage.day = day
+		usage.DailyBytes = 0
+	}
+	if usage.month != month {
+		usage.month = month
+		usage.MonthlyBytes = 0
+	}
+
+	return usage
+}
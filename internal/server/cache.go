@@ -0,0 +1,356 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+
+	"github.com/sombochea/tungo/internal/registry"
+	"github.com/sombochea/tungo/pkg/protocol"
+)
+
+// cacheKeyPrefix namespaces edge cache entries in shared stores
+const cacheKeyPrefix = "tungo:cache:"
+
+// cacheScanBatchSize is the SCAN count hint used when purging a subdomain from Redis
+const cacheScanBatchSize = 500
+
+// uncachedHeaders are response headers never stored with a cached response
+var uncachedHeaders = []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Trailer", "Upgrade"}
+
+// CachedResponse is a tunnel response stored by the edge cache
+type CachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Stored time.Time   `json:"stored"`
+}
+
+// CacheStore holds cached responses until they expire
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, entry *CachedResponse, ttl time.Duration)
+	DeletePrefix(prefix string) // Drops every entry whose key starts with prefix
+}
+
+// ResponseCache serves repeat requests for cacheable tunnel responses without a round trip through the tunnel
+// Responses are cached by per-tunnel path rules or by their Cache-Control max-age
+type ResponseCache struct {
+	store        CacheStore
+	maxEntrySize int64
+}
+
+// NewResponseCache creates an edge cache over store, keeping bodies up to maxEntrySize bytes
+func NewResponseCache(store CacheStore, maxEntrySize int64) *ResponseCache {
+	return &ResponseCache{
+		store:        store,
+		maxEntrySize: maxEntrySize,
+	}
+}
+
+// Lookup returns the cached response for the request, if any (never for a nil receiver)
+func (rc *ResponseCache) Lookup(c fiber.Ctx, client *ClientConnection) (*CachedResponse, bool) {
+	if rc == nil || !cacheableRequest(c) || hasDirective(c.Get(fiber.HeaderCacheControl), "no-cache") {
+		return nil, false
+	}
+	return rc.store.Get(cacheKey(c, client))
+}
+
+// TTL returns how long the response to the request may be cached (0 = not cacheable)
+func (rc *ResponseCache) TTL(c fiber.Ctx, client *ClientConnection, resp *http.Response) time.Duration {
+	if rc == nil || !cacheableRequest(c) || resp.StatusCode != http.StatusOK {
+		return 0
+	}
+	if resp.ContentLength > rc.maxEntrySize {
+		return 0
+	}
+
+	// Responses that are personal, encoded for this visitor or negotiated can't be shared
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Content-Encoding") != "" {
+		return 0
+	}
+	for _, vary := range strings.Split(resp.Header.Get("Vary"), ",") {
+		if vary = strings.TrimSpace(vary); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+			return 0
+		}
+	}
+	cacheControl := resp.Header.Get("Cache-Control")
+	if hasDirective(cacheControl, "no-store") || hasDirective(cacheControl, "private") {
+		return 0
+	}
+
+	if ttl, ok := matchCacheRule(client.CacheRules, c.Path()); ok {
+		return ttl
+	}
+	if hasDirective(cacheControl, "no-cache") {
+		return 0
+	}
+	if maxAge, ok := directiveSeconds(cacheControl, "s-maxage"); ok {
+		return maxAge
+	}
+	maxAge, _ := directiveSeconds(cacheControl, "max-age")
+	return maxAge
+}
+
+// Store caches a complete response body under a key from cacheKey for ttl
+// Bodies over the entry size limit are skipped
+func (rc *ResponseCache) Store(key string, resp *http.Response, body []byte, ttl time.Duration) {
+	if int64(len(body)) > rc.maxEntrySize {
+		return
+	}
+
+	header := resp.Header.Clone()
+	for _, name := range uncachedHeaders {
+		header.Del(name)
+	}
+	rc.store.Set(key, &CachedResponse{
+		Status: resp.StatusCode,
+		Header: header,
+		Body:   body,
+		Stored: time.Now(),
+	}, ttl)
+}
+
+// Purge drops every cached response of a subdomain, whichever owner stored it (no-op for a nil receiver)
+func (rc *ResponseCache) Purge(subDomain string) {
+	if rc == nil {
+		return
+	}
+	rc.store.DeletePrefix(cacheKeyPrefix + subDomain + ":")
+}
+
+// cacheableRequest reports whether a request may be served from or stored in the cache
+func cacheableRequest(c fiber.Ctx) bool {
+	return c.Method() == fiber.MethodGet && c.Get(fiber.HeaderAuthorization) == "" && c.Get(fiber.HeaderRange) == ""
+}
+
+// cacheKey identifies a request by tunnel, owner, path and query
+// Entries outlive their tunnel in shared stores, the owner keeps a subdomain's next owner from being served them
+func cacheKey(c fiber.Ctx, client *ClientConnection) string {
+	key := cacheKeyPrefix + client.SubDomain + ":" + cacheOwner(client) + ":" + c.Path()
+	if query := c.Request().URI().QueryString(); len(query) > 0 {
+		key += "?" + string(query)
+	}
+	return key
+}
+
+// cacheOwner identifies a tunnel's owner in cache keys, anonymous IDs (chosen by the client) kept apart from keyed ones
+func cacheOwner(client *ClientConnection) string {
+	kind := "key:"
+	if client.Anonymous {
+		kind = "anonymous:"
+	}
+	sum := sha256.Sum256([]byte(kind + client.OwnerID.String()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// matchCacheRule returns the TTL of the first rule matching the path
+func matchCacheRule(rules []protocol.CacheRule, requestPath string) (time.Duration, bool) {
+	for _, rule := range rules {
+		matched := strings.HasPrefix(requestPath, rule.Path)
+		if strings.Contains(rule.Path, "*") {
+			matched, _ = path.Match(rule.Path, requestPath)
+		}
+		if matched {
+			return time.Duration(rule.TTL) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// hasDirective reports whether a Cache-Control header contains a directive
+func hasDirective(cacheControl, directive string) bool {
+	for _, part := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// directiveSeconds returns the value of a seconds-valued Cache-Control directive
+func directiveSeconds(cacheControl, directive string) (time.Duration, bool) {
+	for _, part := range strings.Split(cacheControl, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(name, directive) {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil || seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// MemoryCacheStore is an in-memory cache store bounded by total body size, evicting least recently used entries
+type MemoryCacheStore struct {
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	mutex   sync.Mutex
+}
+
+// memoryCacheItem is an entry of the in-memory cache
+type memoryCacheItem struct {
+	key     string
+	entry   *CachedResponse
+	expires time.Time
+}
+
+// NewMemoryCacheStore creates an in-memory cache store holding up to maxSize bytes of bodies
+func NewMemoryCacheStore(maxSize int64) *MemoryCacheStore {
+	return &MemoryCacheStore{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get implements CacheStore
+func (s *MemoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	item := element.Value.(*memoryCacheItem)
+	if time.Now().After(item.expires) {
+		s.remove(element)
+		return nil, false
+	}
+	s.lru.MoveToFront(element)
+	return item.entry, true
+}
+
+// Set implements CacheStore
+func (s *MemoryCacheStore) Set(key string, entry *CachedResponse, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.remove(element)
+	}
+	if int64(len(entry.Body)) > s.maxSize {
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&memoryCacheItem{key: key, entry: entry, expires: time.Now().Add(ttl)})
+	s.size += int64(len(entry.Body))
+	for s.size > s.maxSize {
+		s.remove(s.lru.Back())
+	}
+}
+
+// DeletePrefix implements CacheStore
+func (s *MemoryCacheStore) DeletePrefix(prefix string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, element := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(element)
+		}
+	}
+}
+
+// remove drops an entry (caller holds the mutex)
+func (s *MemoryCacheStore) remove(element *list.Element) {
+	item := s.lru.Remove(element).(*memoryCacheItem)
+	delete(s.entries, item.key)
+	s.size -= int64(len(item.entry.Body))
+}
+
+// RedisCacheStore is a cache store shared by every server through Redis
+type RedisCacheStore struct {
+	client redis.UniversalClient
+	logger zerolog.Logger
+}
+
+// NewRedisCacheStore creates a Redis-backed cache store
+func NewRedisCacheStore(opts registry.RedisOptions, logger zerolog.Logger) (*RedisCacheStore, error) {
+	client, err := registry.NewRedisClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisCacheStore{
+		client: client,
+		logger: logger,
+	}, nil
+}
+
+// Get implements CacheStore
+func (s *RedisCacheStore) Get(key string) (*CachedResponse, bool) {
+	data, err := s.client.Get(context.Background(), key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			s.logger.Warn().Err(err).Msg("Failed to read cached response")
+		}
+		return nil, false
+	}
+
+	var entry CachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Set implements CacheStore
+func (s *RedisCacheStore) Set(key string, entry *CachedResponse, ttl time.Duration) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := s.client.Set(context.Background(), key, data, ttl).Err(); err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to store cached response")
+	}
+}
+
+// DeletePrefix implements CacheStore, scanning rather than using KEYS so a large cache doesn't block Redis
+func (s *RedisCacheStore) DeletePrefix(prefix string) {
+	ctx := context.Background()
+	deleteOnNode := func(ctx context.Context, node redis.UniversalClient) error {
+		iter := node.Scan(ctx, 0, prefix+"*", cacheScanBatchSize).Iterator()
+		for iter.Next(ctx) {
+			if err := node.Unlink(ctx, iter.Val()).Err(); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := s.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return deleteOnNode(ctx, node)
+		})
+	} else {
+		err = deleteOnNode(ctx, s.client)
+	}
+	if err != nil {
+		s.logger.Warn().Err(err).Str("prefix", prefix).Msg("Failed to purge cached responses")
+	}
+}
+
+// Close closes the Redis connection
+func (s *RedisCacheStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+)
+
+// cacheRequest returns a context for a GET of path on a tunnel
+func cacheRequest(t *testing.T, path string) fiber.Ctx {
+	t.Helper()
+	app := fiber.New()
+	fctx := &fasthttp.RequestCtx{}
+	fctx.Request.Header.SetMethod(fiber.MethodGet)
+	fctx.Request.SetRequestURI(path)
+	c := app.AcquireCtx(fctx)
+	t.Cleanup(func() { app.ReleaseCtx(c) })
+	return c
+}
+
+func TestResponseCacheNewOwnerNeverGetsPreviousOwnersResponse(t *testing.T) {
+	cache := NewResponseCache(NewMemoryCacheStore(1<<20), 1<<20)
+	previous := &ClientConnection{OwnerID: "previous", SubDomain: "shared", TunnelOptions: TunnelOptions{Anonymous: true}}
+	next := &ClientConnection{OwnerID: "next", SubDomain: "shared"}
+
+	c := cacheRequest(t, "/index.html")
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"max-age=86400"}}}
+	cache.Store(cacheKey(c, previous), resp, []byte("previous owner"), time.Hour)
+
+	if _, ok := cache.Lookup(c, previous); !ok {
+		t.Fatal("previous owner's response wasn't cached")
+	}
+	if entry, ok := cache.Lookup(c, next); ok {
+		t.Fatalf("new owner got the previous owner's cached response %q", entry.Body)
+	}
+
+	// An anonymous client picking the same ID as a keyed owner still gets its own entries
+	impostor := &ClientConnection{OwnerID: "next", SubDomain: "shared", TunnelOptions: TunnelOptions{Anonymous: true}}
+	cache.Store(cacheKey(c, impostor), resp, []byte("impostor"), time.Hour)
+	if entry, ok := cache.Lookup(c, next); ok {
+		t.Fatalf("keyed owner got an anonymous client's cached response %q", entry.Body)
+	}
+}
+
+func TestResponseCachePurgeDropsSubdomain(t *testing.T) {
+	cache := NewResponseCache(NewMemoryCacheStore(1<<20), 1<<20)
+	owner := &ClientConnection{OwnerID: "owner", SubDomain: "app"}
+	neighbour := &ClientConnection{OwnerID: "owner", SubDomain: "app-staging"}
+
+	c := cacheRequest(t, "/")
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	cache.Store(cacheKey(c, owner), resp, []byte("app"), time.Hour)
+	cache.Store(cacheKey(c, neighbour), resp, []byte("staging"), time.Hour)
+
+	cache.Purge("app")
+	if _, ok := cache.Lookup(c, owner); ok {
+		t.Fatal("purged subdomain still served from the cache")
+	}
+	if _, ok := cache.Lookup(c, neighbour); !ok {
+		t.Fatal("purge dropped another subdomain sharing its prefix")
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker fails requests fast after a tunnel repeatedly times out or cannot accept data
+// Once open it rejects requests for the cooldown, then lets a single failure re-open it (half-open)
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	mutex     sync.Mutex
+}
+
+// NewCircuitBreaker creates a circuit breaker that opens after threshold consecutive failures
+// Returns nil (always closed) if threshold is not positive
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a request may proceed, and if not, how long until it may
+func (cb *CircuitBreaker) Allow() (bool, time.Duration) {
+	if cb == nil {
+		return true, 0
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if remaining := time.Until(cb.openUntil); remaining > 0 {
+		return false, remaining
+	}
+	return true, 0
+}
+
+// RecordSuccess closes the breaker
+func (cb *CircuitBreaker) RecordSuccess() {
+	if cb == nil {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.failures = 0
+}
+
+// RecordFailure counts a failure and reports whether it opened the breaker
+func (cb *CircuitBreaker) RecordFailure() bool {
+	if cb == nil {
+		return false
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.failures++
+	if cb.failures < cb.threshold {
+		return false
+	}
+
+	// Stay one failure away from re-opening while half-open
+	cb.failures = cb.threshold - 1
+	cb.openUntil = time.Now().Add(cb.cooldown)
+	return true
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/sombochea/tungo/internal/registry"
+)
+
+const (
+	clusterCAValidity   = 10 * 365 * 24 * time.Hour // Generated cluster CA
+	clusterCertValidity = 365 * 24 * time.Hour      // Certificates issued to servers at startup
+)
+
+// ClusterTLS holds the certificate this server presents to other cluster servers and the CA it trusts for theirs
+type ClusterTLS struct {
+	cert tls.Certificate
+	ca   *x509.CertPool
+}
+
+// LoadClusterTLS loads this server's certificate and key and the cluster CA from PEM files
+func LoadClusterTLS(certFile, keyFile, caFile string) (*ClusterTLS, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cluster certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &ClusterTLS{cert: cert, ca: pool}, nil
+}
+
+// NewClusterTLS issues this server a certificate from the cluster CA kept in the registry,
+// generating the CA if this is the first server to enable cluster TLS
+func NewClusterTLS(reg registry.Registry, serverID string) (*ClusterTLS, error) {
+	generated, err := newClusterCA()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate cluster CA: %w", err)
+	}
+	clusterCA, err := reg.InitClusterCA(generated)
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, caKey, err := parseClusterCA(clusterCA)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := issueClusterCert(caCert, caKey, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue cluster certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return &ClusterTLS{cert: cert, ca: pool}, nil
+}
+
+// ServerConfig returns the TLS config for the cluster listener, which only accepts servers with a certificate from the cluster CA
+func (t *ClusterTLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    t.ca,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// ClientConfig returns the TLS config for proxying to other servers
+// Peers are verified against the cluster CA rather than by host name, as servers dial each other by advertised address
+func (t *ClusterTLS) ClientConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{t.cert},
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // Replaced by VerifyConnection
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         t.ca,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			return err
+		},
+	}
+}
+
+// newClusterCA generates a self-signed CA for the cluster
+func newClusterCA() (*registry.ClusterCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "tungo cluster CA"},
+		NotBefore:             now.Add(-time.Hour), // Tolerate clock skew between servers
+		NotAfter:              now.Add(clusterCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registry.ClusterCA{
+		CertPEM:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:    string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		CreatedAt: now,
+	}, nil
+}
+
+// parseClusterCA decodes the CA certificate and key stored in the registry
+func parseClusterCA(clusterCA *registry.ClusterCA) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode([]byte(clusterCA.CertPEM))
+	keyBlock, _ := pem.Decode([]byte(clusterCA.KeyPEM))
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("invalid cluster CA in registry")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cluster CA certificate: %w", err)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cluster CA key: %w", err)
+	}
+	return cert, key, nil
+}
+
+// issueClusterCert issues a certificate for serverID, valid both for serving and for dialing other servers
+func issueClusterCert(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, serverID string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serverID},
+		DNSNames:     []string{serverID},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(clusterCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// randomSerial returns a random 128-bit certificate serial number
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
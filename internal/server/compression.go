@@ -0,0 +1,71 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+)
+
+// minCompressSize is the smallest known-length response worth compressing
+const minCompressSize = 1024
+
+// incompressibleTypes are content types that are already compressed (matched by prefix)
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/x-xz",
+	"application/zstd", "application/octet-stream", "application/pdf", "application/wasm",
+}
+
+// ResponseCompressor compresses tunnel responses at the edge with brotli or gzip, as the visitor accepts
+type ResponseCompressor struct {
+	compress fasthttp.RequestHandler
+}
+
+// NewResponseCompressor creates an edge response compressor
+func NewResponseCompressor() *ResponseCompressor {
+	return &ResponseCompressor{
+		compress: fasthttp.CompressHandlerBrotliLevel(func(*fasthttp.RequestCtx) {},
+			fasthttp.CompressBrotliDefaultCompression,
+			fasthttp.CompressDefaultCompression,
+		),
+	}
+}
+
+// Compress compresses the response body stream if the visitor and response allow it (no-op for a nil receiver)
+// contentLength is the uncompressed body size, or -1 if unknown
+func (rc *ResponseCompressor) Compress(c fiber.Ctx, status int, contentLength int64) {
+	if rc == nil || !compressible(c, status, contentLength) {
+		return
+	}
+	rc.compress(c.RequestCtx())
+}
+
+// compressible reports whether a response may be compressed at the edge
+// Bodies the local app already encoded are left alone by fasthttp itself
+func compressible(c fiber.Ctx, status int, contentLength int64) bool {
+	if c.Method() == fiber.MethodHead || c.Get(fiber.HeaderRange) != "" {
+		return false
+	}
+	if status < 200 || status == fiber.StatusNoContent || status == fiber.StatusNotModified || status == fiber.StatusPartialContent {
+		return false
+	}
+	if contentLength >= 0 && contentLength < minCompressSize {
+		return false
+	}
+	if strings.Contains(strings.ToLower(c.GetRespHeader(fiber.HeaderCacheControl)), "no-transform") {
+		return false
+	}
+
+	contentType := strings.ToLower(c.GetRespHeader(fiber.HeaderContentType))
+	if strings.HasPrefix(contentType, "image/svg") {
+		return true
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
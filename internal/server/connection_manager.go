@@ -1,8 +1,12 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
@@ -10,18 +14,55 @@ import (
 	"github.com/sombochea/tungo/pkg/protocol"
 )
 
+// ErrTooManyStreams is returned when a client is at its concurrent stream limit
+var ErrTooManyStreams = errors.New("too many concurrent streams")
+
+// TunnelOptions holds the per-tunnel settings requested by the client
+type TunnelOptions struct {
+	ClientVersion   string
+	Anonymous       bool                  // Created without a secret key
+	Password        string                // Optional password to protect tunnel access
+	BasicAuth       string                // Optional "user:pass" credentials enforced via HTTP Basic Auth
+	OAuth           *protocol.OAuthPolicy // Optional OAuth login visitors need before reaching the tunnel
+	InspectPassword string                // Optional password to access the shared client dashboard
+	IPFilter        *IPFilter             // Optional visitor IP allow/deny lists
+	MaxBodySize     int64                 // Optional request body size limit in bytes
+	ResponseHeaders map[string]string     // Optional headers injected into responses
+	CacheRules      []protocol.CacheRule  // Optional paths cached at the edge
+	Affinity        string                // Optional session affinity across replicas (AffinityCookie or AffinityIP)
+	Labels          map[string]string     // Optional labels stored with the tunnel in the registry
+	Region          string                // Region the client prefers servers in (empty = near this server)
+	Protocol        string                // protocol.ProtocolTCP for a raw TCP tunnel (empty = HTTP)
+	Account         *registry.Account     // Tenant account the tunnel belongs to, if any
+
+	// Optional overrides of the server's response timeouts
+	ResponseTimeouts *protocol.ResponseTimeouts
+}
+
 // ClientConnection represents a connected client
 type ClientConnection struct {
-	ID            protocol.ClientID
-	SubDomain     string
-	ClientVersion string
-	Password      string // Optional password to protect tunnel access
-	Conn          *websocket.Conn
-	Streams       map[protocol.StreamID]*Stream
-	StreamMutex   sync.RWMutex
-	Logger        zerolog.Logger
-	Send          chan []byte
-	Done          chan struct{}
+	TunnelOptions
+	ID          protocol.ClientID
+	OwnerID     protocol.ClientID // The ID the subdomain is held under, shared by its replicas
+	SubDomain   string
+	ConnectedAt time.Time
+	Conn        *websocket.Conn
+	Streams     map[protocol.StreamID]*Stream
+	StreamMutex sync.RWMutex
+	Logger      zerolog.Logger
+	Send        chan []byte
+	Done        chan struct{}
+	Breaker     *CircuitBreaker // Fails requests fast while the tunnel is unresponsive
+	Limits      *AccountLimits  // Shared by every tunnel of the client's account (nil without an account)
+	MaxStreams  int             // Concurrent stream limit (0 = unlimited)
+	lastStream  int64           // Unix nanoseconds of the last stream or the connection (atomic)
+	expiryNoted bool            // The client was warned its session is about to expire (write pump only)
+
+	// Keepalive health, updated by the control server's ping/pong exchange
+	healthMutex sync.RWMutex
+	pingSentAt  time.Time
+	lastPong    time.Time
+	rtt         time.Duration
 }
 
 // Stream represents an active data stream
@@ -31,64 +72,208 @@ type Stream struct {
 	RemoteAddr string
 	DataChan   chan []byte
 	Done       chan struct{}
+	aborted    atomic.Bool // Ended by AbortStream, its data is incomplete
+}
+
+// tunnelReplicas are the clients serving one subdomain, picked round-robin per request
+// Only connections authenticated as the owner (the same secret key) may join
+type tunnelReplicas struct {
+	owner    protocol.ClientID
+	clients  []protocol.ClientID
+	next     int
+	affinity string // Session affinity requested by the client that registered the subdomain
 }
 
 // ConnectionManager manages all active client connections
 type ConnectionManager struct {
 	clients       map[protocol.ClientID]*ClientConnection
-	subdomains    map[string]protocol.ClientID
+	subdomains    map[string]*tunnelReplicas
 	mutex         sync.RWMutex
 	registry      registry.Registry
 	logger        zerolog.Logger
 	maxConnection int
+	bandwidth     *BandwidthMeter
+	accounts      map[string]*AccountLimits // Keyed by account ID
+	draining      bool
+	maintenance   Maintenance
+	cache         *ResponseCache // Edge cache purged as subdomains change hands (nil = disabled)
+
+	// Per-client circuit breaker settings
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	// Default concurrent stream limit per client (0 = unlimited)
+	maxStreams int
+
+	// Subdomains whose client just disconnected; requests are held until it reconnects or the grace period ends
+	reconnecting   map[string]*pendingReconnect
+	reconnectGrace time.Duration
 }
 
 // NewConnectionManager creates a new connection manager
 func NewConnectionManager(reg registry.Registry, logger zerolog.Logger, maxConn int) *ConnectionManager {
 	return &ConnectionManager{
 		clients:       make(map[protocol.ClientID]*ClientConnection),
-		subdomains:    make(map[string]protocol.ClientID),
+		subdomains:    make(map[string]*tunnelReplicas),
 		registry:      reg,
 		logger:        logger,
 		maxConnection: maxConn,
+		bandwidth:     NewBandwidthMeter(BandwidthQuota{}, reg, tunnelUsageScope),
+		accounts:      make(map[string]*AccountLimits),
+		reconnecting:  make(map[string]*pendingReconnect),
+	}
+}
+
+// SetBandwidthQuota sets the per-tunnel bandwidth quota enforced by the proxy
+func (cm *ConnectionManager) SetBandwidthQuota(quota BandwidthQuota) {
+	cm.bandwidth = NewBandwidthMeter(quota, cm.registry, tunnelUsageScope)
+}
+
+// SetResponseCache sets the edge cache whose entries for a subdomain are dropped when it is released or taken
+func (cm *ConnectionManager) SetResponseCache(cache *ResponseCache) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.cache = cache
+}
+
+// SetMaxConnections sets the maximum number of connected clients (existing clients are kept)
+func (cm *ConnectionManager) SetMaxConnections(maxConn int) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.maxConnection = maxConn
+}
+
+// SetCircuitBreaker configures the circuit breaker given to newly connected clients (threshold 0 disables it)
+func (cm *ConnectionManager) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.breakerThreshold = threshold
+	cm.breakerCooldown = cooldown
+}
+
+// SetMaxStreams sets the concurrent stream limit given to newly connected clients without an account override
+func (cm *ConnectionManager) SetMaxStreams(maxStreams int) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.maxStreams = maxStreams
+}
+
+// UpdateAccountLimits applies an account's reloaded limits to the tunnels already sharing its limiters
+func (cm *ConnectionManager) UpdateAccountLimits(account *registry.Account) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	if limits, exists := cm.accounts[account.ID]; exists {
+		limits.Update(account)
 	}
 }
 
+// Bandwidth returns the per-subdomain bandwidth meter
+func (cm *ConnectionManager) Bandwidth() *BandwidthMeter {
+	return cm.bandwidth
+}
+
+// SyncBandwidth adds the traffic metered since the last sync to the registry, for tunnel and account quotas
+func (cm *ConnectionManager) SyncBandwidth() {
+	cm.mutex.RLock()
+	meters := make([]*BandwidthMeter, 0, len(cm.accounts)+1)
+	meters = append(meters, cm.bandwidth)
+	for _, limits := range cm.accounts {
+		meters = append(meters, limits.Bandwidth)
+	}
+	cm.mutex.RUnlock()
+
+	for _, meter := range meters {
+		if err := meter.Sync(); err != nil {
+			cm.logger.Warn().Err(err).Msg("Failed to sync bandwidth usage")
+		}
+	}
+}
+
+// SetDraining marks the server as shutting down so no new tunnels or streams are accepted
+func (cm *ConnectionManager) SetDraining() {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.draining = true
+}
+
+// IsDraining reports whether the server is shutting down
+func (cm *ConnectionManager) IsDraining() bool {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.draining
+}
+
 // AddClient adds a new client connection
-func (cm *ConnectionManager) AddClient(clientID protocol.ClientID, subDomain string, clientVersion string, password string, conn *websocket.Conn) (*ClientConnection, error) {
+// Clients with the same ID (derived from the same secret key) may share a subdomain; each extra
+// replica gets its own connection ID, so the returned client's ID may differ from clientID
+func (cm *ConnectionManager) AddClient(clientID protocol.ClientID, subDomain string, opts TunnelOptions, conn *websocket.Conn) (*ClientConnection, error) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
+	if cm.draining {
+		return nil, fmt.Errorf("server is shutting down")
+	}
+
 	// Check if max connections reached
 	if len(cm.clients) >= cm.maxConnection {
 		return nil, fmt.Errorf("maximum connections reached")
 	}
 
-	// Check if subdomain is already in use
-	if existingID, exists := cm.subdomains[subDomain]; exists {
-		if existingID != clientID {
-			return nil, fmt.Errorf("subdomain already in use")
-		}
+	// Check if subdomain is already in use by another owner, only keyed clients can add replicas
+	replicas, exists := cm.subdomains[subDomain]
+	if exists && (replicas.owner != clientID || opts.Anonymous) {
+		return nil, fmt.Errorf("subdomain already in use")
+	}
+	if !exists {
+		replicas = &tunnelReplicas{owner: clientID, affinity: opts.Affinity}
+		// Shared stores may still hold a previous owner's responses (cache is I/O, not done under the mutex)
+		go cm.cache.Purge(subDomain)
+	}
+
+	ownerID := clientID
+	if _, taken := cm.clients[clientID]; taken {
+		clientID = protocol.GenerateClientID()
 	}
 
 	client := &ClientConnection{
+		TunnelOptions: opts,
 		ID:            clientID,
+		OwnerID:       ownerID,
 		SubDomain:     subDomain,
-		ClientVersion: clientVersion,
-		Password:      password,
+		ConnectedAt:   time.Now(),
 		Conn:          conn,
 		Streams:       make(map[protocol.StreamID]*Stream),
 		Logger:        cm.logger.With().Str("client_id", clientID.String()).Str("subdomain", subDomain).Logger(),
 		Send:          make(chan []byte, 512), // Increased buffer for high throughput
 		Done:          make(chan struct{}),
+		Breaker:       NewCircuitBreaker(cm.breakerThreshold, cm.breakerCooldown),
+		MaxStreams:    cm.maxStreams,
+		lastStream:    time.Now().UnixNano(),
+	}
+
+	// Tunnels of the same account share its limiters (usage survives reconnections)
+	if opts.Account != nil {
+		limits, exists := cm.accounts[opts.Account.ID]
+		if !exists {
+			limits = NewAccountLimits(opts.Account, cm.registry)
+			cm.accounts[opts.Account.ID] = limits
+		}
+		client.Limits = limits
+		if opts.Account.MaxStreams > 0 {
+			client.MaxStreams = opts.Account.MaxStreams
+		}
 	}
 
 	cm.clients[clientID] = client
-	cm.subdomains[subDomain] = clientID
+	replicas.clients = append(replicas.clients, clientID)
+	cm.subdomains[subDomain] = replicas
+	cm.resolveReconnecting(subDomain)
 
 	cm.logger.Info().
 		Str("client_id", clientID.String()).
+		Str("owner_id", ownerID.String()).
 		Str("subdomain", subDomain).
+		Int("replicas", len(replicas.clients)).
 		Msg("Client connected")
 
 	return client, nil
@@ -104,8 +289,17 @@ func (cm *ConnectionManager) RemoveClient(clientID protocol.ClientID) {
 		return
 	}
 
-	// Clean up subdomain mapping
-	delete(cm.subdomains, client.SubDomain)
+	// Clean up subdomain mapping once the last replica has gone
+	if replicas, ok := cm.subdomains[client.SubDomain]; ok {
+		replicas.clients = slices.DeleteFunc(replicas.clients, func(id protocol.ClientID) bool {
+			return id == clientID
+		})
+		if len(replicas.clients) == 0 {
+			delete(cm.subdomains, client.SubDomain)
+			cm.markReconnecting(client.SubDomain)
+			go cm.cache.Purge(client.SubDomain)
+		}
+	}
 
 	// Close all streams
 	client.StreamMutex.Lock()
@@ -135,26 +329,73 @@ func (cm *ConnectionManager) GetClient(clientID protocol.ClientID) (*ClientConne
 	return client, exists
 }
 
-// GetClientBySubDomain retrieves a client by subdomain
+// GetClientBySubDomain retrieves the next client serving a subdomain, round-robin across its replicas
+// Replicas whose circuit breaker is open are skipped while another one can take the request
 func (cm *ConnectionManager) GetClientBySubDomain(subDomain string) (*ClientConnection, bool) {
-	cm.mutex.RLock()
-	defer cm.mutex.RUnlock()
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
 
-	clientID, exists := cm.subdomains[subDomain]
+	replicas, exists := cm.subdomains[subDomain]
 	if !exists {
 		return nil, false
 	}
 
-	client, exists := cm.clients[clientID]
-	return client, exists
+	client, index := cm.pickReplica(replicas, replicas.next)
+	if client == nil {
+		return nil, false
+	}
+	replicas.next = (index + 1) % len(replicas.clients)
+	return client, true
+}
+
+// pickReplica returns the first replica from index start whose circuit breaker allows requests
+// (or the first connected one if none does) and its index; the caller holds the mutex
+func (cm *ConnectionManager) pickReplica(replicas *tunnelReplicas, start int) (*ClientConnection, int) {
+	var fallback *ClientConnection
+	fallbackIndex := -1
+	for i := range replicas.clients {
+		index := (start + i) % len(replicas.clients)
+		client, exists := cm.clients[replicas.clients[index]]
+		if !exists {
+			continue
+		}
+		if allowed, _ := client.Breaker.Allow(); allowed {
+			return client, index
+		}
+		if fallback == nil {
+			fallback, fallbackIndex = client, index
+		}
+	}
+	return fallback, fallbackIndex
 }
 
-// IsSubDomainAvailable checks if a subdomain is available
-func (cm *ConnectionManager) IsSubDomainAvailable(subDomain string) bool {
+// HasSubDomain reports whether a subdomain has at least one connected client
+func (cm *ConnectionManager) HasSubDomain(subDomain string) bool {
 	cm.mutex.RLock()
 	defer cm.mutex.RUnlock()
 	_, exists := cm.subdomains[subDomain]
-	return !exists
+	return exists
+}
+
+// IsSubDomainAvailable checks if a subdomain is available to the given client ID
+// A subdomain held by the same ID (the same secret key) is available, so replicas can join it
+func (cm *ConnectionManager) IsSubDomainAvailable(subDomain string, clientID protocol.ClientID) bool {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	replicas, exists := cm.subdomains[subDomain]
+	return !exists || replicas.owner == clientID
+}
+
+// IsOwnedByKey reports whether a connected subdomain is held by the given secret key
+func (cm *ConnectionManager) IsOwnedByKey(subDomain, key string) bool {
+	if key == "" {
+		return false
+	}
+	secretKey := protocol.SecretKey{Key: key}
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	replicas, exists := cm.subdomains[subDomain]
+	return exists && (replicas.owner == secretKey.ClientIDFromKey() || replicas.owner == secretKey.TunnelClientIDFromKey(subDomain))
 }
 
 // GetActiveConnections returns the number of active connections
@@ -176,11 +417,93 @@ func (cm *ConnectionManager) ListSubDomains() []string {
 	return subdomains
 }
 
-// AddStream adds a new stream to a client
-func (cc *ClientConnection) AddStream(streamID protocol.StreamID, protocol, remoteAddr string) *Stream {
+// ClientSummary is a read-only snapshot of a connected client
+type ClientSummary struct {
+	ID            string     `json:"id"`
+	SubDomain     string     `json:"subdomain"`
+	ClientVersion string     `json:"client_version"`
+	ConnectedAt   time.Time  `json:"connected_at"`
+	ActiveStreams int        `json:"active_streams"`
+	LastPong      *time.Time `json:"last_pong,omitempty"`
+	RTTMillis     float64    `json:"rtt_ms"`
+	SendBuffered  int        `json:"send_buffered"`           // Messages queued for the client
+	SendBufferUse float64    `json:"send_buffer_utilization"` // Fraction of the send buffer in use
+	Degraded      bool       `json:"degraded"`                // Pongs overdue or send buffer nearly full
+}
+
+// A client is degraded when it misses this many pings or its send buffer is this full
+const (
+	degradedMissedPings = 3
+	degradedBufferUse   = 0.8
+)
+
+// ListClients returns a snapshot of all connected clients
+func (cm *ConnectionManager) ListClients() []ClientSummary {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	clients := make([]ClientSummary, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		clients = append(clients, client.Summary())
+	}
+	return clients
+}
+
+// Summary returns a snapshot of the client including its keepalive health
+func (cc *ClientConnection) Summary() ClientSummary {
+	summary := ClientSummary{
+		ID:            cc.ID.String(),
+		SubDomain:     cc.SubDomain,
+		ClientVersion: cc.ClientVersion,
+		ConnectedAt:   cc.ConnectedAt,
+		ActiveStreams: cc.GetActiveStreams(),
+		SendBuffered:  len(cc.Send),
+	}
+	if cap(cc.Send) > 0 {
+		summary.SendBufferUse = float64(len(cc.Send)) / float64(cap(cc.Send))
+	}
+
+	cc.healthMutex.RLock()
+	lastPong, rtt := cc.lastPong, cc.rtt
+	cc.healthMutex.RUnlock()
+
+	// Measure pong age from connect time until the first pong arrives
+	since := cc.ConnectedAt
+	if !lastPong.IsZero() {
+		summary.LastPong = &lastPong
+		since = lastPong
+	}
+	summary.RTTMillis = float64(rtt.Microseconds()) / 1000
+	summary.Degraded = time.Since(since) > degradedMissedPings*pingInterval || summary.SendBufferUse >= degradedBufferUse
+	return summary
+}
+
+// MarkPingSent records when a keepalive ping was sent so the pong can be timed
+func (cc *ClientConnection) MarkPingSent() {
+	cc.healthMutex.Lock()
+	defer cc.healthMutex.Unlock()
+	cc.pingSentAt = time.Now()
+}
+
+// MarkPong records a keepalive pong and the round trip time since the last ping
+func (cc *ClientConnection) MarkPong() {
+	cc.healthMutex.Lock()
+	defer cc.healthMutex.Unlock()
+	cc.lastPong = time.Now()
+	if !cc.pingSentAt.IsZero() {
+		cc.rtt = cc.lastPong.Sub(cc.pingSentAt)
+	}
+}
+
+// AddStream adds a new stream to a client, failing with ErrTooManyStreams at the client's stream limit
+func (cc *ClientConnection) AddStream(streamID protocol.StreamID, protocol, remoteAddr string) (*Stream, error) {
 	cc.StreamMutex.Lock()
 	defer cc.StreamMutex.Unlock()
 
+	if cc.MaxStreams > 0 && len(cc.Streams) >= cc.MaxStreams {
+		return nil, ErrTooManyStreams
+	}
+
 	stream := &Stream{
 		ID:         streamID,
 		Protocol:   protocol,
@@ -190,6 +513,7 @@ func (cc *ClientConnection) AddStream(streamID protocol.StreamID, protocol, remo
 	}
 
 	cc.Streams[streamID] = stream
+	atomic.StoreInt64(&cc.lastStream, time.Now().UnixNano())
 
 	cc.Logger.Debug().
 		Str("stream_id", streamID.String()).
@@ -197,7 +521,17 @@ func (cc *ClientConnection) AddStream(streamID protocol.StreamID, protocol, remo
 		Str("remote_addr", remoteAddr).
 		Msg("Stream added")
 
-	return stream
+	return stream, nil
+}
+
+// IdleFor returns how long the client has had no streams (0 while any are open)
+func (cc *ClientConnection) IdleFor() time.Duration {
+	cc.StreamMutex.RLock()
+	defer cc.StreamMutex.RUnlock()
+	if len(cc.Streams) > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&cc.lastStream)))
 }
 
 // GetStream retrieves a stream by ID
@@ -226,6 +560,23 @@ func (cc *ClientConnection) RemoveStream(streamID protocol.StreamID) {
 		Msg("Stream removed")
 }
 
+// AbortStream ends a stream whose data can't all be delivered, telling the client to stop sending it
+// Readers see an error rather than the end of the data
+func (cc *ClientConnection) AbortStream(streamID protocol.StreamID) {
+	if stream, exists := cc.GetStream(streamID); exists {
+		stream.aborted.Store(true)
+	}
+	cc.RemoveStream(streamID)
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeEnd, streamID, nil)
+	if err != nil {
+		return
+	}
+	if err := cc.SendMessage(msg); err != nil {
+		cc.Logger.Debug().Err(err).Str("stream_id", streamID.String()).Msg("Failed to send stream end")
+	}
+}
+
 // GetActiveStreams returns the number of active streams
 func (cc *ClientConnection) GetActiveStreams() int {
 	cc.StreamMutex.RLock()
@@ -250,6 +601,26 @@ func (cc *ClientConnection) SendMessage(msg *protocol.Message) error {
 	}
 }
 
+// SendMessageWait sends a message, waiting up to timeout for room in the send buffer
+func (cc *ClientConnection) SendMessageWait(msg *protocol.Message, timeout time.Duration) error {
+	data, err := protocol.EncodeMessage(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case cc.Send <- data:
+		return nil
+	case <-cc.Done:
+		return fmt.Errorf("client connection closed")
+	case <-timer.C:
+		return fmt.Errorf("send buffer full")
+	}
+}
+
 // GetActiveConnectionsCount returns the total number of active client connections
 func (cm *ConnectionManager) GetActiveConnectionsCount() int {
 	cm.mutex.RLock()
@@ -257,3 +628,71 @@ func (cm *ConnectionManager) GetActiveConnectionsCount() int {
 
 	return len(cm.clients)
 }
+
+// CountAccountTunnels returns the number of tunnels on this server belonging to an account
+func (cm *ConnectionManager) CountAccountTunnels(accountID string) int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	// Replicas sharing a subdomain count as one tunnel
+	subdomains := make(map[string]bool)
+	for _, client := range cm.clients {
+		if client.Account != nil && client.Account.ID == accountID {
+			subdomains[client.SubDomain] = true
+		}
+	}
+	return len(subdomains)
+}
+
+// GetActiveStreamsCount returns the total number of in-flight streams across all clients
+func (cm *ConnectionManager) GetActiveStreamsCount() int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	total := 0
+	for _, client := range cm.clients {
+		total += client.GetActiveStreams()
+	}
+	return total
+}
+
+// Clients returns a snapshot of the connected clients
+func (cm *ConnectionManager) Clients() []*ClientConnection {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	clients := make([]*ClientConnection, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Broadcast sends a message to every connected client, once per connection however many tunnels it carries
+func (cm *ConnectionManager) Broadcast(msg *protocol.Message) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	sent := make(map[*websocket.Conn]bool)
+	for _, client := range cm.clients {
+		if sent[client.Conn] {
+			continue
+		}
+		sent[client.Conn] = true
+		if err := client.SendMessage(msg); err != nil {
+			client.Logger.Warn().Err(err).Msg("Failed to send broadcast message")
+		}
+	}
+}
+
+// CloseAll closes every client connection with a going-away close frame
+func (cm *ConnectionManager) CloseAll(reason string) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	for _, client := range cm.clients {
+		client.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		client.Conn.Close()
+	}
+}
@@ -1,8 +1,15 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,6 +25,19 @@ type ControlServer struct {
 	connMgr      *ConnectionManager
 	logger       zerolog.Logger
 	distRegistry registry.Registry
+	webhooks     *WebhookNotifier
+
+	// Subdomains clients may not claim
+	reserved        map[string]bool
+	reservedPattern *regexp.Regexp
+	configMutex     sync.RWMutex // Guards config and the reserved subdomains, replaced on reload
+
+	// Subdomains handed to a peer server during drain, left in the registry for the peer to take over
+	migrated      map[string]bool
+	migratedMutex sync.Mutex
+
+	// Public ports of raw TCP tunnels (nil when tcp_port_range is unset)
+	tcpTunnels *TCPTunnels
 }
 
 // NewControlServer creates a new control server
@@ -27,12 +47,213 @@ func NewControlServer(
 	logger zerolog.Logger,
 	reg registry.Registry,
 ) *ControlServer {
+	var eventRegistry registry.Registry
+	if cfg.WebhookPublish || cfg.EventStream {
+		eventRegistry = reg
+	}
+
+	reserved, reservedPattern := reservedSubDomains(cfg)
+
+	var tcpTunnels *TCPTunnels
+	if cfg.TCPPortRange != "" {
+		minPort, maxPort := cfg.TCPPorts()
+		tcpTunnels = NewTCPTunnels(cfg.Host, minPort, maxPort, connMgr, logger)
+	}
+
 	return &ControlServer{
-		config:       cfg,
-		connMgr:      connMgr,
-		logger:       logger,
-		distRegistry: reg,
+		config:          cfg,
+		connMgr:         connMgr,
+		logger:          logger,
+		distRegistry:    reg,
+		webhooks:        NewWebhookNotifier(cfg.WebhookURLs, cfg.WebhookSecret, cfg.WebhookTimeout, cfg.ID, eventRegistry, logger),
+		reserved:        reserved,
+		reservedPattern: reservedPattern,
+		migrated:        make(map[string]bool),
+		tcpTunnels:      tcpTunnels,
+	}
+}
+
+// reservedSubDomains returns the subdomains and pattern clients may not claim
+func reservedSubDomains(cfg *config.ServerConfig) (map[string]bool, *regexp.Regexp) {
+	reserved := make(map[string]bool, len(cfg.ReservedSubDomains))
+	for _, name := range cfg.ReservedSubDomains {
+		reserved[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	var reservedPattern *regexp.Regexp
+	if cfg.ReservedSubDomainPattern != "" {
+		// Validated when the config is loaded
+		reservedPattern = regexp.MustCompile(cfg.ReservedSubDomainPattern)
+	}
+	return reserved, reservedPattern
+}
+
+// Config returns the current server configuration
+func (cs *ControlServer) Config() *config.ServerConfig {
+	cs.configMutex.RLock()
+	defer cs.configMutex.RUnlock()
+	return cs.config
+}
+
+// Reload replaces the server configuration used for new tunnels (connected tunnels are kept)
+func (cs *ControlServer) Reload(cfg *config.ServerConfig) {
+	reserved, reservedPattern := reservedSubDomains(cfg)
+
+	cs.configMutex.Lock()
+	defer cs.configMutex.Unlock()
+	cs.config = cfg
+	cs.reserved = reserved
+	cs.reservedPattern = reservedPattern
+}
+
+// Drain stops accepting new tunnels, migrates connected clients to a peer
+// server and waits up to timeout for in-flight streams to finish
+func (cs *ControlServer) Drain(timeout time.Duration) {
+	cs.connMgr.SetDraining()
+
+	reconnect := &protocol.ReconnectMessage{Reason: "server shutting down"}
+	var peers []*registry.ServerInfo
+	if cs.distRegistry != nil {
+		servers, err := cs.distRegistry.GetAllServers()
+		if err != nil {
+			cs.logger.Warn().Err(err).Msg("Failed to list peer servers")
+		}
+		for _, server := range servers {
+			if server.ServerID != cs.Config().ID {
+				peers = append(peers, server)
+			}
+		}
+		// Offer peers near this server first, since its clients chose it
+		registry.PreferRegion(peers, cs.Config().Region, cs.Config().Zone)
+		for _, peer := range peers {
+			reconnect.Servers = append(reconnect.Servers, peerServer(peer))
+		}
+	}
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeReconnect, "", reconnect)
+	if err != nil {
+		cs.logger.Error().Err(err).Msg("Failed to create reconnect message")
+	} else {
+		cs.connMgr.Broadcast(msg)
+	}
+	if len(peers) > 0 {
+		cs.migrateClients(peers)
 	}
+
+	cs.logger.Info().
+		Int("clients", cs.connMgr.GetActiveConnectionsCount()).
+		Int("peers", len(reconnect.Servers)).
+		Dur("timeout", timeout).
+		Msg("Draining connections")
+
+	deadline := time.Now().Add(timeout)
+	for cs.connMgr.GetActiveStreamsCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if remaining := cs.connMgr.GetActiveStreamsCount(); remaining > 0 {
+		cs.logger.Warn().Int("streams", remaining).Msg("Drain timeout reached, closing remaining streams")
+	}
+
+	cs.connMgr.CloseAll("server shutting down")
+}
+
+// migrateClients hands every tunnel to a peer server, preferring peers in the client's region, least loaded first
+// Each client gets a one-time token so the peer can take over the registry entry in place;
+// replicas of a subdomain and tunnels sharing a connection are all sent to the same peer
+func (cs *ControlServer) migrateClients(peers []*registry.ServerInfo) {
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LoadScore() < peers[j].LoadScore()
+	})
+
+	targets := make(map[string]*registry.ServerInfo)
+	connTargets := make(map[*websocket.Conn]*registry.ServerInfo)
+	assigned := make(map[string]int) // Tunnels sent to each region so far, to spread them round-robin
+	for _, client := range cs.connMgr.Clients() {
+		peer, exists := targets[client.SubDomain]
+		if !exists {
+			peer, exists = connTargets[client.Conn]
+		}
+		if !exists {
+			// Clients that didn't declare a region are assumed to be near this server
+			region := client.Region
+			if region == "" {
+				region = cs.Config().Region
+			}
+			candidates := peers
+			if nearby := peersInRegion(peers, region); len(nearby) > 0 {
+				candidates = nearby
+			}
+			peer = candidates[assigned[region]%len(candidates)]
+			assigned[region]++
+		}
+		targets[client.SubDomain] = peer
+		connTargets[client.Conn] = peer
+
+		token, err := cs.distRegistry.CreateMigration(client.SubDomain)
+		if err != nil {
+			client.Logger.Warn().Err(err).Msg("Failed to create tunnel migration")
+			continue
+		}
+		msg, err := protocol.NewMessage(protocol.MessageTypeMigrate, "", &protocol.MigrateMessage{
+			Reason:    "server shutting down",
+			Server:    peerServer(peer),
+			Token:     token,
+			SubDomain: client.SubDomain,
+		})
+		if err != nil {
+			client.Logger.Error().Err(err).Msg("Failed to create migrate message")
+			continue
+		}
+
+		cs.migratedMutex.Lock()
+		cs.migrated[client.SubDomain] = true
+		cs.migratedMutex.Unlock()
+
+		if err := client.SendMessage(msg); err != nil {
+			client.Logger.Warn().Err(err).Msg("Failed to send migrate message")
+			continue
+		}
+		client.Logger.Info().
+			Str("peer", peer.ServerID).
+			Msg("Migrating tunnel to peer server")
+	}
+}
+
+// peersInRegion returns the peers in region, keeping their order (none if region is empty)
+func peersInRegion(peers []*registry.ServerInfo, region string) []*registry.ServerInfo {
+	if region == "" {
+		return nil
+	}
+	var nearby []*registry.ServerInfo
+	for _, peer := range peers {
+		if peer.Region == region {
+			nearby = append(nearby, peer)
+		}
+	}
+	return nearby
+}
+
+// peerServer describes a peer for clients to reconnect to
+func peerServer(server *registry.ServerInfo) protocol.PeerServer {
+	return protocol.PeerServer{
+		Host:   server.Host,
+		Port:   server.ControlPort,
+		Region: server.Region,
+		Zone:   server.Zone,
+	}
+}
+
+// isMigrated reports whether a subdomain was handed to a peer server
+func (cs *ControlServer) isMigrated(subDomain string) bool {
+	cs.migratedMutex.Lock()
+	defer cs.migratedMutex.Unlock()
+	return cs.migrated[subDomain]
+}
+
+// Close flushes pending webhook events
+func (cs *ControlServer) Close() {
+	cs.webhooks.Close()
 }
 
 // HandleConnection handles a new WebSocket connection
@@ -52,34 +273,204 @@ func (cs *ControlServer) HandleConnection(c *websocket.Conn) {
 
 	logger = logger.With().Str("client_id", clientHello.ID.String()).Logger()
 
+	// Refuse new tunnels while draining
+	if cs.connMgr.IsDraining() {
+		logger.Info().Msg("Rejecting client, server is shutting down")
+		cs.sendErrorHello(c, protocol.ServerHelloError, "Server is shutting down")
+		return
+	}
+
+	// Refuse new tunnels during maintenance
+	if maintenance := cs.connMgr.Maintenance(); maintenance.Enabled {
+		logger.Info().Msg("Rejecting client, server is in maintenance")
+		cs.sendErrorHello(c, protocol.ServerHelloMaintenance, maintenance.Notice())
+		return
+	}
+
+	if len(clientHello.Tunnels) >= protocol.MaxTunnelsPerConnection {
+		logger.Info().Int("tunnels", len(clientHello.Tunnels)+1).Msg("Rejecting client, too many tunnels")
+		cs.sendErrorHello(c, protocol.ServerHelloError,
+			fmt.Sprintf("Too many tunnels on one connection (max %d)", protocol.MaxTunnelsPerConnection))
+		return
+	}
+
+	// Load the tenant account for authenticated clients
+	account, err := cs.lookupAccount(&clientHello)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to load account")
+		cs.sendErrorHello(c, protocol.ServerHelloError, "Failed to load account")
+		return
+	}
+
+	// Open every tunnel the client asked for; they share the connection and close with it
+	hellos := append([]protocol.ClientHello{clientHello}, clientHello.Tunnels...)
+	tunnels := make([]*ClientConnection, 0, len(hellos))
+	var serverHello *protocol.ServerHello
+	for i := range hellos {
+		hello := &hellos[i]
+		hello.Tunnels = nil
+		if i > 0 {
+			// Further tunnels are opened with the connection's credentials
+			hello.ClientType = clientHello.ClientType
+			hello.SecretKey = clientHello.SecretKey
+			hello.ClientVersion = clientHello.ClientVersion
+		}
+
+		tunnel, tunnelHello, closeTunnel, err := cs.openTunnel(c, hello, account, logger)
+		if err != nil {
+			if i > 0 && tunnelHello.Error != "" {
+				tunnelHello.Error = fmt.Sprintf("tunnel %d: %s", i+1, tunnelHello.Error)
+			}
+			cs.sendServerHello(c, tunnelHello)
+			return
+		}
+		defer closeTunnel()
+
+		tunnels = append(tunnels, tunnel)
+		if serverHello == nil {
+			serverHello = tunnelHello
+		} else {
+			serverHello.Tunnels = append(serverHello.Tunnels, *tunnelHello)
+		}
+	}
+
+	// Send success response
+	if err := cs.sendServerHello(c, serverHello); err != nil {
+		logger.Error().Err(err).Msg("Failed to send server hello")
+		return
+	}
+
+	logger.Info().
+		Str("subdomain", serverHello.SubDomain).
+		Str("hostname", serverHello.Hostname).
+		Int("tunnels", len(tunnels)).
+		Msg("Client authenticated and tunnel established")
+
+	// Start goroutines for reading and writing; further tunnels write through the first one's pump
+	for _, tunnel := range tunnels[1:] {
+		go cs.relayPump(tunnel, tunnels[0])
+	}
+	go cs.writePump(tunnels)
+	cs.readPump(tunnels)
+}
+
+// openTunnel authenticates one tunnel of a connection and adds it to the connection manager and registry
+// On success the returned func closes the tunnel again; on failure the server hello holds the error for the client
+func (cs *ControlServer) openTunnel(c *websocket.Conn, clientHello *protocol.ClientHello, account *registry.Account, logger zerolog.Logger) (*ClientConnection, *protocol.ServerHello, func(), error) {
 	// Handle authentication
-	serverHello, clientID, subDomain, err := cs.authenticate(&clientHello)
+	serverHello, clientID, subDomain, err := cs.authenticate(clientHello, account)
 	if err != nil {
 		logger.Error().Err(err).Msg("Authentication failed")
-		cs.sendServerHello(c, serverHello)
-		return
+		return nil, serverHello, nil, err
 	}
 
 	// Add client to connection manager (fully in-memory, stateless)
-	password := ""
+	opts := TunnelOptions{
+		ClientVersion: clientHello.ClientVersion,
+		Anonymous:     clientHello.ClientType == protocol.ClientTypeAnonymous,
+		Account:       account,
+	}
 	if clientHello.Password != nil {
-		password = *clientHello.Password
+		opts.Password = *clientHello.Password
+	}
+	if clientHello.BasicAuth != nil {
+		opts.BasicAuth = *clientHello.BasicAuth
+	}
+	if clientHello.InspectPassword != nil {
+		opts.InspectPassword = *clientHello.InspectPassword
+	}
+	if clientHello.OAuth != nil {
+		if err := config.ValidateOAuth(clientHello.OAuth.Provider, clientHello.OAuth.Allow); err != nil {
+			logger.Error().Err(err).Msg("Invalid OAuth policy")
+			return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+		}
+		if !slices.Contains(cs.Config().OAuthProviders(), clientHello.OAuth.Provider) {
+			err := fmt.Errorf("oauth provider %s is not enabled on this server", clientHello.OAuth.Provider)
+			logger.Error().Err(err).Msg("Invalid OAuth policy")
+			return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+		}
+		opts.OAuth = clientHello.OAuth
 	}
-	clientConn, err := cs.connMgr.AddClient(clientID, subDomain, clientHello.ClientVersion, password, c)
+	if clientHello.MaxBodySize > 0 {
+		opts.MaxBodySize = clientHello.MaxBodySize
+	}
+	if err := config.ValidateResponseHeaders(clientHello.ResponseHeaders); err != nil {
+		logger.Error().Err(err).Msg("Invalid response headers")
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+	}
+	opts.ResponseHeaders = clientHello.ResponseHeaders
+	if err := config.ValidateCacheRules(clientHello.CacheRules); err != nil {
+		logger.Error().Err(err).Msg("Invalid cache rules")
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+	}
+	opts.CacheRules = clientHello.CacheRules
+	if err := config.ValidateAffinity(clientHello.Affinity); err != nil {
+		logger.Error().Err(err).Msg("Invalid affinity")
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+	}
+	opts.Affinity = clientHello.Affinity
+	if err := config.ValidateLabels(clientHello.Labels); err != nil {
+		logger.Error().Err(err).Msg("Invalid labels")
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+	}
+	opts.Labels = clientHello.Labels
+	if err := config.ValidateRegion(clientHello.Region); err != nil {
+		logger.Error().Err(err).Msg("Invalid region")
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+	}
+	opts.Region = clientHello.Region
+	if err := config.ValidateResponseTimeouts(clientHello.ResponseTimeouts, cs.Config().MaxResponseTimeout); err != nil {
+		logger.Error().Err(err).Msg("Invalid response timeouts")
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+	}
+	opts.ResponseTimeouts = clientHello.ResponseTimeouts
+	ipFilter, err := NewIPFilter(clientHello.IPAllow, clientHello.IPDeny)
+	if err != nil {
+		logger.Error().Err(err).Msg("Invalid IP filter")
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+	}
+	opts.IPFilter = ipFilter
+	switch clientHello.Protocol {
+	case "", "http":
+	case protocol.ProtocolTCP:
+		if cs.tcpTunnels == nil {
+			err := fmt.Errorf("TCP tunnels are not enabled on this server")
+			logger.Error().Err(err).Msg("Invalid tunnel protocol")
+			return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+		}
+		if opts.OAuth != nil {
+			err := fmt.Errorf("oauth applies to HTTP tunnels only")
+			logger.Error().Err(err).Msg("Invalid tunnel protocol")
+			return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+		}
+		opts.Protocol = protocol.ProtocolTCP
+	default:
+		err := fmt.Errorf("unsupported tunnel protocol: %s", clientHello.Protocol)
+		logger.Error().Err(err).Msg("Invalid tunnel protocol")
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
+	}
+	clientConn, err := cs.connMgr.AddClient(clientID, subDomain, opts, c)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to add client")
-		cs.sendErrorHello(c, protocol.ServerHelloError, err.Error())
-		return
+		return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
 	}
-	defer func() {
-		cs.connMgr.RemoveClient(clientID)
-		// Unregister from distributed registry if enabled
-		if cs.distRegistry != nil {
-			if err := cs.distRegistry.UnregisterTunnel(subDomain); err != nil {
-				logger.Error().Err(err).Msg("Failed to unregister tunnel from registry")
-			}
+	clientID = clientConn.ID // Replicas sharing a subdomain get their own ID
+
+	// TCP tunnels are reached on a port of their own at the tunnel's hostname
+	if opts.Protocol == protocol.ProtocolTCP {
+		port, err := cs.tcpTunnels.Open(subDomain)
+		if err != nil {
+			cs.connMgr.RemoveClient(clientID)
+			logger.Error().Err(err).Msg("Failed to open TCP tunnel")
+			return nil, protocol.NewErrorHello(protocol.ServerHelloError, err.Error()), nil, err
 		}
-	}()
+		serverHello.Hostname = net.JoinHostPort(serverHello.Hostname, strconv.Itoa(port))
+		serverHello.PublicURL = "tcp://" + serverHello.Hostname
+	}
+	cs.webhooks.Notify(EventClientConnected, subDomain, clientID.String())
+	reconnectToken := cs.issueReconnectToken(subDomain)
+	serverHello.ReconnectToken = reconnectToken
+	cs.holdSubDomain(clientHello, subDomain, reconnectToken)
 
 	logger.Info().
 		Str("client_id", clientID.String()).
@@ -89,43 +480,82 @@ func (cs *ControlServer) HandleConnection(c *websocket.Conn) {
 
 	// Register tunnel in distributed registry if enabled
 	if cs.distRegistry != nil {
+		cfg := cs.Config()
 		tunnelInfo := &registry.TunnelInfo{
-			Subdomain:   subDomain,
-			ServerHost:  cs.config.Host,
-			ClientID:    clientID.String(),
-			ProxyPort:   cs.config.Port,
-			ControlPort: cs.config.ControlPort,
-			CreatedAt:   time.Now(),
-		}
-		if err := cs.distRegistry.RegisterTunnel(tunnelInfo); err != nil {
+			Subdomain:         subDomain,
+			ServerHost:        cfg.Host,
+			ClientID:          clientID.String(),
+			ProxyPort:         cfg.Port,
+			ControlPort:       cfg.AdvertisedControlPort(),
+			ClusterPort:       cfg.AdvertisedClusterPort(),
+			NodeHost:          cfg.NodeHost(subDomain),
+			DataPort:          cfg.AdvertisedDataPlanePort(),
+			CreatedAt:         time.Now(),
+			ClientVersion:     opts.ClientVersion,
+			Authenticated:     !opts.Anonymous,
+			PasswordProtected: opts.Password != "" || opts.BasicAuth != "" || opts.OAuth != nil,
+			Labels:            opts.Labels,
+			BytesServed:       cs.bytesServed(subDomain),
+			IPAllow:           clientHello.IPAllow,
+			IPDeny:            clientHello.IPDeny,
+		}
+		if account != nil {
+			tunnelInfo.AccountID = account.ID
+		}
+		migrated := false
+		if clientHello.MigrationToken != "" {
+			if err := cs.distRegistry.CompleteMigration(clientHello.MigrationToken, tunnelInfo); err != nil {
+				logger.Warn().Err(err).Msg("Failed to take over migrated tunnel, registering instead")
+			} else {
+				migrated = true
+				logger.Info().Str("subdomain", subDomain).Msg("Tunnel migrated from peer server")
+				cs.webhooks.NotifyTunnel(EventTunnelMigrated, tunnelInfo)
+			}
+		}
+		if migrated {
+			// The migration already replaced the peer's registry entry
+		} else if err := cs.distRegistry.RegisterTunnel(tunnelInfo); err != nil {
 			logger.Error().Err(err).Msg("Failed to register tunnel in distributed registry")
 			// Don't fail the connection, continue anyway
 		} else {
 			logger.Info().Str("subdomain", subDomain).Msg("Tunnel registered in distributed registry")
+			cs.webhooks.NotifyTunnel(EventTunnelRegistered, tunnelInfo)
 		}
+		go cs.refreshTunnel(clientConn, *tunnelInfo)
 	}
 
-	// Send success response
-	if err := cs.sendServerHello(c, serverHello); err != nil {
-		logger.Error().Err(err).Msg("Failed to send server hello")
-		return
+	closeTunnel := func() {
+		cs.connMgr.RemoveClient(clientID)
+		if opts.Protocol == protocol.ProtocolTCP {
+			cs.tcpTunnels.Close(subDomain)
+		}
+		cs.webhooks.Notify(EventClientDisconnected, subDomain, clientID.String())
+		// Renew the hold so it expires a full TTL after the client was last seen
+		cs.holdSubDomain(clientHello, subDomain, reconnectToken)
+		// Unregister from distributed registry if enabled and no replica is left,
+		// unless a peer server is taking the tunnel over
+		if cs.distRegistry != nil && !cs.connMgr.HasSubDomain(subDomain) && !cs.isMigrated(subDomain) {
+			if err := cs.distRegistry.UnregisterTunnel(subDomain); err != nil {
+				logger.Error().Err(err).Msg("Failed to unregister tunnel from registry")
+			} else {
+				cs.webhooks.Notify(EventTunnelUnregistered, subDomain, clientID.String())
+			}
+		}
 	}
 
-	logger.Info().
-		Str("subdomain", subDomain).
-		Str("hostname", serverHello.Hostname).
-		Msg("Client authenticated and tunnel established")
-
-	// Start goroutines for reading and writing
-	go cs.writePump(clientConn)
-	cs.readPump(clientConn)
+	return clientConn, serverHello, closeTunnel, nil
 }
 
 // authenticate authenticates a client hello message (stateless)
-func (cs *ControlServer) authenticate(hello *protocol.ClientHello) (*protocol.ServerHello, protocol.ClientID, string, error) {
+func (cs *ControlServer) authenticate(hello *protocol.ClientHello, account *registry.Account) (*protocol.ServerHello, protocol.ClientID, string, error) {
 	var clientID protocol.ClientID
 	var subDomain string
 
+	// Basic auth credentials must be in "user:pass" form
+	if hello.BasicAuth != nil && !strings.Contains(*hello.BasicAuth, ":") {
+		return protocol.NewErrorHello(protocol.ServerHelloError, "Basic auth must be in user:pass format"), "", "", fmt.Errorf("invalid basic auth format")
+	}
+
 	// Handle authentication (stateless)
 	if hello.ClientType == protocol.ClientTypeAuth {
 		if hello.SecretKey == nil {
@@ -140,6 +570,9 @@ func (cs *ControlServer) authenticate(hello *protocol.ClientHello) (*protocol.Se
 			if err := protocol.ValidateSubDomain(*hello.SubDomain); err != nil {
 				return protocol.NewErrorHello(protocol.ServerHelloInvalidSubDomain, err.Error()), "", "", err
 			}
+			if err := cs.checkSubDomainPolicy(*hello.SubDomain); err != nil {
+				return protocol.NewErrorHello(protocol.ServerHelloInvalidSubDomain, err.Error()), "", "", err
+			}
 			subDomain = *hello.SubDomain
 		} else {
 			randomSub, err := protocol.GenerateRandomSubDomain()
@@ -149,13 +582,36 @@ func (cs *ControlServer) authenticate(hello *protocol.ClientHello) (*protocol.Se
 			subDomain = randomSub
 		}
 
-		// Check if subdomain is available (in-memory only)
-		if !cs.connMgr.IsSubDomainAvailable(subDomain) {
+		// Enforce account limits
+		if account != nil {
+			if len(account.SubDomainPrefixes) > 0 {
+				if hello.SubDomain == nil {
+					subDomain = account.SubDomainPrefixes[0] + subDomain
+				} else if !hasAnyPrefix(subDomain, account.SubDomainPrefixes) {
+					return protocol.NewErrorHello(protocol.ServerHelloInvalidSubDomain,
+							fmt.Sprintf("Subdomain must start with one of: %s", strings.Join(account.SubDomainPrefixes, ", "))),
+						"", "", fmt.Errorf("subdomain prefix not allowed for account %s", account.ID)
+				}
+			}
+
+			// Replicas joining an existing tunnel don't count against the limit
+			if account.MaxTunnels > 0 && !cs.connMgr.HasSubDomain(subDomain) && cs.countAccountTunnels(account.ID) >= account.MaxTunnels {
+				return protocol.NewErrorHello(protocol.ServerHelloError,
+						fmt.Sprintf("Account tunnel limit reached (%d)", account.MaxTunnels)),
+					"", "", fmt.Errorf("tunnel limit reached for account %s", account.ID)
+			}
+
+			// Accounts may hold several tunnels under one key
+			clientID = hello.SecretKey.TunnelClientIDFromKey(subDomain)
+		}
+
+		// Check if subdomain is available (in-memory only); clients with the same key share it
+		if !cs.connMgr.IsSubDomainAvailable(subDomain, clientID) {
 			return protocol.NewErrorHello(protocol.ServerHelloSubDomainInUse, "Subdomain is already in use"), "", "", fmt.Errorf("subdomain in use")
 		}
 	} else {
 		// Anonymous client
-		if !cs.config.AllowAnonymous {
+		if !cs.Config().AllowAnonymous {
 			return protocol.NewErrorHello(protocol.ServerHelloAuthFailed, "Anonymous clients not allowed"), "", "", fmt.Errorf("anonymous not allowed")
 		}
 
@@ -166,6 +622,9 @@ func (cs *ControlServer) authenticate(hello *protocol.ClientHello) (*protocol.Se
 			if err := protocol.ValidateSubDomain(*hello.SubDomain); err != nil {
 				return protocol.NewErrorHello(protocol.ServerHelloInvalidSubDomain, err.Error()), "", "", err
 			}
+			if err := cs.checkSubDomainPolicy(*hello.SubDomain); err != nil {
+				return protocol.NewErrorHello(protocol.ServerHelloInvalidSubDomain, err.Error()), "", "", err
+			}
 			subDomain = *hello.SubDomain
 		} else {
 			randomSub, err := protocol.GenerateRandomSubDomain()
@@ -175,15 +634,21 @@ func (cs *ControlServer) authenticate(hello *protocol.ClientHello) (*protocol.Se
 			subDomain = randomSub
 		}
 
-		// Check if subdomain is available (in-memory only)
-		if !cs.connMgr.IsSubDomainAvailable(subDomain) {
+		// Anonymous IDs are chosen by the client, so they never join a taken subdomain as replicas
+		if cs.connMgr.HasSubDomain(subDomain) {
 			return protocol.NewErrorHello(protocol.ServerHelloSubDomainInUse, "Subdomain is already in use"), "", "", fmt.Errorf("subdomain in use")
 		}
 	}
 
-	// Create success response (stateless, no reconnect token needed)
+	// Honor reservations held by other keys, even while their client is offline
+	if errorHello, err := cs.checkReservation(hello, subDomain); err != nil {
+		return errorHello, "", "", err
+	}
+
+	// Create success response; openTunnel adds the reconnect token once the tunnel is up
 	// Build domain from template
-	domain := cs.config.Domain
+	cfg := cs.Config()
+	domain := cfg.Domain
 	if domain == "" {
 		domain = fmt.Sprintf("%s.localhost", subDomain)
 	} else {
@@ -192,7 +657,7 @@ func (cs *ControlServer) authenticate(hello *protocol.ClientHello) (*protocol.Se
 	hostname := domain
 
 	// Build public URL from template
-	publicURL := cs.config.PublicURL
+	publicURL := cfg.PublicURL
 	if publicURL == "" {
 		// Fallback if not configured
 		publicURL = fmt.Sprintf("http://%s", hostname)
@@ -200,7 +665,7 @@ func (cs *ControlServer) authenticate(hello *protocol.ClientHello) (*protocol.Se
 		// Replace template variables
 		publicURL = strings.ReplaceAll(publicURL, "{{ .domain }}", domain)
 		publicURL = strings.ReplaceAll(publicURL, "{{ .subdomain }}", subDomain)
-		publicURL = strings.ReplaceAll(publicURL, "{{ .port }}", fmt.Sprintf("%d", cs.config.Port))
+		publicURL = strings.ReplaceAll(publicURL, "{{ .port }}", fmt.Sprintf("%d", cfg.Port))
 	}
 
 	serverHello := protocol.NewSuccessHello(subDomain, hostname, publicURL, clientID, nil)
@@ -208,12 +673,136 @@ func (cs *ControlServer) authenticate(hello *protocol.ClientHello) (*protocol.Se
 	return serverHello, clientID, subDomain, nil
 }
 
-// readPump reads messages from the WebSocket connection
-func (cs *ControlServer) readPump(client *ClientConnection) {
+// lookupAccount returns the tenant account for an authenticated client's secret key (nil if none)
+func (cs *ControlServer) lookupAccount(hello *protocol.ClientHello) (*registry.Account, error) {
+	if hello.ClientType != protocol.ClientTypeAuth || hello.SecretKey == nil || cs.distRegistry == nil {
+		return nil, nil
+	}
+	return cs.distRegistry.GetAccount(hello.SecretKey.Key)
+}
+
+// checkReservation rejects a subdomain reserved for another secret key or held for another client's reconnect token
+// Registry errors reject the client rather than risk handing out someone else's subdomain
+func (cs *ControlServer) checkReservation(hello *protocol.ClientHello, subDomain string) (*protocol.ServerHello, error) {
+	if cs.distRegistry == nil {
+		return nil, nil
+	}
+
+	reservation, err := cs.distRegistry.GetReservation(subDomain)
+	if err != nil {
+		return protocol.NewErrorHello(protocol.ServerHelloError, "Failed to check subdomain reservation"), fmt.Errorf("failed to check subdomain reservation: %w", err)
+	}
+	if reservation == nil {
+		return nil, nil
+	}
+	if hello.ClientType == protocol.ClientTypeAuth && hello.SecretKey != nil && reservation.OwnedBy(hello.SecretKey.Key) {
+		return nil, nil
+	}
+	if hello.ReconnectToken != nil && reservation.HeldBy(hello.ReconnectToken.Token) {
+		return nil, nil
+	}
+	return protocol.NewErrorHello(protocol.ServerHelloSubDomainInUse, "Subdomain is reserved"), fmt.Errorf("subdomain %q is reserved", subDomain)
+}
+
+// issueReconnectToken creates the token a tunnel's client presents to get its subdomain back after a disconnect
+// Returns nil when reconnect tokens are disabled
+func (cs *ControlServer) issueReconnectToken(subDomain string) *protocol.ReconnectToken {
+	if cs.Config().ReconnectTokenTTL <= 0 || cs.distRegistry == nil {
+		return nil
+	}
+	token, err := protocol.GenerateReconnectToken()
+	if err != nil {
+		cs.logger.Warn().Err(err).Str("subdomain", subDomain).Msg("Failed to issue reconnect token")
+		return nil
+	}
+	return token
+}
+
+// holdSubDomain reserves the subdomain for its client across disconnects: for an authenticated client's
+// secret key when reservations are enabled, and for the holder of the tunnel's reconnect token
+func (cs *ControlServer) holdSubDomain(hello *protocol.ClientHello, subDomain string, token *protocol.ReconnectToken) {
+	if cs.distRegistry == nil {
+		return
+	}
+	cfg := cs.Config()
+
+	secretKey := ""
+	if hello.ClientType == protocol.ClientTypeAuth && hello.SecretKey != nil {
+		secretKey = hello.SecretKey.Key
+	}
+	var ttl time.Duration
+	if token != nil {
+		ttl = cfg.ReconnectTokenTTL
+	}
+	if secretKey != "" && cfg.SubDomainReservationTTL > 0 {
+		ttl = max(ttl, cfg.SubDomainReservationTTL)
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	reservation := registry.NewReservation(subDomain, secretKey, ttl)
+	if token != nil {
+		reservation.WithReconnectToken(token.Token)
+	}
+	if err := cs.distRegistry.ReserveSubdomain(reservation); err != nil {
+		cs.logger.Warn().Err(err).Str("subdomain", subDomain).Msg("Failed to reserve subdomain")
+	}
+}
+
+// countAccountTunnels counts an account's tunnels on this server plus those registered by other servers
+func (cs *ControlServer) countAccountTunnels(accountID string) int {
+	count := cs.connMgr.CountAccountTunnels(accountID)
+	if cs.distRegistry == nil {
+		return count
+	}
+
+	tunnels, err := cs.distRegistry.GetAllTunnels()
+	if err != nil {
+		cs.logger.Warn().Err(err).Msg("Failed to list tunnels for account limit")
+		return count
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.AccountID == accountID && tunnel.ServerID != cs.Config().ID {
+			count++
+		}
+	}
+	return count
+}
+
+// hasAnyPrefix reports whether s starts with any of the prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSubDomainPolicy rejects reserved subdomains and those matching the reserved pattern
+func (cs *ControlServer) checkSubDomainPolicy(subDomain string) error {
+	cs.configMutex.RLock()
+	defer cs.configMutex.RUnlock()
+
+	if cs.reserved[subDomain] {
+		return fmt.Errorf("subdomain %q is reserved", subDomain)
+	}
+	if cs.reservedPattern != nil && cs.reservedPattern.MatchString(subDomain) {
+		return fmt.Errorf("subdomain %q is not allowed", subDomain)
+	}
+	return nil
+}
+
+// readPump reads messages from the WebSocket connection shared by a client's tunnels
+func (cs *ControlServer) readPump(tunnels []*ClientConnection) {
 	defer func() {
-		cs.connMgr.RemoveClient(client.ID)
+		for _, tunnel := range tunnels {
+			cs.connMgr.RemoveClient(tunnel.ID)
+		}
 	}()
 
+	client := tunnels[0]
 	for {
 		var msg protocol.Message
 		if err := client.Conn.ReadJSON(&msg); err != nil {
@@ -223,15 +812,59 @@ func (cs *ControlServer) readPump(client *ClientConnection) {
 			break
 		}
 
-		cs.handleMessage(client, &msg)
+		cs.handleMessage(tunnels, &msg)
+	}
+}
+
+// tunnelRefreshInterval is how often a tunnel's registry entry is rewritten with fresh metadata,
+// often enough that a couple of failed refreshes don't let it expire
+func tunnelRefreshInterval(tunnelTTL time.Duration) time.Duration {
+	return tunnelTTL / 3
+}
+
+// refreshTunnel keeps a tunnel's registry entry alive and its metadata current until the client disconnects
+func (cs *ControlServer) refreshTunnel(client *ClientConnection, info registry.TunnelInfo) {
+	ticker := time.NewTicker(tunnelRefreshInterval(cs.Config().RegistryTunnelTTL))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.Done:
+			return
+		case <-ticker.C:
+			refreshed := info
+			refreshed.BytesServed = cs.bytesServed(client.SubDomain)
+			err := cs.distRegistry.RefreshTunnel(&refreshed)
+			if errors.Is(err, registry.ErrTunnelMoved) {
+				client.Logger.Info().Msg("Tunnel is registered on another server, no longer refreshing it")
+				return
+			}
+			if err != nil {
+				client.Logger.Warn().Err(err).Msg("Failed to refresh tunnel in registry")
+				continue
+			}
+			cs.webhooks.NotifyTunnel(EventTunnelRefreshed, &refreshed)
+		}
 	}
 }
 
-// writePump writes messages to the WebSocket connection
-func (cs *ControlServer) writePump(client *ClientConnection) {
-	ticker := time.NewTicker(30 * time.Second)
+// bytesServed returns the request and response bytes proxied for a subdomain
+func (cs *ControlServer) bytesServed(subDomain string) int64 {
+	usage := cs.connMgr.Bandwidth().Usage(subDomain)
+	return usage.BytesIn + usage.BytesOut
+}
+
+// pingInterval is how often keepalive pings are sent to each client
+const pingInterval = 30 * time.Second
+
+// writePump writes messages to the WebSocket connection shared by a client's tunnels
+// Keepalive and session limits apply to the connection: it is idle once every tunnel is
+func (cs *ControlServer) writePump(tunnels []*ClientConnection) {
+	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
 
+	client := tunnels[0]
+
 	for {
 		select {
 		case message, ok := <-client.Send:
@@ -246,9 +879,45 @@ func (cs *ControlServer) writePump(client *ClientConnection) {
 			}
 
 		case <-ticker.C:
+			// Expire tunnels that have been idle too long
+			if timeout := cs.idleTimeout(client); timeout > 0 && idleFor(tunnels) >= timeout {
+				client.Logger.Info().Dur("idle_timeout", timeout).Msg("Disconnecting idle tunnel")
+				closeMsg := websocket.FormatCloseMessage(protocol.CloseTunnelIdle, "tunnel idle")
+				client.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+				client.Conn.Close()
+				return
+			}
+
+			// Enforce the maximum session duration, warning the client ahead of time
+			if maxSession := cs.maxSessionDuration(client); maxSession > 0 {
+				expiresAt := client.ConnectedAt.Add(maxSession)
+				if !time.Now().Before(expiresAt) {
+					client.Logger.Info().Dur("max_session_duration", maxSession).Msg("Closing expired tunnel session")
+					closeMsg := websocket.FormatCloseMessage(protocol.CloseSessionExpired, "session expired")
+					client.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+					client.Conn.Close()
+					return
+				}
+				if !client.expiryNoted && time.Until(expiresAt) <= cs.Config().SessionExpiryNotice+pingInterval {
+					client.expiryNoted = true
+					expiringMsg, _ := protocol.NewMessage(protocol.MessageTypeExpiring, "", &protocol.ExpiringMessage{
+						Reason:    "maximum session duration reached",
+						ExpiresAt: expiresAt,
+					})
+					data, _ := protocol.EncodeMessage(expiringMsg)
+					if err := client.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
+						client.Logger.Error().Err(err).Msg("Failed to send session expiry notice")
+						return
+					}
+				}
+			}
+
 			// Send ping
 			pingMsg, _ := protocol.NewMessage(protocol.MessageTypePing, "", nil)
 			data, _ := protocol.EncodeMessage(pingMsg)
+			for _, tunnel := range tunnels {
+				tunnel.MarkPingSent()
+			}
 			if err := client.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
 				client.Logger.Error().Err(err).Msg("Failed to send ping")
 				return
@@ -260,14 +929,78 @@ func (cs *ControlServer) writePump(client *ClientConnection) {
 	}
 }
 
-// handleMessage handles a received message
-func (cs *ControlServer) handleMessage(client *ClientConnection, msg *protocol.Message) {
+// relayPump hands a tunnel's messages to the write pump of the tunnel whose connection it shares
+func (cs *ControlServer) relayPump(tunnel, primary *ClientConnection) {
+	for {
+		select {
+		case message := <-tunnel.Send:
+			select {
+			case primary.Send <- message:
+			case <-primary.Done:
+				return
+			}
+		case <-tunnel.Done:
+			return
+		}
+	}
+}
+
+// idleFor returns how long none of a connection's tunnels has had a stream
+func idleFor(tunnels []*ClientConnection) time.Duration {
+	idle := tunnels[0].IdleFor()
+	for _, tunnel := range tunnels[1:] {
+		if tunnelIdle := tunnel.IdleFor(); tunnelIdle < idle {
+			idle = tunnelIdle
+		}
+	}
+	return idle
+}
+
+// idleTimeout returns how long a client's tunnel may go without requests (0 = no limit)
+func (cs *ControlServer) idleTimeout(client *ClientConnection) time.Duration {
+	cfg := cs.Config()
+	if client.Anonymous && cfg.AnonymousIdleTimeout > 0 {
+		return cfg.AnonymousIdleTimeout
+	}
+	return cfg.TunnelIdleTimeout
+}
+
+// maxSessionDuration returns how long a client's tunnel session may last (0 = no limit)
+func (cs *ControlServer) maxSessionDuration(client *ClientConnection) time.Duration {
+	cfg := cs.Config()
+	if client.Anonymous && cfg.AnonymousMaxSessionDuration > 0 {
+		return cfg.AnonymousMaxSessionDuration
+	}
+	return cfg.MaxSessionDuration
+}
+
+// streamTunnel returns the tunnel of a connection that a stream belongs to (the first tunnel if none does)
+func streamTunnel(tunnels []*ClientConnection, streamID protocol.StreamID) (*ClientConnection, *Stream, bool) {
+	for _, tunnel := range tunnels {
+		if stream, exists := tunnel.GetStream(streamID); exists {
+			return tunnel, stream, true
+		}
+	}
+	return tunnels[0], nil, false
+}
+
+// streamStallTimeout is how long a stream's full data queue may hold up the client's reader before the stream
+// is aborted; a visitor reading slowly keeps draining it, while one that stopped reading would stall every stream.
+// It stays well below the 10 seconds the client allows each write, so waiting never breaks the client's connection
+const streamStallTimeout = 5 * time.Second
+
+// handleMessage handles a message received on the connection shared by a client's tunnels
+func (cs *ControlServer) handleMessage(tunnels []*ClientConnection, msg *protocol.Message) {
+	client, stream, exists := streamTunnel(tunnels, msg.StreamID)
+
 	switch msg.Type {
 	case protocol.MessageTypePong:
+		for _, tunnel := range tunnels {
+			tunnel.MarkPong()
+		}
 		client.Logger.Debug().Msg("Received pong")
 
 	case protocol.MessageTypeData:
-		stream, exists := client.GetStream(msg.StreamID)
 		if !exists {
 			client.Logger.Warn().Str("stream_id", msg.StreamID.String()).Msg("Stream not found for data message")
 			return
@@ -284,18 +1017,32 @@ func (cs *ControlServer) handleMessage(client *ClientConnection, msg *protocol.M
 		if len(dataMsg.Data) < previewLen {
 			previewLen = len(dataMsg.Data)
 		}
-		client.Logger.Info().
+		client.Logger.Debug().
 			Str("stream_id", msg.StreamID.String()).
 			Int("bytes", len(dataMsg.Data)).
 			Str("preview", string(dataMsg.Data[:previewLen])).
 			Msg("Received DATA from client")
 
+		// Never drop a chunk mid-stream: once the queue is full, stop reading so the client's connection
+		// pushes back until the visitor catches up, aborting the stream only if it stays stalled
 		select {
 		case stream.DataChan <- dataMsg.Data:
 		case <-stream.Done:
 			client.Logger.Debug().Str("stream_id", msg.StreamID.String()).Msg("Stream closed while sending data")
 		default:
-			client.Logger.Warn().Str("stream_id", msg.StreamID.String()).Msg("Stream data channel full")
+			timer := time.NewTimer(streamStallTimeout)
+			select {
+			case stream.DataChan <- dataMsg.Data:
+			case <-stream.Done:
+				client.Logger.Debug().Str("stream_id", msg.StreamID.String()).Msg("Stream closed while sending data")
+			case <-timer.C:
+				client.Logger.Warn().
+					Str("stream_id", msg.StreamID.String()).
+					Dur("timeout", streamStallTimeout).
+					Msg("Stream data queue stayed full, aborting stream")
+				client.AbortStream(msg.StreamID)
+			}
+			timer.Stop()
 		}
 
 	case protocol.MessageTypeEnd:
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// ErrorEvent records a failed proxied request
+type ErrorEvent struct {
+	Time      time.Time `json:"time"`
+	SubDomain string    `json:"subdomain"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	RequestID string    `json:"request_id"`
+}
+
+// ErrorLog keeps the most recent proxy errors in a fixed-size ring
+type ErrorLog struct {
+	events []ErrorEvent
+	next   int
+	full   bool
+	mutex  sync.Mutex
+}
+
+// NewErrorLog creates an error log holding up to size events
+func NewErrorLog(size int) *ErrorLog {
+	return &ErrorLog{
+		events: make([]ErrorEvent, size),
+	}
+}
+
+// Add records an error event, overwriting the oldest once full
+func (l *ErrorLog) Add(event ErrorEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.events[l.next] = event
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Recent returns recorded events, most recent first
+func (l *ErrorLog) Recent() []ErrorEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.events)
+	}
+
+	recent := make([]ErrorEvent, 0, count)
+	for i := 1; i <= count; i++ {
+		idx := (l.next - i + len(l.events)) % len(l.events)
+		recent = append(recent, l.events[idx])
+	}
+	return recent
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/rs/zerolog"
+	"github.com/sombochea/tungo/internal/registry"
+)
+
+const (
+	// eventStreamBuffer is the number of events queued per subscriber before new ones are dropped
+	eventStreamBuffer = 256
+	// eventStreamKeepalive is how often an idle stream gets a comment so proxies keep it open
+	eventStreamKeepalive = 15 * time.Second
+)
+
+// eventSubscriber is a stream client and the events it asked for
+type eventSubscriber struct {
+	events    map[string]bool // Event types to receive (all if empty)
+	subDomain string          // Subdomain to receive events for (all if empty)
+	ch        chan streamedEvent
+}
+
+// streamedEvent is an event queued for a stream client
+type streamedEvent struct {
+	name    string
+	payload []byte
+}
+
+// EventStream fans out tunnel events published by any server in the cluster to server-sent event clients
+type EventStream struct {
+	token       string
+	logger      zerolog.Logger
+	unsubscribe func()
+	subscribers map[*eventSubscriber]struct{}
+	mutex       sync.RWMutex
+	closed      bool
+}
+
+// NewEventStream subscribes to the registry's events; clients must present token
+func NewEventStream(reg registry.Registry, token string, logger zerolog.Logger) (*EventStream, error) {
+	s := &EventStream{
+		token:       token,
+		logger:      logger.With().Str("component", "events").Logger(),
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+
+	unsubscribe, err := reg.SubscribeEvents(s.deliver)
+	if err != nil {
+		return nil, err
+	}
+	s.unsubscribe = unsubscribe
+
+	return s, nil
+}
+
+// Close unsubscribes from the registry and ends every stream
+func (s *EventStream) Close() {
+	s.unsubscribe()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for sub := range s.subscribers {
+		close(sub.ch)
+		delete(s.subscribers, sub)
+	}
+}
+
+// deliver queues an event for the subscribers it matches (never blocks)
+func (s *EventStream) deliver(payload []byte) {
+	var event WebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		s.logger.Warn().Err(err).Msg("Ignoring malformed event")
+		return
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for sub := range s.subscribers {
+		if (len(sub.events) > 0 && !sub.events[event.Event]) || (sub.subDomain != "" && sub.subDomain != event.SubDomain) {
+			continue
+		}
+		select {
+		case sub.ch <- streamedEvent{name: event.Event, payload: payload}:
+		default:
+			s.logger.Warn().Str("event", event.Event).Msg("Event stream client too slow, dropping event")
+		}
+	}
+}
+
+// subscribe adds a stream client (nil once the stream is closed)
+func (s *EventStream) subscribe(events []string, subDomain string) *eventSubscriber {
+	sub := &eventSubscriber{
+		events:    make(map[string]bool, len(events)),
+		subDomain: subDomain,
+		ch:        make(chan streamedEvent, eventStreamBuffer),
+	}
+	for _, event := range events {
+		if event = strings.TrimSpace(event); event != "" {
+			sub.events[event] = true
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// remove drops a stream client
+func (s *EventStream) remove(sub *eventSubscriber) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.subscribers[sub]; exists {
+		close(sub.ch)
+		delete(s.subscribers, sub)
+	}
+}
+
+// Handler serves events as text/event-stream, filtered by the optional event and subdomain query parameters
+func (s *EventStream) Handler() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		provided, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok {
+			provided = c.Query("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(s.token)) != 1 {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="events"`)
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		var events []string
+		if filter := c.Query("event"); filter != "" {
+			events = strings.Split(filter, ",")
+		}
+		sub := s.subscribe(events, strings.ToLower(c.Query("subdomain")))
+		if sub == nil {
+			return c.SendStatus(fiber.StatusServiceUnavailable)
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set("X-Accel-Buffering", "no")
+
+		conn := c.RequestCtx().Conn()
+		return c.SendStreamWriter(func(w *bufio.Writer) {
+			defer s.remove(sub)
+
+			keepalive := time.NewTicker(eventStreamKeepalive)
+			defer keepalive.Stop()
+
+			// Tell the client it is subscribed before the first event arrives
+			fmt.Fprint(w, ": subscribed\n\n")
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			for {
+				select {
+				case event, ok := <-sub.ch:
+					if !ok {
+						return
+					}
+					fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.payload)
+				case <-keepalive.C:
+					fmt.Fprint(w, ": keepalive\n\n")
+				}
+				// The server's write timeout covers the whole response, so extend it per write instead
+				conn.SetWriteDeadline(time.Now().Add(2 * eventStreamKeepalive))
+				if err := w.Flush(); err != nil {
+					// The client went away
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/sombochea/tungo/internal/registry"
+)
+
+// housekeepingInterval is how often the cluster leader runs housekeeping jobs
+const housekeepingInterval = 15 * time.Second
+
+// Cluster-wide gauges, only reported by the leader (zero elsewhere)
+var (
+	clusterLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tungo_cluster_leader",
+		Help: "Whether this server leads the cluster and runs its housekeeping (1 or 0)",
+	})
+	clusterTunnels = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tungo_tunnels_active",
+		Help: "Number of active tunnels across the cluster",
+	})
+	clusterServers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tungo_servers_active",
+		Help: "Number of active servers in the cluster",
+	})
+)
+
+// housekeepingJob is a cluster-wide job run by the leader only
+type housekeepingJob struct {
+	name string
+	run  func() error
+}
+
+// Housekeeper runs cluster-wide jobs on whichever server the registry elected leader,
+// so they run once per cluster instead of once per server
+type Housekeeper struct {
+	registry    registry.Registry
+	orphanGrace time.Duration // How long a tunnel of a vanished server may go without a refresh before it is swept
+	logger      zerolog.Logger
+	jobs        []housekeepingJob
+	stop        chan struct{}
+}
+
+// NewHousekeeper creates a housekeeper with the built-in jobs for tunnels expiring after tunnelTTL
+func NewHousekeeper(reg registry.Registry, tunnelTTL time.Duration, logger zerolog.Logger) *Housekeeper {
+	h := &Housekeeper{
+		registry:    reg,
+		orphanGrace: 2 * tunnelRefreshInterval(tunnelTTL),
+		logger:      logger,
+		stop:        make(chan struct{}),
+	}
+	h.jobs = []housekeepingJob{
+		{name: "sweep_orphaned_tunnels", run: h.sweepOrphanedTunnels},
+		{name: "aggregate_usage", run: h.aggregateUsage},
+	}
+	return h
+}
+
+// Start begins running the jobs whenever this server is the leader
+func (h *Housekeeper) Start() {
+	go func() {
+		ticker := time.NewTicker(housekeepingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				h.tick()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops running the jobs
+func (h *Housekeeper) Stop() {
+	close(h.stop)
+}
+
+// tick runs every job if this server is the leader, clearing the leader-only gauges otherwise
+func (h *Housekeeper) tick() {
+	if !h.registry.IsLeader() {
+		clusterLeader.Set(0)
+		clusterTunnels.Set(0)
+		clusterServers.Set(0)
+		return
+	}
+	clusterLeader.Set(1)
+
+	for _, job := range h.jobs {
+		start := time.Now()
+		if err := job.run(); err != nil {
+			h.logger.Warn().Err(err).Str("job", job.name).Msg("Housekeeping job failed")
+			continue
+		}
+		h.logger.Debug().Str("job", job.name).Dur("duration", time.Since(start)).Msg("Housekeeping job finished")
+	}
+}
+
+// sweepOrphanedTunnels removes tunnels whose server is gone and that stopped being refreshed,
+// instead of routing visitors to a dead server until the entries expire
+func (h *Housekeeper) sweepOrphanedTunnels() error {
+	servers, err := h.registry.GetAllServers()
+	if err != nil {
+		return err
+	}
+	alive := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		alive[server.ServerID] = true
+	}
+
+	tunnels, err := h.registry.GetAllTunnels()
+	if err != nil {
+		return err
+	}
+	for _, tunnel := range tunnels {
+		if alive[tunnel.ServerID] || time.Since(tunnel.LastSeenAt) < h.orphanGrace {
+			continue
+		}
+		if err := h.registry.UnregisterTunnel(tunnel.Subdomain); err != nil {
+			h.logger.Warn().Err(err).Str("subdomain", tunnel.Subdomain).Msg("Failed to sweep orphaned tunnel")
+			continue
+		}
+		h.logger.Info().
+			Str("subdomain", tunnel.Subdomain).
+			Str("server_id", tunnel.ServerID).
+			Msg("Swept tunnel of a vanished server")
+	}
+	return nil
+}
+
+// aggregateUsage reports the cluster's tunnel and server counts
+func (h *Housekeeper) aggregateUsage() error {
+	tunnels, err := h.registry.GetAllTunnels()
+	if err != nil {
+		return err
+	}
+	servers, err := h.registry.GetAllServers()
+	if err != nil {
+		return err
+	}
+	clusterTunnels.Set(float64(len(tunnels)))
+	clusterServers.Set(float64(len(servers)))
+	return nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPFilter decides whether a visitor IP may access a tunnel based on CIDR allow/deny lists
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter creates an IP filter from CIDR strings (bare IPs are treated as single hosts)
+// Returns nil if both lists are empty
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow list: %w", err)
+	}
+
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny list: %w", err)
+	}
+
+	return &IPFilter{
+		allow: allowNets,
+		deny:  denyNets,
+	}, nil
+}
+
+// Allowed reports whether the IP may access the tunnel
+// Deny entries take precedence; a non-empty allow list rejects anything it doesn't match
+func (f *IPFilter) Allowed(ip string) bool {
+	if f == nil {
+		return true
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+
+	for _, n := range f.deny {
+		if n.Contains(parsed) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, n := range f.allow {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCIDRs parses a list of CIDRs or bare IP addresses
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
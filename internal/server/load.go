@@ -0,0 +1,70 @@
+package server
+
+import (
+	"runtime"
+	"runtime/metrics"
+	"time"
+
+	"github.com/prometheus/procfs"
+	"github.com/sombochea/tungo/internal/registry"
+)
+
+// memoryMetric is the runtime metric reported as the server's memory usage
+const memoryMetric = "/memory/classes/total:bytes"
+
+// LoadSampler measures this server's load for its heartbeats
+// Rates (bytes/sec, CPU) are averaged over the time since the previous sample
+type LoadSampler struct {
+	connMgr *ConnectionManager
+	memory  []metrics.Sample
+
+	lastSample time.Time
+	lastBytes  int64
+	lastCPU    float64 // Process CPU seconds
+}
+
+// NewLoadSampler creates a sampler for the connection manager's traffic and the process's CPU and memory
+func NewLoadSampler(connMgr *ConnectionManager) *LoadSampler {
+	s := &LoadSampler{
+		connMgr: connMgr,
+		memory:  []metrics.Sample{{Name: memoryMetric}},
+	}
+	s.Sample() // Start the rate windows
+	return s
+}
+
+// Sample returns the server's current load (not safe for concurrent use)
+func (s *LoadSampler) Sample() registry.ServerLoad {
+	now := time.Now()
+	bytes := s.connMgr.Bandwidth().TotalBytes()
+	cpu := processCPUSeconds()
+
+	load := registry.ServerLoad{
+		ActiveConnections: s.connMgr.GetActiveConnectionsCount(),
+		ActiveStreams:     s.connMgr.GetActiveStreamsCount(),
+	}
+	metrics.Read(s.memory)
+	if s.memory[0].Value.Kind() == metrics.KindUint64 {
+		load.MemoryBytes = s.memory[0].Value.Uint64()
+	}
+	if elapsed := now.Sub(s.lastSample).Seconds(); !s.lastSample.IsZero() && elapsed > 0 {
+		load.BytesPerSecond = float64(bytes-s.lastBytes) / elapsed
+		load.CPUPercent = 100 * (cpu - s.lastCPU) / (elapsed * float64(runtime.NumCPU()))
+	}
+
+	s.lastSample, s.lastBytes, s.lastCPU = now, bytes, cpu
+	return load
+}
+
+// processCPUSeconds returns the CPU time used by this process (0 where /proc is unavailable)
+func processCPUSeconds() float64 {
+	proc, err := procfs.Self()
+	if err != nil {
+		return 0
+	}
+	stat, err := proc.Stat()
+	if err != nil {
+		return 0
+	}
+	return stat.CPUTime()
+}
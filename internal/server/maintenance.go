@@ -0,0 +1,52 @@
+package server
+
+import (
+	"time"
+)
+
+// DefaultMaintenanceMessage is shown to clients and visitors when no message is set
+const DefaultMaintenanceMessage = "This server is undergoing scheduled maintenance. Please try again shortly."
+
+// Maintenance describes the server's maintenance mode
+type Maintenance struct {
+	Enabled     bool      `json:"enabled"`
+	Message     string    `json:"message,omitempty"` // Shown to clients and visitors (DefaultMaintenanceMessage if empty)
+	KeepTunnels bool      `json:"keep_tunnels"`      // Connected tunnels keep serving visitors
+	Since       time.Time `json:"since,omitempty"`
+}
+
+// Notice returns the message shown to clients and visitors
+func (m Maintenance) Notice() string {
+	if m.Message == "" {
+		return DefaultMaintenanceMessage
+	}
+	return m.Message
+}
+
+// SetMaintenance turns maintenance mode on or off
+// While it is on new tunnels are rejected and, unless KeepTunnels is set, visitors get a maintenance page
+func (cm *ConnectionManager) SetMaintenance(maintenance Maintenance) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if maintenance.Enabled && !cm.maintenance.Enabled {
+		maintenance.Since = time.Now()
+	} else if maintenance.Enabled {
+		maintenance.Since = cm.maintenance.Since
+	} else {
+		maintenance = Maintenance{}
+	}
+	cm.maintenance = maintenance
+
+	cm.logger.Info().
+		Bool("enabled", maintenance.Enabled).
+		Bool("keep_tunnels", maintenance.KeepTunnels).
+		Msg("Maintenance mode updated")
+}
+
+// Maintenance returns the current maintenance mode
+func (cm *ConnectionManager) Maintenance() Maintenance {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.maintenance
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// otherSubDomain labels traffic for subdomains beyond the cardinality cap (never a valid subdomain)
+const otherSubDomain = "_other"
+
+// tunnelMetricsPruneInterval limits how often disconnected subdomains are pruned once the cap is reached
+const tunnelMetricsPruneInterval = time.Minute
+
+var (
+	tunnelRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tungo_tunnel_requests_total",
+			Help: "Total number of requests proxied through a tunnel",
+		},
+		[]string{"subdomain", "code"},
+	)
+	tunnelErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tungo_tunnel_errors_total",
+			Help: "Total number of tunnel requests that failed with a 5xx status",
+		},
+		[]string{"subdomain"},
+	)
+	tunnelBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tungo_tunnel_bytes_total",
+			Help: "Total request (in) and response (out) body bytes transferred through a tunnel",
+		},
+		[]string{"subdomain", "direction"},
+	)
+	tunnelLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tungo_tunnel_request_duration_seconds",
+			Help:    "Tunnel request latency in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"subdomain"},
+	)
+)
+
+// TunnelMetrics records per-subdomain Prometheus metrics for at most limit subdomains at a time
+// Traffic for further subdomains is grouped under "_other"; slots of disconnected tunnels are reclaimed
+type TunnelMetrics struct {
+	limit     int
+	active    func(subDomain string) bool // Reports whether a subdomain is still connected
+	tracked   map[string]struct{}
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+// NewTunnelMetrics creates per-subdomain metrics tracking up to limit subdomains
+func NewTunnelMetrics(limit int, active func(subDomain string) bool) *TunnelMetrics {
+	return &TunnelMetrics{
+		limit:   limit,
+		active:  active,
+		tracked: make(map[string]struct{}),
+	}
+}
+
+// Observe records a finished request (no-op for a nil receiver)
+func (tm *TunnelMetrics) Observe(subDomain string, status int, bytesIn, bytesOut int64, latency time.Duration) {
+	if tm == nil {
+		return
+	}
+
+	label := tm.label(subDomain)
+	tunnelRequests.WithLabelValues(label, statusClass(status)).Inc()
+	if status >= 500 {
+		tunnelErrors.WithLabelValues(label).Inc()
+	}
+	tunnelBytes.WithLabelValues(label, "in").Add(float64(bytesIn))
+	tunnelBytes.WithLabelValues(label, "out").Add(float64(bytesOut))
+	tunnelLatency.WithLabelValues(label).Observe(latency.Seconds())
+}
+
+// label returns the subdomain label to use, claiming a slot if one is free
+func (tm *TunnelMetrics) label(subDomain string) string {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if _, ok := tm.tracked[subDomain]; ok {
+		return subDomain
+	}
+	if len(tm.tracked) >= tm.limit && time.Since(tm.lastPrune) >= tunnelMetricsPruneInterval {
+		tm.prune()
+	}
+	if len(tm.tracked) >= tm.limit {
+		return otherSubDomain
+	}
+
+	tm.tracked[subDomain] = struct{}{}
+	return subDomain
+}
+
+// prune drops the series of disconnected subdomains to free their slots
+func (tm *TunnelMetrics) prune() {
+	tm.lastPrune = time.Now()
+	for subDomain := range tm.tracked {
+		if tm.active(subDomain) {
+			continue
+		}
+		delete(tm.tracked, subDomain)
+
+		labels := prometheus.Labels{"subdomain": subDomain}
+		tunnelRequests.DeletePartialMatch(labels)
+		tunnelErrors.DeletePartialMatch(labels)
+		tunnelBytes.DeletePartialMatch(labels)
+		tunnelLatency.DeletePartialMatch(labels)
+	}
+}
+
+// statusClass returns the status code class label (e.g. "2xx")
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return strconv.Itoa(status)
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
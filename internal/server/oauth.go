@@ -0,0 +1,454 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/rs/zerolog"
+
+	"github.com/sombochea/tungo/pkg/config"
+	"github.com/sombochea/tungo/pkg/protocol"
+)
+
+// OAuthCallbackPath is where providers send visitors back to on the control server (oauth_callback_url),
+// which passes them on to the same path on the tunnel's host to finish logging in
+const OAuthCallbackPath = "/_tungo/oauth/callback"
+
+// oauthStateTTL bounds how long a visitor may take to log in with the provider
+const oauthStateTTL = 10 * time.Minute
+
+var (
+	// ErrOAuthDenied is returned when a visitor logged in but isn't allowed by the tunnel's rules
+	ErrOAuthDenied = errors.New("not allowed to access this tunnel")
+	// ErrOAuthInvalidState is returned for callbacks that don't belong to a login started here
+	ErrOAuthInvalidState = errors.New("invalid or expired login state")
+)
+
+// oauthProvider is an OAuth app visitors log in with
+type oauthProvider struct {
+	authURL      string
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	identify     func(ctx context.Context, g *OAuthGate, token string, policy *protocol.OAuthPolicy) (*oauthIdentity, error)
+}
+
+// oauthIdentity is who a visitor logged in as
+type oauthIdentity struct {
+	Login  string   // GitHub login (empty for Google)
+	Emails []string // Verified email addresses
+	Orgs   []string // GitHub organizations
+}
+
+// OAuthGate makes visitors of OAuth-protected tunnels log in at the edge before reaching them
+// Sessions are signed cookies per subdomain, bound to the tunnel's provider and allow rules
+// Providers only know the control server's callback, so the login state carries the tunnel host to return to
+type OAuthGate struct {
+	providers   map[string]*oauthProvider
+	secret      []byte
+	callbackURL string
+	sessionTTL  time.Duration
+	httpClient  *http.Client
+	logger      zerolog.Logger
+}
+
+// NewOAuthGate creates the gate for the providers configured on the server
+func NewOAuthGate(cfg *config.ServerConfig, logger zerolog.Logger) *OAuthGate {
+	secret := []byte(cfg.OAuthCookieSecret)
+	if len(secret) == 0 {
+		// Sessions then last until the server restarts (config validation requires a secret in a cluster)
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+
+	providers := make(map[string]*oauthProvider)
+	if cfg.OAuthGitHubClientID != "" {
+		providers[config.OAuthGitHub] = &oauthProvider{
+			authURL:      "https://github.com/login/oauth/authorize",
+			tokenURL:     "https://github.com/login/oauth/access_token",
+			clientID:     cfg.OAuthGitHubClientID,
+			clientSecret: cfg.OAuthGitHubClientSecret,
+			identify:     githubIdentity,
+		}
+	}
+	if cfg.OAuthGoogleClientID != "" {
+		providers[config.OAuthGoogle] = &oauthProvider{
+			authURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+			tokenURL:     "https://oauth2.googleapis.com/token",
+			clientID:     cfg.OAuthGoogleClientID,
+			clientSecret: cfg.OAuthGoogleClientSecret,
+			identify:     googleIdentity,
+		}
+	}
+
+	return &OAuthGate{
+		providers:   providers,
+		secret:      secret,
+		callbackURL: cfg.OAuthCallbackURL,
+		sessionTTL:  cfg.OAuthSessionTTL,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		logger:      logger,
+	}
+}
+
+// Authorized reports whether the visitor has a session for the tunnel's current provider and rules
+func (g *OAuthGate) Authorized(c fiber.Ctx, subDomain string, policy *protocol.OAuthPolicy) bool {
+	payload, ok := g.verify(c.Cookies(oauthSessionCookie(subDomain)))
+	if !ok {
+		return false
+	}
+	// payload: subdomain | policy hash | expiry | identity
+	parts := strings.SplitN(payload, "|", 4)
+	if len(parts) != 4 || parts[0] != subDomain || parts[1] != oauthPolicyHash(policy) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
+	return err == nil && time.Now().Unix() < expiry
+}
+
+// LoginURL starts a visitor's login, returning the provider URL to redirect to
+// The visitor comes back to next (a path on the tunnel) once logged in
+func (g *OAuthGate) LoginURL(c fiber.Ctx, subDomain string, policy *protocol.OAuthPolicy, next string) (string, error) {
+	provider, exists := g.providers[policy.Provider]
+	if !exists {
+		return "", fmt.Errorf("oauth provider %s is not enabled on this server", policy.Provider)
+	}
+
+	// The nonce ties the callback to this browser, so logins can't be planted in someone else's
+	nonceBytes := make([]byte, 16)
+	rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+	c.Cookie(&fiber.Cookie{
+		Name:     oauthStateCookie(subDomain),
+		Value:    nonce,
+		Path:     OAuthCallbackPath,
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HTTPOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: "Lax",
+	})
+
+	expiry := time.Now().Add(oauthStateTTL).Unix()
+	origin := c.Scheme() + "://" + c.Host()
+	state := g.sign(fmt.Sprintf("%s|%s|%d|%s|%s", subDomain, nonce, expiry, origin, next))
+
+	query := url.Values{
+		"client_id":     {provider.clientID},
+		"redirect_uri":  {g.callbackURL},
+		"response_type": {"code"},
+		"scope":         {oauthScope(policy)},
+		"state":         {state},
+	}
+	return provider.authURL + "?" + query.Encode(), nil
+}
+
+// Return checks the state a provider sent a visitor back to the control server with,
+// and returns the callback URL on the tunnel's host to pass the provider's response on to
+func (g *OAuthGate) Return(c fiber.Ctx) (string, error) {
+	payload, ok := g.verify(c.Query("state"))
+	if !ok {
+		return "", ErrOAuthInvalidState
+	}
+	// payload: subdomain | nonce | expiry | origin | next
+	parts := strings.SplitN(payload, "|", 5)
+	if len(parts) != 5 {
+		return "", ErrOAuthInvalidState
+	}
+	if expiry, err := strconv.ParseInt(parts[2], 10, 64); err != nil || time.Now().Unix() >= expiry {
+		return "", ErrOAuthInvalidState
+	}
+	origin, err := url.Parse(parts[3])
+	if err != nil || (origin.Scheme != "http" && origin.Scheme != "https") || origin.Host == "" {
+		return "", ErrOAuthInvalidState
+	}
+	return parts[3] + OAuthCallbackPath + "?" + string(c.Request().URI().QueryString()), nil
+}
+
+// Callback completes a visitor's login, setting their session cookie, and returns the path to go back to
+func (g *OAuthGate) Callback(c fiber.Ctx, subDomain string, policy *protocol.OAuthPolicy) (string, error) {
+	provider, exists := g.providers[policy.Provider]
+	if !exists {
+		return "", fmt.Errorf("oauth provider %s is not enabled on this server", policy.Provider)
+	}
+
+	payload, ok := g.verify(c.Query("state"))
+	if !ok {
+		return "", ErrOAuthInvalidState
+	}
+	// payload: subdomain | nonce | expiry | origin | next
+	parts := strings.SplitN(payload, "|", 5)
+	if len(parts) != 5 || parts[0] != subDomain || !hmac.Equal([]byte(parts[1]), []byte(c.Cookies(oauthStateCookie(subDomain)))) {
+		return "", ErrOAuthInvalidState
+	}
+	if expiry, err := strconv.ParseInt(parts[2], 10, 64); err != nil || time.Now().Unix() >= expiry {
+		return "", ErrOAuthInvalidState
+	}
+	next := parts[4]
+	c.Cookie(&fiber.Cookie{Name: oauthStateCookie(subDomain), Path: OAuthCallbackPath, MaxAge: -1})
+
+	if c.Query("error") != "" {
+		return "", fmt.Errorf("login was cancelled: %s", c.Query("error"))
+	}
+	code := c.Query("code")
+	if code == "" {
+		return "", ErrOAuthInvalidState
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), 30*time.Second)
+	defer cancel()
+
+	token, err := g.exchange(ctx, provider, code, g.callbackURL)
+	if err != nil {
+		return "", err
+	}
+	identity, err := provider.identify(ctx, g, token, policy)
+	if err != nil {
+		return "", err
+	}
+	who := identity.Login
+	if who == "" && len(identity.Emails) > 0 {
+		who = identity.Emails[0]
+	}
+	if !oauthAllowed(identity, policy.Allow) {
+		g.logger.Info().Str("subdomain", subDomain).Str("provider", policy.Provider).Str("identity", who).Msg("OAuth visitor denied")
+		return "", ErrOAuthDenied
+	}
+
+	expiry := time.Now().Add(g.sessionTTL).Unix()
+	c.Cookie(&fiber.Cookie{
+		Name:     oauthSessionCookie(subDomain),
+		Value:    g.sign(fmt.Sprintf("%s|%s|%d|%s", subDomain, oauthPolicyHash(policy), expiry, who)),
+		Path:     "/",
+		MaxAge:   int(g.sessionTTL.Seconds()),
+		HTTPOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: "Lax",
+	})
+	g.logger.Info().Str("subdomain", subDomain).Str("provider", policy.Provider).Str("identity", who).Msg("OAuth visitor logged in")
+
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	return next, nil
+}
+
+// exchange trades an authorization code for an access token
+func (g *OAuthGate) exchange(ctx context.Context, provider *oauthProvider, code, redirectURI string) (string, error) {
+	form := url.Values{
+		"client_id":     {provider.clientID},
+		"client_secret": {provider.clientSecret},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"grant_type":    {"authorization_code"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := g.getJSON(req, &body); err != nil {
+		return "", fmt.Errorf("failed to exchange login code: %w", err)
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("failed to exchange login code: %s %s", body.Error, body.ErrorDescription)
+	}
+	return body.AccessToken, nil
+}
+
+// fetch gets a provider API resource with the visitor's access token
+func (g *OAuthGate) fetch(ctx context.Context, apiURL, token string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	if err := g.getJSON(req, out); err != nil {
+		return fmt.Errorf("failed to look up visitor identity: %w", err)
+	}
+	return nil
+}
+
+// getJSON sends req and decodes its JSON response
+func (g *OAuthGate) getJSON(req *http.Request, out any) error {
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// githubIdentity looks up the visitor's login, and their emails and organizations when the rules need them
+func githubIdentity(ctx context.Context, g *OAuthGate, token string, policy *protocol.OAuthPolicy) (*oauthIdentity, error) {
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := g.fetch(ctx, "https://api.github.com/user", token, &user); err != nil {
+		return nil, err
+	}
+	identity := &oauthIdentity{Login: user.Login}
+
+	if oauthNeeds(policy, "email", "domain") {
+		var emails []struct {
+			Email    string `json:"email"`
+			Verified bool   `json:"verified"`
+		}
+		if err := g.fetch(ctx, "https://api.github.com/user/emails", token, &emails); err != nil {
+			return nil, err
+		}
+		for _, email := range emails {
+			if email.Verified {
+				identity.Emails = append(identity.Emails, email.Email)
+			}
+		}
+	}
+
+	if oauthNeeds(policy, "org") {
+		var orgs []struct {
+			Login string `json:"login"`
+		}
+		if err := g.fetch(ctx, "https://api.github.com/user/orgs?per_page=100", token, &orgs); err != nil {
+			return nil, err
+		}
+		for _, org := range orgs {
+			identity.Orgs = append(identity.Orgs, org.Login)
+		}
+	}
+	return identity, nil
+}
+
+// googleIdentity looks up the visitor's verified email address
+func googleIdentity(ctx context.Context, g *OAuthGate, token string, policy *protocol.OAuthPolicy) (*oauthIdentity, error) {
+	var user struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := g.fetch(ctx, "https://openidconnect.googleapis.com/v1/userinfo", token, &user); err != nil {
+		return nil, err
+	}
+	identity := &oauthIdentity{}
+	if user.EmailVerified {
+		identity.Emails = []string{user.Email}
+	}
+	return identity, nil
+}
+
+// oauthAllowed reports whether an identity matches any of the tunnel's allow rules
+func oauthAllowed(identity *oauthIdentity, allow []string) bool {
+	for _, rule := range allow {
+		kind, value, _ := strings.Cut(rule, ":")
+		matches := func(candidate string) bool { return strings.EqualFold(candidate, value) }
+		switch kind {
+		case "user":
+			if identity.Login != "" && matches(identity.Login) {
+				return true
+			}
+		case "org":
+			if slices.ContainsFunc(identity.Orgs, matches) {
+				return true
+			}
+		case "email":
+			if slices.ContainsFunc(identity.Emails, matches) {
+				return true
+			}
+		case "domain":
+			if slices.ContainsFunc(identity.Emails, func(email string) bool {
+				_, domain, _ := strings.Cut(email, "@")
+				return matches(domain)
+			}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// oauthNeeds reports whether the tunnel's rules include any of the given kinds
+func oauthNeeds(policy *protocol.OAuthPolicy, kinds ...string) bool {
+	return slices.ContainsFunc(policy.Allow, func(rule string) bool {
+		kind, _, _ := strings.Cut(rule, ":")
+		return slices.Contains(kinds, kind)
+	})
+}
+
+// oauthScope returns the scopes needed to check the tunnel's rules
+func oauthScope(policy *protocol.OAuthPolicy) string {
+	if policy.Provider == config.OAuthGoogle {
+		return "openid email"
+	}
+	scope := "read:user"
+	if oauthNeeds(policy, "email", "domain") {
+		scope += " user:email"
+	}
+	if oauthNeeds(policy, "org") {
+		scope += " read:org"
+	}
+	return scope
+}
+
+// oauthPolicyHash identifies a tunnel's provider and rules, so changing them logs visitors out
+func oauthPolicyHash(policy *protocol.OAuthPolicy) string {
+	sum := sha256.Sum256([]byte(policy.Provider + "\n" + strings.Join(policy.Allow, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// oauthSessionCookie names a visitor's session cookie for a tunnel
+func oauthSessionCookie(subDomain string) string {
+	return "tungo-oauth-" + subDomain
+}
+
+// oauthStateCookie names the cookie holding a login's nonce until the provider sends the visitor back
+func oauthStateCookie(subDomain string) string {
+	return "tungo-oauth-state-" + subDomain
+}
+
+// sign encodes payload with its HMAC
+func (g *OAuthGate) sign(payload string) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the payload of a value made by sign, if its HMAC matches
+func (g *OAuthGate) verify(value string) (string, bool) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	provided, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(payload)
+	return string(payload), hmac.Equal(provided, mac.Sum(nil))
+}
@@ -3,45 +3,211 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/sombochea/tungo/pkg/protocol"
+	"github.com/sombochea/tungo/pkg/tracing"
 )
 
-// Buffer pool for high performance
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		return new(bytes.Buffer)
-	},
-}
+// requestChunkSize is the largest request body chunk sent in a single data frame
+const requestChunkSize = 32 * 1024
+
+// Errors returned while streaming a request body into the tunnel
+var (
+	errBodyTooLarge = errors.New("request body too large")
+	errBodyRead     = errors.New("failed to read request body")
+)
 
 // ProxyHandler handles HTTP requests and routes them through tunnels
 type ProxyHandler struct {
-	connMgr *ConnectionManager
-	logger  zerolog.Logger
+	connMgr   *ConnectionManager
+	logger    zerolog.Logger
+	accessLog *AccessLogger
+	errors    *ErrorLog
+	headers   map[string]string // Server-wide response headers, applied after tunnel headers
+	// Server-wide request body limit in bytes (0 = unlimited), enforced while streaming
+	maxBodySize int64
+	metrics     *TunnelMetrics      // Optional per-subdomain Prometheus metrics
+	trusted     *TrustedProxies     // Peers whose forwarding headers are kept
+	compressor  *ResponseCompressor // Optional edge compression of tunnel responses
+	cache       *ResponseCache      // Optional edge cache of tunnel responses
+	timeouts    ResponseTimeouts    // Defaults for tunnels that don't override them
 }
 
-// NewProxyHandler creates a new proxy handler
-func NewProxyHandler(connMgr *ConnectionManager, logger zerolog.Logger) *ProxyHandler {
+// NewProxyHandler creates a new proxy handler (accessLog may be nil to disable access logging)
+func NewProxyHandler(connMgr *ConnectionManager, logger zerolog.Logger, accessLog *AccessLogger) *ProxyHandler {
 	return &ProxyHandler{
-		connMgr: connMgr,
-		logger:  logger,
+		connMgr:   connMgr,
+		logger:    logger,
+		accessLog: accessLog,
+		errors:    NewErrorLog(100),
+		timeouts: ResponseTimeouts{
+			FirstByte: 5 * time.Second,
+			Header:    30 * time.Second,
+			Idle:      30 * time.Second,
+		},
 	}
 }
 
+// SetResponseTimeouts sets how long tunnels' responses are waited for unless a tunnel overrides them
+func (ph *ProxyHandler) SetResponseTimeouts(timeouts ResponseTimeouts) {
+	ph.timeouts = timeouts
+}
+
+// SetResponseHeaders sets response headers injected into every tunnel response
+func (ph *ProxyHandler) SetResponseHeaders(headers map[string]string) {
+	ph.headers = headers
+}
+
+// SetMaxBodySize sets the server-wide request body limit enforced while streaming bodies
+func (ph *ProxyHandler) SetMaxBodySize(limit int64) {
+	ph.maxBodySize = limit
+}
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For chain is passed on to the tunnel
+func (ph *ProxyHandler) SetTrustedProxies(trusted *TrustedProxies) {
+	ph.trusted = trusted
+}
+
+// SetCompression enables or disables edge compression of tunnel responses
+func (ph *ProxyHandler) SetCompression(enabled bool) {
+	ph.compressor = nil
+	if enabled {
+		ph.compressor = NewResponseCompressor()
+	}
+}
+
+// SetCache sets the edge cache serving repeat requests for cacheable responses (nil disables it)
+func (ph *ProxyHandler) SetCache(cache *ResponseCache) {
+	ph.cache = cache
+}
+
+// SetTunnelMetrics enables per-subdomain Prometheus metrics for up to limit subdomains (0 disables them)
+func (ph *ProxyHandler) SetTunnelMetrics(limit int) {
+	if limit <= 0 {
+		ph.metrics = nil
+		return
+	}
+	ph.metrics = NewTunnelMetrics(limit, func(subDomain string) bool {
+		return ph.connMgr.HasSubDomain(subDomain)
+	})
+}
+
+// RecentErrors returns the most recent failed requests (status >= 500)
+func (ph *ProxyHandler) RecentErrors() []ErrorEvent {
+	return ph.errors.Recent()
+}
+
 // HandleRequest handles an incoming HTTP request
 func (ph *ProxyHandler) HandleRequest(c fiber.Ctx, client *ClientConnection) error {
+	// Reject traffic once the tunnel is over its bandwidth quota (unless throttling instead)
+	bandwidth := ph.connMgr.Bandwidth()
+	if bandwidth.Exceeded(client.SubDomain) && !bandwidth.Throttles() {
+		return ph.sendPrettyErrorWithInfo(c, fiber.StatusTooManyRequests,
+			"Bandwidth Quota Exceeded",
+			"This tunnel has used up its bandwidth allowance. Please try again later.",
+			client, "", nil)
+	}
+
+	// Enforce the account's shared caps
+	if client.Limits.Exceeded() {
+		return ph.sendPrettyErrorWithInfo(c, fiber.StatusTooManyRequests,
+			"Bandwidth Quota Exceeded",
+			"This account has used up its bandwidth allowance. Please try again later.",
+			client, "", nil)
+	}
+	if !client.Limits.Allow() {
+		c.Set("Retry-After", "1")
+		return ph.sendPrettyErrorWithInfo(c, fiber.StatusTooManyRequests,
+			"Rate Limit Exceeded",
+			"This account is receiving too many requests. Please slow down and try again.",
+			client, "", nil)
+	}
+
+	// Serve repeat requests for cacheable responses without a round trip through the tunnel
+	if entry, ok := ph.cache.Lookup(c, client); ok {
+		return ph.sendCached(c, client, entry)
+	}
+
+	return ph.handleStream(c, client, "http")
+}
+
+// sendCached replies with a response from the edge cache
+func (ph *ProxyHandler) sendCached(c fiber.Ctx, client *ClientConnection, entry *CachedResponse) error {
+	start := time.Now()
+	requestID := EnsureRequestID(c)
+
+	c.Status(entry.Status)
+	for key, values := range entry.Header {
+		for _, value := range values {
+			c.Set(key, value)
+		}
+	}
+	c.Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	c.Set("X-Tungo-Cache", "HIT")
+	c.Set("X-Tungo-Subdomain", client.SubDomain)
+	if requestID != "" {
+		c.Set("X-Tungo-Request-ID", requestID)
+	}
+	ph.setEdgeHeaders(c, client)
+
+	err := c.Send(entry.Body)
+	ph.compressor.Compress(c, entry.Status, int64(len(entry.Body)))
+
+	bytesOut := int64(len(entry.Body))
+	ph.connMgr.Bandwidth().Record(client.SubDomain, 0, bytesOut)
+	client.Limits.Record(0, bytesOut)
+	ph.metrics.Observe(client.SubDomain, entry.Status, 0, bytesOut, time.Since(start))
+	ph.accessLog.Log(AccessLogEntry{
+		SubDomain:    client.SubDomain,
+		RequestID:    requestID,
+		Method:       c.Method(),
+		Path:         c.Path(),
+		Status:       entry.Status,
+		BytesOut:     int(bytesOut),
+		Latency:      time.Since(start),
+		VisitorIP:    VisitorIP(c),
+		Cache:        "HIT",
+		ResponseBody: entry.Body,
+	})
+	return err
+}
+
+// HandleInspectRequest forwards a request for the shared dashboard to the client over an inspect stream
+func (ph *ProxyHandler) HandleInspectRequest(c fiber.Ctx, client *ClientConnection) error {
+	return ph.handleStream(c, client, protocol.StreamProtocolInspect)
+}
+
+// handleStream sends the request through a new stream of the given protocol and relays the response
+func (ph *ProxyHandler) handleStream(c fiber.Ctx, client *ClientConnection, streamProtocol string) error {
+	// Only in-flight streams are allowed to finish while draining
+	if ph.connMgr.IsDraining() {
+		c.Set("Retry-After", "5")
+		return ph.sendPrettyError(c, fiber.StatusServiceUnavailable,
+			"Server Restarting",
+			"This tunnel server is shutting down. The tunnel will be available again shortly.")
+	}
+
 	// Generate stream ID
 	streamID := protocol.GenerateStreamID()
+	requestID := EnsureRequestID(c)
+	logger := ph.requestLogger(c)
 
-	ph.logger.Debug().
+	logger.Debug().
 		Str("stream_id", streamID.String()).
 		Str("client_id", client.ID.String()).
 		Str("subdomain", client.SubDomain).
@@ -49,14 +215,102 @@ func (ph *ProxyHandler) HandleRequest(c fiber.Ctx, client *ClientConnection) err
 		Str("method", c.Method()).
 		Msg("Handling request")
 
+	// Continue the visitor's trace (if any) with an edge span
+	ctx := tracing.Extract(context.Background(), requestHeaders(c))
+	ctx, span := tracing.Tracer().Start(ctx, "tungo.proxy",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.HTTPAttributes(c.Method(), c.Path(), client.SubDomain)...),
+		trace.WithAttributes(
+			attribute.String("tungo.stream_id", streamID.String()),
+			attribute.String("tungo.request_id", requestID)))
+
+	// Snapshot the request for logging, since a streamed body completes after the context is released
+	start := time.Now()
+	method, path, visitorIP := c.Method(), c.Path(), VisitorIP(c)
+	var bytesIn int
+	var requestBody []byte // Leading request body bytes kept for the access log
+
+	// Tunnel responses to cacheable requests may be stored in the edge cache
+	cacheStatus := ""
+	if streamProtocol == "http" && ph.cache != nil && cacheableRequest(c) {
+		cacheStatus = "MISS"
+		c.Set("X-Tungo-Cache", cacheStatus)
+	}
+
+	// finish releases the stream and emits one access log line once the response has been written
+	var finishOnce sync.Once
+	finish := func(status int, bytesOut int64, responseBody []byte) {
+		finishOnce.Do(func() {
+			client.RemoveStream(streamID)
+
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			if status >= fiber.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			span.End()
+
+			if status >= fiber.StatusInternalServerError {
+				ph.errors.Add(ErrorEvent{
+					Time:      time.Now(),
+					SubDomain: client.SubDomain,
+					Method:    method,
+					Path:      path,
+					Status:    status,
+					RequestID: requestID,
+				})
+			}
+			ph.metrics.Observe(client.SubDomain, status, int64(bytesIn), bytesOut, time.Since(start))
+			ph.accessLog.Log(AccessLogEntry{
+				SubDomain:    client.SubDomain,
+				StreamID:     streamID.String(),
+				RequestID:    requestID,
+				Method:       method,
+				Path:         path,
+				Status:       status,
+				BytesIn:      bytesIn,
+				BytesOut:     int(bytesOut),
+				Latency:      time.Since(start),
+				VisitorIP:    visitorIP,
+				Cache:        cacheStatus,
+				RequestBody:  requestBody,
+				ResponseBody: responseBody,
+			})
+		})
+	}
+
+	// Responses sent from the handler are finished on return, streamed ones when the body completes
+	streaming := false
+	defer func() {
+		if !streaming {
+			finish(c.Response().StatusCode(), int64(len(c.Response().Body())), c.Response().Body())
+		}
+	}()
+
+	// Fail fast while the tunnel is known to be unresponsive
+	if allowed, retryAfter := client.Breaker.Allow(); !allowed {
+		c.Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+		return ph.sendPrettyErrorWithInfo(c, fiber.StatusServiceUnavailable,
+			"Tunnel Unresponsive",
+			"This tunnel has stopped responding and is temporarily unavailable. Please try again shortly.",
+			client, "", nil)
+	}
+
 	// Add stream to client
-	stream := client.AddStream(streamID, "http", c.IP())
-	defer client.RemoveStream(streamID)
+	stream, err := client.AddStream(streamID, streamProtocol, visitorIP)
+	if err != nil {
+		client.Logger.Warn().Int("max_streams", client.MaxStreams).Msg("Stream limit reached")
+		c.Set("Retry-After", "1")
+		return ph.sendPrettyErrorWithInfo(c, fiber.StatusServiceUnavailable,
+			"Tunnel Busy",
+			"This tunnel is handling too many requests at once. Please try again shortly.",
+			client, "", nil)
+	}
 
 	// Send init message to client
 	initMsg := &protocol.InitStreamMessage{
-		StreamID: streamID,
-		Protocol: "http",
+		StreamID:  streamID,
+		Protocol:  streamProtocol,
+		SubDomain: client.SubDomain,
 	}
 
 	msg, err := protocol.NewMessage(protocol.MessageTypeInit, streamID, initMsg)
@@ -67,6 +321,7 @@ func (ph *ProxyHandler) HandleRequest(c fiber.Ctx, client *ClientConnection) err
 	}
 
 	if err := client.SendMessage(msg); err != nil {
+		ph.recordTunnelFailure(client, err.Error())
 		return ph.sendPrettyError(c, fiber.StatusBadGateway,
 			"Communication Error",
 			"Failed to communicate with the tunnel client. The connection may be unstable.")
@@ -83,88 +338,185 @@ func (ph *ProxyHandler) HandleRequest(c fiber.Ctx, client *ClientConnection) err
 	}
 
 	if !streamReady {
-		ph.logger.Warn().Str("stream_id", streamID.String()).Msg("Stream not ready after init")
+		logger.Warn().Str("stream_id", streamID.String()).Msg("Stream not ready after init")
 	}
 
-	// Build HTTP request data
-	requestData, err := ph.buildHTTPRequest(c)
-	if err != nil {
-		return ph.sendPrettyError(c, fiber.StatusInternalServerError,
-			"Request Processing Error",
-			"Unable to process your request. Please check your request format and try again.")
+	// Reject bodies declared larger than the limit before forwarding anything
+	bodyLimit := ph.bodyLimit(client)
+	if bodyLimit > 0 && int64(c.Request().Header.ContentLength()) > bodyLimit {
+		ph.endStream(client, streamID)
+		return ph.sendBodyTooLarge(c, bodyLimit)
 	}
 
-	// Send request data
-	dataMsg := &protocol.DataMessage{
-		Data: requestData,
-	}
-	msg, err = protocol.NewMessage(protocol.MessageTypeData, streamID, dataMsg)
-	if err != nil {
-		return ph.sendPrettyError(c, fiber.StatusInternalServerError,
-			"Message Creation Failed",
-			"Unable to create tunnel message. Please try again.")
+	// Send the request head, then stream the body through the tunnel in chunks
+	if err := ph.sendData(client, streamID, ph.buildRequestHead(c, ctx)); err != nil {
+		ph.recordTunnelFailure(client, err.Error())
+		return ph.sendPrettyError(c, fiber.StatusBadGateway,
+			"Data Transmission Failed",
+			"Unable to send your request through the tunnel. The connection may have been interrupted.")
 	}
 
-	if err := client.SendMessage(msg); err != nil {
+	bandwidth := ph.connMgr.Bandwidth()
+	if err := ph.streamRequestBody(c, client, streamID, bodyLimit, func(chunk []byte) {
+		bytesIn += len(chunk)
+		if room := maxLoggedBodyBytes + 1 - len(requestBody); room > 0 {
+			requestBody = append(requestBody, chunk[:min(len(chunk), room)]...)
+		}
+		bandwidth.Record(client.SubDomain, int64(len(chunk)), 0)
+		client.Limits.Record(int64(len(chunk)), 0)
+	}); err != nil {
+		ph.endStream(client, streamID)
+		if errors.Is(err, errBodyTooLarge) {
+			return ph.sendBodyTooLarge(c, bodyLimit)
+		}
+		if errors.Is(err, errBodyRead) {
+			return ph.sendPrettyError(c, fiber.StatusBadRequest,
+				"Request Body Error",
+				"Unable to read the request body. Please try again.")
+		}
+		ph.recordTunnelFailure(client, err.Error())
 		return ph.sendPrettyError(c, fiber.StatusBadGateway,
 			"Data Transmission Failed",
 			"Unable to send your request through the tunnel. The connection may have been interrupted.")
 	}
 
-	// Wait for response data with timeout
-	timeout := time.After(30 * time.Second)
-	responseBuffer := bufferPool.Get().(*bytes.Buffer)
-	responseBuffer.Reset()
-	defer bufferPool.Put(responseBuffer)
-
-	noDataTimeout := time.NewTimer(5 * time.Second) // Initial timeout for first response
-	defer noDataTimeout.Stop()
-
-	for {
-		select {
-		case data := <-stream.DataChan:
-			ph.logger.Info().
+	// Meter traffic as it flows and slow down delivery if the tunnel is throttled
+	timeouts := ph.timeouts.Override(client.ResponseTimeouts)
+	reader := &streamReader{
+		stream: stream,
+		idle:   timeouts.FirstByte, // Initial timeout for first response
+		onData: func(data []byte) {
+			logger.Debug().
 				Str("stream_id", streamID.String()).
 				Int("chunk_bytes", len(data)).
-				Int("total_bytes", responseBuffer.Len()).
-				Str("chunk_preview", string(data[:min(50, len(data))])).
 				Msg("Received response chunk")
 
-			responseBuffer.Write(data)
-			// Reset the no-data timeout since we received data
-			// Use shorter timeout for subsequent data chunks
-			noDataTimeout.Reset(200 * time.Millisecond)
-
-		case <-noDataTimeout.C:
-			// No more data coming, parse and return HTTP response
-			if responseBuffer.Len() > 0 {
-				return ph.sendHTTPResponse(c, responseBuffer, client, streamID, stream)
+			bandwidth.Record(client.SubDomain, 0, int64(len(data)))
+			client.Limits.Record(0, int64(len(data)))
+			if bandwidth.Exceeded(client.SubDomain) && bandwidth.Throttles() {
+				time.Sleep(bandwidth.ThrottleDelay(len(data)))
 			}
+		},
+	}
+	responseReader := bufio.NewReaderSize(reader, 32*1024)
+
+	// Wait for the first bytes of the response
+	prefix, err := responseReader.Peek(len("HTTP/"))
+	if len(prefix) == 0 {
+		if errors.Is(err, errStreamIdle) {
+			ph.recordTunnelFailure(client, "no response")
 			return ph.sendPrettyErrorWithInfo(c, fiber.StatusBadGateway,
 				"No Response Received",
 				"Your local server didn't respond. Please check if your local application is running and accessible.",
 				client, streamID, stream)
+		}
+		return ph.sendPrettyErrorWithInfo(c, fiber.StatusBadGateway,
+			"Connection Closed",
+			"The tunnel connection was closed before receiving a response. Your local server may have stopped or crashed.",
+			client, streamID, stream)
+	}
 
-		case <-stream.Done:
-			if responseBuffer.Len() > 0 {
-				return ph.sendHTTPResponse(c, responseBuffer, client, streamID, stream)
-			}
-			return ph.sendPrettyErrorWithInfo(c, fiber.StatusBadGateway,
-				"Connection Closed",
-				"The tunnel connection was closed before receiving a response. Your local server may have stopped or crashed.",
-				client, streamID, stream)
+	// Headers must be complete within the request timeout; after that only idle gaps are bounded
+	reader.idle = timeouts.Idle
+	reader.deadline = start.Add(timeouts.Header)
+
+	// Stream the response body to the visitor as it arrives from the tunnel
+	// store (if set) receives the complete body once it has been sent
+	sendBody := func(status int, body io.Reader, size int, capture int, store func(body []byte)) error {
+		reader.deadline = time.Time{}
+		streaming = true
+		return c.SendStream(&responseBody{
+			reader:  body,
+			capture: capture,
+			onClose: func(body *responseBody) {
+				if store != nil && body.eof {
+					store(body.captured)
+				}
+				finish(status, body.written, body.captured)
+			},
+		}, size)
+	}
 
-		case <-timeout:
+	// Non-HTTP responses are relayed as-is
+	if !bytes.Equal(prefix, []byte("HTTP/")) {
+		logger.Warn().
+			Str("start", string(prefix)).
+			Msg("Response doesn't start with HTTP/, returning as-is")
+		client.Breaker.RecordSuccess()
+		c.Set("Content-Type", "text/plain")
+		// Add TunGo headers even for non-HTTP responses
+		setTunGoHeaders(c, client, streamID, stream)
+		ph.setEdgeHeaders(c, client)
+		c.Status(fiber.StatusOK)
+		return sendBody(fiber.StatusOK, responseReader, -1, 0, nil)
+	}
+
+	// Parse the status line and headers
+	resp, err := http.ReadResponse(responseReader, &http.Request{Method: method})
+	if err != nil {
+		if errors.Is(err, errStreamDeadline) {
+			ph.recordTunnelFailure(client, "timeout")
 			return ph.sendPrettyErrorWithInfo(c, fiber.StatusGatewayTimeout,
 				"Request Timeout",
-				"Your local server took too long to respond (>30s). Please check if your application is experiencing performance issues.",
+				fmt.Sprintf("Your local server took too long to respond (>%s). Please check if your application is experiencing performance issues.", timeouts.Header),
 				client, streamID, stream)
 		}
+		logger.Error().
+			Err(err).
+			Str("stream_id", streamID.String()).
+			Msg("Failed to parse HTTP response")
+		return ph.sendPrettyError(c, fiber.StatusBadGateway,
+			"Invalid Response",
+			"Your local server returned an invalid HTTP response. Please ensure your application is sending properly formatted HTTP responses.")
 	}
+	client.Breaker.RecordSuccess()
+
+	// Set status code
+	c.Status(resp.StatusCode)
+
+	// Add TunGo custom headers for tunnel information
+	setTunGoHeaders(c, client, streamID, stream)
+
+	// Copy headers (framing is handled by the body stream)
+	for key, values := range resp.Header {
+		if key == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			c.Set(key, value)
+		}
+	}
+
+	// Inject edge headers over whatever the local server sent
+	ph.setEdgeHeaders(c, client)
+
+	// Keep the whole body of cacheable responses to store once it has been sent
+	var capture int
+	var store func(body []byte)
+	if cacheStatus != "" {
+		if ttl := ph.cache.TTL(c, client, resp); ttl > 0 {
+			key := cacheKey(c, client)
+			capture = int(ph.cache.maxEntrySize) + 1
+			store = func(body []byte) {
+				ph.cache.Store(key, resp, body, ttl)
+			}
+		}
+	}
+
+	err = sendBody(resp.StatusCode, resp.Body, int(resp.ContentLength), capture, store)
+	ph.compressor.Compress(c, resp.StatusCode, resp.ContentLength)
+	return err
 }
 
-// buildHTTPRequest builds an HTTP request from Fiber context
-func (ph *ProxyHandler) buildHTTPRequest(c fiber.Ctx) ([]byte, error) {
+// recordTunnelFailure counts a timeout or send failure against the client's circuit breaker
+func (ph *ProxyHandler) recordTunnelFailure(client *ClientConnection, reason string) {
+	if client.Breaker.RecordFailure() {
+		client.Logger.Warn().Str("reason", reason).Msg("Tunnel unresponsive, circuit breaker opened")
+	}
+}
+
+// buildRequestHead builds the request line and headers from Fiber context, carrying the trace context of ctx
+func (ph *ProxyHandler) buildRequestHead(c fiber.Ctx, ctx context.Context) []byte {
 	buf := bytes.NewBuffer(nil)
 
 	// Request line
@@ -175,10 +527,42 @@ func (ph *ProxyHandler) buildHTTPRequest(c fiber.Ctx) ([]byte, error) {
 	}
 	fmt.Fprintf(buf, "%s %s HTTP/1.1\r\n", method, path)
 
-	// Headers
+	// Headers (trace context is replaced by the edge span's, framing is set below)
+	traceFields := tracing.Fields()
 	c.Request().Header.VisitAll(func(key, value []byte) {
+		switch {
+		case strings.EqualFold(string(key), "Transfer-Encoding"),
+			strings.EqualFold(string(key), "X-Forwarded-For"),
+			strings.EqualFold(string(key), "X-Real-IP"):
+			return
+		}
+		for _, field := range traceFields {
+			if strings.EqualFold(string(key), field) {
+				return
+			}
+		}
 		fmt.Fprintf(buf, "%s: %s\r\n", key, value)
 	})
+	traceHeaders := make(http.Header)
+	tracing.Inject(ctx, traceHeaders)
+	for key, values := range traceHeaders {
+		for _, value := range values {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+
+	// Forwarding headers from untrusted peers are replaced rather than extended, so they can't be spoofed
+	forwardedFor := c.IP()
+	if prior := c.Get("X-Forwarded-For"); prior != "" && ph.trusted.Trusted(c.IP()) {
+		forwardedFor = prior + ", " + forwardedFor
+	}
+	fmt.Fprintf(buf, "X-Real-IP: %s\r\n", VisitorIP(c))
+	fmt.Fprintf(buf, "X-Forwarded-For: %s\r\n", forwardedFor)
+
+	// Bodies of unknown length are re-chunked by streamRequestBody
+	if c.Request().Header.ContentLength() == -1 {
+		fmt.Fprintf(buf, "Transfer-Encoding: chunked\r\n")
+	}
 
 	// Host header
 	if c.Request().Header.Peek("Host") == nil {
@@ -188,88 +572,115 @@ func (ph *ProxyHandler) buildHTTPRequest(c fiber.Ctx) ([]byte, error) {
 	// End of headers
 	fmt.Fprintf(buf, "\r\n")
 
-	// Body
-	if len(c.Body()) > 0 {
-		buf.Write(c.Body())
-	}
-
-	return buf.Bytes(), nil
+	return buf.Bytes()
 }
 
-// sendHTTPResponse parses raw HTTP response and sends it through Fiber
-func (ph *ProxyHandler) sendHTTPResponse(c fiber.Ctx, responseBuffer *bytes.Buffer, client *ClientConnection, streamID protocol.StreamID, stream *Stream) error {
-	data := responseBuffer.Bytes()
+// streamRequestBody forwards the request body to the client in chunks as it is read from the visitor,
+// so large uploads are never held in memory; sent is called with every chunk of body bytes
+func (ph *ProxyHandler) streamRequestBody(c fiber.Ctx, client *ClientConnection, streamID protocol.StreamID, limit int64, sent func(chunk []byte)) error {
+	var body io.Reader = bytes.NewReader(c.Body())
+	if stream := c.Request().BodyStream(); stream != nil {
+		body = stream
+	}
+	chunked := c.Request().Header.ContentLength() == -1
+
+	buf := make([]byte, requestChunkSize)
+	var total int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			if limit > 0 && total > limit {
+				return errBodyTooLarge
+			}
 
-	// Log first 200 bytes for debugging
-	previewLen := 200
-	if len(data) < previewLen {
-		previewLen = len(data)
+			chunk := buf[:n]
+			if chunked {
+				chunk = append([]byte(fmt.Sprintf("%x\r\n", n)), append(chunk, "\r\n"...)...)
+			}
+			if sendErr := ph.sendData(client, streamID, chunk); sendErr != nil {
+				return sendErr
+			}
+			sent(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBodyRead, err)
+		}
 	}
-	ph.logger.Info().
-		Int("total_bytes", len(data)).
-		Str("preview", string(data[:previewLen])).
-		Msg("Parsing HTTP response")
-
-	// Validate we have at least some data that looks like HTTP
-	if len(data) < 12 { // Minimum: "HTTP/1.0 200"
-		ph.logger.Warn().Int("bytes", len(data)).Msg("Response too short to be valid HTTP, returning as-is")
-		// Return as plain text instead of error
-		c.Set("Content-Type", "text/plain")
-		// Add TunGo headers even for non-HTTP responses
-		setTunGoHeaders(c, client, streamID, stream)
-		return c.Status(fiber.StatusOK).Send(data)
+
+	if chunked {
+		return ph.sendData(client, streamID, []byte("0\r\n\r\n"))
 	}
+	return nil
+}
 
-	// Check if response starts with HTTP
-	if !bytes.HasPrefix(data, []byte("HTTP/")) {
-		ph.logger.Warn().
-			Str("start", string(data[:min(20, len(data))])).
-			Msg("Response doesn't start with HTTP/, returning as-is")
-		// Return as plain text instead of error
-		c.Set("Content-Type", "text/plain")
-		// Add TunGo headers even for non-HTTP responses
-		setTunGoHeaders(c, client, streamID, stream)
-		return c.Status(fiber.StatusOK).Send(data)
+// sendData sends a chunk of stream data to the client, waiting for room in its send buffer
+func (ph *ProxyHandler) sendData(client *ClientConnection, streamID protocol.StreamID, data []byte) error {
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, streamID, &protocol.DataMessage{Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to create data message: %w", err)
 	}
+	return client.SendMessageWait(msg, 5*time.Second)
+}
 
-	// Parse HTTP response
-	reader := bufio.NewReader(responseBuffer)
-	resp, err := http.ReadResponse(reader, nil)
+// endStream tells the client to abandon a stream whose request will not be completed
+func (ph *ProxyHandler) endStream(client *ClientConnection, streamID protocol.StreamID) {
+	msg, err := protocol.NewMessage(protocol.MessageTypeEnd, streamID, nil)
 	if err != nil {
-		ph.logger.Error().
-			Err(err).
-			Int("buffer_size", len(data)).
-			Str("buffer_preview", string(data[:min(100, len(data))])).
-			Msg("Failed to parse HTTP response")
-		return ph.sendPrettyError(c, fiber.StatusBadGateway,
-			"Invalid Response",
-			"Your local server returned an invalid HTTP response. Please ensure your application is sending properly formatted HTTP responses.")
+		return
+	}
+	if err := client.SendMessage(msg); err != nil {
+		client.Logger.Debug().Err(err).Str("stream_id", streamID.String()).Msg("Failed to send stream end")
 	}
-	defer resp.Body.Close()
+}
 
-	// Set status code
-	c.Status(resp.StatusCode)
+// bodyLimit returns the effective request body limit: the tunnel's own limit if set, capped by the server's
+func (ph *ProxyHandler) bodyLimit(client *ClientConnection) int64 {
+	limit := ph.maxBodySize
+	if client.MaxBodySize > 0 && (limit <= 0 || client.MaxBodySize < limit) {
+		limit = client.MaxBodySize
+	}
+	return limit
+}
 
-	// Add TunGo custom headers for tunnel information
-	setTunGoHeaders(c, client, streamID, stream)
+// sendBodyTooLarge rejects a request whose body exceeds limit
+func (ph *ProxyHandler) sendBodyTooLarge(c fiber.Ctx, limit int64) error {
+	return ph.sendPrettyError(c, fiber.StatusRequestEntityTooLarge,
+		"Request Too Large",
+		fmt.Sprintf("The request body exceeds the maximum allowed size of %d bytes.", limit))
+}
 
-	// Copy headers (preserve all headers including Content-Type)
-	for key, values := range resp.Header {
-		for _, value := range values {
-			c.Set(key, value)
-		}
+// maxRequestIDLength bounds visitor-supplied request IDs that are reused as-is
+const maxRequestIDLength = 128
+
+// EnsureRequestID returns the request's ID, generating one if the visitor didn't send a usable one
+// The ID is set on the request so it travels through the tunnel (and to other servers) with it
+func EnsureRequestID(c fiber.Ctx) string {
+	requestID := c.Get(protocol.RequestIDHeader)
+	if requestID == "" || len(requestID) > maxRequestIDLength || strings.IndexFunc(requestID, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f
+	}) >= 0 {
+		requestID = protocol.GenerateRequestID()
+		c.Request().Header.Set(protocol.RequestIDHeader, requestID)
 	}
+	return requestID
+}
 
-	// Read and send body efficiently
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		ph.logger.Error().Err(err).Msg("Failed to read response body")
-		return ph.sendPrettyError(c, fiber.StatusBadGateway,
-			"Response Read Error",
-			"Unable to read the full response from your local server. The connection may have been interrupted.")
-	}
+// requestLogger returns the handler's logger tagged with the request ID
+func (ph *ProxyHandler) requestLogger(c fiber.Ctx) zerolog.Logger {
+	return ph.logger.With().Str("request_id", c.Get(protocol.RequestIDHeader)).Logger()
+}
 
-	return c.Send(body)
+// requestHeaders copies the visitor's request headers into an http.Header
+func requestHeaders(c fiber.Ctx) http.Header {
+	headers := make(http.Header)
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		headers.Add(string(key), string(value))
+	})
+	return headers
 }
 
 func min(a, b int) int {
@@ -279,6 +690,16 @@ func min(a, b int) int {
 	return b
 }
 
+// setEdgeHeaders applies the tunnel's response headers, then the server policy headers (which win)
+func (ph *ProxyHandler) setEdgeHeaders(c fiber.Ctx, client *ClientConnection) {
+	for name, value := range client.ResponseHeaders {
+		c.Set(name, value)
+	}
+	for name, value := range ph.headers {
+		c.Set(name, value)
+	}
+}
+
 // setTunGoHeaders adds TunGo custom headers to the response
 func setTunGoHeaders(c fiber.Ctx, client *ClientConnection, streamID protocol.StreamID, stream *Stream) {
 	protocolType := "unknown"
@@ -296,6 +717,9 @@ func setTunGoHeaders(c fiber.Ctx, client *ClientConnection, streamID protocol.St
 	c.Set("X-Tungo-Subdomain", client.SubDomain)
 	c.Set("X-Tungo-Protocol", protocolType)
 	c.Set("X-Tungo-Version", clientVersion)
+	if requestID := c.Get(protocol.RequestIDHeader); requestID != "" {
+		c.Set("X-Tungo-Request-ID", requestID)
+	}
 }
 
 // sendPrettyError sends a user-friendly HTML error response
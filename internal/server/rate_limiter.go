@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket allowing a steady number of requests per second with an equal burst
+type RateLimiter struct {
+	rate     float64
+	tokens   float64
+	lastFill time.Time
+	mutex    sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter for perSecond requests (nil, i.e. unlimited, if not positive)
+func NewRateLimiter(perSecond int) *RateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:     float64(perSecond),
+		tokens:   float64(perSecond),
+		lastFill: time.Now(),
+	}
+}
+
+// Allow consumes a token if one is available
+func (rl *RateLimiter) Allow() bool {
+	if rl == nil {
+		return true
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	rl.tokens += now.Sub(rl.lastFill).Seconds() * rl.rate
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+	rl.lastFill = now
+
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"time"
+)
+
+// maxReconnectWaiters caps the requests held per subdomain while its client reconnects
+const maxReconnectWaiters = 256
+
+// pendingReconnect is a subdomain whose last client disconnected, awaiting a reconnection
+type pendingReconnect struct {
+	ready   chan struct{} // Closed when a client reconnects
+	expires time.Time
+	waiters int
+}
+
+// SetReconnectGrace sets how long requests for a tunnel whose client disconnected are held
+// waiting for it to reconnect (0 fails them immediately)
+func (cm *ConnectionManager) SetReconnectGrace(grace time.Duration) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.reconnectGrace = grace
+}
+
+// AwaitReconnect waits for a client to reconnect to a subdomain whose last client disconnected
+// less than the reconnect grace period ago, reporting whether one did
+func (cm *ConnectionManager) AwaitReconnect(subDomain string) bool {
+	cm.mutex.Lock()
+	pending, exists := cm.reconnecting[subDomain]
+	if !exists || cm.draining || pending.waiters >= maxReconnectWaiters {
+		cm.mutex.Unlock()
+		return false
+	}
+	wait := time.Until(pending.expires)
+	if wait <= 0 {
+		delete(cm.reconnecting, subDomain)
+		cm.mutex.Unlock()
+		return false
+	}
+	pending.waiters++
+	cm.mutex.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	reconnected := false
+	select {
+	case <-pending.ready:
+		reconnected = true
+	case <-timer.C:
+	}
+
+	cm.mutex.Lock()
+	pending.waiters--
+	cm.mutex.Unlock()
+	return reconnected
+}
+
+// markReconnecting starts the grace period of a subdomain that lost its last client (caller holds the lock)
+func (cm *ConnectionManager) markReconnecting(subDomain string) {
+	if cm.reconnectGrace <= 0 || cm.draining {
+		return
+	}
+
+	// Drop expired entries of tunnels that never came back
+	now := time.Now()
+	for name, pending := range cm.reconnecting {
+		if now.After(pending.expires) && pending.waiters == 0 {
+			delete(cm.reconnecting, name)
+		}
+	}
+
+	cm.reconnecting[subDomain] = &pendingReconnect{
+		ready:   make(chan struct{}),
+		expires: now.Add(cm.reconnectGrace),
+	}
+}
+
+// resolveReconnecting releases the requests held for a subdomain once a client connects (caller holds the lock)
+func (cm *ConnectionManager) resolveReconnecting(subDomain string) {
+	if pending, exists := cm.reconnecting[subDomain]; exists {
+		close(pending.ready)
+		delete(cm.reconnecting, subDomain)
+	}
+}
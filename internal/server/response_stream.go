@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sombochea/tungo/pkg/protocol"
+)
+
+// Errors returned by streamReader when the tunnel stops delivering data
+var (
+	errStreamIdle     = errors.New("no data received from tunnel")
+	errStreamDeadline = errors.New("tunnel response deadline exceeded")
+	errStreamAborted  = errors.New("tunnel stream aborted, the visitor fell too far behind")
+)
+
+// ResponseTimeouts bounds how long the proxy waits for a tunnel's response
+type ResponseTimeouts struct {
+	FirstByte time.Duration // Until the first response bytes arrive
+	Header    time.Duration // From the request until the response headers are complete
+	Idle      time.Duration // Between response body chunks
+}
+
+// Override returns the timeouts with a tunnel's non-zero overrides applied
+func (t ResponseTimeouts) Override(overrides *protocol.ResponseTimeouts) ResponseTimeouts {
+	if overrides == nil {
+		return t
+	}
+	if overrides.FirstByte > 0 {
+		t.FirstByte = time.Duration(overrides.FirstByte) * time.Millisecond
+	}
+	if overrides.Header > 0 {
+		t.Header = time.Duration(overrides.Header) * time.Millisecond
+	}
+	if overrides.Idle > 0 {
+		t.Idle = time.Duration(overrides.Idle) * time.Millisecond
+	}
+	return t
+}
+
+// streamReader reads a stream's data chunks as they arrive from the tunnel
+// It returns io.EOF once the stream is done and all queued chunks have been read, errStreamAborted
+// instead when the stream was aborted
+type streamReader struct {
+	stream   *Stream
+	pending  []byte
+	idle     time.Duration // Max wait for the next chunk (0 = wait indefinitely)
+	deadline time.Time     // Optional absolute deadline (zero = none)
+	onData   func(data []byte)
+}
+
+// Read implements io.Reader
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		data, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = data
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// next waits for the next chunk, honouring the idle timeout and deadline
+func (r *streamReader) next() ([]byte, error) {
+	wait := r.idle
+	timeoutErr := errStreamIdle
+	if !r.deadline.IsZero() {
+		if remaining := time.Until(r.deadline); wait == 0 || remaining < wait {
+			wait = remaining
+			timeoutErr = errStreamDeadline
+		}
+		if wait <= 0 {
+			return nil, errStreamDeadline
+		}
+	}
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-r.stream.DataChan:
+		r.received(data)
+		return data, nil
+	case <-r.stream.Done:
+		// Deliver chunks that were queued before the stream ended
+		select {
+		case data := <-r.stream.DataChan:
+			r.received(data)
+			return data, nil
+		default:
+			if r.stream.aborted.Load() {
+				return nil, errStreamAborted
+			}
+			return nil, io.EOF
+		}
+	case <-timeout:
+		return nil, timeoutErr
+	}
+}
+
+// received reports a chunk to the onData hook
+func (r *streamReader) received(data []byte) {
+	if r.onData != nil {
+		r.onData(data)
+	}
+}
+
+// responseBody streams a response body to the visitor and runs onClose exactly once when
+// the body has been fully written or the visitor went away
+type responseBody struct {
+	reader   io.Reader
+	written  int64
+	captured []byte // Leading bytes kept for the access log and edge cache
+	capture  int    // Max bytes captured (0 = enough for the access log)
+	eof      bool   // The whole body was read
+	onClose  func(body *responseBody)
+	once     sync.Once
+}
+
+// Read implements io.Reader
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.written += int64(n)
+	limit := b.capture
+	if limit == 0 {
+		limit = maxLoggedBodyBytes + 1
+	}
+	if room := limit - len(b.captured); room > 0 && n > 0 {
+		b.captured = append(b.captured, p[:min(n, room)]...)
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// Close implements io.Closer (called by fasthttp once the body has been sent)
+func (b *responseBody) Close() error {
+	b.once.Do(func() {
+		b.onClose(b)
+	})
+	return nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// sniHandshakeTimeout bounds how long a client may take to complete the TLS handshake
+const sniHandshakeTimeout = 10 * time.Second
+
+// SNIRouter splits one TLS listener into per-backend listeners chosen by the client's SNI hostname
+// Connections for hostnames that match no backend are rejected during the handshake
+type SNIRouter struct {
+	listener net.Listener
+	match    func(serverName string) int // Index of the backend serving a hostname, -1 to reject
+	backends []*sniBackend
+	logger   zerolog.Logger
+}
+
+// NewSNIRouter creates a router over a raw TCP listener with the given number of backends
+// The returned TLS config must be used for the router; it rejects unknown hostnames
+func NewSNIRouter(ln net.Listener, config *tls.Config, backends int, match func(serverName string) int, logger zerolog.Logger) *SNIRouter {
+	router := &SNIRouter{
+		match:  match,
+		logger: logger,
+	}
+	for range backends {
+		router.backends = append(router.backends, &sniBackend{
+			addr:  ln.Addr(),
+			conns: make(chan net.Conn),
+			done:  make(chan struct{}),
+		})
+	}
+
+	config = config.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if match(hello.ServerName) < 0 {
+			return nil, errors.New("unknown server name")
+		}
+		return nil, nil
+	}
+	router.listener = tls.NewListener(ln, config)
+
+	return router
+}
+
+// Listener returns the listener receiving connections for backend i
+func (r *SNIRouter) Listener(i int) net.Listener {
+	return r.backends[i]
+}
+
+// Serve accepts connections until the underlying listener is closed
+func (r *SNIRouter) Serve() error {
+	defer func() {
+		for _, backend := range r.backends {
+			backend.Close()
+		}
+	}()
+
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go r.route(conn.(*tls.Conn))
+	}
+}
+
+// Close stops accepting connections
+func (r *SNIRouter) Close() error {
+	return r.listener.Close()
+}
+
+// route completes the handshake and hands the connection to the backend for its hostname
+func (r *SNIRouter) route(conn *tls.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), sniHandshakeTimeout)
+	defer cancel()
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		r.logger.Debug().Err(err).Str("remote_addr", conn.RemoteAddr().String()).Msg("TLS handshake failed")
+		conn.Close()
+		return
+	}
+
+	serverName := conn.ConnectionState().ServerName
+	backend := r.backends[r.match(serverName)]
+	select {
+	case backend.conns <- conn:
+	case <-backend.done:
+		conn.Close()
+	}
+}
+
+// sniBackend is a net.Listener fed with the connections routed to it
+type sniBackend struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Accept implements net.Listener
+func (b *sniBackend) Accept() (net.Conn, error) {
+	select {
+	case conn := <-b.conns:
+		return conn, nil
+	case <-b.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener
+func (b *sniBackend) Close() error {
+	b.once.Do(func() {
+		close(b.done)
+	})
+	return nil
+}
+
+// Addr implements net.Listener
+func (b *sniBackend) Addr() net.Addr {
+	return b.addr
+}
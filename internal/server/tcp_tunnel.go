@@ -0,0 +1,249 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/sombochea/tungo/pkg/protocol"
+)
+
+// TCPTunnels serves raw TCP tunnels, each on a public port of its own
+// Every visitor connection becomes a stream to one of the tunnel's replicas
+type TCPTunnels struct {
+	host    string
+	minPort int
+	maxPort int
+	connMgr *ConnectionManager
+	logger  zerolog.Logger
+
+	mutex     sync.Mutex
+	listeners map[string]*tcpListener // Keyed by subdomain
+	lastPorts map[string]int          // Ports of closed tunnels, offered again if they reconnect
+}
+
+// tcpListener is the public port of one TCP tunnel
+type tcpListener struct {
+	ln   net.Listener
+	port int
+}
+
+// NewTCPTunnels creates TCP tunnels listening on host with ports from minPort to maxPort
+func NewTCPTunnels(host string, minPort, maxPort int, connMgr *ConnectionManager, logger zerolog.Logger) *TCPTunnels {
+	return &TCPTunnels{
+		host:      host,
+		minPort:   minPort,
+		maxPort:   maxPort,
+		connMgr:   connMgr,
+		logger:    logger,
+		listeners: make(map[string]*tcpListener),
+		lastPorts: make(map[string]int),
+	}
+}
+
+// Open starts accepting visitors for a tunnel and returns its port (the same one for every replica)
+func (t *TCPTunnels) Open(subDomain string) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if l, exists := t.listeners[subDomain]; exists {
+		return l.port, nil
+	}
+
+	inUse := make(map[int]bool, len(t.listeners))
+	for _, l := range t.listeners {
+		inUse[l.port] = true
+	}
+
+	// Prefer the port the tunnel had before it reconnected
+	ports := make([]int, 0, t.maxPort-t.minPort+2)
+	if port, exists := t.lastPorts[subDomain]; exists {
+		ports = append(ports, port)
+	}
+	for port := t.minPort; port <= t.maxPort; port++ {
+		ports = append(ports, port)
+	}
+
+	for _, port := range ports {
+		if inUse[port] {
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(t.host, strconv.Itoa(port)))
+		if err != nil {
+			continue // Taken by another process
+		}
+
+		l := &tcpListener{ln: ln, port: port}
+		t.listeners[subDomain] = l
+		for other, lastPort := range t.lastPorts {
+			if lastPort == port {
+				delete(t.lastPorts, other)
+			}
+		}
+		go t.serve(subDomain, l)
+
+		t.logger.Info().Str("subdomain", subDomain).Int("port", port).Msg("TCP tunnel listening")
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free TCP port in %d-%d", t.minPort, t.maxPort)
+}
+
+// Close stops accepting visitors for a tunnel once its last replica has gone
+// Connections already open end with their streams
+func (t *TCPTunnels) Close(subDomain string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	l, exists := t.listeners[subDomain]
+	if !exists || t.connMgr.HasSubDomain(subDomain) {
+		return
+	}
+	l.ln.Close()
+	delete(t.listeners, subDomain)
+	t.lastPorts[subDomain] = l.port
+
+	t.logger.Info().Str("subdomain", subDomain).Int("port", l.port).Msg("TCP tunnel closed")
+}
+
+// serve accepts visitor connections until the listener is closed
+func (t *TCPTunnels) serve(subDomain string, l *tcpListener) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		go t.handle(subDomain, conn)
+	}
+}
+
+// handle relays one visitor connection through a stream to one of the tunnel's replicas
+func (t *TCPTunnels) handle(subDomain string, conn net.Conn) {
+	defer conn.Close()
+
+	if t.connMgr.IsDraining() {
+		return
+	}
+
+	visitorIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	var client *ClientConnection
+	var exists bool
+	if t.connMgr.affinity(subDomain) == AffinityIP {
+		client, exists = t.connMgr.hashedClient(subDomain, visitorIP)
+	} else {
+		client, exists = t.connMgr.GetClientBySubDomain(subDomain)
+	}
+	if !exists {
+		return
+	}
+	logger := client.Logger.With().Str("visitor_ip", visitorIP).Logger()
+
+	if !client.IPFilter.Allowed(visitorIP) {
+		logger.Debug().Msg("TCP visitor denied by IP filter")
+		return
+	}
+	bandwidth := t.connMgr.Bandwidth()
+	if (bandwidth.Exceeded(subDomain) && !bandwidth.Throttles()) || client.Limits.Exceeded() {
+		logger.Debug().Msg("TCP visitor rejected, bandwidth quota exceeded")
+		return
+	}
+
+	streamID := protocol.GenerateStreamID()
+	stream, err := client.AddStream(streamID, protocol.ProtocolTCP, conn.RemoteAddr().String())
+	if err != nil {
+		logger.Warn().Int("max_streams", client.MaxStreams).Msg("Stream limit reached")
+		return
+	}
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeInit, streamID, &protocol.InitStreamMessage{
+		StreamID:  streamID,
+		Protocol:  protocol.ProtocolTCP,
+		SubDomain: subDomain,
+	})
+	if err != nil {
+		return
+	}
+	if err := client.SendMessage(msg); err != nil {
+		client.RemoveStream(streamID)
+		logger.Debug().Err(err).Msg("Failed to open TCP stream")
+		return
+	}
+
+	// Whichever side finishes first, the client closes its local connection too
+	defer func() {
+		client.RemoveStream(streamID)
+		if end, err := protocol.NewMessage(protocol.MessageTypeEnd, streamID, nil); err == nil {
+			client.SendMessage(end)
+		}
+	}()
+
+	start := time.Now()
+	var bytesIn atomic.Int64
+	var bytesOut int64
+
+	// Visitor to tunnel, ending the stream when the visitor closes the connection
+	go func() {
+		defer client.RemoveStream(streamID)
+
+		buf := make([]byte, requestChunkSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				msg, msgErr := protocol.NewMessage(protocol.MessageTypeData, streamID, &protocol.DataMessage{Data: buf[:n]})
+				if msgErr != nil || client.SendMessageWait(msg, 5*time.Second) != nil {
+					return
+				}
+				bytesIn.Add(int64(n))
+				bandwidth.Record(subDomain, int64(n), 0)
+				client.Limits.Record(int64(n), 0)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Tunnel to visitor, until either side ends the stream
+	write := func(data []byte) bool {
+		if _, err := conn.Write(data); err != nil {
+			return false
+		}
+		bytesOut += int64(len(data))
+		bandwidth.Record(subDomain, 0, int64(len(data)))
+		client.Limits.Record(0, int64(len(data)))
+		if bandwidth.Exceeded(subDomain) && bandwidth.Throttles() {
+			time.Sleep(bandwidth.ThrottleDelay(len(data)))
+		}
+		return true
+	}
+	for {
+		select {
+		case data := <-stream.DataChan:
+			if !write(data) {
+				return
+			}
+		case <-stream.Done:
+			// Deliver chunks that were queued before the stream ended
+			for {
+				select {
+				case data := <-stream.DataChan:
+					if !write(data) {
+						return
+					}
+				default:
+					logger.Debug().
+						Str("stream_id", streamID.String()).
+						Int64("bytes_in", bytesIn.Load()).
+						Int64("bytes_out", bytesOut).
+						Dur("duration", time.Since(start)).
+						Msg("TCP connection closed")
+					return
+				}
+			}
+		}
+	}
+}
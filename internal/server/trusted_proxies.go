@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// visitorIPLocal is the context key holding the resolved visitor IP
+const visitorIPLocal = "tungo.visitor_ip"
+
+// TrustedProxies decides whether forwarding headers (X-Forwarded-For, X-Real-IP) can be believed
+// Headers are only honoured on requests arriving directly from a trusted proxy
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedProxies creates a trusted proxy list from CIDR strings (bare IPs are treated as single hosts)
+// Returns nil if the list is empty, in which case forwarding headers are never trusted
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustedProxies{nets: nets}, nil
+}
+
+// Trusted reports whether ip belongs to a trusted proxy
+func (tp *TrustedProxies) Trusted(ip string) bool {
+	if tp == nil {
+		return false
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range tp.nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP resolves the visitor IP from the peer address and forwarding headers
+// X-Forwarded-For is walked from the right, skipping trusted proxies, so entries the visitor made up are ignored
+func (tp *TrustedProxies) ClientIP(remoteIP, forwardedFor, realIP string) string {
+	if !tp.Trusted(remoteIP) {
+		return remoteIP
+	}
+
+	if forwardedFor != "" {
+		hops := strings.Split(forwardedFor, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !tp.Trusted(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	if ip := strings.TrimSpace(realIP); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return remoteIP
+}
+
+// ResolveVisitorIP resolves and stores the visitor IP for the request, see VisitorIP
+func (tp *TrustedProxies) ResolveVisitorIP(c fiber.Ctx) string {
+	ip := tp.ClientIP(c.IP(), c.Get("X-Forwarded-For"), c.Get("X-Real-IP"))
+	c.Locals(visitorIPLocal, ip)
+	return ip
+}
+
+// ResolvePeerVisitorIP resolves and stores the visitor IP of a request proxied by an authenticated cluster peer,
+// which sends the visitor IP it resolved as the last X-Forwarded-For entry
+func ResolvePeerVisitorIP(c fiber.Ctx) string {
+	ip := c.IP()
+	hops := strings.Split(c.Get("X-Forwarded-For"), ",")
+	if hop := strings.TrimSpace(hops[len(hops)-1]); net.ParseIP(hop) != nil {
+		ip = hop
+	}
+	c.Locals(visitorIPLocal, ip)
+	return ip
+}
+
+// VisitorIP returns the visitor IP resolved by ResolveVisitorIP, or the peer address if none was resolved
+func VisitorIP(c fiber.Ctx) string {
+	if ip, ok := c.Locals(visitorIPLocal).(string); ok {
+		return ip
+	}
+	return c.IP()
+}
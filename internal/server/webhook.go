@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/sombochea/tungo/internal/registry"
+)
+
+// Tunnel lifecycle event types
+const (
+	EventClientConnected    = "client.connected"
+	EventClientDisconnected = "client.disconnected"
+	EventTunnelRegistered   = "tunnel.registered"
+	EventTunnelUnregistered = "tunnel.unregistered"
+	EventTunnelMigrated     = "tunnel.migrated"
+	EventTunnelRefreshed    = "tunnel.refreshed" // Only published to the registry, too frequent for webhooks
+)
+
+const (
+	// webhookQueueSize is the number of events buffered before new ones are dropped
+	webhookQueueSize = 256
+	// webhookAttempts is how many times delivery to a URL is tried
+	webhookAttempts = 3
+)
+
+// WebhookEvent is the payload sent for a tunnel lifecycle event
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	SubDomain string    `json:"subdomain"`
+	ClientID  string    `json:"client_id"`
+	ServerID  string    `json:"server_id"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// Registry entry of the tunnel, for events that (re)write it
+	Tunnel *registry.TunnelInfo `json:"tunnel,omitempty"`
+}
+
+// WebhookNotifier delivers lifecycle events to HTTP webhooks and/or the registry event channel
+type WebhookNotifier struct {
+	urls     []string
+	secret   string
+	serverID string
+	registry registry.Registry // Publishes events when set
+	client   *http.Client
+	logger   zerolog.Logger
+	queue    chan WebhookEvent
+	wg       sync.WaitGroup
+}
+
+// NewWebhookNotifier creates a notifier and starts its delivery worker
+// Returns nil if there are no URLs and registry publishing is disabled
+func NewWebhookNotifier(urls []string, secret string, timeout time.Duration, serverID string, reg registry.Registry, logger zerolog.Logger) *WebhookNotifier {
+	if len(urls) == 0 && reg == nil {
+		return nil
+	}
+
+	n := &WebhookNotifier{
+		urls:     urls,
+		secret:   secret,
+		serverID: serverID,
+		registry: reg,
+		client:   &http.Client{Timeout: timeout},
+		logger:   logger.With().Str("component", "webhooks").Logger(),
+		queue:    make(chan WebhookEvent, webhookQueueSize),
+	}
+
+	n.wg.Add(1)
+	go n.run()
+
+	return n
+}
+
+// Notify queues an event for delivery (no-op on a nil notifier)
+func (n *WebhookNotifier) Notify(event, subDomain, clientID string) {
+	if n == nil {
+		return
+	}
+
+	n.enqueue(WebhookEvent{
+		Event:     event,
+		SubDomain: subDomain,
+		ClientID:  clientID,
+		ServerID:  n.serverID,
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+// NotifyTunnel queues an event carrying the tunnel's registry entry (no-op on a nil notifier)
+// Refresh events are dropped unless events are published to the registry
+func (n *WebhookNotifier) NotifyTunnel(event string, info *registry.TunnelInfo) {
+	if n == nil || (event == EventTunnelRefreshed && n.registry == nil) {
+		return
+	}
+
+	n.enqueue(WebhookEvent{
+		Event:     event,
+		SubDomain: info.Subdomain,
+		ClientID:  info.ClientID,
+		ServerID:  n.serverID,
+		Timestamp: time.Now().UTC(),
+		Tunnel:    info,
+	})
+}
+
+// enqueue adds an event to the delivery queue, dropping it if the queue is full
+func (n *WebhookNotifier) enqueue(event WebhookEvent) {
+	select {
+	case n.queue <- event:
+	default:
+		n.logger.Warn().Str("event", event.Event).Str("subdomain", event.SubDomain).Msg("Webhook queue full, dropping event")
+	}
+}
+
+// Close stops accepting events and waits for queued ones to be delivered
+func (n *WebhookNotifier) Close() {
+	if n == nil {
+		return
+	}
+	close(n.queue)
+	n.wg.Wait()
+}
+
+// run delivers queued events in order
+func (n *WebhookNotifier) run() {
+	defer n.wg.Done()
+
+	for event := range n.queue {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			n.logger.Error().Err(err).Msg("Failed to encode webhook event")
+			continue
+		}
+
+		if n.registry != nil {
+			if err := n.registry.PublishEvent(payload); err != nil {
+				n.logger.Warn().Err(err).Str("event", event.Event).Msg("Failed to publish event to registry")
+			}
+		}
+
+		if event.Event == EventTunnelRefreshed {
+			continue
+		}
+		for _, url := range n.urls {
+			n.deliver(url, event.Event, payload)
+		}
+	}
+}
+
+// deliver posts a payload to a webhook URL, retrying with backoff on failure
+func (n *WebhookNotifier) deliver(url, event string, payload []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = n.post(url, event, payload); err == nil {
+			return
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+
+	n.logger.Warn().Err(err).Str("url", url).Str("event", event).Msg("Webhook delivery failed")
+}
+
+// post sends a single webhook request
+func (n *WebhookNotifier) post(url, event string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-TunGo-Event", event)
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(payload)
+		req.Header.Set("X-TunGo-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -46,6 +47,12 @@ func (s *SecretKey) ClientIDFromKey() ClientID {
 	return ClientID(base64.StdEncoding.EncodeToString(hash[:]))
 }
 
+// TunnelClientIDFromKey derives a per-tunnel client ID so one secret key can hold several tunnels
+func (s *SecretKey) TunnelClientIDFromKey(subDomain string) ClientID {
+	hash := sha256.Sum256([]byte(s.Key + ":" + subDomain))
+	return ClientID(base64.StdEncoding.EncodeToString(hash[:]))
+}
+
 // ReconnectToken represents a token for reconnecting to an existing tunnel
 type ReconnectToken struct {
 	Token string `json:"token"`
@@ -72,13 +79,52 @@ const (
 
 // ClientHello represents the initial message from client to server
 type ClientHello struct {
-	ID             ClientID        `json:"id"`
-	SubDomain      *string         `json:"sub_domain,omitempty"`
-	ClientType     ClientType      `json:"client_type"`
-	ClientVersion  string          `json:"client_version,omitempty"`
-	SecretKey      *SecretKey      `json:"secret_key,omitempty"`
-	ReconnectToken *ReconnectToken `json:"reconnect_token,omitempty"`
-	Password       *string         `json:"password,omitempty"` // Optional password to protect tunnel access
+	ID              ClientID          `json:"id"`
+	SubDomain       *string           `json:"sub_domain,omitempty"`
+	ClientType      ClientType        `json:"client_type"`
+	ClientVersion   string            `json:"client_version,omitempty"`
+	SecretKey       *SecretKey        `json:"secret_key,omitempty"`
+	ReconnectToken  *ReconnectToken   `json:"reconnect_token,omitempty"`
+	Password        *string           `json:"password,omitempty"`         // Optional password to protect tunnel access
+	BasicAuth       *string           `json:"basic_auth,omitempty"`       // Optional "user:pass" credentials enforced via HTTP Basic Auth
+	OAuth           *OAuthPolicy      `json:"oauth,omitempty"`            // Optional OAuth login visitors need at the edge
+	InspectPassword *string           `json:"inspect_password,omitempty"` // Optional password to share the dashboard at InspectPathPrefix
+	IPAllow         []string          `json:"ip_allow,omitempty"`         // Optional CIDRs allowed to access the tunnel
+	IPDeny          []string          `json:"ip_deny,omitempty"`          // Optional CIDRs denied access to the tunnel
+	MaxBodySize     int64             `json:"max_body_size,omitempty"`    // Optional request body size limit in bytes
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"` // Optional headers injected into responses at the edge
+	CacheRules      []CacheRule       `json:"cache_rules,omitempty"`      // Optional paths cached at the edge regardless of Cache-Control
+	Affinity        string            `json:"affinity,omitempty"`         // Optional session affinity across clients sharing the subdomain (cookie or ip)
+	Labels          map[string]string `json:"labels,omitempty"`           // Optional key/value labels stored with the tunnel in the registry
+	Region          string            `json:"region,omitempty"`           // Optional region the client prefers servers in when migrated
+	MigrationToken  string            `json:"migration_token,omitempty"`  // Token from a MigrateMessage letting this server take over the tunnel
+	Protocol        string            `json:"protocol,omitempty"`         // ProtocolTCP for a raw TCP tunnel on a public port (empty = HTTP)
+	// Optional overrides of the server's response timeouts (capped by the server)
+	ResponseTimeouts *ResponseTimeouts `json:"response_timeouts,omitempty"`
+	// Optional further tunnels opened on the same connection, each with its own subdomain and settings
+	Tunnels []ClientHello `json:"tunnels,omitempty"`
+}
+
+// MaxTunnelsPerConnection caps the tunnels one client connection may open
+const MaxTunnelsPerConnection = 16
+
+// ResponseTimeouts overrides how long the server waits for a tunnel's responses, in milliseconds (0 = server default)
+type ResponseTimeouts struct {
+	FirstByte int64 `json:"first_byte,omitempty"` // Until the first response bytes arrive
+	Header    int64 `json:"header,omitempty"`     // From the request until the response headers are complete
+	Idle      int64 `json:"idle,omitempty"`       // Between response body chunks
+}
+
+// CacheRule asks the server to cache responses for matching paths at the edge
+type CacheRule struct {
+	Path string `json:"path"` // Path prefix, or a path.Match pattern if it contains "*"
+	TTL  int64  `json:"ttl"`  // Seconds to cache matching responses
+}
+
+// OAuthPolicy asks the server to have visitors log in with an OAuth provider before reaching the tunnel
+type OAuthPolicy struct {
+	Provider string   `json:"provider"` // github or google
+	Allow    []string `json:"allow"`    // org:<name>, user:<login>, email:<address> or domain:<domain>
 }
 
 // NewClientHello creates a new client hello message
@@ -121,6 +167,7 @@ const (
 	ServerHelloInvalidSubDomain ServerHelloType = "invalid_sub_domain"
 	ServerHelloAuthFailed       ServerHelloType = "auth_failed"
 	ServerHelloError            ServerHelloType = "error"
+	ServerHelloMaintenance      ServerHelloType = "maintenance"
 )
 
 // ServerHello represents the server's response to a client hello
@@ -132,6 +179,7 @@ type ServerHello struct {
 	ClientID       ClientID        `json:"client_id,omitempty"`
 	ReconnectToken *ReconnectToken `json:"reconnect_token,omitempty"`
 	Error          string          `json:"error,omitempty"`
+	Tunnels        []ServerHello   `json:"tunnels,omitempty"` // The further tunnels of the client hello, in order
 }
 
 // NewSuccessHello creates a success server hello
@@ -178,6 +226,9 @@ const (
 	MessageTypeEnd         MessageType = "end"
 	MessageTypePing        MessageType = "ping"
 	MessageTypePong        MessageType = "pong"
+	MessageTypeReconnect   MessageType = "reconnect"
+	MessageTypeMigrate     MessageType = "migrate"
+	MessageTypeExpiring    MessageType = "expiring"
 )
 
 // Message represents a message in the tunnel protocol
@@ -213,10 +264,65 @@ func (m *Message) Unmarshal(v interface{}) error {
 	return json.Unmarshal(m.Data, v)
 }
 
+// PeerServer is a cluster member a client can reconnect to
+type PeerServer struct {
+	Host   string `json:"host"`
+	Port   int    `json:"port"` // Control port
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+}
+
+// ReconnectMessage asks a client to reconnect elsewhere because the server is shutting down
+type ReconnectMessage struct {
+	Reason  string       `json:"reason"`
+	Servers []PeerServer `json:"servers,omitempty"`
+}
+
+// MigrateMessage asks a client to move its tunnel to a specific server, presenting Token in its hello
+type MigrateMessage struct {
+	Reason    string     `json:"reason"`
+	Server    PeerServer `json:"server"`
+	Token     string     `json:"token"`
+	SubDomain string     `json:"sub_domain,omitempty"` // The tunnel the token is for, on connections carrying several
+}
+
+// ExpiringMessage warns a client that the server will close its tunnel session at ExpiresAt
+type ExpiringMessage struct {
+	Reason    string    `json:"reason"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CloseTunnelIdle is the WebSocket close code sent when the server expires an idle tunnel (clients don't reconnect)
+const CloseTunnelIdle = 4001
+
+// CloseSessionExpired is the WebSocket close code sent when a tunnel session reaches its maximum duration (clients don't reconnect)
+const CloseSessionExpired = 4002
+
+// StreamProtocolInspect marks a stream carrying shared dashboard traffic rather than local app traffic
+const StreamProtocolInspect = "inspect"
+
+// ProtocolHTTP marks an HTTP tunnel, the default
+const ProtocolHTTP = "http"
+
+// ProtocolTCP marks a raw TCP tunnel, and the streams of its visitor connections
+const ProtocolTCP = "tcp"
+
+// InspectPathPrefix is the reserved public path under which a client's dashboard is shared
+const InspectPathPrefix = "/_tungo/inspect"
+
+// RequestIDHeader carries the edge-generated request ID through the tunnel to the local server
+const RequestIDHeader = "X-Request-ID"
+
+// GenerateRequestID creates a new random request ID
+func GenerateRequestID() string {
+	return uuid.New().String()
+}
+
 // InitStreamMessage represents a message to initialize a new stream
 type InitStreamMessage struct {
-	StreamID StreamID `json:"stream_id"`
-	Protocol string   `json:"protocol"` // "http", "https", etc.
+	StreamID  StreamID `json:"stream_id"`
+	Protocol  string   `json:"protocol"`             // "http", "https", etc.
+	SubDomain string   `json:"sub_domain,omitempty"` // The tunnel the stream is for, on connections carrying several
 }
 
 // DataMessage represents a message containing stream data
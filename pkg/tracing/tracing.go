@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sombochea/tungo/pkg/version"
+)
+
+// Tracer name used for every span emitted by tungo
+const tracerName = "github.com/sombochea/tungo"
+
+// Config configures the OTLP trace exporter
+type Config struct {
+	Enabled    bool
+	Endpoint   string  // OTLP/HTTP collector host:port (e.g. localhost:4318)
+	Insecure   bool    // Send to the collector over plain HTTP
+	SampleRate float64 // Fraction of new traces to record (parent decisions are always honoured)
+}
+
+// Init installs the global tracer provider and W3C trace context propagator
+// Returns a shutdown func that flushes pending spans; when tracing is disabled spans are no-ops
+func Init(serviceName string, cfg Config) (func(context.Context) error, error) {
+	// Always propagate trace context so upstream traces pass through untouched
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	resource, err := sdkresource.Merge(sdkresource.Default(), sdkresource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version.Version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRate))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tungo tracer from the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Extract returns a context carrying the trace context found in headers
+func Extract(ctx context.Context, headers http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(headers))
+}
+
+// Inject writes the trace context of ctx (traceparent/tracestate) into headers
+func Inject(ctx context.Context, headers http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(headers))
+}
+
+// Fields returns the header names written by Inject
+func Fields() []string {
+	return otel.GetTextMapPropagator().Fields()
+}
+
+// HTTPAttributes returns the common span attributes for a proxied request
+func HTTPAttributes(method, path, subDomain string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(method),
+		semconv.URLPath(path),
+		attribute.String("tungo.subdomain", subDomain),
+	}
+}